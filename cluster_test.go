@@ -0,0 +1,133 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// +build dqlite
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/clustertest"
+	"github.com/SimonRichardson/nu-juju-data/server"
+)
+
+const (
+	// clusterStartTimeout is the time a node is given to find the cluster.
+	clusterStartTimeout = 30 * time.Second
+
+	// clusterReadTimeout is the time a node is given to serve an action that
+	// has been committed elsewhere in the cluster.
+	clusterReadTimeout = 10 * time.Second
+)
+
+var clusterClient = &http.Client{Timeout: 5 * time.Second}
+
+// startClusterNode starts a node of the binary for the cluster harness, so
+// that killing it runs the shutdown of the binary.
+func startClusterNode(ctx context.Context, dir string, node clustertest.NodeConfig) (clustertest.Runner, error) {
+	cfg := DefaultConfig()
+	cfg.API.Address = node.APIAddress
+	cfg.API.Peers = node.Peers
+	cfg.API.Proxy = true
+	cfg.DB.Address = node.DBAddress
+	cfg.DB.Join = node.Join
+	cfg.DB.ReadyTimeout = clusterStartTimeout
+	return StartNode(ctx, dir, cfg)
+}
+
+// addClusterAction enqueues an action through the API of the node.
+func addClusterAction(t *testing.T, node *clustertest.Node, input server.InputAction) server.OutputAction {
+	t.Helper()
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		t.Fatalf("encoding action: %v", err)
+	}
+	resp, err := clusterClient.Post(node.URL("/v1/actions"), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("adding action: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("adding action: got status %d", resp.StatusCode)
+	}
+	var output server.OutputAction
+	if err := json.NewDecoder(resp.Body).Decode(&output); err != nil {
+		t.Fatalf("decoding action: %v", err)
+	}
+	return output
+}
+
+// waitForClusterAction waits for the node to serve the action, as a follower
+// may not have applied the latest entries of the log yet.
+func waitForClusterAction(t *testing.T, node *clustertest.Node, want server.OutputAction) {
+	t.Helper()
+
+	url := node.URL("/v1/actions/" + strconv.FormatInt(want.ID, 10))
+	deadline := time.Now().Add(clusterReadTimeout)
+	for {
+		got, status, err := getClusterAction(url)
+		if err == nil && status == http.StatusOK {
+			if got.Tag != want.Tag || got.Receiver != want.Receiver || got.Name != want.Name {
+				t.Fatalf("got action %+v, want %+v", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("action %d not readable from %s: status %d, error %v", want.ID, node.APIAddress, status, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func getClusterAction(url string) (server.OutputAction, int, error) {
+	var output server.OutputAction
+	resp, err := clusterClient.Get(url)
+	if err != nil {
+		return output, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return output, resp.StatusCode, nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(&output)
+	return output, resp.StatusCode, err
+}
+
+func TestActionSurvivesLeaderFailure(t *testing.T) {
+	c := clustertest.Start(t, 3, startClusterNode)
+	leader := c.WaitForLeader(t)
+
+	added := addClusterAction(t, c.Node(leader), server.InputAction{
+		Receiver: "unit-mysql-0",
+		Name:     "backup",
+	})
+	waitForClusterAction(t, c.Node(c.Follower(t)), added)
+
+	c.Kill(t, leader)
+	newLeader := c.WaitForLeader(t)
+	if newLeader == leader {
+		t.Fatalf("killed node %d is still the leader", leader)
+	}
+	waitForClusterAction(t, c.Node(newLeader), added)
+	waitForClusterAction(t, c.Node(c.Follower(t)), added)
+
+	// The cluster still accepts writes, and the killed node catches up once
+	// it's restarted.
+	second := addClusterAction(t, c.Node(c.Follower(t)), server.InputAction{
+		Receiver: "unit-mysql-1",
+		Name:     "restore",
+	})
+	c.Restart(t, leader)
+	waitForClusterAction(t, c.Node(leader), added)
+	waitForClusterAction(t, c.Node(leader), second)
+}
@@ -0,0 +1,288 @@
+// Package clustertest runs in-process clusters of nodes, each serving the
+// API over its own dqlite node, for testing the whole stack end to end.
+//
+// The nodes are started by the StartFunc given to the harness, so that the
+// tests run the same start up and shutdown as the binary. A typical test
+// starts a cluster, enqueues an action through the leader, reads it back
+// through a follower, then kills the leader and checks the action can still
+// be read once a new leader has been elected:
+//
+//	c := clustertest.Start(t, 3, startNode)
+//	leader := c.WaitForLeader(t)
+//	// POST to c.Node(leader).URL("/v1/actions") ...
+//	c.Kill(t, leader)
+//	c.WaitForLeader(t)
+//
+// The tests using the harness need the dqlite libraries, so they're behind
+// the dqlite build tag:
+//
+//	go test -tags dqlite .
+package clustertest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// leaderTimeout is the time the cluster is given to elect a leader.
+	leaderTimeout = 30 * time.Second
+
+	// stopTimeout is the time a node is given to stop.
+	stopTimeout = 10 * time.Second
+
+	// leadershipPollInterval is the time between checks of the leadership of
+	// the nodes. It's short, so that tests notice changes quickly.
+	leadershipPollInterval = 250 * time.Millisecond
+)
+
+// NodeConfig holds the addresses of a node started by the harness.
+type NodeConfig struct {
+	DBAddress  string
+	APIAddress string
+
+	// Join holds the database addresses of the nodes to join, empty for
+	// the node bootstrapping the cluster and for a restarted node.
+	Join []string
+
+	// Peers maps the database address of every node of the cluster to its
+	// API address, so that writes can be sent to the leader.
+	Peers map[string]string
+}
+
+// Runner is a node that has been started.
+type Runner interface {
+	// IsLeader returns true if the node is the leader of the cluster.
+	IsLeader(context.Context) bool
+
+	// Shutdown stops the node, within the context.
+	Shutdown(context.Context) error
+}
+
+// StartFunc starts a node in the data directory, blocking until it serves
+// the API. The context is only done once the test has finished.
+type StartFunc func(ctx context.Context, dir string, cfg NodeConfig) (Runner, error)
+
+// Cluster is a cluster of in-process nodes on loopback addresses, each with
+// its own data directory.
+type Cluster struct {
+	start StartFunc
+	peers map[string]string
+
+	mutex sync.Mutex
+	nodes []*Node
+}
+
+// Node is a node of the cluster. A killed node keeps its data directory and
+// addresses, so that it can be restarted.
+type Node struct {
+	Dir        string
+	DBAddress  string
+	APIAddress string
+
+	mutex  sync.Mutex
+	runner Runner
+}
+
+// Start starts a cluster of n nodes with the start func, bootstrapped by the
+// first node, and waits for every node to serve the API. The cluster is
+// stopped when the test finishes.
+func Start(t testing.TB, n int, start StartFunc) *Cluster {
+	t.Helper()
+
+	c := &Cluster{
+		start: start,
+		peers: make(map[string]string, n),
+	}
+	t.Cleanup(c.stop)
+
+	// Every address is known up front, so that each node can send writes
+	// to whichever node is the leader.
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", fmt.Sprintf("clustertest-node%d-", i))
+		if err != nil {
+			t.Fatalf("creating data directory: %v", err)
+		}
+		t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+		node := &Node{
+			Dir:        dir,
+			DBAddress:  freeAddress(t),
+			APIAddress: freeAddress(t),
+		}
+		c.peers[node.DBAddress] = node.APIAddress
+		c.nodes = append(c.nodes, node)
+	}
+
+	for i, node := range c.nodes {
+		var join []string
+		if i > 0 {
+			join = []string{c.nodes[0].DBAddress}
+		}
+		if err := c.startNode(node, join); err != nil {
+			t.Fatalf("starting node %d: %v", i, err)
+		}
+	}
+	return c
+}
+
+// Size returns the number of nodes of the cluster, running or not.
+func (c *Cluster) Size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.nodes)
+}
+
+// Node returns the node with the index.
+func (c *Cluster) Node(i int) *Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.nodes[i]
+}
+
+// WaitForLeader waits for a running node to be the leader, returning its
+// index.
+func (c *Cluster) WaitForLeader(t testing.TB) int {
+	t.Helper()
+
+	deadline := time.Now().Add(leaderTimeout)
+	for time.Now().Before(deadline) {
+		for i := 0; i < c.Size(); i++ {
+			if node := c.Node(i); node.Running() && node.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(leadershipPollInterval)
+	}
+	t.Fatalf("no leader elected after %v", leaderTimeout)
+	return -1
+}
+
+// Follower returns the index of a running node that isn't the leader.
+func (c *Cluster) Follower(t testing.TB) int {
+	t.Helper()
+
+	for i := 0; i < c.Size(); i++ {
+		if node := c.Node(i); node.Running() && !node.IsLeader() {
+			return i
+		}
+	}
+	t.Fatalf("no running follower")
+	return -1
+}
+
+// Kill stops the node with its shutdown sequence, as when the process is
+// asked to terminate.
+func (c *Cluster) Kill(t testing.TB, i int) {
+	t.Helper()
+
+	node := c.Node(i)
+	if !node.Running() {
+		t.Fatalf("node %d isn't running", i)
+	}
+	if err := node.stop(); err != nil {
+		t.Fatalf("stopping node %d: %v", i, err)
+	}
+}
+
+// Restart starts the killed node again, with its data directory and
+// addresses.
+func (c *Cluster) Restart(t testing.TB, i int) {
+	t.Helper()
+
+	node := c.Node(i)
+	if node.Running() {
+		t.Fatalf("node %d is already running", i)
+	}
+	if err := c.startNode(node, nil); err != nil {
+		t.Fatalf("restarting node %d: %v", i, err)
+	}
+}
+
+func (c *Cluster) startNode(node *Node, join []string) error {
+	runner, err := c.start(context.Background(), node.Dir, NodeConfig{
+		DBAddress:  node.DBAddress,
+		APIAddress: node.APIAddress,
+		Join:       join,
+		Peers:      c.peers,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	node.mutex.Lock()
+	node.runner = runner
+	node.mutex.Unlock()
+	return nil
+}
+
+// stop stops every running node. The last nodes can't hand over to anyone,
+// so the errors stopping them are ignored.
+func (c *Cluster) stop() {
+	c.mutex.Lock()
+	nodes := c.nodes
+	c.mutex.Unlock()
+
+	for _, node := range nodes {
+		if node.Running() {
+			_ = node.stop()
+		}
+	}
+}
+
+// URL returns the URL of the path on the API of the node.
+func (n *Node) URL(path string) string {
+	return "http://" + n.APIAddress + path
+}
+
+// Running returns true if the node hasn't been killed.
+func (n *Node) Running() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.runner != nil
+}
+
+// IsLeader returns true if the node is the leader of the cluster.
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	runner := n.runner
+	n.mutex.Unlock()
+	if runner == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return runner.IsLeader(ctx)
+}
+
+// stop shuts the node down, within the stop timeout.
+func (n *Node) stop() error {
+	n.mutex.Lock()
+	runner := n.runner
+	n.runner = nil
+	n.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return runner.Shutdown(ctx)
+}
+
+// freeAddress returns a loopback address with a free port.
+func freeAddress(t testing.TB) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
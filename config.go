@@ -0,0 +1,331 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the name of the config file, in the data directory.
+const configFile = "config.yaml"
+
+// Config holds the configuration of a node, written to the data directory by
+// init or join and read by serve.
+type Config struct {
+	API     APIConfig  `yaml:"api"`
+	DB      DBConfig   `yaml:"db"`
+	REPL    REPLConfig `yaml:"repl"`
+	Verbose bool       `yaml:"verbose,omitempty"`
+}
+
+// APIConfig holds the configuration of the demo API.
+type APIConfig struct {
+	Address     string   `yaml:"address"`
+	Cert        string   `yaml:"cert,omitempty"`
+	Key         string   `yaml:"key,omitempty"`
+	CA          string   `yaml:"ca,omitempty"`
+	Tokens      []string `yaml:"tokens,omitempty"`
+	ReadTokens  []string `yaml:"read-tokens,omitempty"`
+	AdminTokens []string `yaml:"admin-tokens,omitempty"`
+	CORSOrigins []string `yaml:"cors-origins,omitempty"`
+	Proxy       bool     `yaml:"proxy,omitempty"`
+	// Peers maps the database addresses of the other nodes to their API
+	// addresses, so that writes can be sent to the leader.
+	Peers map[string]string `yaml:"peers,omitempty"`
+}
+
+// DBConfig holds the configuration of the database replication.
+type DBConfig struct {
+	Address string `yaml:"address"`
+	// Join holds the database addresses of the existing nodes to join, empty
+	// when bootstrapping a new cluster.
+	Join []string `yaml:"join,omitempty"`
+	// Role is the role assigned to the node once it has joined the cluster,
+	// empty to leave it to the cluster.
+	Role string `yaml:"role,omitempty"`
+	// Voters and StandBys are the target numbers of nodes with each role,
+	// which must be the same for every node of the cluster.
+	Voters   int `yaml:"voters"`
+	StandBys int `yaml:"stand-bys"`
+	// Databases holds the names of the databases that can be opened, besides
+	// the database holding the state. Any database can be opened if empty.
+	Databases []string `yaml:"databases,omitempty"`
+	// ReadyTimeout is the time the node waits for the cluster to be found
+	// on start up, before giving up.
+	ReadyTimeout time.Duration `yaml:"ready-timeout"`
+}
+
+// REPLConfig holds the configuration of the REPL.
+type REPLConfig struct {
+	Address          string        `yaml:"address,omitempty"`
+	Token            string        `yaml:"token,omitempty"`
+	ReadToken        string        `yaml:"read-token,omitempty"`
+	ReadOnly         bool          `yaml:"read-only,omitempty"`
+	IdleTimeout      time.Duration `yaml:"idle-timeout"`
+	StatementTimeout time.Duration `yaml:"statement-timeout"`
+	SlowThreshold    time.Duration `yaml:"slow-threshold"`
+	MaxSessions      int           `yaml:"max-sessions"`
+}
+
+// DefaultConfig returns the config used for anything not set in the config
+// file or by flags.
+func DefaultConfig() Config {
+	return Config{
+		DB: DBConfig{
+			Voters:       3,
+			StandBys:     3,
+			ReadyTimeout: 5 * time.Minute,
+		},
+		REPL: REPLConfig{
+			IdleTimeout:      30 * time.Minute,
+			StatementTimeout: time.Minute,
+			SlowThreshold:    time.Second,
+			MaxSessions:      10,
+		},
+	}
+}
+
+// Validate returns an error describing the first problem with the config.
+func (c Config) Validate() error {
+	if c.API.Address == "" {
+		return errors.NotValidf("empty API address")
+	}
+	if err := validateAddress(c.API.Address); err != nil {
+		return errors.Annotate(err, "API address")
+	}
+	if c.API.Cert != "" && c.API.Key == "" {
+		return errors.NotValidf("API certificate without key")
+	}
+	if c.API.Key != "" && c.API.Cert == "" {
+		return errors.NotValidf("API key without certificate")
+	}
+	if c.API.CA != "" && c.API.Cert == "" {
+		return errors.NotValidf("API CA without certificate")
+	}
+	for _, origin := range c.API.CORSOrigins {
+		if origin == "" {
+			return errors.NotValidf("empty API CORS origin")
+		}
+	}
+	for dbAddress, apiAddress := range c.API.Peers {
+		if err := validateAddress(dbAddress); err != nil {
+			return errors.Annotatef(err, "API peer %q", dbAddress)
+		}
+		if err := validateAddress(apiAddress); err != nil {
+			return errors.Annotatef(err, "API address of peer %q", dbAddress)
+		}
+	}
+
+	if c.DB.Address == "" {
+		return errors.NotValidf("empty database address")
+	}
+	if err := validateAddress(c.DB.Address); err != nil {
+		return errors.Annotate(err, "database address")
+	}
+	for _, address := range c.DB.Join {
+		if err := validateAddress(address); err != nil {
+			return errors.Annotate(err, "join address")
+		}
+		if address == c.DB.Address {
+			return errors.NotValidf("joining own database address %q", address)
+		}
+	}
+	if c.DB.Role != "" {
+		if len(c.DB.Join) == 0 {
+			return errors.NotValidf("role without addresses to join")
+		}
+		if _, err := parseRole(c.DB.Role); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.DB.Voters < 3 || c.DB.Voters%2 == 0 {
+		return errors.NotValidf("%d voters, expected an odd number of at least 3", c.DB.Voters)
+	}
+	if c.DB.StandBys%2 == 0 {
+		return errors.NotValidf("%d stand-bys, expected an odd number", c.DB.StandBys)
+	}
+	for _, name := range c.DB.Databases {
+		if err := db.ValidateName(name); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if c.DB.ReadyTimeout <= 0 {
+		return errors.NotValidf("ready timeout %v, expected a positive duration", c.DB.ReadyTimeout)
+	}
+
+	if c.REPL.Address != "" {
+		if err := validateAddress(c.REPL.Address); err != nil {
+			return errors.Annotate(err, "REPL address")
+		}
+	}
+	if c.REPL.Token != "" && c.REPL.Token == c.REPL.ReadToken {
+		return errors.NotValidf("REPL read token matching the REPL token")
+	}
+	if c.REPL.IdleTimeout < 0 {
+		return errors.NotValidf("negative REPL idle timeout")
+	}
+	if c.REPL.StatementTimeout < 0 {
+		return errors.NotValidf("negative REPL statement timeout")
+	}
+	if c.REPL.SlowThreshold < 0 {
+		return errors.NotValidf("negative REPL slow threshold")
+	}
+	if c.REPL.MaxSessions < 0 {
+		return errors.NotValidf("negative REPL max sessions")
+	}
+	return nil
+}
+
+func validateAddress(address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return errors.NotValidf("address %q", address)
+	}
+	return nil
+}
+
+// configPath returns the path of the config file in the data directory.
+func configPath(dir string) string {
+	return filepath.Join(dir, configFile)
+}
+
+// ReadConfig reads the config file at the path on top of the default config.
+// Unknown keys are an error, so that typos aren't silently ignored.
+func ReadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, errors.Trace(err)
+	}
+	cfg := DefaultConfig()
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return Config{}, errors.Annotatef(err, "parsing config %q", path)
+	}
+	return cfg, nil
+}
+
+// WriteConfig writes the config file to the path, replacing any existing
+// file.
+func WriteConfig(path string, cfg Config) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// The config holds tokens, so only the owner can read it.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
+
+// configFlags holds the flags overriding the config file.
+type configFlags struct {
+	flags *pflag.FlagSet
+	cfg   Config
+	peers []string
+}
+
+// newConfigFlags registers the flags overriding the config file on the flag
+// set.
+func newConfigFlags(flags *pflag.FlagSet) *configFlags {
+	f := &configFlags{
+		flags: flags,
+		cfg:   DefaultConfig(),
+	}
+	cfg := &f.cfg
+	flags.StringVarP(&cfg.API.Address, "api", "a", "", "address used to expose the demo API")
+	flags.StringVarP(&cfg.DB.Address, "db", "d", "", "address used for internal database replication")
+	flags.StringSliceVarP(&cfg.DB.Join, "join", "j", nil, "database addresses of existing nodes")
+	flags.StringVar(&cfg.DB.Role, "role", "", "role of the node once it has joined; voter, stand-by or spare")
+	flags.IntVar(&cfg.DB.Voters, "voters", cfg.DB.Voters, "target number of voters, kept online by promoting stand-bys")
+	flags.IntVar(&cfg.DB.StandBys, "standbys", cfg.DB.StandBys, "target number of stand-bys")
+	flags.StringSliceVar(&cfg.DB.Databases, "databases", nil, "names of the databases that can be opened, besides the state database, or any if empty")
+	flags.DurationVar(&cfg.DB.ReadyTimeout, "ready-timeout", cfg.DB.ReadyTimeout, "time to wait for the cluster on start up, before giving up")
+	flags.StringVar(&cfg.API.Cert, "api-cert", "", "certificate file used to serve the demo API over TLS")
+	flags.StringVar(&cfg.API.Key, "api-key", "", "key file of the API certificate")
+	flags.StringVar(&cfg.API.CA, "api-ca", "", "CA file used to verify API client certificates")
+	flags.StringSliceVar(&cfg.API.Tokens, "api-token", nil, "bearer tokens allowed to read and change the demo API")
+	flags.StringSliceVar(&cfg.API.ReadTokens, "api-read-token", nil, "bearer tokens only allowed to read the demo API")
+	flags.StringSliceVar(&cfg.API.AdminTokens, "api-admin-token", nil, "bearer tokens also allowed to use the admin endpoints of the demo API")
+	flags.StringSliceVar(&f.peers, "api-peer", nil, "API addresses of the other nodes, as <db-address>=<api-address>")
+	flags.StringSliceVar(&cfg.API.CORSOrigins, "api-cors-origin", nil, "origins allowed to make cross-origin requests to the demo API, or * for any")
+	flags.BoolVar(&cfg.API.Proxy, "api-proxy", false, "proxy writes to the leader rather than redirecting them")
+	flags.StringVar(&cfg.REPL.Address, "repl-addr", "", "TCP address used to expose the REPL, as well as the UNIX socket in the data directory")
+	flags.StringVar(&cfg.REPL.Token, "repl-token", "", "token that REPL sessions over TCP must send first")
+	flags.StringVar(&cfg.REPL.ReadToken, "repl-read-token", "", "token that REPL sessions over TCP can send first to get a read-only session")
+	flags.BoolVar(&cfg.REPL.ReadOnly, "repl-read-only", false, "only allow REPL statements that read the database")
+	flags.DurationVar(&cfg.REPL.IdleTimeout, "repl-idle-timeout", cfg.REPL.IdleTimeout, "time after which idle REPL sessions are disconnected, or 0 to never disconnect them")
+	flags.DurationVar(&cfg.REPL.StatementTimeout, "repl-statement-timeout", cfg.REPL.StatementTimeout, "time after which REPL statements are cancelled, or 0 to never cancel them")
+	flags.DurationVar(&cfg.REPL.SlowThreshold, "repl-slow-threshold", cfg.REPL.SlowThreshold, "time after which REPL statements are logged as slow, or 0 to never log them")
+	flags.IntVar(&cfg.REPL.MaxSessions, "repl-max-sessions", cfg.REPL.MaxSessions, "maximum number of open REPL sessions, or 0 for no maximum")
+	flags.BoolVarP(&cfg.Verbose, "verbose", "v", false, "verbose logging")
+	return f
+}
+
+// configFlagSetters copies the value of each flag from the config of the
+// flags to the config.
+var configFlagSetters = map[string]func(dst *Config, src Config){
+	"api":                    func(dst *Config, src Config) { dst.API.Address = src.API.Address },
+	"db":                     func(dst *Config, src Config) { dst.DB.Address = src.DB.Address },
+	"join":                   func(dst *Config, src Config) { dst.DB.Join = src.DB.Join },
+	"role":                   func(dst *Config, src Config) { dst.DB.Role = src.DB.Role },
+	"voters":                 func(dst *Config, src Config) { dst.DB.Voters = src.DB.Voters },
+	"standbys":               func(dst *Config, src Config) { dst.DB.StandBys = src.DB.StandBys },
+	"databases":              func(dst *Config, src Config) { dst.DB.Databases = src.DB.Databases },
+	"ready-timeout":          func(dst *Config, src Config) { dst.DB.ReadyTimeout = src.DB.ReadyTimeout },
+	"api-cert":               func(dst *Config, src Config) { dst.API.Cert = src.API.Cert },
+	"api-key":                func(dst *Config, src Config) { dst.API.Key = src.API.Key },
+	"api-ca":                 func(dst *Config, src Config) { dst.API.CA = src.API.CA },
+	"api-token":              func(dst *Config, src Config) { dst.API.Tokens = src.API.Tokens },
+	"api-read-token":         func(dst *Config, src Config) { dst.API.ReadTokens = src.API.ReadTokens },
+	"api-admin-token":        func(dst *Config, src Config) { dst.API.AdminTokens = src.API.AdminTokens },
+	"api-cors-origin":        func(dst *Config, src Config) { dst.API.CORSOrigins = src.API.CORSOrigins },
+	"api-proxy":              func(dst *Config, src Config) { dst.API.Proxy = src.API.Proxy },
+	"repl-addr":              func(dst *Config, src Config) { dst.REPL.Address = src.REPL.Address },
+	"repl-token":             func(dst *Config, src Config) { dst.REPL.Token = src.REPL.Token },
+	"repl-read-token":        func(dst *Config, src Config) { dst.REPL.ReadToken = src.REPL.ReadToken },
+	"repl-read-only":         func(dst *Config, src Config) { dst.REPL.ReadOnly = src.REPL.ReadOnly },
+	"repl-idle-timeout":      func(dst *Config, src Config) { dst.REPL.IdleTimeout = src.REPL.IdleTimeout },
+	"repl-statement-timeout": func(dst *Config, src Config) { dst.REPL.StatementTimeout = src.REPL.StatementTimeout },
+	"repl-slow-threshold":    func(dst *Config, src Config) { dst.REPL.SlowThreshold = src.REPL.SlowThreshold },
+	"repl-max-sessions":      func(dst *Config, src Config) { dst.REPL.MaxSessions = src.REPL.MaxSessions },
+	"verbose":                func(dst *Config, src Config) { dst.Verbose = src.Verbose },
+}
+
+// Apply overrides the config with the flags set on the command line, so that
+// flags take precedence over the config file.
+func (f *configFlags) Apply(cfg Config) (Config, error) {
+	f.flags.Visit(func(flag *pflag.Flag) {
+		if setter, ok := configFlagSetters[flag.Name]; ok {
+			setter(&cfg, f.cfg)
+		}
+	})
+	if f.flags.Changed("api-peer") {
+		peers, err := parsePeers(f.peers)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.API.Peers = peers
+	}
+	return cfg, nil
+}
+
+// parsePeers parses the peers given as <db-address>=<api-address>.
+func parsePeers(values []string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range values {
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.NotValidf("API peer %q, expected <db-address>=<api-address>", peer)
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
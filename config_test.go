@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+)
+
+// validConfig returns the default config, with the required addresses set.
+func validConfig() Config {
+	cfg := DefaultConfig()
+	cfg.API.Address = "127.0.0.1:8080"
+	cfg.DB.Address = "127.0.0.1:9000"
+	return cfg
+}
+
+// writeConfigFile writes the contents to a config file, returning its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := configPath(t.TempDir())
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parseFlags parses the arguments with the config flags.
+func parseFlags(t *testing.T, args ...string) *configFlags {
+	t.Helper()
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	cfgFlags := newConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("parsing flags: %v", err)
+	}
+	return cfgFlags
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+api:
+  address: 127.0.0.1:8080
+  tokens: [from-file]
+db:
+  address: 127.0.0.1:9000
+  voters: 5
+repl:
+  max-sessions: 2
+`)
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+
+	cfg, err = parseFlags(t,
+		"--api", "127.0.0.1:8081",
+		"--repl-max-sessions", "10",
+		"--api-peer", "127.0.0.1:9001=127.0.0.1:8082",
+	).Apply(cfg)
+	if err != nil {
+		t.Fatalf("applying flags: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		// Flags take precedence over the file, even when set to the
+		// default.
+		{"flag", cfg.API.Address, "127.0.0.1:8081"},
+		{"flag set to the default", cfg.REPL.MaxSessions, 10},
+		{"peers flag", cfg.API.Peers, map[string]string{"127.0.0.1:9001": "127.0.0.1:8082"}},
+		// The file takes precedence over the defaults of the flags that
+		// aren't set.
+		{"file", cfg.DB.Address, "127.0.0.1:9000"},
+		{"file over flag default", cfg.DB.Voters, 5},
+		{"file list", cfg.API.Tokens, []string{"from-file"}},
+		// Anything set by neither keeps the default.
+		{"default", cfg.REPL.IdleTimeout, 30 * time.Minute},
+		{"default stand-bys", cfg.DB.StandBys, 3},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("validating: %v", err)
+	}
+}
+
+func TestConfigFlagsCoverEveryFlag(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	newConfigFlags(flags)
+
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if _, ok := configFlagSetters[flag.Name]; !ok && flag.Name != "api-peer" {
+			t.Errorf("flag %q doesn't override the config file", flag.Name)
+		}
+	})
+}
+
+func TestConfigInvalidPeerFlag(t *testing.T) {
+	_, err := parseFlags(t, "--api-peer", "127.0.0.1:9001").Apply(validConfig())
+	if !errors.IsNotValid(err) {
+		t.Fatalf("got error %v, want not valid", err)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{"unknown key", "api:\n  adress: 127.0.0.1:8080\n", "field adress not found"},
+		{"wrong type", "db:\n  voters: three\n", "cannot unmarshal"},
+		{"bad duration", "db:\n  ready-timeout: soon\n", "cannot unmarshal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadConfig(writeConfigFile(t, test.contents))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want it to contain %q", err, test.err)
+			}
+		})
+	}
+
+	if _, err := ReadConfig(filepath.Join(t.TempDir(), configFile)); !os.IsNotExist(errors.Cause(err)) {
+		t.Fatalf("got error %v reading a missing config, want not exist", err)
+	}
+}
+
+func TestWriteConfigRoundTrips(t *testing.T) {
+	cfg := validConfig()
+	cfg.API.Tokens = []string{"secret"}
+	cfg.API.Peers = map[string]string{"127.0.0.1:9001": "127.0.0.1:8082"}
+	cfg.DB.Join = []string{"127.0.0.1:9001"}
+	cfg.DB.Role = "stand-by"
+	cfg.REPL.ReadOnly = true
+
+	path := configPath(t.TempDir())
+	if err := WriteConfig(path, cfg); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("got mode %v, want the config only readable by its owner", mode)
+	}
+
+	got, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Fatalf("got config %+v, want %+v", got, cfg)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"empty API address", func(c *Config) { c.API.Address = "" }},
+		{"API address without port", func(c *Config) { c.API.Address = "localhost" }},
+		{"certificate without key", func(c *Config) { c.API.Cert = "cert.pem" }},
+		{"key without certificate", func(c *Config) { c.API.Key = "key.pem" }},
+		{"CA without certificate", func(c *Config) { c.API.CA = "ca.pem" }},
+		{"empty CORS origin", func(c *Config) { c.API.CORSOrigins = []string{""} }},
+		{"invalid peer", func(c *Config) { c.API.Peers = map[string]string{"peer": "127.0.0.1:8082"} }},
+		{"invalid peer API address", func(c *Config) { c.API.Peers = map[string]string{"127.0.0.1:9001": "peer"} }},
+		{"empty database address", func(c *Config) { c.DB.Address = "" }},
+		{"invalid join address", func(c *Config) { c.DB.Join = []string{"node"} }},
+		{"joining itself", func(c *Config) { c.DB.Join = []string{c.DB.Address} }},
+		{"role without join", func(c *Config) { c.DB.Role = "voter" }},
+		{"unknown role", func(c *Config) {
+			c.DB.Join = []string{"127.0.0.1:9001"}
+			c.DB.Role = "leader"
+		}},
+		{"even voters", func(c *Config) { c.DB.Voters = 4 }},
+		{"too few voters", func(c *Config) { c.DB.Voters = 1 }},
+		{"even stand-bys", func(c *Config) { c.DB.StandBys = 2 }},
+		{"invalid database name", func(c *Config) { c.DB.Databases = []string{"../escape"} }},
+		{"zero ready timeout", func(c *Config) { c.DB.ReadyTimeout = 0 }},
+		{"invalid REPL address", func(c *Config) { c.REPL.Address = "repl" }},
+		{"matching REPL tokens", func(c *Config) {
+			c.REPL.Token = "secret"
+			c.REPL.ReadToken = "secret"
+		}},
+		{"negative idle timeout", func(c *Config) { c.REPL.IdleTimeout = -time.Second }},
+		{"negative statement timeout", func(c *Config) { c.REPL.StatementTimeout = -time.Second }},
+		{"negative slow threshold", func(c *Config) { c.REPL.SlowThreshold = -time.Second }},
+		{"negative max sessions", func(c *Config) { c.REPL.MaxSessions = -1 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			test.modify(&cfg)
+			if err := cfg.Validate(); !errors.IsNotValid(err) {
+				t.Fatalf("got error %v, want not valid", err)
+			}
+		})
+	}
+
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("validating the valid config: %v", err)
+	}
+}
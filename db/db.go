@@ -3,6 +3,8 @@ package db
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/juju/errors"
@@ -12,6 +14,8 @@ import (
 // required retry semantics.
 type SQLDatabase struct {
 	db *sqlx.DB
+	// closers are closed along with the database.
+	closers []func() error
 }
 
 // NewSQLDatabase creates a new SQLDatabase from a given *sql.DB
@@ -21,12 +25,30 @@ func NewSQLDatabase(db *sql.DB, driverName string) *SQLDatabase {
 	}
 }
 
+// Close closes the underlying database.
+func (s *SQLDatabase) Close() error {
+	err := s.db.Close()
+	for _, closer := range s.closers {
+		if closeErr := closer(); err == nil {
+			err = closeErr
+		}
+	}
+	return errors.Trace(err)
+}
+
 // Run is a convince function for running one shot transactions, which correctly
 // handles the rollback semantics and retries where available.
 // The run function maybe called multiple times if the transaction is being
 // retried.
 func (s *SQLDatabase) Run(fn func(context.Context, *sqlx.Tx) error) error {
-	txn, err := s.CreateTxn(context.Background())
+	return s.RunContext(context.Background(), fn)
+}
+
+// RunContext is like Run, but the transaction is bound to the given context.
+// Once the context is done the transaction is rolled back and won't be
+// retried.
+func (s *SQLDatabase) RunContext(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) error {
+	txn, err := s.CreateTxn(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -34,6 +56,61 @@ func (s *SQLDatabase) Run(fn func(context.Context, *sqlx.Tx) error) error {
 	return txn.Stage(fn).Commit()
 }
 
+// RunReadOnly runs the function within a transaction that is only used for
+// reading. Writes made by the function fail, as not every driver enforces a
+// read-only transaction, and the transaction is always rolled back. The
+// function maybe called multiple times if the transaction is being retried.
+func (s *SQLDatabase) RunReadOnly(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) error {
+	return withRetry(func() error {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+
+		conn, err := s.db.Connx(ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.ExecContext(ctx, "PRAGMA query_only = 1"); err != nil {
+			return errors.Trace(err)
+		}
+		defer resetQueryOnly(conn)
+
+		tx, err := conn.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer func() { _ = tx.Rollback() }()
+
+		return errors.Trace(fn(ctx, tx))
+	})
+}
+
+// resetQueryOnly allows writes on the connection again, before it's returned
+// to the pool. If that fails, the connection is discarded instead.
+func resetQueryOnly(conn *sqlx.Conn) {
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA query_only = 0"); err == nil {
+		return
+	}
+	_ = conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
+
+// RunStandalone runs the function on a dedicated connection outside of any
+// transaction, for statements that can not be run within a transaction.
+// Unlike Run, the function is never retried.
+func (s *SQLDatabase) RunStandalone(ctx context.Context, fn func(context.Context, *sqlx.Conn) error) error {
+	conn, err := s.db.Connx(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	return errors.Trace(fn(ctx, conn))
+}
+
 // CreateTxn creates a transaction builder. The transaction builder accumulates
 // a series of functions that can be executed on a given commit.
 func (s *SQLDatabase) CreateTxn(ctx context.Context) (TxnBuilder, error) {
@@ -50,6 +127,7 @@ func (s *SQLDatabase) CreateTxn(ctx context.Context) (TxnBuilder, error) {
 // how many retries are employed.
 type TxnBuilder interface {
 	Stage(func(context.Context, *sqlx.Tx) error) TxnBuilder
+	OnCommit(func()) TxnBuilder
 	Commit() error
 }
 
@@ -59,6 +137,7 @@ type txnBuilder struct {
 	db        *sqlx.DB
 	ctx       context.Context
 	runnables []func(context.Context, *sqlx.Tx) error
+	onCommit  []func()
 }
 
 // Context returns the underlying TxnBuilder context.
@@ -75,16 +154,27 @@ func (t *txnBuilder) Stage(fn func(context.Context, *sqlx.Tx) error) TxnBuilder
 	return t
 }
 
+// OnCommit adds a function that is called once the transaction has been
+// successfully committed. The function is never called if the transaction is
+// rolled back, and is only called once regardless of retries.
+func (t *txnBuilder) OnCommit(fn func()) TxnBuilder {
+	t.onCommit = append(t.onCommit, fn)
+	return t
+}
+
 // Commit commits the transaction.
 func (t *txnBuilder) Commit() error {
-	return withRetry(func() error {
+	var hooks []func()
+	err := withRetry(func() error {
 		// Ensure that we don't attempt to retry if the context has been
 		// cancelled or errored out.
 		if err := t.ctx.Err(); err != nil {
 			return errors.Trace(err)
 		}
 
-		rawTx, err := t.db.Beginx()
+		// The transaction is bound to the context, so that it's rolled back
+		// once the context is done.
+		rawTx, err := t.db.BeginTxx(t.ctx, nil)
 		if err != nil {
 			// Nested transactions are not supported, if we get an error during
 			// the begin transaction phase, attempt to rollback both
@@ -95,14 +185,73 @@ func (t *txnBuilder) Commit() error {
 			return errors.Trace(err)
 		}
 
+		registerCommitHooks(rawTx)
 		for _, fn := range t.runnables {
 			if err := fn(t.ctx, rawTx); err != nil {
 				// Ensure we rollback when attempt to run each function with in
 				// a transaction commit.
 				_ = rawTx.Rollback()
+				_ = unregisterCommitHooks(rawTx)
 				return errors.Trace(err)
 			}
 		}
-		return rawTx.Commit()
+
+		txHooks := unregisterCommitHooks(rawTx)
+		if err := rawTx.Commit(); err != nil {
+			return errors.Trace(err)
+		}
+		hooks = txHooks
+		return nil
 	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, fn := range hooks {
+		fn()
+	}
+	for _, fn := range t.onCommit {
+		fn()
+	}
+	return nil
+}
+
+// commitHooks holds the functions to be called once a transaction has been
+// committed, keyed by the transaction.
+var commitHooks = struct {
+	sync.Mutex
+	hooks map[*sqlx.Tx][]func()
+}{
+	hooks: make(map[*sqlx.Tx][]func()),
+}
+
+// OnCommit registers a function to be called once the transaction has been
+// successfully committed. This allows code that is only handed the
+// transaction to react to the changes it made, once they're visible. The
+// function is never called if the transaction is rolled back. The transaction
+// must have been created by a TxnBuilder.
+func OnCommit(tx *sqlx.Tx, fn func()) error {
+	commitHooks.Lock()
+	defer commitHooks.Unlock()
+
+	hooks, ok := commitHooks.hooks[tx]
+	if !ok {
+		return errors.NotFoundf("transaction for commit hook")
+	}
+	commitHooks.hooks[tx] = append(hooks, fn)
+	return nil
+}
+
+func registerCommitHooks(tx *sqlx.Tx) {
+	commitHooks.Lock()
+	defer commitHooks.Unlock()
+	commitHooks.hooks[tx] = nil
+}
+
+func unregisterCommitHooks(tx *sqlx.Tx) []func() {
+	commitHooks.Lock()
+	defer commitHooks.Unlock()
+	hooks := commitHooks.hooks[tx]
+	delete(commitHooks.hooks, tx)
+	return hooks
 }
@@ -0,0 +1,138 @@
+package db_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// newTestDatabase returns an in-memory database with a things table, which
+// is closed when the test finishes.
+func newTestDatabase(t *testing.T) *db.SQLDatabase {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	err = backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "CREATE TABLE things (name TEXT)")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("creating table: %v", err)
+	}
+	return backend
+}
+
+// countThings returns the number of rows in the things table.
+func countThings(t *testing.T, backend *db.SQLDatabase) int {
+	t.Helper()
+
+	var count int
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM things")
+	})
+	if err != nil {
+		t.Fatalf("counting things: %v", err)
+	}
+	return count
+}
+
+func TestRunContextAbortsOnCancel(t *testing.T) {
+	backend := newTestDatabase(t)
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO things (name) VALUES ('kept')")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("inserting: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var committed bool
+	txn, err := backend.CreateTxn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = txn.Stage(func(ctx context.Context, tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO things (name) VALUES ('widget')"); err != nil {
+			return err
+		}
+		// The client goes away before the transaction is committed.
+		cancel()
+		return nil
+	}).OnCommit(func() {
+		committed = true
+	}).Commit()
+	if err == nil {
+		t.Fatalf("expected the cancelled transaction to fail")
+	}
+	if committed {
+		t.Fatalf("commit hook called for the cancelled transaction")
+	}
+	// The database outlives the connection discarded with the cancelled
+	// transaction.
+	if count := countThings(t, backend); count != 1 {
+		t.Fatalf("got %d things, want the cancelled transaction rolled back", count)
+	}
+}
+
+func TestRunContextCancelledBeforeStart(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var called bool
+	err := backend.RunContext(ctx, func(context.Context, *sqlx.Tx) error {
+		called = true
+		return nil
+	})
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("got error %v, want context canceled", err)
+	}
+	if called {
+		t.Fatalf("transaction run with a cancelled context")
+	}
+}
+
+func TestRunReadOnlyRejectsWrites(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	var count int
+	err := backend.RunReadOnly(context.Background(), func(ctx context.Context, tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO things (name) VALUES ('widget')"); err == nil {
+			t.Errorf("expected a write in a read-only transaction to fail")
+		}
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM things")
+	})
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d things, want none", count)
+	}
+
+	// The connection accepts writes again once it's returned to the pool.
+	err = backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO things (name) VALUES ('widget')")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writing after a read-only transaction: %v", err)
+	}
+	if count := countThings(t, backend); count != 1 {
+		t.Fatalf("got %d things, want 1", count)
+	}
+}
@@ -0,0 +1,54 @@
+// +build cgo
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// inMemoryDatabases counts the in-memory databases created, so that each one
+// has a unique name.
+var inMemoryDatabases int64
+
+// NewInMemorySQLDatabase creates a new SQLDatabase backed by a private
+// in-memory sqlite database. The database is discarded when it is closed.
+func NewInMemorySQLDatabase() (*SQLDatabase, error) {
+	// The database is named and shared, so that it outlives the connection
+	// used for transactions, which database/sql discards once the context of
+	// a transaction is done.
+	dsn := fmt.Sprintf("file:memory-%d?mode=memory&cache=shared&_foreign_keys=1",
+		atomic.AddInt64(&inMemoryDatabases, 1))
+
+	// The in-memory database is only discarded once its last connection is
+	// closed, so a connection is held open until the database is closed.
+	keeper, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := keeper.Conn(context.Background())
+	if err != nil {
+		_ = keeper.Close()
+		return nil, errors.Trace(err)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		_ = conn.Close()
+		_ = keeper.Close()
+		return nil, errors.Trace(err)
+	}
+	// Ensure there is only ever one connection running transactions, as
+	// connections sharing the cache fail rather than wait on each other's
+	// locks.
+	db.SetMaxOpenConns(1)
+
+	database := NewSQLDatabase(db, "sqlite3")
+	database.closers = append(database.closers, conn.Close, keeper.Close)
+	return database, nil
+}
@@ -0,0 +1,11 @@
+// +build !cgo
+
+package db
+
+import "github.com/juju/errors"
+
+// NewInMemorySQLDatabase creates a new SQLDatabase backed by a private
+// in-memory sqlite database. The database is discarded when it is closed.
+func NewInMemorySQLDatabase() (*SQLDatabase, error) {
+	return nil, errors.NotSupportedf("in-memory database without cgo")
+}
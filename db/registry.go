@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// maxNameLength is the longest name a database can have.
+const maxNameLength = 255
+
+// Opener opens the database with the name, creating it if needed.
+type Opener func(ctx context.Context, name string) (*sql.DB, error)
+
+// Registry opens databases by name the first time they're asked for, and
+// keeps the handles until it's closed.
+type Registry struct {
+	open Opener
+	// allowed holds the names of the databases that can be opened, nil if
+	// any valid name can be.
+	allowed map[string]bool
+
+	mutex  sync.Mutex
+	dbs    map[string]*sql.DB
+	closed bool
+}
+
+// RegistryOption configures a Registry.
+type RegistryOption func(*Registry)
+
+// WithAllowedNames only allows the databases with the names to be opened.
+func WithAllowedNames(names ...string) RegistryOption {
+	return func(r *Registry) {
+		if r.allowed == nil {
+			r.allowed = make(map[string]bool)
+		}
+		for _, name := range names {
+			r.allowed[name] = true
+		}
+	}
+}
+
+// NewRegistry creates a registry opening the databases with the opener.
+func NewRegistry(open Opener, opts ...RegistryOption) *Registry {
+	r := &Registry{
+		open: open,
+		dbs:  make(map[string]*sql.DB),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// ValidateName checks the name can be used for a database. Names can't be
+// empty or contain path separators, so that they can't escape the data
+// directory.
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return errors.NotValidf("empty database name")
+	case len(name) > maxNameLength:
+		return errors.NotValidf("database name longer than %d bytes", maxNameLength)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return errors.NotValidf("database name %q containing a path separator", name)
+	case name == "." || name == "..":
+		return errors.NotValidf("database name %q", name)
+	}
+	return nil
+}
+
+// GetDB returns the database with the name, opening it if it isn't open yet.
+// A NotValid error means the name can't be used, and a NotFound error means
+// the name isn't allowed.
+func (r *Registry) GetDB(ctx context.Context, name string) (*sql.DB, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.Errorf("database registry closed")
+	}
+	if sqlDB, ok := r.dbs[name]; ok {
+		return sqlDB, nil
+	}
+	if r.allowed != nil && !r.allowed[name] {
+		return nil, errors.NotFoundf("database %q in the allowed databases", name)
+	}
+
+	sqlDB, err := r.open(ctx, name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "opening database %q", name)
+	}
+	r.dbs[name] = sqlDB
+	return sqlDB, nil
+}
+
+// GetExistingDB returns the database with the name if it's open or allowed,
+// without creating databases on demand for arbitrary names. A NotFound error
+// means there's no such database.
+func (r *Registry) GetExistingDB(name string) (*sql.DB, error) {
+	r.mutex.Lock()
+	_, open := r.dbs[name]
+	known := open || r.allowed[name]
+	r.mutex.Unlock()
+
+	if !known {
+		return nil, errors.NotFoundf("database %q", name)
+	}
+	return r.GetDB(context.Background(), name)
+}
+
+// DatabaseNames returns the names of the open and allowed databases, sorted.
+func (r *Registry) DatabaseNames() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	seen := make(map[string]bool)
+	var names []string
+	for name := range r.dbs {
+		seen[name] = true
+		names = append(names, name)
+	}
+	for name := range r.allowed {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every open database. The registry can't be used afterwards.
+func (r *Registry) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	var failed []string
+	for name, sqlDB := range r.dbs {
+		if err := sqlDB.Close(); err != nil {
+			failed = append(failed, name+": "+err.Error())
+		}
+	}
+	r.dbs = nil
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("closing databases: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
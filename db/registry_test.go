@@ -0,0 +1,217 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/juju/errors"
+)
+
+// nopConnector is a connector that can't connect, for handles that are
+// opened but never used.
+type nopConnector struct{}
+
+func (nopConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("not connectable")
+}
+
+func (nopConnector) Driver() driver.Driver { return nil }
+
+// countingOpener opens a handle for each name, counting the calls.
+type countingOpener struct {
+	mutex sync.Mutex
+	opens map[string]int
+	err   error
+}
+
+func (o *countingOpener) open(_ context.Context, name string) (*sql.DB, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.opens == nil {
+		o.opens = make(map[string]int)
+	}
+	o.opens[name]++
+	if o.err != nil {
+		return nil, o.err
+	}
+	return sql.OpenDB(nopConnector{}), nil
+}
+
+func (o *countingOpener) count(name string) int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.opens[name]
+}
+
+func TestRegistryOpensEachNameOnce(t *testing.T) {
+	opener := &countingOpener{}
+	registry := db.NewRegistry(opener.open)
+	defer registry.Close()
+
+	handles := make(map[string]*sql.DB)
+	for _, name := range []string{"main", "other", "main", "other"} {
+		sqlDB, err := registry.GetDB(context.Background(), name)
+		if err != nil {
+			t.Fatalf("getting %q: %v", name, err)
+		}
+		if previous, ok := handles[name]; ok && previous != sqlDB {
+			t.Fatalf("got a new handle for %q", name)
+		}
+		handles[name] = sqlDB
+	}
+	if handles["main"] == handles["other"] {
+		t.Fatalf("got the same handle for both databases")
+	}
+	for _, name := range []string{"main", "other"} {
+		if n := opener.count(name); n != 1 {
+			t.Errorf("opened %q %d times, want once", name, n)
+		}
+	}
+	if got, want := registry.DatabaseNames(), []string{"main", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got names %v, want %v", got, want)
+	}
+}
+
+func TestRegistryValidatesNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"main", true},
+		{"6ba7b810-9dad-41d1-80b4-00c04fd430c8", true},
+		{"with.dots", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../escape", false},
+		{"nested/name", false},
+		{`windows\name`, false},
+		{"nul\x00name", false},
+		{strings.Repeat("x", 256), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opener := &countingOpener{}
+			registry := db.NewRegistry(opener.open)
+			defer registry.Close()
+
+			_, err := registry.GetDB(context.Background(), test.name)
+			if test.valid {
+				if err != nil {
+					t.Fatalf("getting %q: %v", test.name, err)
+				}
+				return
+			}
+			if !errors.IsNotValid(err) {
+				t.Fatalf("got error %v, want not valid", err)
+			}
+			if n := opener.count(test.name); n != 0 {
+				t.Fatalf("opened the invalid name %d times", n)
+			}
+			if err := db.ValidateName(test.name); !errors.IsNotValid(err) {
+				t.Fatalf("got error %v validating, want not valid", err)
+			}
+		})
+	}
+}
+
+func TestRegistryAllowedNames(t *testing.T) {
+	opener := &countingOpener{}
+	registry := db.NewRegistry(opener.open, db.WithAllowedNames("main", "other"))
+	defer registry.Close()
+
+	// The allowed databases are listed before they're opened.
+	if got, want := registry.DatabaseNames(), []string{"main", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got names %v, want %v", got, want)
+	}
+
+	if _, err := registry.GetDB(context.Background(), "unknown"); !errors.IsNotFound(err) {
+		t.Fatalf("got error %v opening a name that isn't allowed, want not found", err)
+	}
+	if _, err := registry.GetExistingDB("unknown"); !errors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+	if _, err := registry.GetExistingDB("other"); err != nil {
+		t.Fatalf("getting an allowed database: %v", err)
+	}
+	if n := opener.count("unknown"); n != 0 {
+		t.Fatalf("opened a name that isn't allowed %d times", n)
+	}
+}
+
+func TestRegistryGetExistingDB(t *testing.T) {
+	opener := &countingOpener{}
+	registry := db.NewRegistry(opener.open)
+	defer registry.Close()
+
+	// Without allowed names, only the databases already opened exist.
+	if _, err := registry.GetExistingDB("main"); !errors.IsNotFound(err) {
+		t.Fatalf("got error %v before opening, want not found", err)
+	}
+	opened, err := registry.GetDB(context.Background(), "main")
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	existing, err := registry.GetExistingDB("main")
+	if err != nil {
+		t.Fatalf("getting once opened: %v", err)
+	}
+	if existing != opened {
+		t.Fatalf("got a different handle for the opened database")
+	}
+	if n := opener.count("main"); n != 1 {
+		t.Fatalf("opened %d times, want once", n)
+	}
+}
+
+func TestRegistryOpenFailureIsRetried(t *testing.T) {
+	opener := &countingOpener{err: errors.New("boom")}
+	registry := db.NewRegistry(opener.open)
+	defer registry.Close()
+
+	if _, err := registry.GetDB(context.Background(), "main"); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got error %v, want the open failure", err)
+	}
+	if names := registry.DatabaseNames(); len(names) != 0 {
+		t.Fatalf("got names %v, want the failed database not to be kept", names)
+	}
+
+	opener.mutex.Lock()
+	opener.err = nil
+	opener.mutex.Unlock()
+	if _, err := registry.GetDB(context.Background(), "main"); err != nil {
+		t.Fatalf("retrying: %v", err)
+	}
+	if n := opener.count("main"); n != 2 {
+		t.Fatalf("opened %d times, want twice", n)
+	}
+}
+
+func TestRegistryClose(t *testing.T) {
+	opener := &countingOpener{}
+	registry := db.NewRegistry(opener.open)
+
+	sqlDB, err := registry.GetDB(context.Background(), "main")
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	if err := registry.Close(); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	if err := sqlDB.Ping(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("got error %v, want the database closed", err)
+	}
+	if _, err := registry.GetDB(context.Background(), "main"); err == nil {
+		t.Fatalf("expected getting a database after closing to fail")
+	}
+	if err := registry.Close(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+}
@@ -4,18 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/SimonRichardson/nu-juju-data/db"
 	"github.com/SimonRichardson/nu-juju-data/repl"
 	"github.com/SimonRichardson/nu-juju-data/server"
 	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
 	"github.com/canonical/go-dqlite/app"
 	"github.com/canonical/go-dqlite/client"
+	"github.com/canonical/go-dqlite/driver"
+	"github.com/jmoiron/sqlx"
 	"github.com/juju/clock"
+	"github.com/juju/errors"
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
 )
@@ -31,96 +39,883 @@ func main() {
 }
 
 func doItLive() {
-	var apiAddr string
-	var dbAddr string
-	var join *[]string
-	var dir string
-	var verbose bool
-
 	cmd := &cobra.Command{
 		Use:   "nu-juju-data",
 		Short: "Demo to show the nu-juju-data",
+	}
+	cmd.AddCommand(initCommand())
+	cmd.AddCommand(joinCommand())
+	cmd.AddCommand(serveCommand())
+	cmd.AddCommand(replCommand())
+	cmd.AddCommand(clusterCommand())
+	cmd.AddCommand(removeNodeCommand())
+	cmd.AddCommand(backupCommand())
+	cmd.AddCommand(restoreCommand())
+
+	if err := cmd.Execute(); err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitClusterUnavailable is the exit code when the node gave up waiting for
+// the cluster on start up, distinguishing it from other failures so that
+// orchestration can retry it.
+const exitClusterUnavailable = 3
+
+// exitCode returns the exit code for the error the command failed with.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case IsClusterUnavailable(err):
+		return exitClusterUnavailable
+	}
+	return 1
+}
+
+// defaultDataDir is the data directory used when none is given.
+const defaultDataDir = "/tmp/dqlite-demo"
+
+// initCommand returns the command writing the config of the first node of a
+// new cluster, which is bootstrapped when the node is first served.
+func initCommand() *cobra.Command {
+	var dir string
+	var force bool
+	var cfgFlags *configFlags
+
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "create the data directory and config of the first node of a new cluster",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			logFunc := func(l client.LogLevel, format string, a ...interface{}) {
-				if !verbose {
-					return
-				}
-				log.Printf(fmt.Sprintf("%s: %s: %s\n", apiAddr, l.String(), format), a...)
+			cfg, err := cfgFlags.Apply(DefaultConfig())
+			if err != nil {
+				return err
 			}
+			if len(cfg.DB.Join) > 0 {
+				return errors.New("init bootstraps a new cluster; use join to join an existing cluster")
+			}
+			if err := writeNodeConfig(dir, cfg, force); err != nil {
+				return err
+			}
+			fmt.Printf("Initialised %q; start the node with: nu-juju-data serve --dir %s\n", dir, dir)
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory")
+	flags.BoolVar(&force, "force", false, "replace an existing config")
+	cfgFlags = newConfigFlags(flags)
+
+	cmd.MarkFlagRequired("api")
+	cmd.MarkFlagRequired("db")
 
-			// Setup up the database.
-			app, err := app.New(dir, app.WithAddress(dbAddr), app.WithCluster(*join), app.WithLogFunc(logFunc))
+	return cmd
+}
+
+// joinCommand returns the command writing the config of a node joining an
+// existing cluster, once one of its nodes has been contacted.
+func joinCommand() *cobra.Command {
+	var dir string
+	var force bool
+	var cfgFlags *configFlags
+
+	cmd := &cobra.Command{
+		Use:   "join",
+		Short: "create the data directory and config of a node joining an existing cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := cfgFlags.Apply(DefaultConfig())
 			if err != nil {
 				return err
 			}
-			if err := app.Ready(context.Background()); err != nil {
+			if err := cfg.Validate(); err != nil {
 				return err
 			}
-			dqliteDB, err := app.Open(context.Background(), "demo")
+
+			ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+			defer cancel()
+			leader, err := contactCluster(ctx, cfg.DB.Join)
 			if err != nil {
 				return err
 			}
 
-			replSock := filepath.Join(dir, "juju.sock")
-			_ = os.Remove(replSock)
-			_, err = repl.New(replSock, dbGetter{db: dqliteDB}, clock.WallClock)
-			if err != nil {
+			if err := writeNodeConfig(dir, cfg, force); err != nil {
 				return err
 			}
+			fmt.Printf("Contacted the cluster led by %s; join it by starting the node with: nu-juju-data serve --dir %s\n", leader, dir)
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory")
+	flags.BoolVar(&force, "force", false, "replace an existing config")
+	cfgFlags = newConfigFlags(flags)
+
+	cmd.MarkFlagRequired("api")
+	cmd.MarkFlagRequired("db")
+	cmd.MarkFlagRequired("join")
+
+	return cmd
+}
 
-			backend := db.NewSQLDatabase(dqliteDB, app.Driver())
-			state := state.NewState(backend)
-			if err := state.StartUp(context.Background()); err != nil {
+// contactCluster returns the address of the leader of the cluster the nodes
+// at the addresses are members of.
+func contactCluster(ctx context.Context, addresses []string) (string, error) {
+	store := client.NewInmemNodeStore()
+	nodes := make([]client.NodeInfo, len(addresses))
+	for i, address := range addresses {
+		nodes[i] = client.NodeInfo{Address: address}
+	}
+	if err := store.Set(ctx, nodes); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	cli, err := client.FindLeader(ctx, store)
+	if err != nil {
+		return "", errors.Annotatef(err, "contacting the cluster at %s", strings.Join(addresses, ", "))
+	}
+	defer cli.Close()
+
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return "", errors.Annotate(err, "finding the leader of the cluster")
+	}
+	return leader.Address, nil
+}
+
+// writeNodeConfig validates the config and writes it to the data directory,
+// which is created if needed. An existing config is only replaced if force is
+// true.
+func writeNodeConfig(dir string, cfg Config, force bool) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	path := configPath(dir)
+	if _, err := os.Stat(path); err == nil && !force {
+		return errors.Errorf("%q is already initialised; serve it, or pass --force to replace its config", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Annotate(err, "creating data directory")
+	}
+	return errors.Annotate(WriteConfig(path, cfg), "writing config")
+}
+
+// serveCommand returns the command serving a node with the config in its
+// data directory.
+func serveCommand() *cobra.Command {
+	var dir, path string
+	var cfgFlags *configFlags
+
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "serve a node, with flags overriding its config",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if path == "" {
+				path = configPath(dir)
+			}
+			cfg, err := ReadConfig(path)
+			if os.IsNotExist(errors.Cause(err)) {
+				return errors.Errorf("no config found at %q; create it with init or join first", path)
+			} else if err != nil {
+				return err
+			}
+			if cfg, err = cfgFlags.Apply(cfg); err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return errors.Annotatef(err, "config %q", path)
+			}
+
+			node, err := StartNode(context.Background(), dir, cfg)
+			if err != nil {
 				return err
 			}
 
-			// Log out the current applied schema.
-			fmt.Println(state.SchemaManager().Applied())
+			// Shutdown once asked to stop, or the API fails to serve.
+			ctx, stop := signal.NotifyContext(context.Background(), unix.SIGINT, unix.SIGTERM, unix.SIGPWR)
+			defer stop()
+			return node.Run(ctx, shutdownTimeout)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory")
+	flags.StringVar(&path, "config", "", "config file, instead of the one in the data directory")
+	cfgFlags = newConfigFlags(flags)
+
+	return cmd
+}
 
-			server := server.New(state)
-			listener, err := server.Serve(apiAddr)
+// replSocket is the name of the UNIX socket of the REPL, in the data
+// directory.
+const replSocket = "juju.sock"
+
+// replCommand returns the command connecting to the REPL of a running node,
+// with line editing, history and completion.
+func replCommand() *cobra.Command {
+	var dir, connect, token string
+
+	cmd := &cobra.Command{
+		Use:   "repl",
+		Short: "connect to the REPL of a running node",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			network, address := "unix", filepath.Join(dir, replSocket)
+			if connect != "" {
+				network, address = replNetwork(connect)
+			}
+
+			client, err := repl.Dial(network, address, token)
 			if err != nil {
 				return err
 			}
+			defer client.Close()
+
+			return client.Run(os.Stdin, os.Stdout, filepath.Join(dir, "repl_history"))
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory of the node, holding the REPL socket and history")
+	flags.StringVar(&connect, "connect", "", "REPL socket or TCP address to connect to, instead of the socket in the data directory")
+	flags.StringVar(&token, "token", "", "token sent first, as required by REPL sessions over TCP")
 
-			ch := make(chan os.Signal, 1)
-			signal.Notify(ch, unix.SIGPWR)
-			signal.Notify(ch, unix.SIGINT)
-			signal.Notify(ch, unix.SIGQUIT)
-			signal.Notify(ch, unix.SIGTERM)
-			signal.Notify(ch, unix.SIGKILL)
+	return cmd
+}
+
+// replNetwork returns the network of the REPL address; an existing file is a
+// UNIX socket, anything else a TCP address.
+func replNetwork(address string) (string, string) {
+	if _, err := os.Stat(address); err == nil {
+		return "unix", address
+	}
+	return "tcp", address
+}
+
+// demoDB is the name of the database holding the state.
+const demoDB = "demo"
+
+// shutdownTimeout is the time the node is given to shut down, including the
+// time in-flight API requests are given to complete.
+const shutdownTimeout = 30 * time.Second
+
+// leadershipPollInterval is how often the dqlite cluster is asked for the
+// current leader.
+const leadershipPollInterval = 5 * time.Second
+
+// dqliteLeadership reports whether the local dqlite node is the leader of the
+// cluster, by periodically polling the cluster for its leader.
+type dqliteLeadership struct {
+	app     *app.App
+	clock   clock.Clock
+	changes chan bool
+}
+
+func newDQLiteLeadership(ctx context.Context, app *app.App, clock clock.Clock) *dqliteLeadership {
+	l := &dqliteLeadership{
+		app:     app,
+		clock:   clock,
+		changes: make(chan bool),
+	}
+	go l.loop(ctx)
+	return l
+}
+
+// Changes implements state.LeadershipWatcher.
+func (l *dqliteLeadership) Changes() <-chan bool {
+	return l.changes
+}
+
+func (l *dqliteLeadership) loop(ctx context.Context) {
+	defer close(l.changes)
+
+	var leader, reported bool
+	for {
+		if isLeader := l.isLeader(ctx); !reported || isLeader != leader {
 			select {
-			case <-ch:
+			case l.changes <- isLeader:
+				leader, reported = isLeader, true
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-l.clock.After(leadershipPollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *dqliteLeadership) isLeader(ctx context.Context) bool {
+	leader, err := leaderAddress(ctx, l.app)
+	return err == nil && leader == l.app.Address()
+}
+
+// dqliteCluster reports the leader of the dqlite cluster to the API server.
+type dqliteCluster struct {
+	app *app.App
+}
+
+// Address implements server.Cluster.
+func (c dqliteCluster) Address() string {
+	return c.app.Address()
+}
+
+// LeaderAddress implements server.Cluster.
+func (c dqliteCluster) LeaderAddress(ctx context.Context) (string, error) {
+	return leaderAddress(ctx, c.app)
+}
+
+// leaderAddress asks the cluster for the address of the leader.
+func leaderAddress(ctx context.Context, app *app.App) (string, error) {
+	cli, err := app.Leader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	info, err := cli.Leader(ctx)
+	if err != nil {
+		return "", err
+	}
+	if info == nil {
+		return "", errors.NotFoundf("cluster leader")
+	}
+	return info.Address, nil
+}
+
+// Members implements server.ClusterMembers.
+func (c dqliteCluster) Members(ctx context.Context) ([]server.ClusterMember, string, error) {
+	cli, err := c.app.Leader(ctx)
+	if err != nil {
+		return nil, "", errors.NewNotProvisioned(err, "cluster leader unreachable; check that a majority of the voters are running")
+	}
+	defer cli.Close()
+
+	return clusterMembers(ctx, cli)
+}
+
+// RemoveMember implements server.ClusterMembers.
+func (c dqliteCluster) RemoveMember(ctx context.Context, id uint64) (server.ClusterMember, []string, error) {
+	node, warnings, err := removeNode(ctx, func(ctx context.Context) (nodeRemover, error) {
+		cli, err := c.app.Leader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}, func(node client.NodeInfo) bool {
+		return node.ID == id
+	})
+	if err != nil {
+		return server.ClusterMember{}, nil, err
+	}
+	return server.ClusterMember{
+		ID:      node.ID,
+		Address: node.Address,
+		Role:    node.Role.String(),
+	}, warnings, nil
+}
+
+// minFaultTolerantVoters is the number of voters needed for the cluster to
+// tolerate losing a voter.
+const minFaultTolerantVoters = 3
+
+// nodeRemover is the part of the dqlite client connected to the leader that
+// removes nodes from the cluster.
+type nodeRemover interface {
+	Cluster(context.Context) ([]client.NodeInfo, error)
+	Leader(context.Context) (*client.NodeInfo, error)
+	Transfer(ctx context.Context, id uint64) error
+	Remove(ctx context.Context, id uint64) error
+	Close() error
+}
+
+// removeNode permanently removes the first node matching from the cluster.
+// If the node is the leader, leadership is transferred to another voter
+// first. The last voter is never removed, as that would destroy the cluster.
+// Warnings are returned if the cluster is left unable to tolerate losing a
+// voter.
+func removeNode(ctx context.Context, dialLeader func(context.Context) (nodeRemover, error), match func(client.NodeInfo) bool) (client.NodeInfo, []string, error) {
+	cli, err := dialLeader(ctx)
+	if err != nil {
+		return client.NodeInfo{}, nil, errors.NewNotProvisioned(err, "cluster leader unreachable; check that a majority of the voters are running")
+	}
+	defer func() { _ = cli.Close() }()
+
+	nodes, err := cli.Cluster(ctx)
+	if err != nil {
+		return client.NodeInfo{}, nil, errors.Annotate(err, "listing cluster nodes")
+	}
+
+	var (
+		target   *client.NodeInfo
+		voters   []client.NodeInfo
+		warnings []string
+	)
+	for i, node := range nodes {
+		if match(node) {
+			target = &nodes[i]
+		}
+		if node.Role == client.Voter {
+			voters = append(voters, node)
+		}
+	}
+	if target == nil {
+		return client.NodeInfo{}, nil, errors.NotFoundf("node in the cluster; run the cluster command to list the nodes")
+	}
+	if target.Role == client.Voter {
+		if len(voters) == 1 {
+			return client.NodeInfo{}, nil, errors.NewForbidden(nil, fmt.Sprintf("node %d (%s) is the last voter; removing it would destroy the cluster", target.ID, target.Address))
+		}
+		if remaining := len(voters) - 1; remaining < minFaultTolerantVoters {
+			warnings = append(warnings, fmt.Sprintf("the cluster is left with %d voter(s), so losing another voter will lose quorum; add nodes to restore fault tolerance", remaining))
+		}
+	}
+
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return client.NodeInfo{}, nil, errors.NewNotProvisioned(err, "cluster leader unreachable; check that a majority of the voters are running")
+	}
+	if leader != nil && leader.ID == target.ID {
+		var successor client.NodeInfo
+		for _, voter := range voters {
+			if voter.ID != target.ID {
+				successor = voter
+				break
+			}
+		}
+		if err := cli.Transfer(ctx, successor.ID); err != nil {
+			return client.NodeInfo{}, nil, errors.Annotatef(err, "transferring leadership from node %d to node %d; check node %d is running, or stop node %d and try again", target.ID, successor.ID, successor.ID, target.ID)
+		}
+
+		// Removing the node has to go through the new leader.
+		_ = cli.Close()
+		if cli, err = dialLeader(ctx); err != nil {
+			return client.NodeInfo{}, nil, errors.NewNotProvisioned(err, "new cluster leader unreachable after transferring leadership; try again")
+		}
+	}
+
+	if err := cli.Remove(ctx, target.ID); err != nil {
+		return client.NodeInfo{}, nil, errors.Annotatef(err, "removing node %d (%s)", target.ID, target.Address)
+	}
+	return *target, warnings, nil
+}
+
+// removeNodeCommand returns the command permanently removing a node from the
+// cluster, such as a node that has died and won't come back.
+func removeNodeCommand() *cobra.Command {
+	var dir, clusterAddress, address string
+	var id uint64
+
+	cmd := &cobra.Command{
+		Use:   "remove-node",
+		Short: "permanently remove a node from the cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (address == "") == (id == 0) {
+				return errors.New("pass either --address or --id of the node to remove")
 			}
-			dqliteDB.Close()
 
-			listener.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+			defer cancel()
 
-			app.Handover(context.Background())
-			app.Close()
+			node, warnings, err := removeNode(ctx, func(ctx context.Context) (nodeRemover, error) {
+				cli, err := dialLeader(ctx, dir, clusterAddress)
+				if err != nil {
+					return nil, err
+				}
+				return cli, nil
+			}, func(node client.NodeInfo) bool {
+				if address != "" {
+					return node.Address == address
+				}
+				return node.ID == id
+			})
+			if err != nil {
+				return err
+			}
 
+			for _, warning := range warnings {
+				fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+			}
+			fmt.Printf("Removed node %d (%s)\n", node.ID, node.Address)
 			return nil
 		},
 	}
 	flags := cmd.Flags()
-	flags.StringVarP(&apiAddr, "api", "a", "", "address used to expose the demo API")
-	flags.StringVarP(&dbAddr, "db", "d", "", "address used for internal database replication")
-	join = flags.StringSliceP("join", "j", nil, "database addresses of existing nodes")
-	flags.StringVarP(&dir, "dir", "D", "/tmp/dqlite-demo", "data directory")
-	flags.BoolVarP(&verbose, "verbose", "v", false, "verbose logging")
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory of a node, holding the addresses of the cluster")
+	flags.StringVar(&clusterAddress, "cluster-address", "", "database address of a running node, instead of the addresses in the data directory")
+	flags.StringVar(&address, "address", "", "database address of the node to remove")
+	flags.Uint64Var(&id, "id", 0, "ID of the node to remove")
+
+	return cmd
+}
+
+// clusterMembers asks the leader for the nodes of the cluster.
+func clusterMembers(ctx context.Context, cli *client.Client) ([]server.ClusterMember, string, error) {
+	nodes, err := cli.Cluster(ctx)
+	if err != nil {
+		return nil, "", errors.Annotate(err, "listing cluster nodes")
+	}
+	leader, err := cli.Leader(ctx)
+	if err != nil {
+		return nil, "", errors.NewNotProvisioned(err, "cluster leader unreachable; check that a majority of the voters are running")
+	}
+
+	online := probeNodes(ctx, nodes)
+	members := make([]server.ClusterMember, len(nodes))
+	for i, node := range nodes {
+		members[i] = server.ClusterMember{
+			ID:      node.ID,
+			Address: node.Address,
+			Role:    node.Role.String(),
+			Online:  online[i],
+		}
+	}
+	var leaderAddress string
+	if leader != nil {
+		leaderAddress = leader.Address
+	}
+	return members, leaderAddress, nil
+}
+
+// clusterCommand returns the command reporting the nodes of the cluster,
+// found from the node store in the data directory or a node's address.
+func clusterCommand() *cobra.Command {
+	var dir, address string
+
+	cmd := &cobra.Command{
+		Use:   "cluster",
+		Short: "show the nodes of the cluster and the leader",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), clusterTimeout)
+			defer cancel()
+
+			cli, err := dialLeader(ctx, dir, address)
+			if err != nil {
+				return err
+			}
+			defer cli.Close()
+
+			members, leader, err := clusterMembers(ctx, cli)
+			if err != nil {
+				return err
+			}
+			return writeClusterStatus(os.Stdout, members, leader)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory of a node, holding the addresses of the cluster")
+	flags.StringVar(&address, "address", "", "database address of a node, instead of the addresses in the data directory")
+
+	return cmd
+}
+
+// clusterTimeout is the time given to commands talking to the cluster.
+const clusterTimeout = 10 * time.Second
+
+// dialLeader connects to the leader of the cluster, found from the node at
+// the address if there is one, otherwise from the node store in the data
+// directory.
+func dialLeader(ctx context.Context, dir, address string) (*client.Client, error) {
+	store, err := nodeStore(ctx, dir, address)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := client.FindLeader(ctx, store)
+	if err != nil {
+		return nil, errors.Annotate(err, "cluster leader unreachable; check that a majority of the voters are running")
+	}
+	return cli, nil
+}
+
+// nodeStore returns the store holding the addresses of the cluster; either
+// the node at the address, if there is one, or the nodes recorded in the data
+// directory.
+func nodeStore(ctx context.Context, dir, address string) (client.NodeStore, error) {
+	if address != "" {
+		store := client.NewInmemNodeStore()
+		if err := store.Set(ctx, []client.NodeInfo{{Address: address}}); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return store, nil
+	}
+
+	path := filepath.Join(dir, "cluster.yaml")
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Annotatef(err, "no cluster found in %q; pass the data directory or the address of a running node", dir)
+	}
+	store, err := client.NewYamlNodeStore(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading cluster nodes from %q", path)
+	}
+	return store, nil
+}
+
+// writeClusterStatus writes the nodes of the cluster as a table, marking the
+// leader.
+func writeClusterStatus(w io.Writer, members []server.ClusterMember, leader string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDRESS\tROLE\tONLINE\tLEADER")
+	for _, member := range members {
+		var mark string
+		if member.Address == leader {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%s\n", member.ID, member.Address, member.Role, member.Online, mark)
+	}
+	return tw.Flush()
+}
+
+// pendingActionsManager is an example of a manager registered outside of the
+// state package. It logs the number of pending actions every ensure pass.
+type pendingActionsManager struct {
+	backend state.Backend
+	logger  stdLogger
+}
+
+func (m *pendingActionsManager) StartUp(ctx context.Context) error {
+	return nil
+}
+
+func (m *pendingActionsManager) Stop(ctx context.Context) {}
+
+func (m *pendingActionsManager) Ensure(ctx context.Context) error {
+	var pending int
+	err := m.backend.RunReadOnly(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &pending, "SELECT COUNT(*) FROM actions WHERE status = 'pending'")
+	})
+	if err != nil {
+		return err
+	}
+	m.logger.Infof("%d pending actions", pending)
+	return nil
+}
+
+// stdLogger logs using the standard library logger.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) {
+	log.Printf("DEBUG: "+format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (stdLogger) Warningf(format string, args ...interface{}) {
+	log.Printf("WARNING: "+format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+// backupDriverName is the name the dqlite driver is registered under to
+// back up a running cluster.
+const backupDriverName = "dqlite-backup"
+
+// backupCommand returns the command writing a dump of the schema and data of
+// a running cluster, without going through the API.
+func backupCommand() *cobra.Command {
+	var dir, address, output string
+
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "write a SQL dump of the schema and data of the cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := nodeStore(context.Background(), dir, address)
+			if err != nil {
+				return err
+			}
+			dqliteDriver, err := driver.New(store)
+			if err != nil {
+				return errors.Annotate(err, "creating dqlite driver")
+			}
+			sql.Register(backupDriverName, dqliteDriver)
+
+			sqlDB, err := sql.Open(backupDriverName, demoDB)
+			if err != nil {
+				return errors.Annotatef(err, "opening database %q", demoDB)
+			}
+			backend := db.NewSQLDatabase(sqlDB, backupDriverName)
+			defer backend.Close()
+
+			w := io.Writer(os.Stdout)
+			if output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return errors.Annotate(err, "creating backup file")
+				}
+				defer f.Close()
+				w = f
+			}
+
+			schema := state.NewState(backend, stdLogger{}, clock.WallClock, nil).SchemaManager().Schema()
+			if err := schemastate.DumpTo(w, backend, schema, schemastate.DumpOptions{}); err != nil {
+				if output != "-" {
+					_ = os.Remove(output)
+				}
+				return errors.Annotate(err, "writing backup")
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory of a node, holding the addresses of the cluster")
+	flags.StringVar(&address, "address", "", "database address of a running node, instead of the addresses in the data directory")
+	flags.StringVarP(&output, "output", "o", "-", "file the dump is written to, or - for stdout")
+
+	return cmd
+}
+
+// restoreCommand returns the command initialising a new single node cluster
+// from a dump written by the backup command. The config of the node is
+// written alongside, so that the restored node can be served.
+func restoreCommand() *cobra.Command {
+	var dir, input string
+	var force bool
+	var cfgFlags *configFlags
+
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "initialise a data directory from a SQL dump",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := cfgFlags.Apply(DefaultConfig())
+			if err != nil {
+				return err
+			}
+			if len(cfg.DB.Join) > 0 {
+				return errors.New("restore bootstraps a new cluster; join the restored node once it's served")
+			}
+
+			in := io.Reader(os.Stdin)
+			if input != "-" {
+				f, err := os.Open(input)
+				if err != nil {
+					return errors.Annotate(err, "opening dump")
+				}
+				defer f.Close()
+				in = f
+			}
+
+			var status schemastate.Status
+			err = restoreNode(dir, cfg, force, func() error {
+				var err error
+				status, err = restoreDataDir(context.Background(), dir, cfg.DB.Address, in)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Restored schema version %d into %q; start the node with: nu-juju-data serve --dir %s\n", status.Current, dir, dir)
+			if !status.UpToDate() {
+				fmt.Printf("The remaining patches, up to version %d, are applied when the node is started\n", status.Expected)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVarP(&dir, "dir", "D", defaultDataDir, "data directory to initialise")
+	flags.StringVarP(&input, "input", "i", "-", "file the dump is read from, or - for stdin")
+	flags.BoolVar(&force, "force", false, "replace the contents of a data directory that isn't empty")
+	cfgFlags = newConfigFlags(flags)
 
 	cmd.MarkFlagRequired("api")
 	cmd.MarkFlagRequired("db")
 
-	if err := cmd.Execute(); err != nil {
-		os.Exit(1)
+	return cmd
+}
+
+// prepareDataDir ensures the data directory exists and is empty. The contents
+// of a directory that isn't empty are only removed if force is true.
+func prepareDataDir(dir string, force bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return errors.Annotate(os.MkdirAll(dir, 0755), "creating data directory")
+	} else if err != nil {
+		return errors.Annotate(err, "reading data directory")
+	}
+	if len(entries) == 0 {
+		return nil
 	}
+	if !force {
+		return errors.Errorf("data directory %q is not empty; restore into a new directory, or pass --force to replace its contents", dir)
+	}
+	return clearDataDir(dir)
 }
 
-type dbGetter struct {
-	db *sql.DB
+// clearDataDir removes the contents of the data directory.
+func clearDataDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Annotate(err, "reading data directory")
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return errors.Annotate(err, "clearing data directory")
+		}
+	}
+	return nil
 }
 
-func (g dbGetter) GetExistingDB(_ string) (*sql.DB, error) {
-	return g.db, nil
+// restoreNode prepares the data directory and restores a node into it,
+// writing the config of the node once it's restored. If the restore fails,
+// the contents of the data directory are removed again, so that a partially
+// restored node is never served and the restore can be retried without
+// --force.
+func restoreNode(dir string, cfg Config, force bool, restore func() error) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := prepareDataDir(dir, force); err != nil {
+		return err
+	}
+	err := restore()
+	if err == nil {
+		err = writeNodeConfig(dir, cfg, false)
+	}
+	if err != nil {
+		if clearErr := clearDataDir(dir); clearErr != nil {
+			return errors.Errorf("%v; the data directory %q must be cleared before restoring again: %v", err, dir, clearErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreDataDir starts a single node in the data directory and restores the
+// dump into it.
+func restoreDataDir(ctx context.Context, dir, dbAddr string, dump io.Reader) (schemastate.Status, error) {
+	node, err := app.New(dir, app.WithAddress(dbAddr))
+	if err != nil {
+		return schemastate.Status{}, errors.Annotate(err, "starting node")
+	}
+	defer node.Close()
+	if err := node.Ready(ctx); err != nil {
+		return schemastate.Status{}, errors.Annotate(err, "starting node")
+	}
+
+	sqlDB, err := node.Open(ctx, demoDB)
+	if err != nil {
+		return schemastate.Status{}, errors.Annotatef(err, "opening database %q", demoDB)
+	}
+	defer sqlDB.Close()
+
+	return restoreDatabase(db.NewSQLDatabase(sqlDB, node.Driver()), dump)
+}
+
+// restoreDatabase loads the dump into the empty database and verifies the
+// schema version restored is known.
+func restoreDatabase(backend *db.SQLDatabase, dump io.Reader) (schemastate.Status, error) {
+	if err := schemastate.Restore(dump, backend); err != nil {
+		return schemastate.Status{}, errors.Annotate(err, "restoring dump")
+	}
+
+	status, err := state.NewState(backend, stdLogger{}, clock.WallClock, nil).SchemaManager().Status()
+	if err != nil {
+		return schemastate.Status{}, errors.Annotate(err, "verifying schema")
+	}
+	if len(status.Unknown) > 0 || status.Current > status.Expected {
+		return status, errors.Errorf("restored schema version %d is newer than the version %d known to this binary; restore with a newer binary", status.Current, status.Expected)
+	}
+	return status, nil
 }
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/server"
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+func TestWriteClusterStatus(t *testing.T) {
+	var out bytes.Buffer
+	err := writeClusterStatus(&out, []server.ClusterMember{
+		{ID: 1, Address: "10.0.0.1:9000", Role: "voter", Online: true},
+		{ID: 2, Address: "10.0.0.2:9000", Role: "voter", Online: true},
+		{ID: 3445, Address: "10.0.0.10:9000", Role: "stand-by"},
+	}, "10.0.0.2:9000")
+	if err != nil {
+		t.Fatalf("writing cluster status: %v", err)
+	}
+
+	want := "ID    ADDRESS         ROLE      ONLINE  LEADER\n" +
+		"1     10.0.0.1:9000   voter     true    \n" +
+		"2     10.0.0.2:9000   voter     true    *\n" +
+		"3445  10.0.0.10:9000  stand-by  false   \n"
+	if got := out.String(); got != want {
+		t.Fatalf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+// fakeNodes is a cluster whose nodes can be removed, through clients
+// connected to its leader.
+type fakeNodes struct {
+	nodes    []client.NodeInfo
+	leader   uint64
+	dialErr  error
+	transfer error
+	remove   error
+
+	dials     int
+	clients   []*fakeRemover
+	transfers []uint64
+	removed   []uint64
+}
+
+func (c *fakeNodes) dial(context.Context) (nodeRemover, error) {
+	c.dials++
+	if c.dialErr != nil {
+		return nil, c.dialErr
+	}
+	cli := &fakeRemover{cluster: c, leader: c.leader}
+	c.clients = append(c.clients, cli)
+	return cli, nil
+}
+
+// fakeRemover is a client connected to the leader of the fake cluster.
+type fakeRemover struct {
+	cluster *fakeNodes
+	// leader is the node the client is connected to.
+	leader uint64
+	closed bool
+}
+
+func (r *fakeRemover) Cluster(context.Context) ([]client.NodeInfo, error) {
+	return append([]client.NodeInfo(nil), r.cluster.nodes...), nil
+}
+
+func (r *fakeRemover) Leader(context.Context) (*client.NodeInfo, error) {
+	for _, node := range r.cluster.nodes {
+		if node.ID == r.cluster.leader {
+			return &node, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeRemover) Transfer(_ context.Context, id uint64) error {
+	if r.cluster.transfer != nil {
+		return r.cluster.transfer
+	}
+	r.cluster.transfers = append(r.cluster.transfers, id)
+	r.cluster.leader = id
+	return nil
+}
+
+func (r *fakeRemover) Remove(_ context.Context, id uint64) error {
+	if r.leader != r.cluster.leader {
+		return errors.New("not leader")
+	}
+	if r.cluster.remove != nil {
+		return r.cluster.remove
+	}
+	r.cluster.removed = append(r.cluster.removed, id)
+	return nil
+}
+
+func (r *fakeRemover) Close() error {
+	r.closed = true
+	return nil
+}
+
+// newFakeNodes returns a cluster with the voters and a stand-by, led by the
+// first voter.
+func newFakeNodes(voters int) *fakeNodes {
+	c := &fakeNodes{leader: 1}
+	for id := uint64(1); id <= uint64(voters); id++ {
+		c.nodes = append(c.nodes, client.NodeInfo{ID: id, Address: fmt.Sprintf("10.0.0.%d:9000", id), Role: client.Voter})
+	}
+	c.nodes = append(c.nodes, client.NodeInfo{ID: 9, Address: "10.0.0.9:9000", Role: client.StandBy})
+	return c
+}
+
+// removeID removes the node with the id from the cluster.
+func removeID(c *fakeNodes, id uint64) (client.NodeInfo, []string, error) {
+	return removeNode(context.Background(), c.dial, func(node client.NodeInfo) bool {
+		return node.ID == id
+	})
+}
+
+func TestRemoveNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		voters   int
+		id       uint64
+		warnings int
+	}{
+		{"follower", 4, 3, 0},
+		{"follower leaving too few voters", 3, 3, 1},
+		{"stand-by", 1, 9, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeNodes(test.voters)
+			node, warnings, err := removeID(c, test.id)
+			if err != nil {
+				t.Fatalf("removing node: %v", err)
+			}
+			if node.ID != test.id {
+				t.Errorf("got removed node %+v, want node %d", node, test.id)
+			}
+			if len(warnings) != test.warnings {
+				t.Errorf("got warnings %q, want %d", warnings, test.warnings)
+			}
+			if !reflect.DeepEqual(c.removed, []uint64{test.id}) {
+				t.Errorf("got removed %v, want %d", c.removed, test.id)
+			}
+			if len(c.transfers) != 0 {
+				t.Errorf("got leadership transferred to %v removing a follower", c.transfers)
+			}
+			for _, cli := range c.clients {
+				if !cli.closed {
+					t.Errorf("client left open")
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveNodeLeader(t *testing.T) {
+	c := newFakeNodes(3)
+	if _, _, err := removeID(c, 1); err != nil {
+		t.Fatalf("removing leader: %v", err)
+	}
+	// Leadership moves to another voter, and the node is removed through
+	// the new leader.
+	if !reflect.DeepEqual(c.transfers, []uint64{2}) {
+		t.Fatalf("got leadership transferred to %v, want node 2", c.transfers)
+	}
+	if !reflect.DeepEqual(c.removed, []uint64{1}) {
+		t.Fatalf("got removed %v, want node 1", c.removed)
+	}
+	if c.dials != 2 {
+		t.Fatalf("got %d dials, want the new leader dialled", c.dials)
+	}
+	for _, cli := range c.clients {
+		if !cli.closed {
+			t.Errorf("client left open")
+		}
+	}
+}
+
+func TestRemoveNodeFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		voters int
+		id     uint64
+		modify func(*fakeNodes)
+		check  func(error) bool
+		err    string
+	}{{
+		name:   "last voter",
+		voters: 1,
+		id:     1,
+		check:  errors.IsForbidden,
+		err:    "node 1 (10.0.0.1:9000) is the last voter",
+	}, {
+		name:   "unknown node",
+		voters: 3,
+		id:     7,
+		check:  errors.IsNotFound,
+		err:    "run the cluster command to list the nodes",
+	}, {
+		name:   "leader unreachable",
+		voters: 3,
+		id:     3,
+		modify: func(c *fakeNodes) { c.dialErr = errors.New("no leader") },
+		check:  errors.IsNotProvisioned,
+		err:    "check that a majority of the voters are running",
+	}, {
+		name:   "transfer failure",
+		voters: 3,
+		id:     1,
+		modify: func(c *fakeNodes) { c.transfer = errors.New("timed out") },
+		err:    "transferring leadership from node 1 to node 2; check node 2 is running",
+	}, {
+		name:   "remove failure",
+		voters: 3,
+		id:     3,
+		modify: func(c *fakeNodes) { c.remove = errors.New("busy") },
+		err:    "removing node 3 (10.0.0.3:9000): busy",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeNodes(test.voters)
+			if test.modify != nil {
+				test.modify(c)
+			}
+			_, _, err := removeID(c, test.id)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want it to contain %q", err, test.err)
+			}
+			if test.check != nil && !test.check(err) {
+				t.Fatalf("got error %v of the wrong type", err)
+			}
+			if len(c.removed) != 0 {
+				t.Fatalf("got removed %v, want none", c.removed)
+			}
+		})
+	}
+}
+
+func TestPrepareDataDir(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "data")
+		if err := prepareDataDir(dir, false); err != nil {
+			t.Fatalf("preparing data dir: %v", err)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Fatalf("data dir not created: %v", err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if err := prepareDataDir(t.TempDir(), false); err != nil {
+			t.Fatalf("preparing data dir: %v", err)
+		}
+	})
+
+	t.Run("not empty", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "cluster.yaml")
+		if err := ioutil.WriteFile(path, []byte("- 1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := prepareDataDir(dir, false)
+		if err == nil || !strings.Contains(err.Error(), "pass --force") {
+			t.Fatalf("got error %v, want the restore refused", err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("contents removed without force: %v", err)
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "snapshots"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cluster.yaml"), []byte("- 1"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := prepareDataDir(dir, true); err != nil {
+			t.Fatalf("preparing data dir: %v", err)
+		}
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+			t.Fatalf("got entries %v (%v), want the data dir cleared", entries, err)
+		}
+	})
+}
+
+func TestRestoreNodeClearsDataDirOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "cluster.yaml"), []byte("- 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restore fails once the node has written to the data directory,
+	// such as when the schema of the dump is too new.
+	cfg := DefaultConfig()
+	cfg.API.Address = "127.0.0.1:8080"
+	cfg.DB.Address = "127.0.0.1:9000"
+	err := restoreNode(dir, cfg, true, func() error {
+		if err := ioutil.WriteFile(filepath.Join(dir, "00000001-00000002"), []byte("segment"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("restore with a newer binary")
+	})
+	if err == nil || err.Error() != "restore with a newer binary" {
+		t.Fatalf("got error %v, want the restore error", err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("got entries %v (%v), want the data dir cleared", entries, err)
+	}
+
+	// The restore can then be retried without force.
+	var restored bool
+	err = restoreNode(dir, cfg, false, func() error {
+		restored = true
+		return nil
+	})
+	if err != nil || !restored {
+		t.Fatalf("got error %v retrying the restore, want it restored", err)
+	}
+}
+
+func TestRestoreNodeWritesConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	cfg := DefaultConfig()
+	cfg.API.Address = "127.0.0.1:8080"
+	cfg.DB.Address = "127.0.0.1:9000"
+	if err := restoreNode(dir, cfg, false, func() error { return nil }); err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+
+	// The restored node can be served with the config.
+	got, err := ReadConfig(configPath(dir))
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Fatalf("got config %+v, want %+v", got, cfg)
+	}
+}
+
+func TestRestoreNodeInvalidConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	// The config is checked before anything is restored.
+	var restored bool
+	err := restoreNode(dir, DefaultConfig(), false, func() error {
+		restored = true
+		return nil
+	})
+	if !errors.IsNotValid(err) || restored {
+		t.Fatalf("got error %v, want the config rejected before restoring", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("got data dir created (%v), want it untouched", err)
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{})   {}
+func (nopLogger) Infof(string, ...interface{})    {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+func (nopLogger) Errorf(string, ...interface{})   {}
+
+// newTestState returns the state over a new in-memory database, started up.
+func newTestState(t *testing.T) (*state.State, *db.SQLDatabase) {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	st := state.NewState(backend, nopLogger{}, clock.WallClock, nil)
+	if err := st.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting state: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Stop() })
+	return st, backend
+}
+
+// backupState returns a dump of the state, after running the statements.
+func backupState(t *testing.T, statements ...string) string {
+	t.Helper()
+
+	st, backend := newTestState(t)
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("preparing database: %v", err)
+	}
+
+	var dump bytes.Buffer
+	if err := schemastate.DumpTo(&dump, backend, st.SchemaManager().Schema(), schemastate.DumpOptions{}); err != nil {
+		t.Fatalf("writing backup: %v", err)
+	}
+	return dump.String()
+}
+
+// newEmptyDatabase returns a new in-memory database without a schema.
+func newEmptyDatabase(t *testing.T) *db.SQLDatabase {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	return backend
+}
+
+func TestRestoreDatabase(t *testing.T) {
+	dump := backupState(t, "INSERT INTO actions (tag, receiver, name) VALUES ('action-1', 'unit-mysql-0', 'backup')")
+
+	backend := newEmptyDatabase(t)
+	status, err := restoreDatabase(backend, strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	if !status.UpToDate() {
+		t.Fatalf("got schema status %+v, want up to date", status)
+	}
+
+	var tags []string
+	err = backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &tags, "SELECT tag FROM actions")
+	})
+	if err != nil {
+		t.Fatalf("reading restored actions: %v", err)
+	}
+	if !reflect.DeepEqual(tags, []string{"action-1"}) {
+		t.Fatalf("got restored actions %v, want action-1", tags)
+	}
+}
+
+func TestRestoreDatabaseFromNewerSchema(t *testing.T) {
+	// A newer binary has applied a patch this binary doesn't know about.
+	dump := backupState(t) + "INSERT INTO schema (version, updated_at) VALUES (11, '2021-06-01 12:00:00.000+00:00');\n"
+
+	_, err := restoreDatabase(newEmptyDatabase(t), strings.NewReader(dump))
+	if err == nil || !strings.Contains(err.Error(), "restore with a newer binary") {
+		t.Fatalf("got error %v, want the newer schema refused", err)
+	}
+}
+
+func TestRestoreDatabaseInvalidDump(t *testing.T) {
+	_, err := restoreDatabase(newEmptyDatabase(t), strings.NewReader("CREATE TABLE broken (;\n"))
+	if err == nil || !strings.Contains(err.Error(), "restoring dump") {
+		t.Fatalf("got error %v, want the dump refused", err)
+	}
+}
@@ -36,6 +36,53 @@ const (
 	ActionAborted ActionStatus = "aborted"
 )
 
+// validTransitions holds the statuses an action can move to from each status.
+// Statuses that are missing are terminal.
+var validTransitions = map[ActionStatus][]ActionStatus{
+	ActionPending: {
+		ActionRunning,
+		ActionCancelled,
+		// Pending actions fail without running once they expire.
+		ActionFailed,
+	},
+	ActionRunning: {
+		ActionAborting,
+		ActionCompleted,
+		ActionFailed,
+		ActionError,
+		ActionCancelled,
+		ActionAborted,
+	},
+	ActionAborting: {
+		ActionCompleted,
+		ActionFailed,
+		ActionError,
+		ActionCancelled,
+		ActionAborted,
+	},
+}
+
+// ValidTransition returns true if an action can move from the status to the
+// given status.
+func (s ActionStatus) ValidTransition(to ActionStatus) bool {
+	for _, status := range validTransitions[s] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Finished returns true if the status is terminal, so the action can't move
+// to any other status.
+func (s ActionStatus) Finished() bool {
+	switch s {
+	case ActionError, ActionFailed, ActionCompleted, ActionCancelled, ActionAborted:
+		return true
+	}
+	return false
+}
+
 type Action struct {
 	ID  int64
 	Tag names.ActionTag
@@ -71,4 +118,40 @@ type Action struct {
 
 	// Message captures any error returned by the action.
 	Message string
+
+	// IdempotencyKey is the client supplied key the action was added with,
+	// if any.
+	IdempotencyKey string
+
+	// RequestedBy is the tag of the user or client that enqueued the action,
+	// if known.
+	RequestedBy string
+
+	// Source describes where the action was enqueued from, if known.
+	Source string
+
+	// ExpiresAt is the time the action fails if it's still pending, if set.
+	ExpiresAt time.Time
+
+	// Generation is incremented every time the action changes.
+	Generation int64
+
+	// Results holds the results of the action. It's only populated when
+	// explicitly requested, to avoid always reading the results.
+	Results map[string]interface{}
+}
+
+// ActionMessage represents a progress message logged by an action.
+type ActionMessage struct {
+	Message   string
+	Timestamp time.Time
+}
+
+// ActionSummary holds the number of actions for a group of column values.
+type ActionSummary struct {
+	// Key holds the value of each grouped column.
+	Key map[string]string
+
+	// Count is the number of actions in the group.
+	Count int64
 }
@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+// Operation groups a series of actions that were enqueued together. It shares
+// the status vocabulary of actions.
+type Operation struct {
+	ID int64
+
+	// Summary describes the operation.
+	Summary string
+
+	// Enqueued is the time the operation was added.
+	Enqueued time.Time
+
+	// Started reflects the time the operation began running.
+	Started time.Time
+
+	// Completed reflects the time that the operation was finished.
+	Completed time.Time
+
+	// Status represents the state of the operation.
+	Status ActionStatus
+
+	// Fail captures why the operation failed, if it did.
+	Fail string
+
+	// ExpectedActions is the number of actions enqueued under the operation.
+	ExpectedActions int
+
+	// ActionCounts holds the number of actions enqueued under the operation
+	// for each status.
+	ActionCounts map[ActionStatus]int
+}
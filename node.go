@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/repl"
+	"github.com/SimonRichardson/nu-juju-data/server"
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/SimonRichardson/nu-juju-data/state/rolestate"
+	"github.com/canonical/go-dqlite/app"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// dqliteInfoFile is the file dqlite records the identity of the node in, in
+// the data directory.
+const dqliteInfoFile = "info.yaml"
+
+// Node is a running node, serving the API and the REPL over the database in
+// its data directory.
+type Node struct {
+	app              *app.App
+	databases        *db.Registry
+	repl             *repl.SQLRepl
+	state            *state.State
+	server           *server.Server
+	serveErrs        <-chan error
+	cancelLeadership context.CancelFunc
+}
+
+// StartNode starts a node in the data directory with the config. A node with
+// addresses to join joins the existing cluster, otherwise it bootstraps a new
+// cluster the first time it's started.
+func StartNode(ctx context.Context, dir string, cfg Config) (*Node, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	logFunc := func(l client.LogLevel, format string, a ...interface{}) {
+		if !cfg.Verbose {
+			return
+		}
+		log.Printf(fmt.Sprintf("%s: %s: %s\n", cfg.API.Address, l.String(), format), a...)
+	}
+
+	// A node without any dqlite info is joining the cluster for the first
+	// time, once the cluster is found.
+	_, err := os.Stat(filepath.Join(dir, dqliteInfoFile))
+	joining := os.IsNotExist(err) && len(cfg.DB.Join) > 0
+
+	// Setup up the database, retrying until the cluster is found, as the
+	// nodes to join may not be up yet.
+	var dqlite *app.App
+	err = WaitForCluster(ctx, clock.WallClock, cfg.DB.ReadyTimeout, stdLogger{}, func(ctx context.Context) error {
+		attempt, err := app.New(dir,
+			app.WithAddress(cfg.DB.Address),
+			app.WithCluster(cfg.DB.Join),
+			app.WithVoters(cfg.DB.Voters),
+			app.WithStandBys(cfg.DB.StandBys),
+			app.WithLogFunc(logFunc),
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := attempt.Ready(ctx); err != nil {
+			_ = attempt.Close()
+			return NotReady(err)
+		}
+		dqlite = attempt
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	n := &Node{app: dqlite}
+	if err := n.start(ctx, dir, cfg, joining); err != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = n.Shutdown(shutdownCtx)
+		return nil, errors.Trace(err)
+	}
+	return n, nil
+}
+
+func (n *Node) start(ctx context.Context, dir string, cfg Config, joining bool) error {
+	if joining && cfg.DB.Role != "" {
+		role, err := parseRole(cfg.DB.Role)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := assignRole(ctx, n.app, role); err != nil {
+			return errors.Annotate(err, "joining the cluster")
+		}
+		stdLogger{}.Infof("joined the cluster as a %s", role)
+	}
+	// Databases are opened on demand by name, only allowing the configured
+	// databases if there are any.
+	var registryOpts []db.RegistryOption
+	if len(cfg.DB.Databases) > 0 {
+		registryOpts = append(registryOpts, db.WithAllowedNames(demoDB), db.WithAllowedNames(cfg.DB.Databases...))
+	}
+	n.databases = db.NewRegistry(n.app.Open, registryOpts...)
+	dqliteDB, err := n.databases.GetDB(ctx, demoDB)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	backend := db.NewSQLDatabase(dqliteDB, n.app.Driver())
+	leadershipCtx, cancelLeadership := context.WithCancel(context.Background())
+	n.cancelLeadership = cancelLeadership
+	leadership := newDQLiteLeadership(leadershipCtx, n.app, clock.WallClock)
+
+	st := state.NewState(backend, stdLogger{}, clock.WallClock, leadership)
+
+	replSock := filepath.Join(dir, replSocket)
+	_ = os.Remove(replSock)
+	replOpts := []repl.Option{
+		repl.WithIdleTimeout(cfg.REPL.IdleTimeout),
+		repl.WithStatementTimeout(cfg.REPL.StatementTimeout),
+		repl.WithMaxSessions(cfg.REPL.MaxSessions),
+		repl.WithSlowStatementLog(stdLogger{}, cfg.REPL.SlowThreshold),
+	}
+	if cfg.REPL.Address != "" {
+		replOpts = append(replOpts, repl.WithTCP(cfg.REPL.Address, cfg.REPL.Token))
+	}
+	if cfg.REPL.ReadToken != "" {
+		replOpts = append(replOpts, repl.WithReadOnlyToken(cfg.REPL.ReadToken))
+	}
+	if cfg.REPL.ReadOnly {
+		replOpts = append(replOpts, repl.WithReadOnly())
+	}
+	sqlRepl, err := repl.New(replSock, n.databases, demoDB, st.SchemaManager(), clock.WallClock, replOpts...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	n.repl = sqlRepl
+
+	// Register an additional manager, to report the number of pending
+	// actions from the ensure loop.
+	if err := st.RegisterManager("pending-actions", &pendingActionsManager{
+		backend: st.Backend(),
+		logger:  stdLogger{},
+	}, state.DependsOn("actions")); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Keep the target number of voters online, from the leader.
+	roles := rolestate.NewManager(dqliteRoles{app: n.app}, cfg.DB.Voters,
+		rolestate.WithClock(clock.WallClock),
+		rolestate.WithLogger(stdLogger{}),
+	)
+	if err := st.RegisterManager("roles", roles); err != nil {
+		return errors.Trace(err)
+	}
+
+	st.SchemaManager().BackupTo(filepath.Join(dir, "backups"), 5)
+	if err := st.StartUp(ctx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := st.Run(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	// The state is only stopped once it's running.
+	n.state = st
+
+	// Log out the current applied schema.
+	if applied, err := st.SchemaManager().Applied(); err != nil {
+		stdLogger{}.Warningf("unable to read applied schema: %v", err)
+	} else {
+		stdLogger{}.Debugf("applied schema:\n%s", applied)
+	}
+
+	// Serve the API over TLS if a certificate is given, otherwise over
+	// plain HTTP.
+	var tlsConfig *tls.Config
+	if cfg.API.Cert != "" || cfg.API.Key != "" || cfg.API.CA != "" {
+		if tlsConfig, err = server.NewTLSConfig(cfg.API.Cert, cfg.API.Key, cfg.API.CA); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Without any tokens, the API is left unauthenticated.
+	tokens := make(map[string]server.Role)
+	for _, token := range cfg.API.ReadTokens {
+		tokens[token] = server.RoleReadOnly
+	}
+	for _, token := range cfg.API.Tokens {
+		tokens[token] = server.RoleReadWrite
+	}
+	for _, token := range cfg.API.AdminTokens {
+		tokens[token] = server.RoleAdmin
+	}
+
+	srv, err := server.New(st, server.NewMetrics())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	srv.SetLogger(stdLogger{})
+	srv.AddReadinessCheck("cluster", n.app.Ready)
+	srv.SetTLSConfig(tlsConfig)
+	srv.SetTokens(tokens)
+	srv.SetCluster(dqliteCluster{app: n.app}, func(dbAddress string) (string, error) {
+		address, ok := cfg.API.Peers[dbAddress]
+		if !ok {
+			return "", errors.NotFoundf("API address for %q", dbAddress)
+		}
+		return address, nil
+	}, cfg.API.Proxy)
+	srv.SetClusterMembers(dqliteCluster{app: n.app})
+	srv.SetClusterRoles(roleReporter{manager: roles})
+
+	// Report the metrics of the node along with those of the API, refreshing
+	// the leadership until the leadership watcher stops.
+	metrics := newNodeMetrics(dqliteCluster{app: n.app}, clock.WallClock, dir, sqlRepl.Sessions)
+	go metrics.run(leadershipCtx, leadershipPollInterval)
+	srv.AddMetricsProvider(metrics)
+	if len(cfg.API.CORSOrigins) > 0 {
+		srv.SetCORS(server.CORSConfig{
+			AllowedOrigins: cfg.API.CORSOrigins,
+		})
+	}
+	if n.serveErrs, err = srv.Serve(cfg.API.Address); err != nil {
+		return errors.Trace(err)
+	}
+	n.server = srv
+	return nil
+}
+
+// Run blocks until the context is done or the API fails to serve, then shuts
+// down the node within the timeout.
+func (n *Node) Run(ctx context.Context, timeout time.Duration) error {
+	return RunUntilDone(ctx, n.serveErrs, n.shutdownDeps(), timeout)
+}
+
+// IsLeader returns true if the node is the leader of the cluster.
+func (n *Node) IsLeader(ctx context.Context) bool {
+	address, err := leaderAddress(ctx, n.app)
+	return err == nil && address == n.app.Address()
+}
+
+// Shutdown stops the node, in the order described by the Shutdown function.
+func (n *Node) Shutdown(ctx context.Context) error {
+	return Shutdown(ctx, n.shutdownDeps())
+}
+
+// shutdownDeps returns what has been started, so that a node that failed to
+// start is stopped as far as it got.
+func (n *Node) shutdownDeps() ShutdownDeps {
+	deps := ShutdownDeps{
+		Node: n.app,
+	}
+	if n.server != nil {
+		deps.Server = n.server
+	}
+	if n.state != nil {
+		deps.State = nodeState{
+			State:            n.state,
+			cancelLeadership: n.cancelLeadership,
+		}
+	} else if n.cancelLeadership != nil {
+		n.cancelLeadership()
+	}
+	if n.repl != nil {
+		deps.REPL = n.repl
+	}
+	if n.databases != nil {
+		deps.Database = n.databases
+	}
+	return deps
+}
+
+// nodeState stops watching for changes of leadership along with the state.
+type nodeState struct {
+	*state.State
+	cancelLeadership context.CancelFunc
+}
+
+func (s nodeState) Stop() error {
+	s.cancelLeadership()
+	return s.State.Stop()
+}
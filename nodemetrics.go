@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/server"
+	"github.com/juju/clock"
+)
+
+// clusterLeader reports the leader of the cluster, as seen by the local node.
+type clusterLeader interface {
+	// Address returns the database address of the local node.
+	Address() string
+
+	// LeaderAddress returns the database address of the leader.
+	LeaderAddress(context.Context) (string, error)
+}
+
+// nodeMetrics provides the metrics of the node and the process to the API's
+// metrics endpoint. The leadership of the node is refreshed periodically,
+// everything else when the metrics are written.
+type nodeMetrics struct {
+	cluster  clusterLeader
+	clock    clock.Clock
+	dir      string
+	sessions func() int
+
+	mutex sync.Mutex
+	// leader is set whilst the local node is the leader, as of the last
+	// refresh.
+	leader bool
+	// known is set once the leadership has been refreshed successfully.
+	known bool
+	// handover is the time leadership last moved to or from the local node.
+	handover time.Time
+}
+
+// newNodeMetrics returns the metrics of the node with the data directory. The
+// number of open REPL sessions is reported by sessions.
+func newNodeMetrics(cluster clusterLeader, clock clock.Clock, dir string, sessions func() int) *nodeMetrics {
+	return &nodeMetrics{
+		cluster:  cluster,
+		clock:    clock,
+		dir:      dir,
+		sessions: sessions,
+	}
+}
+
+// run refreshes the leadership of the node until the context is done.
+func (m *nodeMetrics) run(ctx context.Context, interval time.Duration) {
+	for {
+		m.refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.clock.After(interval):
+		}
+	}
+}
+
+// refresh records whether the local node is the leader. The leadership is
+// left as it was if the leader can't be found.
+func (m *nodeMetrics) refresh(ctx context.Context) {
+	leader, err := m.cluster.LeaderAddress(ctx)
+	if err != nil {
+		return
+	}
+	isLeader := leader == m.cluster.Address()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.known && isLeader != m.leader {
+		m.handover = m.clock.Now()
+	}
+	m.leader, m.known = isLeader, true
+}
+
+// WriteMetrics implements server.MetricsProvider.
+func (m *nodeMetrics) WriteMetrics(w io.Writer) error {
+	m.mutex.Lock()
+	leader, handover := m.leader, m.handover
+	m.mutex.Unlock()
+
+	var isLeader float64
+	if leader {
+		isLeader = 1
+	}
+	var handoverTime float64
+	if !handover.IsZero() {
+		handoverTime = float64(handover.UnixNano()) / float64(time.Second)
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"dqlite_leader", "Whether this node is the leader of the cluster.", isLeader},
+		{"dqlite_last_handover_timestamp_seconds", "The time leadership last moved to or from this node, or 0 if it hasn't.", handoverTime},
+		{"dqlite_data_dir_bytes", "The size of the database files in the data directory.", float64(dataDirSize(m.dir))},
+		{"repl_sessions_open", "The number of open REPL sessions.", float64(m.sessions())},
+		{"go_goroutines", "The number of goroutines.", float64(runtime.NumGoroutine())},
+		{"go_memstats_heap_alloc_bytes", "The number of heap bytes allocated and in use.", float64(stats.HeapAlloc)},
+		{"go_memstats_heap_objects", "The number of allocated heap objects.", float64(stats.HeapObjects)},
+		{"go_memstats_sys_bytes", "The number of bytes obtained from the system.", float64(stats.Sys)},
+	}
+	for _, gauge := range gauges {
+		if err := server.WriteGauge(w, gauge.name, gauge.help, gauge.value); err != nil {
+			return err
+		}
+	}
+	return server.WriteCounter(w, "go_gc_cycles_total", "The number of completed garbage collection cycles.", float64(stats.NumGC))
+}
+
+// dataDirSize returns the total size of the files directly in the data
+// directory, which hold the database and its replication log. Anything that
+// can't be read counts as empty.
+func dataDirSize(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+	}
+	return size
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// fakeLeader is a cluster whose leader can be changed, or made unreachable.
+type fakeLeader struct {
+	mutex   sync.Mutex
+	address string
+	leader  string
+	err     error
+}
+
+func (c *fakeLeader) Address() string {
+	return c.address
+}
+
+func (c *fakeLeader) LeaderAddress(context.Context) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.leader, c.err
+}
+
+func (c *fakeLeader) set(leader string, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.leader, c.err = leader, err
+}
+
+// metricValue returns the value of the metric written by the metrics.
+func metricValue(t *testing.T, m *nodeMetrics, name string) float64 {
+	t.Helper()
+
+	var out bytes.Buffer
+	if err := m.WriteMetrics(&out); err != nil {
+		t.Fatalf("writing metrics: %v", err)
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != name {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", line, err)
+		}
+		return value
+	}
+	t.Fatalf("metric %q not written in\n%s", name, out.String())
+	return 0
+}
+
+func TestNodeMetricsLeaderFlip(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := testclock.NewClock(start)
+	cluster := &fakeLeader{address: "10.0.0.1:9000", leader: "10.0.0.2:9000"}
+	m := newNodeMetrics(cluster, clock, t.TempDir(), func() int { return 0 })
+
+	steps := []struct {
+		name     string
+		leader   string
+		err      error
+		isLeader float64
+		handover time.Time
+	}{
+		// The first refresh only finds the leadership, it isn't a handover.
+		{"follower", "10.0.0.2:9000", nil, 0, time.Time{}},
+		{"promoted", "10.0.0.1:9000", nil, 1, start.Add(2 * time.Minute)},
+		{"still leader", "10.0.0.1:9000", nil, 1, start.Add(2 * time.Minute)},
+		// The leadership is kept whilst the leader can't be found.
+		{"leader unreachable", "", errors.New("no leader"), 1, start.Add(2 * time.Minute)},
+		{"demoted", "10.0.0.3:9000", nil, 0, start.Add(5 * time.Minute)},
+	}
+	for _, step := range steps {
+		clock.Advance(time.Minute)
+		cluster.set(step.leader, step.err)
+		m.refresh(context.Background())
+
+		if got := metricValue(t, m, "dqlite_leader"); got != step.isLeader {
+			t.Errorf("%s: got leader %v, want %v", step.name, got, step.isLeader)
+		}
+		var want float64
+		if !step.handover.IsZero() {
+			want = float64(step.handover.Unix())
+		}
+		if got := metricValue(t, m, "dqlite_last_handover_timestamp_seconds"); got != want {
+			t.Errorf("%s: got handover %v, want %v", step.name, got, want)
+		}
+	}
+}
+
+func TestNodeMetricsFirstRefreshAsLeader(t *testing.T) {
+	cluster := &fakeLeader{address: "10.0.0.1:9000", leader: "10.0.0.1:9000"}
+	m := newNodeMetrics(cluster, testclock.NewClock(time.Now()), t.TempDir(), func() int { return 0 })
+
+	m.refresh(context.Background())
+	if got := metricValue(t, m, "dqlite_leader"); got != 1 {
+		t.Fatalf("got leader %v, want 1", got)
+	}
+	if got := metricValue(t, m, "dqlite_last_handover_timestamp_seconds"); got != 0 {
+		t.Fatalf("got handover %v on start up, want 0", got)
+	}
+}
+
+func TestNodeMetricsRun(t *testing.T) {
+	clock := testclock.NewClock(time.Now())
+	cluster := &fakeLeader{address: "10.0.0.1:9000", leader: "10.0.0.2:9000"}
+	m := newNodeMetrics(cluster, clock, t.TempDir(), func() int { return 0 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.run(ctx, time.Second)
+	}()
+
+	// The leadership is refreshed straight away, then every interval, so
+	// the change is seen by the refresh after the next one at the latest.
+	if err := clock.WaitAdvance(time.Second, 10*time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	cluster.set("10.0.0.1:9000", nil)
+	if err := clock.WaitAdvance(time.Second, 10*time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := clock.WaitAdvance(0, 10*time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := metricValue(t, m, "dqlite_leader"); got != 1 {
+		t.Fatalf("got leader %v, want the leadership refreshed", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("refreshing didn't stop")
+	}
+}
+
+func TestNodeMetricsNodeGauges(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"db.bin": 100, "open-1": 24} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cluster := &fakeLeader{address: "10.0.0.1:9000", err: errors.New("no leader")}
+	m := newNodeMetrics(cluster, testclock.NewClock(time.Now()), dir, func() int { return 2 })
+
+	if got := metricValue(t, m, "dqlite_data_dir_bytes"); got != 124 {
+		t.Errorf("got data dir size %v, want 124", got)
+	}
+	if got := metricValue(t, m, "repl_sessions_open"); got != 2 {
+		t.Errorf("got sessions %v, want 2", got)
+	}
+	if size := dataDirSize(filepath.Join(dir, "missing")); size != 0 {
+		t.Errorf("got size %d for a missing data dir, want 0", size)
+	}
+}
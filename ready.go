@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+	"github.com/juju/retry"
+)
+
+const (
+	// readyAttemptTimeout is the time each attempt is given to find the
+	// cluster, before it's retried.
+	readyAttemptTimeout = 10 * time.Second
+
+	// minReadyBackoff and maxReadyBackoff bound the delay between attempts
+	// to find the cluster, which doubles with every attempt.
+	minReadyBackoff = time.Second
+	maxReadyBackoff = 30 * time.Second
+)
+
+// notReadyError marks an attempt that failed because the cluster couldn't be
+// found yet, which is worth retrying.
+type notReadyError struct {
+	err error
+}
+
+func (e *notReadyError) Error() string {
+	return e.err.Error()
+}
+
+// NotReady marks the error of an attempt to find the cluster as worth
+// retrying. Any other error fails WaitForCluster straight away.
+func NotReady(err error) error {
+	return &notReadyError{err: err}
+}
+
+// clusterUnavailableError is returned when the node gave up waiting for the
+// cluster.
+type clusterUnavailableError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *clusterUnavailableError) Error() string {
+	return fmt.Sprintf("gave up waiting for the cluster after %v: %v", e.timeout, e.err)
+}
+
+// IsClusterUnavailable returns true if the node gave up waiting for the
+// cluster.
+func IsClusterUnavailable(err error) bool {
+	_, ok := errors.Cause(err).(*clusterUnavailableError)
+	return ok
+}
+
+// WaitForCluster calls attempt until it succeeds, backing off exponentially
+// between attempts that fail with a NotReady error. Each attempt is bounded,
+// and every failed attempt is logged. Once the timeout has passed, a cluster
+// unavailable error is returned.
+func WaitForCluster(ctx context.Context, clock clock.Clock, timeout time.Duration, logger state.Logger, attempt func(context.Context) error) error {
+	start := clock.Now()
+	err := retry.Call(retry.CallArgs{
+		Func: func() error {
+			attemptCtx, cancel := context.WithTimeout(ctx, readyAttemptTimeout)
+			defer cancel()
+			return attempt(attemptCtx)
+		},
+		IsFatalError: func(err error) bool {
+			_, ok := errors.Cause(err).(*notReadyError)
+			return !ok
+		},
+		NotifyFunc: func(err error, attempt int) {
+			logger.Infof("waiting for the cluster, attempt %d failed after %v: %v", attempt, clock.Now().Sub(start).Round(time.Second), err)
+		},
+		Attempts:    retry.UnlimitedAttempts,
+		Delay:       minReadyBackoff,
+		BackoffFunc: retry.ExpBackoff(minReadyBackoff, maxReadyBackoff, 2, true),
+		MaxDuration: timeout,
+		Clock:       clock,
+		Stop:        ctx.Done(),
+	})
+	switch {
+	case err == nil:
+		return nil
+	case retry.IsDurationExceeded(err):
+		return &clusterUnavailableError{
+			timeout: timeout,
+			err:     retry.LastError(err),
+		}
+	case retry.IsRetryStopped(err):
+		return errors.Annotate(ctx.Err(), "waiting for the cluster")
+	}
+	return errors.Trace(err)
+}
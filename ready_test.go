@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// recordingLogger records the messages logged at info.
+type recordingLogger struct {
+	mutex sync.Mutex
+	infos []string
+}
+
+func (l *recordingLogger) Debugf(string, ...interface{}) {}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warningf(string, ...interface{}) {}
+func (l *recordingLogger) Errorf(string, ...interface{})   {}
+
+func (l *recordingLogger) messages() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.infos...)
+}
+
+// failingAttempt fails the first n attempts with the error, then succeeds.
+type failingAttempt struct {
+	mutex sync.Mutex
+	n     int
+	err   error
+	calls int
+}
+
+func (a *failingAttempt) attempt(ctx context.Context) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("attempt without a deadline")
+	}
+	a.calls++
+	if a.n < 0 || a.calls <= a.n {
+		return a.err
+	}
+	return nil
+}
+
+func (a *failingAttempt) attempts() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.calls
+}
+
+// waitForCluster waits for the cluster in the background, advancing the
+// clock past each back off until it returns.
+func waitForCluster(t *testing.T, ctx context.Context, timeout time.Duration, logger *recordingLogger, attempt *failingAttempt) error {
+	t.Helper()
+
+	clock := testclock.NewClock(time.Now())
+	result := make(chan error, 1)
+	go func() {
+		result <- WaitForCluster(ctx, clock, timeout, logger, attempt.attempt)
+	}()
+	for {
+		select {
+		case err := <-result:
+			return err
+		case <-clock.Alarms():
+			clock.Advance(maxReadyBackoff)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for the cluster")
+		}
+	}
+}
+
+func TestWaitForClusterRetriesNotReady(t *testing.T) {
+	logger := &recordingLogger{}
+	attempt := &failingAttempt{n: 3, err: NotReady(errors.New("no leader"))}
+	if err := waitForCluster(t, context.Background(), time.Hour, logger, attempt); err != nil {
+		t.Fatalf("waiting for the cluster: %v", err)
+	}
+	if n := attempt.attempts(); n != 4 {
+		t.Fatalf("got %d attempts, want 4", n)
+	}
+
+	messages := logger.messages()
+	if len(messages) != 3 {
+		t.Fatalf("got messages %q, want each failed attempt logged", messages)
+	}
+	for i, message := range messages {
+		if want := fmt.Sprintf("attempt %d failed", i+1); !strings.Contains(message, want) || !strings.Contains(message, "no leader") {
+			t.Errorf("got message %q, want it to contain %q and the error", message, want)
+		}
+	}
+}
+
+func TestWaitForClusterFatalError(t *testing.T) {
+	attempt := &failingAttempt{n: -1, err: errors.New("bad certificate")}
+	err := waitForCluster(t, context.Background(), time.Hour, &recordingLogger{}, attempt)
+	if err == nil || !strings.Contains(err.Error(), "bad certificate") {
+		t.Fatalf("got error %v, want the attempt error", err)
+	}
+	if IsClusterUnavailable(err) {
+		t.Fatalf("got cluster unavailable for a fatal error")
+	}
+	if n := attempt.attempts(); n != 1 {
+		t.Fatalf("got %d attempts, want the fatal error not retried", n)
+	}
+	if code := exitCode(err); code != 1 {
+		t.Fatalf("got exit code %d, want 1", code)
+	}
+}
+
+func TestWaitForClusterUnavailable(t *testing.T) {
+	attempt := &failingAttempt{n: -1, err: NotReady(errors.New("no leader"))}
+	err := waitForCluster(t, context.Background(), 2*time.Minute, &recordingLogger{}, attempt)
+	if !IsClusterUnavailable(err) {
+		t.Fatalf("got error %v, want cluster unavailable", err)
+	}
+	if want := "gave up waiting for the cluster after 2m0s: no leader"; err.Error() != want {
+		t.Fatalf("got error %q, want %q", err, want)
+	}
+	if n := attempt.attempts(); n < 2 {
+		t.Fatalf("got %d attempts, want the attempts retried", n)
+	}
+
+	// The node exits with a code of its own, so that it can be retried.
+	if code := exitCode(errors.Annotate(err, "serving")); code != exitClusterUnavailable {
+		t.Fatalf("got exit code %d, want %d", code, exitClusterUnavailable)
+	}
+}
+
+func TestWaitForClusterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempt := &failingAttempt{n: -1, err: NotReady(errors.New("no leader"))}
+	err := waitForCluster(t, ctx, time.Hour, &recordingLogger{}, attempt)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("got error %v, want cancelled", err)
+	}
+	if IsClusterUnavailable(err) {
+		t.Fatalf("got cluster unavailable once cancelled")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code := exitCode(nil); code != 0 {
+		t.Fatalf("got exit code %d without an error, want 0", code)
+	}
+}
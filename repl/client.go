@@ -0,0 +1,578 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// dialTimeout is the time given to connect to the REPL.
+	dialTimeout = 5 * time.Second
+
+	// completeTimeout is the time given to fetch the completions.
+	completeTimeout = 5 * time.Second
+
+	// maxHistory is the number of lines kept in the history.
+	maxHistory = 1000
+)
+
+// wordDelimiters separate the words that are completed.
+const wordDelimiters = " \t,()=<>;"
+
+// Client is an interactive client for a REPL session. It provides line
+// editing, a persistent history and completion of table and column names on
+// top of the plain socket protocol.
+type Client struct {
+	network string
+	address string
+	token   string
+	conn    net.Conn
+
+	// outMu guards the output and the line being edited, as the output of
+	// the session is written whilst the line is edited.
+	outMu  sync.Mutex
+	out    io.Writer
+	prompt string
+	line   []rune
+	pos    int
+
+	history     []string
+	historyFile string
+
+	// database is the database last selected, so that the completions are
+	// fetched for the same database.
+	database    string
+	completions *Completions
+}
+
+// Dial connects a client to the REPL listening on the address. The network
+// is either "unix" or "tcp". The token is sent first if it isn't empty, as
+// required by TCP sessions.
+func Dial(network, address, token string) (*Client, error) {
+	c := &Client{
+		network: network,
+		address: address,
+		token:   token,
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.conn = conn
+	return c, nil
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.network, c.address, dialTimeout)
+	if err != nil {
+		return nil, errors.Annotatef(err, "connecting to REPL at %q", c.address)
+	}
+	if c.token != "" {
+		if _, err := fmt.Fprintf(conn, "%s\n", c.token); err != nil {
+			_ = conn.Close()
+			return nil, errors.Annotate(err, "sending token")
+		}
+	}
+	return conn, nil
+}
+
+// Close disconnects the client.
+func (c *Client) Close() error {
+	return errors.Trace(c.conn.Close())
+}
+
+// Run runs the session until the input ends or the session is disconnected.
+// If the input is a terminal, then lines are edited as they're typed.
+// Otherwise the input is sent a line at a time. The lines are recorded in the
+// history file, if there is one.
+func (c *Client) Run(in *os.File, out io.Writer, historyFile string) error {
+	c.out = out
+	c.historyFile = historyFile
+	if err := c.loadHistory(); err != nil {
+		return errors.Trace(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.copyOutput()
+	}()
+
+	restore, err := makeRaw(int(in.Fd()))
+	if err != nil {
+		return errors.Trace(c.runLines(in, done))
+	}
+	defer restore()
+	return errors.Trace(c.runEditor(in, done))
+}
+
+// copyOutput writes the output of the session until it's disconnected. The
+// text following the last line break is held as the prompt, so that it can
+// be redrawn along with the line being edited.
+func (c *Client) copyOutput() error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			chunk := string(buf[:n])
+
+			c.outMu.Lock()
+			if len(c.line) > 0 {
+				_, _ = io.WriteString(c.out, "\r\x1b[K")
+			}
+			_, _ = io.WriteString(c.out, chunk)
+			if i := strings.LastIndexByte(chunk, '\n'); i >= 0 {
+				c.prompt = chunk[i+1:]
+			} else {
+				c.prompt += chunk
+			}
+			if len(c.line) > 0 {
+				c.redrawLocked()
+			}
+			c.outMu.Unlock()
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// runLines sends the input a line at a time, then waits for the session to
+// write the output of the last line.
+func (c *Client) runLines(in io.Reader, done <-chan error) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		if err := c.send(scanner.Text()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	return errors.Trace(<-done)
+}
+
+// send sends the line to the session, recording it in the history.
+func (c *Client) send(line string) error {
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		return errors.Annotate(err, "sending to REPL")
+	}
+
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return nil
+	}
+	if err := c.addHistory(line); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Changing the database or its tables makes the completions stale.
+	fields := strings.Fields(trimmed)
+	switch strings.ToLower(fields[0]) {
+	case ".use", ".open":
+		if len(fields) > 1 {
+			c.database = fields[1]
+		}
+		c.completions = nil
+	case "create", "alter", "drop":
+		c.completions = nil
+	}
+	return nil
+}
+
+// runEditor edits lines in the terminal until the input ends, Ctrl-D is
+// pressed on an empty line or the session is disconnected.
+func (c *Client) runEditor(in io.Reader, done <-chan error) error {
+	keys := make(chan rune)
+	go func() {
+		defer close(keys)
+		reader := bufio.NewReader(in)
+		for {
+			r, _, err := reader.ReadRune()
+			if err != nil {
+				return
+			}
+			keys <- r
+		}
+	}()
+
+	histIndex := len(c.history)
+	for {
+		var key rune
+		select {
+		case err := <-done:
+			return errors.Trace(err)
+		case k, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			key = k
+		}
+
+		switch key {
+		case '\r', '\n':
+			c.outMu.Lock()
+			line := string(c.line)
+			c.line, c.pos, c.prompt = nil, 0, ""
+			_, _ = io.WriteString(c.out, "\n")
+			c.outMu.Unlock()
+
+			if err := c.send(line); err != nil {
+				return errors.Trace(err)
+			}
+			histIndex = len(c.history)
+
+		case 0x03: // Ctrl-C cancels the running statement.
+			if _, err := io.WriteString(c.conn, "\x03"); err != nil {
+				return errors.Annotate(err, "sending to REPL")
+			}
+			c.edit(func() {
+				c.line, c.pos = nil, 0
+				_, _ = io.WriteString(c.out, "^C\n")
+			})
+
+		case 0x04: // Ctrl-D ends the session on an empty line.
+			c.outMu.Lock()
+			empty := len(c.line) == 0
+			c.outMu.Unlock()
+			if empty {
+				_, _ = io.WriteString(c.out, "\n")
+				return nil
+			}
+			c.edit(c.deleteForward)
+
+		case 0x7f, 0x08:
+			c.edit(func() {
+				if c.pos > 0 {
+					c.line = append(c.line[:c.pos-1], c.line[c.pos:]...)
+					c.pos--
+				}
+			})
+
+		case 0x01: // Ctrl-A
+			c.edit(func() { c.pos = 0 })
+
+		case 0x05: // Ctrl-E
+			c.edit(func() { c.pos = len(c.line) })
+
+		case 0x0b: // Ctrl-K
+			c.edit(func() { c.line = c.line[:c.pos] })
+
+		case 0x15: // Ctrl-U
+			c.edit(func() {
+				c.line = append([]rune(nil), c.line[c.pos:]...)
+				c.pos = 0
+			})
+
+		case '\t':
+			c.complete()
+
+		case 0x1b:
+			seq := readEscape(keys)
+			switch seq {
+			case "[A":
+				if histIndex > 0 {
+					histIndex--
+					c.setLine(c.history[histIndex])
+				}
+			case "[B":
+				if histIndex < len(c.history) {
+					histIndex++
+					if histIndex == len(c.history) {
+						c.setLine("")
+					} else {
+						c.setLine(c.history[histIndex])
+					}
+				}
+			case "[C":
+				c.edit(func() {
+					if c.pos < len(c.line) {
+						c.pos++
+					}
+				})
+			case "[D":
+				c.edit(func() {
+					if c.pos > 0 {
+						c.pos--
+					}
+				})
+			case "[H", "OH", "[1~":
+				c.edit(func() { c.pos = 0 })
+			case "[F", "OF", "[4~":
+				c.edit(func() { c.pos = len(c.line) })
+			case "[3~":
+				c.edit(c.deleteForward)
+			}
+
+		default:
+			if key < 0x20 {
+				continue
+			}
+			c.edit(func() { c.insert(string(key)) })
+		}
+	}
+}
+
+// readEscape reads the rest of an escape sequence for the keys handled by
+// the editor.
+func readEscape(keys <-chan rune) string {
+	var seq []rune
+	for {
+		r, ok := <-keys
+		if !ok {
+			return string(seq)
+		}
+		seq = append(seq, r)
+		if len(seq) == 1 {
+			if r != '[' && r != 'O' {
+				return string(seq)
+			}
+			continue
+		}
+		// The sequence ends with a letter or a tilde.
+		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || r == '~' {
+			return string(seq)
+		}
+	}
+}
+
+// edit applies the change to the line being edited, then redraws it.
+func (c *Client) edit(change func()) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	change()
+	c.redrawLocked()
+}
+
+// setLine replaces the line being edited, leaving the cursor at the end.
+func (c *Client) setLine(line string) {
+	c.edit(func() {
+		c.line = []rune(line)
+		c.pos = len(c.line)
+	})
+}
+
+// insert inserts the text at the cursor. The lock must be held.
+func (c *Client) insert(text string) {
+	runes := []rune(text)
+	line := make([]rune, 0, len(c.line)+len(runes))
+	line = append(line, c.line[:c.pos]...)
+	line = append(line, runes...)
+	line = append(line, c.line[c.pos:]...)
+	c.line = line
+	c.pos += len(runes)
+}
+
+// deleteForward deletes the character under the cursor. The lock must be
+// held.
+func (c *Client) deleteForward() {
+	if c.pos < len(c.line) {
+		c.line = append(c.line[:c.pos], c.line[c.pos+1:]...)
+	}
+}
+
+// redrawLocked redraws the prompt and the line being edited, placing the
+// cursor. The lock must be held.
+func (c *Client) redrawLocked() {
+	_, _ = fmt.Fprintf(c.out, "\r%s%s\x1b[K", c.prompt, string(c.line))
+	if n := len(c.line) - c.pos; n > 0 {
+		_, _ = fmt.Fprintf(c.out, "\x1b[%dD", n)
+	}
+}
+
+// complete completes the word before the cursor. A single candidate is
+// completed in full. Otherwise the common prefix of the candidates is
+// completed, or the candidates are listed if there is no more to complete.
+func (c *Client) complete() {
+	completions, err := c.fetchCompletions()
+	if err != nil {
+		c.edit(func() {
+			_, _ = fmt.Fprintf(c.out, "\nUnable to complete: %v\n", err)
+		})
+		return
+	}
+
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	start := c.pos
+	for start > 0 && !strings.ContainsRune(wordDelimiters, c.line[start-1]) {
+		start--
+	}
+	word := string(c.line[start:c.pos])
+	isCommand := strings.TrimSpace(string(c.line[:start])) == "" && strings.HasPrefix(word, ".")
+
+	candidates := completionCandidates(completions, word, isCommand)
+	switch len(candidates) {
+	case 0:
+		return
+	case 1:
+		c.insert(candidates[0][len(word):] + " ")
+	default:
+		if prefix := commonPrefix(candidates); len(prefix) > len(word) {
+			c.insert(prefix[len(word):])
+		} else {
+			_, _ = fmt.Fprintf(c.out, "\n%s\n", strings.Join(candidates, "  "))
+		}
+	}
+	c.redrawLocked()
+}
+
+// completionCandidates returns the names starting with the word. Commands
+// are only completed at the start of a line. A word qualified by a table
+// name is completed with the columns of the table.
+func completionCandidates(completions *Completions, word string, isCommand bool) []string {
+	var names []string
+	switch {
+	case isCommand:
+		names = completions.Commands
+	case strings.Contains(word, "."):
+		table := word[:strings.IndexByte(word, '.')]
+		for _, column := range completions.Tables[table] {
+			names = append(names, table+"."+column)
+		}
+	default:
+		seen := make(map[string]bool)
+		for table, columns := range completions.Tables {
+			for _, name := range append([]string{table}, columns...) {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if strings.HasPrefix(name, word) {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// commonPrefix returns the longest prefix shared by all the names.
+func commonPrefix(names []string) string {
+	prefix := names[0]
+	for _, name := range names[1:] {
+		for !strings.HasPrefix(name, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// fetchCompletions fetches the completions over a separate session, so that
+// the response can't be confused with the output of the interactive session.
+// The completions are cached until the database or its tables change.
+func (c *Client) fetchCompletions() (*Completions, error) {
+	if c.completions != nil {
+		return c.completions, nil
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(completeTimeout))
+
+	var commands string
+	if c.database != "" {
+		commands += fmt.Sprintf(".use %s\n", c.database)
+	}
+	commands += ".complete\n"
+	if _, err := io.WriteString(conn, commands); err != nil {
+		return nil, errors.Annotate(err, "requesting completions")
+	}
+
+	// The completions are written as a single line of JSON, following the
+	// prompt.
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, `{"commands":`)
+		if i < 0 {
+			continue
+		}
+		var completions Completions
+		if err := json.Unmarshal([]byte(line[i:]), &completions); err != nil {
+			return nil, errors.Annotate(err, "decoding completions")
+		}
+		c.completions = &completions
+		return c.completions, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotate(err, "reading completions")
+	}
+	return nil, errors.NotFoundf("completions")
+}
+
+// loadHistory reads the history file, if there is one.
+func (c *Client) loadHistory() error {
+	if c.historyFile == "" {
+		return nil
+	}
+	f, err := os.Open(c.historyFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Annotate(err, "reading history")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			c.history = append(c.history, line)
+		}
+	}
+	if len(c.history) > maxHistory {
+		c.history = c.history[len(c.history)-maxHistory:]
+	}
+	return errors.Annotate(scanner.Err(), "reading history")
+}
+
+// addHistory records the line in the history, appending it to the history
+// file if there is one.
+func (c *Client) addHistory(line string) error {
+	if n := len(c.history); n > 0 && c.history[n-1] == line {
+		return nil
+	}
+	c.history = append(c.history, line)
+	if len(c.history) > maxHistory {
+		c.history = c.history[1:]
+	}
+
+	if c.historyFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(c.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Annotate(err, "writing history")
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, line)
+	return errors.Annotate(err, "writing history")
+}
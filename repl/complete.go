@@ -0,0 +1,84 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+)
+
+// Completions holds the names a client can complete, as written by the
+// '.complete' command.
+type Completions struct {
+	// Commands holds the names of the REPL commands.
+	Commands []string `json:"commands"`
+
+	// Tables maps the tables of the session's database to their columns.
+	Tables map[string][]string `json:"tables"`
+}
+
+// handleCompleteCommand writes the completions as a single line of JSON, so
+// that a client can pick it out from the rest of the output.
+func (r *SQLRepl) handleCompleteCommand(s *replSession) {
+	commands := set.NewStrings()
+	for cmdName := range r.commands {
+		commands.Add(cmdName)
+	}
+	completions := Completions{
+		Commands: commands.SortedValues(),
+		Tables:   make(map[string][]string),
+	}
+
+	if s.db != nil {
+		tables, err := r.tableColumns(s)
+		if err != nil {
+			_, _ = fmt.Fprintf(s.resWriter, "Unable to read tables: %v\n", err)
+			return
+		}
+		completions.Tables = tables
+	}
+
+	data, err := json.Marshal(completions)
+	if err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to encode completions: %v\n", err)
+		return
+	}
+	_, _ = fmt.Fprintf(s.resWriter, "%s\n", data)
+}
+
+// tableColumns returns the columns of every table in the session's database.
+func (r *SQLRepl) tableColumns(s *replSession) (map[string][]string, error) {
+	tables, err := schemastate.Tables(s.backend)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	columns := make(map[string][]string, len(tables))
+	for _, table := range tables {
+		rows, err := s.conn.QueryContext(r.sessionCtx, "SELECT name FROM pragma_table_info(?)", table)
+		if err != nil {
+			return nil, errors.Annotatef(err, "columns of %q", table)
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				_ = rows.Close()
+				return nil, errors.Annotatef(err, "columns of %q", table)
+			}
+			names = append(names, name)
+		}
+		err = rows.Err()
+		_ = rows.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "columns of %q", table)
+		}
+		columns[table] = names
+	}
+	return columns, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import (
+	"time"
+)
+
+// Option configures a SQLRepl when it is created.
+type Option func(*SQLRepl)
+
+// WithTCP listens for sessions on the TCP address, as well as the UNIX
+// socket. The first line sent by a TCP session must be the token, otherwise
+// the session is disconnected.
+func WithTCP(address, token string) Option {
+	return func(r *SQLRepl) {
+		r.tcpAddress = address
+		r.tcpToken = token
+	}
+}
+
+// WithIdleTimeout disconnects sessions that haven't sent any input for the
+// duration. Zero means that sessions are never disconnected.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(r *SQLRepl) {
+		r.idleTimeout = timeout
+	}
+}
+
+// WithReadOnly rejects any statement that could change the database, for
+// every session.
+func WithReadOnly() Option {
+	return func(r *SQLRepl) {
+		r.readOnly = true
+	}
+}
+
+// WithReadOnlyToken allows TCP sessions that send the token, rather than the
+// token passed to WithTCP, but only as read-only sessions.
+func WithReadOnlyToken(token string) Option {
+	return func(r *SQLRepl) {
+		r.readOnlyToken = token
+	}
+}
+
+// WithStatementTimeout cancels statements that run for longer than the
+// timeout. Zero means that statements can run for as long as they need.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(r *SQLRepl) {
+		r.statementTimeout = timeout
+	}
+}
+
+// WithMaxSessions rejects new sessions whilst there are already the maximum
+// number of sessions open. Zero means that there is no maximum.
+func WithMaxSessions(max int) Option {
+	return func(r *SQLRepl) {
+		r.maxSessions = max
+	}
+}
+
+// WithSlowStatementLog logs the statements that run for longer than the
+// threshold, along with the session they were run by.
+func WithSlowStatementLog(logger Logger, threshold time.Duration) Option {
+	return func(r *SQLRepl) {
+		r.logger = logger
+		r.slowThreshold = threshold
+	}
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...interface{})   {}
+func (noopLogger) Infof(string, ...interface{})    {}
+func (noopLogger) Warningf(string, ...interface{}) {}
+func (noopLogger) Errorf(string, ...interface{})   {}
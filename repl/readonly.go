@@ -0,0 +1,84 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import (
+	"strings"
+
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/juju/errors"
+)
+
+// writeKeywords are the keywords that mark a statement starting with WITH as
+// one that changes the database.
+var writeKeywords = map[string]bool{
+	"INSERT":  true,
+	"UPDATE":  true,
+	"DELETE":  true,
+	"REPLACE": true,
+}
+
+// readPragmas are the pragmas that may take an argument without changing the
+// database.
+var readPragmas = map[string]bool{
+	"database_list":     true,
+	"foreign_key_check": true,
+	"foreign_key_list":  true,
+	"index_info":        true,
+	"index_list":        true,
+	"index_xinfo":       true,
+	"integrity_check":   true,
+	"quick_check":       true,
+	"table_info":        true,
+	"table_xinfo":       true,
+}
+
+// checkReadOnly returns an error if the statement could change the database.
+// Only a single SELECT, VALUES or EXPLAIN statement, or a PRAGMA that reads a
+// value, is allowed.
+//
+// The check only gives a friendlier error for the statements it can spot;
+// the connection of a read-only session is what stops it from writing.
+func checkReadOnly(statement string) error {
+	statements, remainder := schemastate.SplitStatements(statement)
+	if strings.TrimSpace(remainder) != "" {
+		statements = append(statements, remainder)
+	}
+	if len(statements) != 1 {
+		return errors.Errorf("multiple statements are not allowed in a read-only session")
+	}
+
+	tokens := strings.Fields(strings.TrimSuffix(statements[0], ";"))
+	if len(tokens) == 0 {
+		return nil
+	}
+	keyword := strings.ToUpper(tokens[0])
+	switch keyword {
+	case "SELECT", "VALUES", "EXPLAIN":
+		return nil
+	case "WITH":
+		for _, token := range tokens[1:] {
+			if writeKeywords[strings.ToUpper(token)] {
+				return errors.Errorf("WITH ... %s is not allowed in a read-only session", strings.ToUpper(token))
+			}
+		}
+		return nil
+	case "PRAGMA":
+		pragma := strings.Join(tokens[1:], " ")
+		if strings.Contains(pragma, "=") {
+			return errors.Errorf("setting a PRAGMA is not allowed in a read-only session")
+		}
+		if i := strings.IndexByte(pragma, '('); i >= 0 {
+			name := strings.ToLower(strings.TrimSpace(pragma[:i]))
+			if j := strings.LastIndexByte(name, '.'); j >= 0 {
+				name = name[j+1:]
+			}
+			if !readPragmas[name] {
+				return errors.Errorf("setting a PRAGMA is not allowed in a read-only session")
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("%s is not allowed in a read-only session", keyword)
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import "testing"
+
+func TestCheckReadOnly(t *testing.T) {
+	tests := []struct {
+		statement string
+		allowed   bool
+	}{
+		{"SELECT * FROM actions;", true},
+		{"select 1", true},
+		{"VALUES (1), (2);", true},
+		{"EXPLAIN SELECT * FROM actions;", true},
+		{"WITH a AS (SELECT 1) SELECT * FROM a;", true},
+		{"PRAGMA table_info(actions);", true},
+		{"PRAGMA main.index_list(actions);", true},
+		{"PRAGMA foreign_keys;", true},
+		{"INSERT INTO actions (name) VALUES ('x');", false},
+		{"UPDATE actions SET name = 'x';", false},
+		{"DELETE FROM actions;", false},
+		{"DROP TABLE actions;", false},
+		{"CREATE TABLE things (id INTEGER);", false},
+		{"ATTACH DATABASE 'x' AS x;", false},
+		{"WITH a AS (SELECT 1) DELETE FROM actions;", false},
+		{"WITH a AS (SELECT 1) insert INTO actions SELECT * FROM a;", false},
+		{"PRAGMA foreign_keys = OFF;", false},
+		{"PRAGMA journal_mode(wal);", false},
+		{"SELECT 1; DELETE FROM actions;", false},
+	}
+	for _, test := range tests {
+		err := checkReadOnly(test.statement)
+		if test.allowed && err != nil {
+			t.Errorf("%q: got error %v, want it allowed", test.statement, err)
+		} else if !test.allowed && err == nil {
+			t.Errorf("%q: got it allowed, want it blocked", test.statement)
+		}
+	}
+}
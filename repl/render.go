@@ -0,0 +1,166 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/errors"
+)
+
+// outputMode controls how the results of a query are rendered.
+type outputMode string
+
+const (
+	// modeTable renders aligned columns for humans.
+	modeTable outputMode = "table"
+
+	// modeCSV renders RFC-4180 CSV.
+	modeCSV outputMode = "csv"
+
+	// modeJSON renders a JSON array of objects keyed by column name.
+	modeJSON outputMode = "json"
+)
+
+// nullText is how a NULL is rendered in table mode.
+const nullText = "NULL"
+
+// resultSet holds the columns and rows of a query result. NULL values are
+// held as nil.
+type resultSet struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// render writes the result set to the writer in the given mode. Headers are
+// omitted from the table and CSV modes when headers is false.
+func (rs resultSet) render(w io.Writer, mode outputMode, headers bool) error {
+	switch mode {
+	case modeCSV:
+		return errors.Trace(rs.renderCSV(w, headers))
+	case modeJSON:
+		return errors.Trace(rs.renderJSON(w))
+	default:
+		return errors.Trace(rs.renderTable(w, headers))
+	}
+}
+
+func (rs resultSet) renderTable(w io.Writer, headers bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if headers {
+		_, _ = fmt.Fprintln(tw, strings.Join(rs.columns, "\t"))
+	}
+	for _, row := range rs.rows {
+		fields := make([]string, len(row))
+		for i, value := range row {
+			if value == nil {
+				fields[i] = nullText
+				continue
+			}
+			fields[i] = fmt.Sprintf("%v", value)
+		}
+		_, _ = fmt.Fprintln(tw, strings.Join(fields, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err := fmt.Fprintf(w, "\nTotal rows: %d\n", len(rs.rows))
+	return errors.Trace(err)
+}
+
+// renderCSV writes the result set as RFC-4180 CSV. A NULL is written as an
+// empty field, whereas an empty string is always quoted, so the two can be
+// told apart.
+func (rs resultSet) renderCSV(w io.Writer, headers bool) error {
+	var lines []string
+	if headers {
+		fields := make([]string, len(rs.columns))
+		for i, column := range rs.columns {
+			fields[i] = csvField(column)
+		}
+		lines = append(lines, strings.Join(fields, ","))
+	}
+	for _, row := range rs.rows {
+		fields := make([]string, len(row))
+		for i, value := range row {
+			if value == nil {
+				continue
+			}
+			fields[i] = csvField(fmt.Sprintf("%v", value))
+		}
+		lines = append(lines, strings.Join(fields, ","))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n")
+	return errors.Trace(err)
+}
+
+// csvField quotes the field if it's empty or contains a delimiter, a quote
+// or a line break.
+func csvField(field string) string {
+	if field != "" && !strings.ContainsAny(field, ",\"\r\n") {
+		return field
+	}
+	return `"` + strings.Replace(field, `"`, `""`, -1) + `"`
+}
+
+// renderJSON writes the result set as a JSON array of objects keyed by
+// column name. A NULL is written as null.
+func (rs resultSet) renderJSON(w io.Writer) error {
+	objects := make([]map[string]interface{}, len(rs.rows))
+	for i, row := range rs.rows {
+		object := make(map[string]interface{}, len(rs.columns))
+		for j, column := range rs.columns {
+			object[column] = row[j]
+		}
+		objects[i] = object
+	}
+
+	data, err := json.MarshalIndent(objects, "", "    ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return errors.Trace(err)
+}
+
+// planStep is a row of the output of EXPLAIN QUERY PLAN.
+type planStep struct {
+	id     int
+	parent int
+	detail string
+}
+
+// renderPlan writes the query plan as a tree, in the style of the sqlite
+// shell.
+func renderPlan(w io.Writer, steps []planStep) {
+	children := make(map[int][]planStep)
+	for _, step := range steps {
+		children[step.parent] = append(children[step.parent], step)
+	}
+
+	_, _ = fmt.Fprintln(w, "QUERY PLAN")
+	var renderChildren func(parent int, indent string)
+	renderChildren = func(parent int, indent string) {
+		for i, step := range children[parent] {
+			branch, next := "|--", "|  "
+			if i == len(children[parent])-1 {
+				branch, next = "`--", "   "
+			}
+			_, _ = fmt.Fprintf(w, "%s%s%s\n", indent, branch, step.detail)
+			if step.id != parent {
+				renderChildren(step.id, indent+next)
+			}
+		}
+	}
+	renderChildren(0, "")
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package repl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRenderResultSet(t *testing.T) {
+	rs := resultSet{
+		columns: []string{"id", "name", "message"},
+		rows: [][]interface{}{
+			{int64(1), "backup", nil},
+			{int64(2), "", "disk full, giving up"},
+			{int64(3), `say "hi"`, "line\nbreak"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		mode    outputMode
+		headers bool
+		want    string
+	}{{
+		name:    "table",
+		mode:    modeTable,
+		headers: true,
+		want: "id  name      message\n" +
+			"1   backup    NULL\n" +
+			"2             disk full, giving up\n" +
+			"3   say \"hi\"  line\n" +
+			"break\n" +
+			"\nTotal rows: 3\n",
+	}, {
+		name:    "table without headers",
+		mode:    modeTable,
+		headers: false,
+		want: "1  backup    NULL\n" +
+			"2            disk full, giving up\n" +
+			"3  say \"hi\"  line\n" +
+			"break\n" +
+			"\nTotal rows: 3\n",
+	}, {
+		name:    "csv",
+		mode:    modeCSV,
+		headers: true,
+		want: "id,name,message\r\n" +
+			"1,backup,\r\n" +
+			"2,\"\",\"disk full, giving up\"\r\n" +
+			"3,\"say \"\"hi\"\"\",\"line\nbreak\"\r\n",
+	}, {
+		name:    "csv without headers",
+		mode:    modeCSV,
+		headers: false,
+		want: "1,backup,\r\n" +
+			"2,\"\",\"disk full, giving up\"\r\n" +
+			"3,\"say \"\"hi\"\"\",\"line\nbreak\"\r\n",
+	}, {
+		name:    "json",
+		mode:    modeJSON,
+		headers: true,
+		want: `[
+    {
+        "id": 1,
+        "message": null,
+        "name": "backup"
+    },
+    {
+        "id": 2,
+        "message": "disk full, giving up",
+        "name": ""
+    },
+    {
+        "id": 3,
+        "message": "line\nbreak",
+        "name": "say \"hi\""
+    }
+]
+`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := rs.render(&out, test.mode, test.headers); err != nil {
+				t.Fatalf("rendering: %v", err)
+			}
+			if got := out.String(); got != test.want {
+				t.Fatalf("got\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderEmptyResultSet(t *testing.T) {
+	rs := resultSet{columns: []string{"id"}}
+
+	tests := []struct {
+		mode outputMode
+		want string
+	}{
+		{modeTable, "id\n\nTotal rows: 0\n"},
+		{modeCSV, "id\r\n"},
+		{modeJSON, "[]\n"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			var out bytes.Buffer
+			if err := rs.render(&out, test.mode, true); err != nil {
+				t.Fatalf("rendering: %v", err)
+			}
+			if got := out.String(); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRenderPlan(t *testing.T) {
+	var out bytes.Buffer
+	renderPlan(&out, []planStep{
+		{id: 2, parent: 0, detail: "SCAN actions"},
+		{id: 3, parent: 0, detail: "CORRELATED SCALAR SUBQUERY 1"},
+		{id: 5, parent: 3, detail: "SEARCH actions_logs USING INDEX idx_logs (action_id=?)"},
+	})
+
+	want := "QUERY PLAN\n" +
+		"|--SCAN actions\n" +
+		"`--CORRELATED SCALAR SUBQUERY 1\n" +
+		"   `--SEARCH actions_logs USING INDEX idx_logs (action_id=?)\n"
+	if got := out.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
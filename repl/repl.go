@@ -5,14 +5,20 @@ package repl
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
 	"github.com/juju/clock"
 	"github.com/juju/collections/set"
 	"github.com/juju/errors"
@@ -21,13 +27,76 @@ import (
 
 const readTimeout = 5 * time.Second
 
+// handshakeTimeout is the time a TCP session is given to send its token.
+const handshakeTimeout = 10 * time.Second
+
+// defaultRowLimit is the number of rows rendered for a query, unless the
+// session changes it with '.limit'.
+const defaultRowLimit = 1000
+
+// driverName is used to wrap the session databases for the schema queries.
+// The databases speak the sqlite dialect, whichever driver opened them.
+const driverName = "sqlite3"
+
+// DBGetter looks up the databases sessions can use by name.
 type DBGetter interface {
+	// GetExistingDB returns the database with the name. A NotFound error
+	// means there's no such database, and a NotValid error means the name
+	// can't be used.
 	GetExistingDB(string) (*sql.DB, error)
+
+	// DatabaseNames returns the names of the databases that can be used.
+	DatabaseNames() []string
+}
+
+// Logger is the logger used by the REPL.
+type Logger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warningf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
+// SchemaDiffer compares the live database schema against the expected schema.
+type SchemaDiffer interface {
+	Diff() (schemastate.SchemaDiff, error)
 }
 
 type replSession struct {
-	id string
-	db *sql.DB
+	id      string
+	remote  string
+	dbName  string
+	db      *sql.DB
+	backend schemastate.Backend
+
+	// conn is the connection pinned to the session, so that a transaction
+	// begun by one statement is still open for the next.
+	conn *sql.Conn
+
+	// The output mode and whether headers are rendered for query results.
+	mode    outputMode
+	headers bool
+
+	// limit is the maximum number of rows rendered for a query. Zero means
+	// that there is no limit.
+	limit int
+
+	// The input that hasn't formed a complete line yet, and the lines of a
+	// statement that hasn't been terminated yet.
+	pending   string
+	statement strings.Builder
+
+	// readOnly rejects any statement that could change the database.
+	readOnly bool
+
+	// timing reports the time taken by every statement when set.
+	timing bool
+
+	// cancelMu guards cancel, which cancels the statement that is running,
+	// if there is one. The input is read whilst a statement runs, so that
+	// it can be cancelled.
+	cancelMu sync.Mutex
+	cancel   context.CancelFunc
 
 	// The params for the current command and a writer for encoding the
 	// command result.
@@ -41,9 +110,29 @@ type replCmdDef struct {
 }
 
 type SQLRepl struct {
-	connListener net.Listener
-	dbGetter     DBGetter
-	clock        clock.Clock
+	connListeners []net.Listener
+	tcpAddress    string
+	tcpToken      string
+	readOnlyToken string
+	readOnly      bool
+
+	// statementTimeout and slowThreshold bound the time statements are
+	// allowed to run, and the time after which they're logged, if set.
+	statementTimeout time.Duration
+	slowThreshold    time.Duration
+	logger           Logger
+
+	// sessionsMu guards sessions, the number of open sessions, which is
+	// capped by maxSessions if it's set.
+	sessionsMu  sync.Mutex
+	sessions    int
+	maxSessions int
+	idleTimeout time.Duration
+
+	dbGetter  DBGetter
+	defaultDB string
+	schema    SchemaDiffer
+	clock     clock.Clock
 
 	sessionCtx      context.Context
 	sessionCancelFn func()
@@ -52,31 +141,66 @@ type SQLRepl struct {
 	commands map[string]replCmdDef
 }
 
-func New(pathToSocket string, dbGetter DBGetter, clock clock.Clock) (*SQLRepl, error) {
+// New creates a REPL listening on the UNIX socket. Sessions are connected to
+// the default database, if one is supplied, and can switch to any other
+// database known to the getter with '.use'.
+func New(pathToSocket string, dbGetter DBGetter, defaultDB string, schema SchemaDiffer, clock clock.Clock, opts ...Option) (*SQLRepl, error) {
+	r := &SQLRepl{
+		dbGetter:  dbGetter,
+		defaultDB: defaultDB,
+		schema:    schema,
+		clock:     clock,
+		logger:    noopLogger{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.tcpAddress != "" && r.tcpToken == "" {
+		return nil, errors.NotValidf("TCP listener for REPL sessions without a token")
+	}
+
 	l, err := net.Listen("unix", pathToSocket)
 	if err != nil {
 		return nil, errors.Annotate(err, "creating UNIX socket for REPL sessions")
 	}
+	r.connListeners = append(r.connListeners, l)
 
-	ctx, cancelFn := context.WithCancel(context.TODO())
-
-	r := &SQLRepl{
-		connListener:    l,
-		dbGetter:        dbGetter,
-		clock:           clock,
-		sessionCtx:      ctx,
-		sessionCancelFn: cancelFn,
+	if r.tcpAddress != "" {
+		tl, err := net.Listen("tcp", r.tcpAddress)
+		if err != nil {
+			_ = l.Close()
+			return nil, errors.Annotate(err, "creating TCP listener for REPL sessions")
+		}
+		r.connListeners = append(r.connListeners, tl)
 	}
+
+	r.sessionCtx, r.sessionCancelFn = context.WithCancel(context.TODO())
 	r.registerCommands()
-	go r.acceptConnections()
+
+	r.sessionGroup.Add(len(r.connListeners))
+	go r.acceptConnections(l, nil)
+	if len(r.connListeners) > 1 {
+		tokens := map[string]bool{
+			r.tcpToken: r.readOnly,
+		}
+		if r.readOnlyToken != "" {
+			tokens[r.readOnlyToken] = true
+		}
+		go r.acceptConnections(r.connListeners[1], tokens)
+	}
 
 	return r, nil
 }
 
-// Kill implements the Worker interface. It closes the REPL socket and notifies
-// any open sessions that they need to gracefully terminate.
+// Kill implements the Worker interface. It closes the REPL sockets and
+// notifies any open sessions that they need to gracefully terminate. Each
+// session rolls back any transaction it has open and releases its pinned
+// connection as it terminates.
 func (r *SQLRepl) Kill() {
-	r.connListener.Close()
+	r.sessionCancelFn()
+	for _, l := range r.connListeners {
+		l.Close()
+	}
 }
 
 // Wait implements the Worker interface. It blocks until all open REPL sessions
@@ -92,58 +216,275 @@ func (r *SQLRepl) registerCommands() {
 			descr:   "display list of supported commands",
 			handler: r.handleHelpCmd,
 		},
+		".diff": {
+			descr:   "display the differences between the live and expected schema",
+			handler: r.handleDiffCommand,
+		},
+		".use": {
+			descr:   "switch to a database (e.g. '.use foo')",
+			handler: r.handleUseCommand,
+		},
 		".open": {
-			descr:   "connect to a database (e.g. '.open foo')",
-			handler: r.handleOpenCommand,
+			descr:   "alias for '.use'",
+			handler: r.handleUseCommand,
+		},
+		".databases": {
+			descr:   "list the databases that can be used",
+			handler: r.handleDatabasesCommand,
+		},
+		".tables": {
+			descr:   "list the tables of the database",
+			handler: r.handleTablesCommand,
+		},
+		".schema": {
+			descr:   "display the CREATE statements of the database or a table (e.g. '.schema actions')",
+			handler: r.handleSchemaCommand,
+		},
+		".mode": {
+			descr:   "set the output mode for query results (table, csv or json)",
+			handler: r.handleModeCommand,
+		},
+		".headers": {
+			descr:   "turn the headers of query results on or off",
+			handler: r.handleHeadersCommand,
+		},
+		".read": {
+			descr:   "execute the SQL statements in a file (e.g. '.read patch.sql')",
+			handler: r.handleReadCommand,
+		},
+		".abort": {
+			descr:   "discard the statement that is being entered",
+			handler: r.handleAbortCommand,
+		},
+		".limit": {
+			descr:   "set the maximum number of rows displayed for a query, or 0 for no limit (e.g. '.limit 100')",
+			handler: r.handleLimitCommand,
+		},
+		".timing": {
+			descr:   "turn reporting the time taken by every statement on or off",
+			handler: r.handleTimingCommand,
+		},
+		".explain": {
+			descr:   "display the query plan of a statement (e.g. '.explain SELECT * FROM actions')",
+			handler: r.handleExplainCommand,
+		},
+		".cancel": {
+			descr:   "cancel the running statement; Ctrl-C does the same",
+			handler: r.handleCancelCommand,
+		},
+		".complete": {
+			descr:   "display the names of the commands, tables and columns as JSON, for completion",
+			handler: r.handleCompleteCommand,
+		},
+		".version": {
+			descr:   "display the schema version of the database",
+			handler: r.handleVersionCommand,
 		},
 	}
 }
 
-func (r *SQLRepl) acceptConnections() {
+// acceptConnections serves sessions from the listener until it's closed. If
+// there are any tokens, then every session must send one of them before
+// anything else. Each token maps to whether its sessions are read-only.
+func (r *SQLRepl) acceptConnections(l net.Listener, tokens map[string]bool) {
 	defer r.sessionGroup.Done()
 	for {
-		conn, err := r.connListener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			return
 		}
 
+		if !r.startSession() {
+			_, _ = fmt.Fprintf(conn, "Sorry, there are already %d REPL sessions open; please try again later\n", r.maxSessions)
+			_ = conn.Close()
+			continue
+		}
+
 		r.sessionGroup.Add(1)
-		go r.serveSession(conn)
+		go r.serveSession(conn, tokens)
+	}
+}
+
+// Sessions returns the number of open sessions.
+func (r *SQLRepl) Sessions() int {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	return r.sessions
+}
+
+// startSession counts a new session, returning false if there are already
+// as many sessions open as are allowed.
+func (r *SQLRepl) startSession() bool {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+	if r.maxSessions > 0 && r.sessions >= r.maxSessions {
+		return false
+	}
+	r.sessions++
+	return true
+}
+
+// endSession stops counting a session.
+func (r *SQLRepl) endSession() {
+	r.sessionsMu.Lock()
+	r.sessions--
+	r.sessionsMu.Unlock()
+}
+
+// authenticate reads the first line of the session and checks it matches one
+// of the tokens, returning whether the session is read-only. Any input
+// following the token is returned, to be processed as the start of the
+// session.
+func (r *SQLRepl) authenticate(conn net.Conn, tokens map[string]bool) (string, bool, bool) {
+	_ = conn.SetReadDeadline(r.clock.Now().Add(handshakeTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	var maxLen int
+	for token := range tokens {
+		if len(token) > maxLen {
+			maxLen = len(token)
+		}
+	}
+
+	var (
+		input  string
+		cmdBuf = make([]byte, 4096)
+	)
+	for {
+		i := strings.IndexByte(input, '\n')
+		if i >= 0 {
+			line := strings.TrimRight(input[:i], "\r")
+			for token, readOnly := range tokens {
+				if subtle.ConstantTimeCompare([]byte(line), []byte(token)) == 1 {
+					return input[i+1:], readOnly, true
+				}
+			}
+			return "", false, false
+		}
+		if len(input) > maxLen+2 {
+			return "", false, false
+		}
+
+		n, err := conn.Read(cmdBuf)
+		if err != nil {
+			return "", false, false
+		}
+		input += string(cmdBuf[:n])
 	}
 }
 
-func (r *SQLRepl) serveSession(conn net.Conn) {
+func (r *SQLRepl) serveSession(conn net.Conn, tokens map[string]bool) {
+	var (
+		pending  string
+		readOnly = r.readOnly
+	)
+	if len(tokens) > 0 {
+		var ok bool
+		if pending, readOnly, ok = r.authenticate(conn, tokens); !ok {
+			_, _ = fmt.Fprintf(conn, "Invalid token; disconnecting\n")
+			_ = conn.Close()
+			r.endSession()
+			r.sessionGroup.Done()
+			return
+		}
+	}
+
 	sessionID, _ := utils.NewUUID()
-	db, _ := r.dbGetter.GetExistingDB("foo")
 	session := &replSession{
 		id:        sessionID.String(),
+		remote:    remoteIdentity(conn),
 		resWriter: conn,
-		db:        db,
+		mode:      modeTable,
+		headers:   true,
+		limit:     defaultRowLimit,
+		pending:   pending,
+		readOnly:  readOnly,
+	}
+	if r.defaultDB != "" {
+		if sqlDB, err := r.dbGetter.GetExistingDB(r.defaultDB); err == nil {
+			_ = session.open(r.sessionCtx, r.defaultDB, sqlDB)
+		}
 	}
 
+	done := make(chan struct{})
 	defer func() {
+		close(done)
+		session.close()
+		_ = conn.Close()
+		r.endSession()
 		r.sessionGroup.Done()
 	}()
 
 	// Render welcome banner and prompt
 	_ = r.renderWelcomeBanner(conn)
-	_, _ = fmt.Fprintf(conn, "\n%s> ", session.id)
+	if session.readOnly {
+		_, _ = fmt.Fprintf(conn, "\nThis session is read-only; only statements that read the database are allowed.\n")
+	}
+	_, _ = fmt.Fprintf(conn, "\n%s> ", session.prompt())
+
+	// Process any input sent along with the token.
+	if session.pending != "" {
+		r.processInput(session, "")
+		_, _ = fmt.Fprintf(conn, "\n%s> ", session.prompt())
+	}
 
-	var cmdBuf = make([]byte, 4096)
+	input := make(chan string)
+	go r.readInput(session, conn, input, done)
 	for {
+		var chunk string
 		select {
 		case <-r.sessionCtx.Done():
 			// Make a best effort attempt to notify client that we are shutting down
 			_, _ = fmt.Fprintf(conn, "\n*** REPL system is shutting down; terminating session\n")
 			return
-		default:
+		case in, ok := <-input:
+			if !ok {
+				return
+			}
+			chunk = in
 		}
 
-		// Read input
+		// Process commands and emit responses
+		r.processInput(session, chunk)
+
+		// Render prompt, or the continuation prompt if a statement is
+		// still being entered. Nothing was processed if the line hasn't
+		// been completed yet, so the prompt is already on screen.
+		if !strings.Contains(chunk, "\n") {
+			continue
+		}
+		if session.statement.Len() > 0 {
+			_, _ = fmt.Fprintf(conn, "%s> ", strings.Repeat(".", len(session.prompt())))
+			continue
+		}
+		_, _ = fmt.Fprintf(conn, "\n%s> ", session.prompt())
+	}
+}
+
+// readInput reads the input of the session until the connection is closed,
+// passing it on to be processed. Interrupts are handled as soon as they are
+// read, as the statement they cancel blocks the processing of the input.
+//
+// Sessions that send no input for longer than the idle timeout are
+// disconnected, unless they're waiting for a statement to complete.
+func (r *SQLRepl) readInput(s *replSession, conn net.Conn, input chan<- string, done <-chan struct{}) {
+	defer close(input)
+
+	var (
+		cmdBuf       = make([]byte, 4096)
+		lastActivity = r.clock.Now()
+	)
+	for {
 		conn.SetReadDeadline(r.clock.Now().Add(readTimeout))
 		n, err := conn.Read(cmdBuf)
 		if err != nil {
 			if err, ok := err.(net.Error); ok && err.Timeout() {
+				if s.running() {
+					lastActivity = r.clock.Now()
+				} else if r.idleTimeout > 0 && r.clock.Now().Sub(lastActivity) >= r.idleTimeout {
+					_, _ = fmt.Fprintf(conn, "\n*** Session idle for %s; disconnecting\n", r.idleTimeout)
+					return
+				}
 				continue // no command available
 			}
 
@@ -151,12 +492,88 @@ func (r *SQLRepl) serveSession(conn net.Conn) {
 		} else if n == 0 {
 			continue // no command available
 		}
+		lastActivity = r.clock.Now()
+
+		chunk, interrupted := stripInterrupts(string(cmdBuf[:n]))
+		if interrupted {
+			s.cancelStatement()
+		}
+		if strings.TrimSpace(chunk) == ".cancel" && s.cancelStatement() {
+			continue
+		}
+		if chunk == "" {
+			continue
+		}
+
+		select {
+		case input <- chunk:
+		case <-done:
+			return
+		}
+	}
+}
+
+// interruptSequences are the sequences sent by clients for Ctrl-C; a raw ETX
+// character, or the telnet interrupt process command with the timing mark
+// that may follow it.
+var interruptSequences = []string{"\xff\xf4", "\xff\xfd\x06", "\x03"}
+
+// stripInterrupts removes any interrupts from the input, reporting whether
+// there were any.
+func stripInterrupts(input string) (string, bool) {
+	var interrupted bool
+	for _, seq := range interruptSequences {
+		if strings.Contains(input, seq) {
+			interrupted = true
+			input = strings.Replace(input, seq, "", -1)
+		}
+	}
+	return input, interrupted
+}
+
+// processInput splits the input into lines, holding back any incomplete
+// line until the rest of it is read.
+func (r *SQLRepl) processInput(s *replSession, input string) {
+	s.pending += input
+	for {
+		i := strings.IndexByte(s.pending, '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimRight(s.pending[:i], "\r")
+		s.pending = s.pending[i+1:]
+		r.processLine(s, line)
+	}
+}
+
+// processLine handles a single line of input. Commands are only recognised
+// at the start of a statement, except for '.abort'. SQL is buffered until a
+// statement is terminated by a semicolon.
+func (r *SQLRepl) processLine(s *replSession, line string) {
+	trimmed := strings.TrimSpace(line)
+	if s.statement.Len() == 0 || trimmed == ".abort" {
+		if trimmed == "" {
+			return
+		}
+		if strings.HasPrefix(trimmed, ".") {
+			r.processCommand(s, trimmed)
+			return
+		}
+	}
 
-		// Process command and emit response
-		r.processCommand(session, string(cmdBuf[:n]))
+	s.statement.WriteString(line)
+	s.statement.WriteByte('\n')
 
-		// Render prompt
-		_, _ = fmt.Fprintf(conn, "\n%s> ", session.id)
+	statements, remainder := schemastate.SplitStatements(s.statement.String())
+	if len(statements) == 0 {
+		return
+	}
+	s.statement.Reset()
+	if strings.TrimSpace(remainder) != "" {
+		s.statement.WriteString(remainder)
+	}
+	for _, statement := range statements {
+		r.processStatement(s, statement)
 	}
 }
 
@@ -166,26 +583,121 @@ func (r *SQLRepl) processCommand(s *replSession, input string) {
 		return
 	}
 
-	// Is it a known command?
 	if cmd, known := r.commands[tokens[0]]; known {
 		s.cmdParams = strings.Join(tokens[1:], " ")
 		cmd.handler(s)
 		return
 	}
 
-	// Is it an SQL select or insert?
-	if strings.EqualFold(tokens[0], "SELECT") {
-		s.cmdParams = strings.Join(tokens, " ")
-		r.handleSelect(s)
+	_, _ = fmt.Fprintf(s.resWriter, "Unknown command %q; for a list of supported commands type '.help'\n", tokens[0])
+}
+
+// queryKeywords are the keywords starting statements that return rows.
+var queryKeywords = []string{"SELECT", "WITH", "VALUES", "EXPLAIN", "PRAGMA"}
+
+// processStatement executes a complete SQL statement.
+func (r *SQLRepl) processStatement(s *replSession, statement string) {
+	tokens := strings.Fields(statement)
+	if len(tokens) == 0 {
 		return
 	}
-	if strings.EqualFold(tokens[0], "INSERT") {
-		s.cmdParams = strings.Join(tokens, " ")
-		r.handleInsert(s)
-		return
+
+	if s.readOnly {
+		if err := checkReadOnly(statement); err != nil {
+			_, _ = fmt.Fprintf(s.resWriter, "Statement rejected: %v\n", err)
+			return
+		}
 	}
 
-	_, _ = fmt.Fprintf(s.resWriter, "Unknown command %q; for a list of supported commands type '.help'\n", tokens[0])
+	s.cmdParams = statement
+	r.runStatement(s, func(ctx context.Context) {
+		for _, keyword := range queryKeywords {
+			if strings.EqualFold(tokens[0], keyword) {
+				r.handleSelect(ctx, s)
+				return
+			}
+		}
+		r.handleExec(ctx, s)
+	})
+}
+
+// runStatement runs the statement with a context that is cancelled by
+// '.cancel' or Ctrl-C, reporting the time it took if timing is on.
+//
+// Statements are cancelled once they exceed the statement timeout, and
+// logged if they exceed the slow threshold.
+func (r *SQLRepl) runStatement(s *replSession, fn func(context.Context)) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if r.statementTimeout > 0 {
+		ctx, cancel = context.WithTimeout(r.sessionCtx, r.statementTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(r.sessionCtx)
+	}
+	defer cancel()
+
+	s.cancelMu.Lock()
+	s.cancel = cancel
+	s.cancelMu.Unlock()
+	defer func() {
+		s.cancelMu.Lock()
+		s.cancel = nil
+		s.cancelMu.Unlock()
+	}()
+
+	start := r.clock.Now()
+	fn(ctx)
+	elapsed := r.clock.Now().Sub(start)
+	if s.timing {
+		_, _ = fmt.Fprintf(s.resWriter, "Run time: %s\n", elapsed)
+	}
+	if r.slowThreshold > 0 && elapsed >= r.slowThreshold {
+		r.logger.Warningf("slow REPL statement took %s (session %s from %s): %s", elapsed, s.id, s.remote, s.cmdParams)
+	}
+}
+
+// remoteIdentity identifies the client of the session in the logs.
+func remoteIdentity(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil || addr.String() == "" || addr.String() == "@" {
+		return conn.LocalAddr().Network() + " socket"
+	}
+	return addr.String()
+}
+
+// running reports whether a statement is running.
+func (s *replSession) running() bool {
+	s.cancelMu.Lock()
+	defer s.cancelMu.Unlock()
+	return s.cancel != nil
+}
+
+// cancelStatement cancels the running statement, reporting whether there
+// was one.
+func (s *replSession) cancelStatement() bool {
+	s.cancelMu.Lock()
+	defer s.cancelMu.Unlock()
+	if s.cancel == nil {
+		return false
+	}
+	s.cancel()
+	return true
+}
+
+// writeStatementError writes the message for a statement that failed, or
+// that the statement was cancelled or timed out if that's why it failed.
+func writeStatementError(ctx context.Context, w io.Writer, message string) {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		_, _ = fmt.Fprintf(w, "Statement cancelled; it exceeded the time allowed for statements\n")
+		return
+	case context.Canceled:
+		_, _ = fmt.Fprintf(w, "Statement cancelled\n")
+		return
+	}
+	_, _ = fmt.Fprintf(w, "%s\n", message)
 }
 
 func (r *SQLRepl) renderWelcomeBanner(w io.Writer) error {
@@ -193,7 +705,7 @@ func (r *SQLRepl) renderWelcomeBanner(w io.Writer) error {
 Welcome to the REPL for accessing dqlite databases for Juju models.
 
 Before running any commands you must first connect to a database. To connect
-to a database, type '.open' followed by the model UUID to connect to.
+to a database, type '.use' followed by the model UUID to connect to.
 
 For a list of supported commands type '.help'`)
 
@@ -212,27 +724,306 @@ func (r *SQLRepl) handleHelpCmd(s *replSession) {
 		_, _ = fmt.Fprintf(s.resWriter, "%s\t%s\n", cmdName, r.commands[cmdName].descr)
 	}
 
-	_, _ = fmt.Fprintf(s.resWriter, "\nIn addition, you can also type SQL SELECT statements\n")
+	_, _ = fmt.Fprintf(s.resWriter, "\nIn addition, you can also type SQL statements, terminated by a semicolon\n")
+}
+
+// prompt returns the prompt of the session, which includes the database the
+// session is connected to.
+func (s *replSession) prompt() string {
+	if s.dbName == "" {
+		return s.id
+	}
+	return fmt.Sprintf("%s [%s]", s.id, s.dbName)
+}
+
+// open connects the session to the named database, pinning a connection for
+// the statements of the session. Any previous connection is closed.
+func (s *replSession) open(ctx context.Context, name string, sqlDB *sql.DB) error {
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The statements of a read-only session are checked before they're run,
+	// but it's the connection that prevents them from writing.
+	if s.readOnly {
+		if _, err := conn.ExecContext(ctx, "PRAGMA query_only = 1"); err != nil {
+			_ = conn.Close()
+			return errors.Trace(err)
+		}
+	}
+
+	s.close()
+	s.dbName = name
+	s.db = sqlDB
+	s.conn = conn
+	s.backend = db.NewSQLDatabase(sqlDB, driverName)
+	return nil
+}
+
+// close releases the connection pinned to the session. Any transaction left
+// open by the session is rolled back first, so that it isn't handed back to
+// the pool.
+func (s *replSession) close() {
+	if s.conn == nil {
+		return
+	}
+	_, _ = s.conn.ExecContext(context.Background(), "ROLLBACK")
+	if s.readOnly {
+		resetQueryOnly(s.conn)
+	}
+	_ = s.conn.Close()
+	s.dbName, s.db, s.conn, s.backend = "", nil, nil, nil
 }
 
-func (r *SQLRepl) handleOpenCommand(s *replSession) {
-	var err error
+// resetQueryOnly allows writes on the connection again, before it's returned
+// to the pool. If that fails, the connection is discarded instead.
+func resetQueryOnly(conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA query_only = 0"); err == nil {
+		return
+	}
+	_ = conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
 
-	s.db, err = r.dbGetter.GetExistingDB(s.cmdParams)
+func (r *SQLRepl) handleUseCommand(s *replSession) {
+	if s.cmdParams == "" {
+		_, _ = fmt.Fprintf(s.resWriter, "Missing database; use '.use' followed by the model UUID to connect to\n")
+		return
+	}
+
+	sqlDB, err := r.dbGetter.GetExistingDB(s.cmdParams)
 	if errors.IsNotFound(err) {
-		_, _ = fmt.Fprintf(s.resWriter, "No such database exists\n")
+		_, _ = fmt.Fprintf(s.resWriter, "No such database %q exists; use '.databases' to list them\n", s.cmdParams)
+		return
+	} else if errors.IsNotValid(err) {
+		_, _ = fmt.Fprintf(s.resWriter, "Invalid database name %q\n", s.cmdParams)
 		return
 	} else if err != nil {
 		_, _ = fmt.Fprintf(s.resWriter, "Unable to acquire DB handle; check the logs for more details\n")
 		return
 	}
+	if err := s.open(r.sessionCtx, s.cmdParams, sqlDB); err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to acquire DB connection: %v\n", err)
+		return
+	}
 
 	_, _ = fmt.Fprintf(s.resWriter, "You are now connected to DB %q\n", s.cmdParams)
 }
 
-func (r *SQLRepl) handleInsert(s *replSession) {
+func (r *SQLRepl) handleDatabasesCommand(s *replSession) {
+	for _, name := range r.dbGetter.DatabaseNames() {
+		mark := " "
+		if name == s.dbName {
+			mark = "*"
+		}
+		_, _ = fmt.Fprintf(s.resWriter, "%s %s\n", mark, name)
+	}
+}
+
+func (r *SQLRepl) handleTablesCommand(s *replSession) {
+	if s.db == nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.use' followed by the model UUID to connect to\n")
+		return
+	}
+
+	tables, err := schemastate.Tables(s.backend)
+	if err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to list tables: %v\n", err)
+		return
+	}
+
+	for _, table := range tables {
+		_, _ = fmt.Fprintf(s.resWriter, "%s\n", table)
+	}
+}
+
+func (r *SQLRepl) handleSchemaCommand(s *replSession) {
+	if s.db == nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.use' followed by the model UUID to connect to\n")
+		return
+	}
+
+	statements, err := schemastate.TablesSQL(s.backend, strings.Fields(s.cmdParams)...)
+	if err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to read schema: %v\n", err)
+		return
+	}
+	if len(statements) == 0 && s.cmdParams != "" {
+		_, _ = fmt.Fprintf(s.resWriter, "No such table %q\n", s.cmdParams)
+		return
+	}
+
+	for _, statement := range statements {
+		_, _ = fmt.Fprintf(s.resWriter, "%s;\n", strings.TrimSpace(statement))
+	}
+}
+
+func (r *SQLRepl) handleModeCommand(s *replSession) {
+	switch mode := outputMode(s.cmdParams); mode {
+	case "":
+		_, _ = fmt.Fprintf(s.resWriter, "Output mode: %s\n", s.mode)
+	case modeTable, modeCSV, modeJSON:
+		s.mode = mode
+	default:
+		_, _ = fmt.Fprintf(s.resWriter, "Unknown output mode %q; use one of table, csv or json\n", s.cmdParams)
+	}
+}
+
+func (r *SQLRepl) handleHeadersCommand(s *replSession) {
+	switch s.cmdParams {
+	case "":
+		_, _ = fmt.Fprintf(s.resWriter, "Headers: %s\n", onOff(s.headers))
+	case "on":
+		s.headers = true
+	case "off":
+		s.headers = false
+	default:
+		_, _ = fmt.Fprintf(s.resWriter, "Unknown headers setting %q; use on or off\n", s.cmdParams)
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func (r *SQLRepl) handleLimitCommand(s *replSession) {
+	if s.cmdParams == "" {
+		_, _ = fmt.Fprintf(s.resWriter, "Row limit: %d\n", s.limit)
+		return
+	}
+
+	limit, err := strconv.Atoi(s.cmdParams)
+	if err != nil || limit < 0 {
+		_, _ = fmt.Fprintf(s.resWriter, "Invalid row limit %q; use a number of rows, or 0 for no limit\n", s.cmdParams)
+		return
+	}
+	s.limit = limit
+}
+
+func (r *SQLRepl) handleTimingCommand(s *replSession) {
+	switch s.cmdParams {
+	case "":
+		_, _ = fmt.Fprintf(s.resWriter, "Timing: %s\n", onOff(s.timing))
+	case "on":
+		s.timing = true
+	case "off":
+		s.timing = false
+	default:
+		_, _ = fmt.Fprintf(s.resWriter, "Unknown timing setting %q; use on or off\n", s.cmdParams)
+	}
+}
+
+// handleCancelCommand is only reached when there is no statement running,
+// as a running statement is cancelled as soon as the command is read.
+func (r *SQLRepl) handleCancelCommand(s *replSession) {
+	_, _ = fmt.Fprintf(s.resWriter, "No statement to cancel\n")
+}
+
+func (r *SQLRepl) handleExplainCommand(s *replSession) {
+	if s.db == nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.use' followed by the model UUID to connect to\n")
+		return
+	}
+
+	statement := strings.TrimSuffix(strings.TrimSpace(s.cmdParams), ";")
+	if statement == "" {
+		_, _ = fmt.Fprintf(s.resWriter, "Missing statement; use '.explain' followed by the statement to explain\n")
+		return
+	}
+
+	r.runStatement(s, func(ctx context.Context) {
+		res, err := s.conn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+statement)
+		if err != nil {
+			writeStatementError(ctx, s.resWriter, fmt.Sprintf("Unable to explain statement: %v", err))
+			return
+		}
+		defer res.Close()
+
+		var steps []planStep
+		for res.Next() {
+			var (
+				step    planStep
+				notUsed int
+			)
+			if err := res.Scan(&step.id, &step.parent, &notUsed, &step.detail); err != nil {
+				_, _ = fmt.Fprintf(s.resWriter, "Unable to read query plan: %v\n", err)
+				return
+			}
+			steps = append(steps, step)
+		}
+		if err := res.Err(); err != nil {
+			writeStatementError(ctx, s.resWriter, fmt.Sprintf("Unable to read query plan: %v", err))
+			return
+		}
+
+		renderPlan(s.resWriter, steps)
+	})
+}
+
+func (r *SQLRepl) handleVersionCommand(s *replSession) {
+	if s.db == nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.use' followed by the model UUID to connect to\n")
+		return
+	}
+
+	version, err := schemastate.CurrentVersion(s.backend)
+	if err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to read schema version: %v\n", err)
+		return
+	}
+
+	_, _ = fmt.Fprintf(s.resWriter, "Schema version: %d\n", version)
+}
+
+func (r *SQLRepl) handleDiffCommand(s *replSession) {
+	diff, err := r.schema.Diff()
+	if err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to diff schema: %v\n", err)
+		return
+	}
+
+	_, _ = fmt.Fprintf(s.resWriter, "%s\n", diff)
+}
+
+func (r *SQLRepl) handleReadCommand(s *replSession) {
+	if s.cmdParams == "" {
+		_, _ = fmt.Fprintf(s.resWriter, "Missing file; use '.read' followed by the path of the file to execute\n")
+		return
+	}
+
+	data, err := ioutil.ReadFile(s.cmdParams)
+	if err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to read file: %v\n", err)
+		return
+	}
+
+	// The last statement in a file doesn't need to be terminated.
+	statements, remainder := schemastate.SplitStatements(string(data))
+	if remainder = strings.TrimSpace(remainder); remainder != "" {
+		statements = append(statements, remainder)
+	}
+	for _, statement := range statements {
+		r.processStatement(s, statement)
+	}
+}
+
+func (r *SQLRepl) handleAbortCommand(s *replSession) {
+	if s.statement.Len() == 0 {
+		_, _ = fmt.Fprintf(s.resWriter, "No statement to abort\n")
+		return
+	}
+	s.statement.Reset()
+	_, _ = fmt.Fprintf(s.resWriter, "Statement aborted\n")
+}
+
+func (r *SQLRepl) handleExec(ctx context.Context, s *replSession) {
 	if s.db == nil {
-		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.open' followed by the model UUID to connect to\n")
+		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.use' followed by the model UUID to connect to\n")
 		return
 	}
 
@@ -244,9 +1035,9 @@ func (r *SQLRepl) handleInsert(s *replSession) {
 	// NOTE(achilleasa): passing unfiltered user input to SQL is a horrible
 	// horrible hack that should NEVER EVER see the light of day. You have
 	// been warned!
-	res, err := s.db.ExecContext(r.sessionCtx, s.cmdParams)
+	res, err := s.conn.ExecContext(ctx, s.cmdParams)
 	if err != nil {
-		_, _ = fmt.Fprintf(s.resWriter, "Unable to execute query; check the logs for more details\n")
+		writeStatementError(ctx, s.resWriter, "Unable to execute query; check the logs for more details")
 		return
 	}
 
@@ -255,9 +1046,9 @@ func (r *SQLRepl) handleInsert(s *replSession) {
 	_, _ = fmt.Fprintf(s.resWriter, "Affected Rows: %d; last insert ID: %v\n", rowsAffected, lastInsertID)
 }
 
-func (r *SQLRepl) handleSelect(s *replSession) {
+func (r *SQLRepl) handleSelect(ctx context.Context, s *replSession) {
 	if s.db == nil {
-		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.open' followed by the model UUID to connect to\n")
+		_, _ = fmt.Fprintf(s.resWriter, "Not connected to a database; use '.use' followed by the model UUID to connect to\n")
 		return
 	}
 
@@ -269,46 +1060,60 @@ func (r *SQLRepl) handleSelect(s *replSession) {
 	// NOTE(achilleasa): passing unfiltered user input to SQL is a horrible
 	// horrible hack that should NEVER EVER see the light of day. You have
 	// been warned!
-	res, err := s.db.QueryContext(r.sessionCtx, s.cmdParams)
+	res, err := s.conn.QueryContext(ctx, s.cmdParams)
 	if err != nil {
-		_, _ = fmt.Fprintf(s.resWriter, "Unable to execute query; check the logs for more details\n")
+		writeStatementError(ctx, s.resWriter, "Unable to execute query; check the logs for more details")
 		return
 	}
 
-	// Render header
+	defer res.Close()
+
 	colMeta, err := res.Columns()
 	if err != nil {
 		_, _ = fmt.Fprintf(s.resWriter, "Unable to obtain column list for query; check the logs for more details\n")
 		return
 	}
-	_, _ = fmt.Fprintf(s.resWriter, "%s\n", strings.Join(colMeta, "\t"))
+	result := resultSet{columns: colMeta}
 
-	// Render Rows
 	fieldList := make([]interface{}, len(colMeta))
 	for i := 0; i < len(fieldList); i++ {
 		var field interface{}
 		fieldList[i] = &field
 	}
 
-	var rowCount int
+	var truncated bool
 	for res.Next() {
-		rowCount++
-		res.Scan(fieldList...)
-		for i := 0; i < len(colMeta); i++ {
-			var delim = '\t'
-			if i == len(colMeta)-1 {
-				delim = '\n'
-			}
-
+		if s.limit > 0 && len(result.rows) == s.limit {
+			truncated = true
+			break
+		}
+		if err := res.Scan(fieldList...); err != nil {
+			_, _ = fmt.Fprintf(s.resWriter, "Error while iterating query result set; check the logs for more details\n")
+			return
+		}
+		row := make([]interface{}, len(colMeta))
+		for i := range row {
 			field := *(fieldList[i].(*interface{}))
-			_, _ = fmt.Fprintf(s.resWriter, "%v%c", field, delim)
+			// Text may be scanned as raw bytes, which would otherwise
+			// render as a byte slice.
+			if b, ok := field.([]byte); ok {
+				field = string(b)
+			}
+			row[i] = field
 		}
+		result.rows = append(result.rows, row)
 	}
 
 	if err := res.Err(); err != nil {
-		_, _ = fmt.Fprintf(s.resWriter, "Error while iterating query result set; check the logs for more details\n")
+		writeStatementError(ctx, s.resWriter, "Error while iterating query result set; check the logs for more details")
 		return
 	}
 
-	_, _ = fmt.Fprintf(s.resWriter, "\nTotal rows: %d\n", rowCount)
+	if err := result.render(s.resWriter, s.mode, s.headers); err != nil {
+		_, _ = fmt.Fprintf(s.resWriter, "Unable to render query result set: %v\n", err)
+		return
+	}
+	if truncated {
+		_, _ = fmt.Fprintf(s.resWriter, "Output truncated to %d rows; use '.limit' to change the limit\n", s.limit)
+	}
 }
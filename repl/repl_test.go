@@ -0,0 +1,811 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// +build cgo
+
+package repl
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/juju/clock"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testDatabases counts the databases opened by the tests, so that each one
+// has a unique name.
+var testDatabases int64
+
+// newTestDB returns a shared in-memory database, so that the connection
+// pinned to a session and the connections used for the schema queries see
+// the same database. The database is closed when the test finishes.
+func newTestDB(t *testing.T, statements ...string) *sql.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:repl-%d?mode=memory&cache=shared", atomic.AddInt64(&testDatabases, 1))
+	sqlDB, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	// The in-memory database is discarded once its last connection is
+	// closed, so one is held open for the test.
+	keeper, err := sqlDB.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = keeper.Close()
+		_ = sqlDB.Close()
+	})
+
+	for _, statement := range statements {
+		if _, err := sqlDB.Exec(statement); err != nil {
+			t.Fatalf("running %q: %v", statement, err)
+		}
+	}
+	return sqlDB
+}
+
+// fakeGetter looks up the databases by name.
+type fakeGetter map[string]*sql.DB
+
+func (g fakeGetter) GetExistingDB(name string) (*sql.DB, error) {
+	if err := db.ValidateName(name); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sqlDB, ok := g[name]
+	if !ok {
+		return nil, errors.NotFoundf("database %q", name)
+	}
+	return sqlDB, nil
+}
+
+func (g fakeGetter) DatabaseNames() []string {
+	var names []string
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newTestREPL returns a REPL over the databases, connecting sessions to the
+// "main" database. The REPL is stopped when the test finishes.
+func newTestREPL(t *testing.T, getter fakeGetter, opts ...Option) *SQLRepl {
+	t.Helper()
+
+	return newTestREPLWithClock(t, clock.WallClock, getter, opts...)
+}
+
+// newTestREPLWithClock is like newTestREPL, but the REPL uses the clock.
+func newTestREPLWithClock(t *testing.T, clock clock.Clock, getter fakeGetter, opts ...Option) *SQLRepl {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "repl.sock")
+	r, err := New(path, getter, "main", nil, clock, opts...)
+	if err != nil {
+		t.Fatalf("creating REPL: %v", err)
+	}
+	t.Cleanup(func() {
+		r.Kill()
+		_ = r.Wait()
+	})
+	return r
+}
+
+// testSession is the client side of a REPL session.
+type testSession struct {
+	t    *testing.T
+	conn net.Conn
+
+	mutex sync.Mutex
+	out   bytes.Buffer
+	// read is the length of the output already returned.
+	read int
+}
+
+// newTestSession serves a session over a pipe, returning the client side
+// once the first prompt has been written.
+func newTestSession(t *testing.T, r *SQLRepl) *testSession {
+	t.Helper()
+
+	server, client := net.Pipe()
+	if !r.startSession() {
+		t.Fatalf("too many sessions")
+	}
+	r.sessionGroup.Add(1)
+	go r.serveSession(server, nil)
+
+	s := dialTestSession(t, client)
+	s.waitForPrompt()
+	return s
+}
+
+// dialTestSession reads the output of the session over the connection, which
+// is closed when the test finishes.
+func dialTestSession(t *testing.T, conn net.Conn) *testSession {
+	s := &testSession{t: t, conn: conn}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			s.mutex.Lock()
+			s.out.Write(buf[:n])
+			s.mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { _ = conn.Close() })
+	return s
+}
+
+// send writes the input to the session, without waiting for the output.
+func (s *testSession) send(input string) {
+	s.t.Helper()
+
+	if _, err := s.conn.Write([]byte(input)); err != nil {
+		s.t.Fatalf("writing %q: %v", input, err)
+	}
+}
+
+// run sends the line to the session, returning its output once the session
+// prompts for more input. The prompt itself isn't returned.
+func (s *testSession) run(line string) string {
+	s.t.Helper()
+
+	s.send(line + "\n")
+	return s.waitForPrompt()
+}
+
+// waitForPrompt waits for the session to prompt for input, returning the
+// output written since the last prompt.
+func (s *testSession) waitForPrompt() string {
+	s.t.Helper()
+
+	return s.waitFor("prompt", func(out string) bool {
+		return strings.HasSuffix(out, "> ")
+	})
+}
+
+// waitFor waits for the output written since it was last read to satisfy the
+// condition, returning the output without the trailing prompt.
+func (s *testSession) waitFor(what string, cond func(string) bool) string {
+	s.t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mutex.Lock()
+		out := s.out.String()[s.read:]
+		if cond(out) {
+			s.read += len(out)
+			s.mutex.Unlock()
+			if i := strings.LastIndexByte(out, '\n'); i >= 0 && strings.HasSuffix(out, "> ") {
+				return out[:i]
+			} else if strings.HasSuffix(out, "> ") {
+				return ""
+			}
+			return out
+		}
+		s.mutex.Unlock()
+
+		if time.Now().After(deadline) {
+			s.t.Fatalf("timed out waiting for %s; got %q", what, out)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// output returns all the output written by the session so far.
+func (s *testSession) output() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.out.String()
+}
+
+// wantContains fails the test if the output doesn't contain every one of the
+// strings.
+func wantContains(t *testing.T, out string, want ...string) {
+	t.Helper()
+
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			t.Errorf("got output %q, want it to contain %q", out, w)
+		}
+	}
+}
+
+// count returns the number of rows in the table.
+func count(t *testing.T, sqlDB *sql.DB, table string) int {
+	t.Helper()
+
+	var n int
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatalf("counting %s: %v", table, err)
+	}
+	return n
+}
+
+func TestReadOnlySessionCannotWrite(t *testing.T) {
+	main := newTestDB(t,
+		"CREATE TABLE actions (id INTEGER PRIMARY KEY, name TEXT)",
+		"INSERT INTO actions (name) VALUES ('backup')",
+	)
+	r := newTestREPL(t, fakeGetter{"main": main}, WithReadOnly())
+	s := newTestSession(t, r)
+
+	tests := []struct {
+		name      string
+		statement string
+		want      string
+	}{{
+		name:      "delete",
+		statement: "DELETE FROM actions;",
+		want:      "Statement rejected: DELETE is not allowed",
+	}, {
+		name:      "with delete",
+		statement: "WITH a AS (SELECT 1) DELETE FROM actions;",
+		want:      "Statement rejected: WITH ... DELETE is not allowed",
+	}, {
+		// The keyword check misses statements without spaces, but the
+		// connection still refuses to write.
+		name:      "with delete without spaces",
+		statement: "WITH a AS(SELECT 1)DELETE FROM actions;",
+		want:      "check the logs for more details",
+	}, {
+		name:      "setting a pragma",
+		statement: "PRAGMA query_only = 0;",
+		want:      "Statement rejected: setting a PRAGMA is not allowed",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantContains(t, s.run(test.statement), test.want)
+			if n := count(t, main, "actions"); n != 1 {
+				t.Fatalf("got %d actions, want the read-only session not to delete any", n)
+			}
+		})
+	}
+
+	wantContains(t, s.run("SELECT name FROM actions;"), "backup")
+	wantContains(t, s.run("PRAGMA table_info(actions);"), "name")
+}
+
+func TestReadOnlySessionReleasesWritableConnection(t *testing.T) {
+	main := newTestDB(t, "CREATE TABLE actions (id INTEGER PRIMARY KEY, name TEXT)")
+	// One connection is held open by the test, so the connection used by the
+	// read-only session is the one handed out afterwards.
+	main.SetMaxOpenConns(2)
+	r := newTestREPL(t, fakeGetter{"main": main}, WithReadOnly())
+
+	s := newTestSession(t, r)
+	wantContains(t, s.run("SELECT COUNT(*) FROM actions;"), "0")
+	_ = s.conn.Close()
+	waitForSessions(t, r, 0)
+
+	if _, err := main.Exec("INSERT INTO actions (name) VALUES ('backup')"); err != nil {
+		t.Fatalf("writing once the read-only session has ended: %v", err)
+	}
+}
+
+// waitForSessions waits until the REPL has the number of open sessions.
+func waitForSessions(t *testing.T, r *SQLRepl, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Sessions() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d sessions, want %d", r.Sessions(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeDiffer returns the diff.
+type fakeDiffer struct {
+	diff schemastate.SchemaDiff
+}
+
+func (d fakeDiffer) Diff() (schemastate.SchemaDiff, error) {
+	return d.diff, nil
+}
+
+// dial connects to the listener of the REPL, returning the client side of
+// the session without waiting for anything to be written.
+func dial(t *testing.T, l net.Listener) *testSession {
+	t.Helper()
+
+	conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing REPL: %v", err)
+	}
+	return dialTestSession(t, conn)
+}
+
+// newActionsDB returns a database with an actions table, holding an action
+// for each of the names.
+func newActionsDB(t *testing.T, names ...string) *sql.DB {
+	t.Helper()
+
+	statements := []string{
+		"CREATE TABLE actions (id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE INDEX idx_actions_name ON actions (name)",
+	}
+	for _, name := range names {
+		statements = append(statements, fmt.Sprintf("INSERT INTO actions (name) VALUES ('%s')", name))
+	}
+	return newTestDB(t, statements...)
+}
+
+// infiniteQuery is a query that only completes once it's cancelled.
+const infiniteQuery = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT COUNT(*) FROM c;"
+
+func TestCommands(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.sql")
+	err := ioutil.WriteFile(script, []byte("INSERT INTO actions (name) VALUES ('upgrade');\nSELECT name FROM actions ORDER BY id"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestREPL(t, fakeGetter{"main": newActionsDB(t, "backup")})
+	r.schema = fakeDiffer{diff: schemastate.SchemaDiff{OnlyLive: []string{"table extra"}}}
+	s := newTestSession(t, r)
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{".help", []string{".use\tswitch to a database", "terminated by a semicolon"}},
+		{".unknown", []string{`Unknown command ".unknown"`}},
+		{".tables", []string{"actions"}},
+		{".schema", []string{"CREATE TABLE actions", "CREATE INDEX idx_actions_name"}},
+		{".schema actions", []string{"CREATE TABLE actions", "CREATE INDEX idx_actions_name"}},
+		{".schema missing", []string{`No such table "missing"`}},
+		{".mode", []string{"Output mode: table"}},
+		{".mode xml", []string{`Unknown output mode "xml"`}},
+		{".headers", []string{"Headers: on"}},
+		{".headers maybe", []string{`Unknown headers setting "maybe"`}},
+		{".limit", []string{"Row limit: 1000"}},
+		{".limit -1", []string{`Invalid row limit "-1"`}},
+		{".timing", []string{"Timing: off"}},
+		{".timing maybe", []string{`Unknown timing setting "maybe"`}},
+		{".version", []string{"Schema version: 0"}},
+		{".explain SELECT * FROM actions WHERE name = 'backup'", []string{"QUERY PLAN", "idx_actions_name"}},
+		{".explain", []string{"Missing statement"}},
+		{".abort", []string{"No statement to abort"}},
+		{".cancel", []string{"No statement to cancel"}},
+		{".diff", []string{"only in live: table extra"}},
+		{"INSERT INTO actions (name) VALUES ('restore');", []string{"Affected Rows: 1"}},
+		{"SELECT name FROM actions ORDER BY id;", []string{"backup", "restore", "Total rows: 2"}},
+		{".read", []string{"Missing file"}},
+		{".read " + script, []string{"Affected Rows: 1", "backup", "restore", "upgrade"}},
+		{".read missing.sql", []string{"Unable to read file"}},
+		{".use", []string{"Missing database"}},
+		{"DROP TABLE actions;", []string{"Bobby Drop Tables"}},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			wantContains(t, s.run(test.command), test.want...)
+		})
+	}
+}
+
+func TestCommandsWithoutDatabase(t *testing.T) {
+	r := newTestREPL(t, fakeGetter{})
+	s := newTestSession(t, r)
+
+	for _, command := range []string{".tables", ".schema", ".version", ".explain SELECT 1", "SELECT 1;", "INSERT INTO actions (name) VALUES ('backup');"} {
+		t.Run(command, func(t *testing.T) {
+			wantContains(t, s.run(command), "Not connected to a database")
+		})
+	}
+}
+
+func TestOutputModes(t *testing.T) {
+	r := newTestREPL(t, fakeGetter{"main": newTestDB(t)})
+	s := newTestSession(t, r)
+	const query = "SELECT 1 AS id, NULL AS missing, 'a, b' AS list, '' AS empty;"
+
+	tests := []struct {
+		commands []string
+		want     string
+	}{{
+		commands: []string{".mode table", ".headers on"},
+		want:     "id  missing  list  empty\n1   NULL     a, b  \n\nTotal rows: 1",
+	}, {
+		commands: []string{".mode csv"},
+		want:     "id,missing,list,empty\r\n1,,\"a, b\",\"\"",
+	}, {
+		commands: []string{".headers off"},
+		want:     "1,,\"a, b\",\"\"",
+	}, {
+		commands: []string{".mode json"},
+		want:     "[\n    {\n        \"empty\": \"\",\n        \"id\": 1,\n        \"list\": \"a, b\",\n        \"missing\": null\n    }\n]",
+	}}
+	for _, test := range tests {
+		t.Run(strings.Join(test.commands, " "), func(t *testing.T) {
+			for _, command := range test.commands {
+				if out := s.run(command); strings.TrimSpace(out) != "" {
+					t.Fatalf("got output %q for %q, want none", out, command)
+				}
+			}
+			if got := strings.TrimSpace(s.run(query)); got != test.want {
+				t.Fatalf("got\n%q\nwant\n%q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMultiLineStatements(t *testing.T) {
+	r := newTestREPL(t, fakeGetter{"main": newActionsDB(t, "backup")})
+	s := newTestSession(t, r)
+
+	// The statement is buffered until it's terminated, with a continuation
+	// prompt for each line.
+	s.send("SELECT name\n")
+	s.waitFor("continuation prompt", func(out string) bool {
+		return strings.HasSuffix(out, ".> ")
+	})
+	if out := s.run("FROM actions"); strings.Contains(out, "backup") {
+		t.Fatalf("got output %q before the statement was terminated", out)
+	}
+	wantContains(t, s.run(";"), "backup", "Total rows: 1")
+
+	// Commands aren't recognised within a statement, except for '.abort'.
+	s.run("SELECT")
+	wantContains(t, s.run(".abort"), "Statement aborted")
+	wantContains(t, s.run("SELECT 'after' AS x;"), "after")
+
+	// Many statements can be entered on a line.
+	wantContains(t, s.run("SELECT 'first' AS x; SELECT 'second' AS x;"), "first", "second")
+
+	// A line can be split across many writes.
+	s.send("SELECT 'sp")
+	wantContains(t, s.run("lit' AS x;"), "split")
+
+	// A semicolon within a literal doesn't terminate the statement.
+	s.run("SELECT 'a;")
+	wantContains(t, s.run("b' AS x;"), "a;\nb")
+}
+
+func TestTransactionsAndTruncation(t *testing.T) {
+	main := newActionsDB(t, "backup")
+	r := newTestREPL(t, fakeGetter{"main": main})
+	s := newTestSession(t, r)
+	s.run(".mode csv")
+	s.run(".headers off")
+
+	countActions := func() string {
+		return strings.TrimSpace(s.run("SELECT COUNT(*) FROM actions;"))
+	}
+
+	// The connection is pinned to the session, so the transaction spans the
+	// statements.
+	s.run("BEGIN;")
+	wantContains(t, s.run("INSERT INTO actions (name) VALUES ('restore');"), "Affected Rows: 1")
+	if got := countActions(); got != "2" {
+		t.Fatalf("got %s actions within the transaction, want 2", got)
+	}
+	s.run("ROLLBACK;")
+	if got := countActions(); got != "1" {
+		t.Fatalf("got %s actions after rolling back, want 1", got)
+	}
+	if n := count(t, main, "actions"); n != 1 {
+		t.Fatalf("got %d actions after rolling back, want 1", n)
+	}
+
+	s.run("BEGIN;")
+	s.run("INSERT INTO actions (name) VALUES ('restore');")
+	s.run("INSERT INTO actions (name) VALUES ('upgrade');")
+	s.run("COMMIT;")
+	if n := count(t, main, "actions"); n != 3 {
+		t.Fatalf("got %d actions after committing, want 3", n)
+	}
+
+	s.run(".limit 2")
+	out := s.run("SELECT name FROM actions ORDER BY id;")
+	wantContains(t, out, "backup", "restore", "Output truncated to 2 rows")
+	if strings.Contains(out, "upgrade") {
+		t.Errorf("got output %q, want it truncated", out)
+	}
+	s.run(".limit 0")
+	out = s.run("SELECT name FROM actions ORDER BY id;")
+	wantContains(t, out, "upgrade")
+	if strings.Contains(out, "truncated") {
+		t.Errorf("got output %q, want it untruncated", out)
+	}
+
+	// A transaction left open by the session is rolled back once it ends.
+	s.run("BEGIN;")
+	s.run("DELETE FROM actions;")
+	_ = s.conn.Close()
+	waitForSessions(t, r, 0)
+	if n := count(t, main, "actions"); n != 3 {
+		t.Fatalf("got %d actions after the session ended, want 3", n)
+	}
+}
+
+func TestKillEndsOpenSessions(t *testing.T) {
+	main := newActionsDB(t, "backup")
+	r := newTestREPL(t, fakeGetter{"main": main})
+	s := newTestSession(t, r)
+
+	// The client stays connected with a transaction open.
+	s.run("BEGIN;")
+	wantContains(t, s.run("DELETE FROM actions;"), "Affected Rows: 1")
+
+	r.Kill()
+	waited := make(chan error, 1)
+	go func() {
+		waited <- r.Wait()
+	}()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("waiting: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the sessions to end")
+	}
+
+	s.waitFor("shutdown notice", func(out string) bool {
+		return strings.Contains(out, "REPL system is shutting down")
+	})
+	if n := count(t, main, "actions"); n != 1 {
+		t.Fatalf("got %d actions once the REPL was killed, want the transaction rolled back", n)
+	}
+}
+
+func TestUseAcrossDatabases(t *testing.T) {
+	main := newActionsDB(t, "backup")
+	other := newTestDB(t,
+		"CREATE TABLE things (id INTEGER PRIMARY KEY, name TEXT)",
+		"INSERT INTO things (name) VALUES ('widget')",
+	)
+	r := newTestREPL(t, fakeGetter{"main": main, "other": other})
+	s := newTestSession(t, r)
+
+	wantContains(t, s.output(), "[main]> ")
+	wantContains(t, s.run(".databases"), "* main", "  other")
+
+	// Switching databases rolls back the transaction left open on the
+	// previous one.
+	s.run("BEGIN;")
+	s.run("DELETE FROM actions;")
+	wantContains(t, s.run(".use other"), `You are now connected to DB "other"`)
+	if !strings.HasSuffix(s.output(), "[other]> ") {
+		t.Fatalf("got output %q, want the prompt to name the database", s.output())
+	}
+	if n := count(t, main, "actions"); n != 1 {
+		t.Fatalf("got %d actions, want the transaction rolled back", n)
+	}
+
+	out := s.run(".tables")
+	wantContains(t, out, "things")
+	if strings.Contains(out, "actions") {
+		t.Errorf("got tables %q, want only those of the other database", out)
+	}
+	wantContains(t, s.run("SELECT name FROM things;"), "widget")
+	wantContains(t, s.run(".databases"), "  main", "* other")
+
+	// Failing to switch leaves the session connected.
+	wantContains(t, s.run(".use missing"), `No such database "missing"`)
+	wantContains(t, s.run(".use .."), `Invalid database name ".."`)
+	wantContains(t, s.run("SELECT name FROM things;"), "widget")
+
+	wantContains(t, s.run(".open main"), `You are now connected to DB "main"`)
+	wantContains(t, s.run("SELECT name FROM actions;"), "backup")
+}
+
+func TestTiming(t *testing.T) {
+	r := newTestREPL(t, fakeGetter{"main": newTestDB(t)})
+	s := newTestSession(t, r)
+
+	s.run(".timing on")
+	wantContains(t, s.run("SELECT 1 AS x;"), "Run time: ")
+	s.run(".timing off")
+	if out := s.run("SELECT 1 AS x;"); strings.Contains(out, "Run time") {
+		t.Fatalf("got output %q, want no timing", out)
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	r := newTestREPL(t, fakeGetter{"main": newTestDB(t)}, WithStatementTimeout(50*time.Millisecond))
+	s := newTestSession(t, r)
+
+	wantContains(t, s.run(infiniteQuery), "it exceeded the time allowed for statements")
+	wantContains(t, s.run("SELECT 'still here' AS x;"), "still here")
+}
+
+// recordingLogger records the warnings logged.
+type recordingLogger struct {
+	noopLogger
+
+	mutex    sync.Mutex
+	warnings []string
+}
+
+func (l *recordingLogger) Warningf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func TestSlowStatementLog(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTestREPL(t, fakeGetter{"main": newTestDB(t)}, WithSlowStatementLog(logger, time.Nanosecond))
+	s := newTestSession(t, r)
+
+	s.run("SELECT 'slow' AS x;")
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if len(logger.warnings) != 1 {
+		t.Fatalf("got warnings %q, want the slow statement logged", logger.warnings)
+	}
+	wantContains(t, logger.warnings[0], "slow REPL statement", "SELECT 'slow' AS x")
+}
+
+func TestCancelStatement(t *testing.T) {
+	for _, interrupt := range interruptSequences {
+		t.Run(fmt.Sprintf("%q", interrupt), func(t *testing.T) {
+			r := newTestREPL(t, fakeGetter{"main": newTestDB(t)})
+			s := newTestSession(t, r)
+
+			s.send(infiniteQuery + "\n")
+			// An interrupt read before the statement starts is ignored, so
+			// keep interrupting until the statement is cancelled.
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+					if _, err := s.conn.Write([]byte(interrupt)); err != nil {
+						return
+					}
+				}
+			}()
+			out := s.waitForPrompt()
+			close(stop)
+			<-stopped
+
+			wantContains(t, out, "Statement cancelled")
+			wantContains(t, s.run("SELECT 'still here' AS x;"), "still here")
+		})
+	}
+}
+
+func TestTCPTokens(t *testing.T) {
+	main := newActionsDB(t, "backup")
+	r := newTestREPL(t, fakeGetter{"main": main}, WithTCP("127.0.0.1:0", "secret"), WithReadOnlyToken("viewer"))
+	listener := r.connListeners[1]
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"invalid token", "wrong\n", "Invalid token; disconnecting"},
+		{"token too long", strings.Repeat("x", 64), "Invalid token; disconnecting"},
+		{"token", "secret\nINSERT INTO actions (name) VALUES ('restore');\n", "Affected Rows: 1"},
+		{"read-only token", "viewer\nDELETE FROM actions;\n", "Statement rejected: DELETE is not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := dial(t, listener)
+			s.send(test.input)
+			s.waitFor(test.want, func(out string) bool {
+				return strings.Contains(out, test.want)
+			})
+		})
+	}
+	if n := count(t, main, "actions"); n != 2 {
+		t.Fatalf("got %d actions, want only the token session to write", n)
+	}
+}
+
+func TestTCPRequiresToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repl.sock")
+	_, err := New(path, fakeGetter{}, "main", nil, clock.WallClock, WithTCP("127.0.0.1:0", ""))
+	if !errors.IsNotValid(err) {
+		t.Fatalf("got error %v, want not valid", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// The clock is behind the wall clock, so every read times out at once
+	// and the idle time is checked as soon as the clock is advanced.
+	clk := testclock.NewClock(time.Now().Add(-time.Hour))
+	r := newTestREPLWithClock(t, clk, fakeGetter{"main": newTestDB(t)}, WithIdleTimeout(time.Minute))
+	s := newTestSession(t, r)
+
+	clk.Advance(30 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if r.Sessions() != 1 {
+		t.Fatalf("session disconnected before the idle timeout")
+	}
+
+	clk.Advance(30 * time.Second)
+	s.waitFor("idle disconnect", func(out string) bool {
+		return strings.Contains(out, "Session idle for 1m0s; disconnecting")
+	})
+	waitForSessions(t, r, 0)
+}
+
+func TestMaxSessions(t *testing.T) {
+	r := newTestREPL(t, fakeGetter{"main": newTestDB(t)}, WithMaxSessions(1))
+	listener := r.connListeners[0]
+
+	first := dial(t, listener)
+	first.waitForPrompt()
+
+	rejected := dial(t, listener)
+	rejected.waitFor("rejection", func(out string) bool {
+		return strings.Contains(out, "there are already 1 REPL sessions open")
+	})
+
+	// The session is available again once the first one ends.
+	_ = first.conn.Close()
+	waitForSessions(t, r, 0)
+	dial(t, listener).waitForPrompt()
+}
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		name   string
+		getter func(t *testing.T) fakeGetter
+		tables map[string][]string
+	}{{
+		name: "connected",
+		getter: func(t *testing.T) fakeGetter {
+			return fakeGetter{"main": newActionsDB(t)}
+		},
+		tables: map[string][]string{"actions": {"id", "name"}},
+	}, {
+		name: "not connected",
+		getter: func(t *testing.T) fakeGetter {
+			return fakeGetter{}
+		},
+		tables: map[string][]string{},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestREPL(t, test.getter(t))
+			s := newTestSession(t, r)
+
+			var completions Completions
+			out := strings.TrimSpace(s.run(".complete"))
+			if err := json.Unmarshal([]byte(out), &completions); err != nil {
+				t.Fatalf("decoding completions %q: %v", out, err)
+			}
+			if len(completions.Commands) != len(r.commands) || !sort.StringsAreSorted(completions.Commands) {
+				t.Errorf("got commands %v, want every command sorted", completions.Commands)
+			}
+			if !reflect.DeepEqual(completions.Tables, test.tables) {
+				t.Errorf("got tables %v, want %v", completions.Tables, test.tables)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// +build linux
+
+package repl
+
+import (
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// makeRaw puts the terminal into raw mode, so that every key press is read as
+// it's typed and nothing is echoed. Output processing is left on, so that
+// line feeds still return the carriage. The returned function restores the
+// terminal.
+func makeRaw(fd int) (func(), error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	original := *termios
+	termios.Iflag &^= unix.ICRNL | unix.IXON
+	termios.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, &original)
+	}, nil
+}
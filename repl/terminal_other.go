@@ -0,0 +1,14 @@
+// Copyright 2021 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// +build !linux
+
+package repl
+
+import "github.com/juju/errors"
+
+// makeRaw isn't supported, so input is read a line at a time without any
+// editing.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.NotSupportedf("line editing")
+}
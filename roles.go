@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/server"
+	"github.com/SimonRichardson/nu-juju-data/state/rolestate"
+	"github.com/canonical/go-dqlite/app"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/juju/errors"
+)
+
+// nodeProbeTimeout is the time a node is given to answer, before it's
+// considered offline.
+const nodeProbeTimeout = 2 * time.Second
+
+// probeNodes returns whether each of the nodes could be reached. The nodes
+// are probed concurrently.
+func probeNodes(ctx context.Context, nodes []client.NodeInfo) []bool {
+	online := make([]bool, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, nodeProbeTimeout)
+			defer cancel()
+			cli, err := client.New(probeCtx, address)
+			if err != nil {
+				return
+			}
+			_ = cli.Close()
+			online[i] = true
+		}(i, node.Address)
+	}
+	wg.Wait()
+	return online
+}
+
+// parseRole returns the dqlite role with the name.
+func parseRole(name string) (client.NodeRole, error) {
+	switch rolestate.Role(name) {
+	case rolestate.Voter:
+		return client.Voter, nil
+	case rolestate.StandBy:
+		return client.StandBy, nil
+	case rolestate.Spare:
+		return client.Spare, nil
+	}
+	return 0, errors.NotValidf("role %q, expected %s, %s or %s", name, rolestate.Voter, rolestate.StandBy, rolestate.Spare)
+}
+
+// dqliteRoles implements rolestate.Cluster over the dqlite app.
+type dqliteRoles struct {
+	app *app.App
+}
+
+// Nodes implements rolestate.Cluster.
+func (r dqliteRoles) Nodes(ctx context.Context) ([]rolestate.Node, error) {
+	cli, err := r.app.Leader(ctx)
+	if err != nil {
+		return nil, errors.Annotate(err, "cluster leader unreachable")
+	}
+	defer cli.Close()
+
+	nodes, err := cli.Cluster(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	online := probeNodes(ctx, nodes)
+
+	result := make([]rolestate.Node, len(nodes))
+	for i, node := range nodes {
+		result[i] = rolestate.Node{
+			ID:      node.ID,
+			Address: node.Address,
+			Role:    rolestate.Role(node.Role.String()),
+			Online:  online[i],
+		}
+	}
+	return result, nil
+}
+
+// Assign implements rolestate.Cluster.
+func (r dqliteRoles) Assign(ctx context.Context, id uint64, role rolestate.Role) error {
+	nodeRole, err := parseRole(string(role))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cli, err := r.app.Leader(ctx)
+	if err != nil {
+		return errors.Annotate(err, "cluster leader unreachable")
+	}
+	defer cli.Close()
+
+	return errors.Trace(cli.Assign(ctx, id, nodeRole))
+}
+
+// assignRole assigns the role to the local node, unless it already has it.
+func assignRole(ctx context.Context, dqlite *app.App, role client.NodeRole) error {
+	cli, err := dqlite.Leader(ctx)
+	if err != nil {
+		return errors.Annotate(err, "cluster leader unreachable")
+	}
+	defer cli.Close()
+
+	nodes, err := cli.Cluster(ctx)
+	if err != nil {
+		return errors.Annotate(err, "listing cluster nodes")
+	}
+	for _, node := range nodes {
+		if node.ID != dqlite.ID() {
+			continue
+		}
+		if node.Role == role {
+			return nil
+		}
+		return errors.Annotatef(cli.Assign(ctx, node.ID, role), "assigning role %s", role)
+	}
+	return errors.NotFoundf("node %d in the cluster", dqlite.ID())
+}
+
+// roleReporter implements server.ClusterRoleReporter over the role manager.
+type roleReporter struct {
+	manager *rolestate.RoleManager
+}
+
+// Roles implements server.ClusterRoleReporter.
+func (r roleReporter) Roles() server.ClusterRoles {
+	status := r.manager.Status()
+	roles := server.ClusterRoles{
+		Voters: status.Voters,
+	}
+	if !status.Checked.IsZero() {
+		checked := status.Checked
+		roles.Checked = &checked
+	}
+	for _, change := range status.Changes {
+		roles.Changes = append(roles.Changes, server.ClusterRoleChange{
+			ID:      change.Node.ID,
+			Address: change.Node.Address,
+			From:    string(change.Node.Role),
+			To:      string(change.Role),
+			Time:    change.Time,
+		})
+	}
+	return roles
+}
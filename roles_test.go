@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/server"
+	"github.com/SimonRichardson/nu-juju-data/state/rolestate"
+	"github.com/canonical/go-dqlite/client"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// staticCluster is a cluster whose nodes take the roles assigned to them.
+type staticCluster struct {
+	nodes []rolestate.Node
+}
+
+func (c *staticCluster) Nodes(context.Context) ([]rolestate.Node, error) {
+	return append([]rolestate.Node(nil), c.nodes...), nil
+}
+
+func (c *staticCluster) Assign(_ context.Context, id uint64, role rolestate.Role) error {
+	for i := range c.nodes {
+		if c.nodes[i].ID == id {
+			c.nodes[i].Role = role
+			return nil
+		}
+	}
+	return errors.NotFoundf("node %d", id)
+}
+
+func TestParseRole(t *testing.T) {
+	tests := []struct {
+		name string
+		role client.NodeRole
+	}{
+		{"voter", client.Voter},
+		{"stand-by", client.StandBy},
+		{"spare", client.Spare},
+	}
+	for _, test := range tests {
+		role, err := parseRole(test.name)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.name, err)
+		}
+		if role != test.role {
+			t.Errorf("got role %v for %q, want %v", role, test.name, test.role)
+		}
+	}
+
+	for _, name := range []string{"", "leader", "Voter"} {
+		if _, err := parseRole(name); !errors.IsNotValid(err) {
+			t.Errorf("got error %v parsing %q, want not valid", err, name)
+		}
+	}
+}
+
+func TestRoleReporter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cluster := &staticCluster{
+		nodes: []rolestate.Node{
+			{ID: 1, Address: "10.0.0.1:9000", Role: rolestate.Voter},
+			{ID: 2, Address: "10.0.0.2:9000", Role: rolestate.Voter, Online: true},
+			{ID: 3, Address: "10.0.0.3:9000", Role: rolestate.Voter, Online: true},
+			{ID: 4, Address: "10.0.0.4:9000", Role: rolestate.StandBy, Online: true},
+		},
+	}
+	manager := rolestate.NewManager(cluster, 3, rolestate.WithClock(testclock.NewClock(now)))
+	reporter := roleReporter{manager: manager}
+
+	// The roles haven't been checked yet.
+	roles := reporter.Roles()
+	if roles.Voters != 3 || roles.Checked != nil || len(roles.Changes) != 0 {
+		t.Fatalf("got roles %+v before checking, want only the voters", roles)
+	}
+
+	if err := manager.Adjust(context.Background()); err != nil {
+		t.Fatalf("adjusting roles: %v", err)
+	}
+	roles = reporter.Roles()
+	if roles.Checked == nil || !roles.Checked.Equal(now) {
+		t.Errorf("got checked %v, want %v", roles.Checked, now)
+	}
+
+	want := server.ClusterRoleChange{ID: 4, Address: "10.0.0.4:9000", From: "stand-by", To: "voter", Time: now}
+	if len(roles.Changes) != 1 || roles.Changes[0] != want {
+		t.Fatalf("got changes %+v, want %+v", roles.Changes, want)
+	}
+}
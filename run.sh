@@ -33,12 +33,16 @@ function header {
 #
 header "Setup cluster..."
 
-nu-juju-data --api 127.0.0.1:8666 --db 127.0.0.1:9666 --dir example0 &
+nu-juju-data init --api 127.0.0.1:8666 --db 127.0.0.1:9666 --dir example0
+nu-juju-data serve --dir example0 &
 PID0=$!
 if [ -n "$ENABLE_HA" ]; then
-    nu-juju-data --api 127.0.0.1:8667 --db 127.0.0.1:9667 --join 127.0.0.1:9666 --dir example1 &
+    sleep 3
+    nu-juju-data join --api 127.0.0.1:8667 --db 127.0.0.1:9667 --join 127.0.0.1:9666 --dir example1
+    nu-juju-data serve --dir example1 &
     PID1=$!
-    nu-juju-data --api 127.0.0.1:8668 --db 127.0.0.1:9668 --join 127.0.0.1:9666 --dir example2 &
+    nu-juju-data join --api 127.0.0.1:8668 --db 127.0.0.1:9668 --join 127.0.0.1:9666 --dir example2
+    nu-juju-data serve --dir example2 &
     PID2=$!
 fi
 
@@ -65,12 +69,22 @@ echo ""
 echo "Create new Action using POST..."
 curl -X POST http://127.0.0.1:8666/actions/ \
    -H 'Content-Type: application/json' \
-   -d '{"receiver":"machine-0","name":"test", "parameters":{"a": 1}, "operation": "machine-0"}'
+   -d '{"receiver":"machine-0","name":"test", "parameters":{"a": 1}}'
 
 echo ""
 echo "Get Action by ID using GET..."
 curl http://127.0.0.1:8666/actions/1
 
+echo ""
+echo "Create new Operation with its Actions using POST..."
+curl -X POST http://127.0.0.1:8666/operations/ \
+   -H 'Content-Type: application/json' \
+   -d '{"receivers":["machine-0","machine-1"],"name":"test", "parameters":{"a": 1}}'
+
+echo ""
+echo "Get the Actions of the Operation using GET..."
+curl http://127.0.0.1:8666/operations/1/actions
+
 # Show the repl if requested.
 if [ -n "$REPL" ]; then 
     rlwrap -H ~/.dqlite_repl.history socat - ./example0/juju.sock
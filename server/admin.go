@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+)
+
+// handleDump streams a SQL text dump of the database. The dump is written as
+// it's read, so the whole dump is never held in memory. The schema-only query
+// parameter skips the table rows.
+func (s *Server) handleDump(w http.ResponseWriter, r *http.Request, _ params) {
+	var opts schemastate.DumpOptions
+	if value := r.URL.Query().Get("schema-only"); value != "" {
+		schemaOnly, err := strconv.ParseBool(value)
+		if err != nil {
+			badRequest(w, "schema-only", "invalid schema-only %q", value)
+			return
+		}
+		opts.SkipData = schemaOnly
+	}
+
+	// The dump outlives the request timeout, but is still cancelled when the
+	// client goes away.
+	ctx := withoutRequestTimeout(r)
+	backend := contextBackend{Backend: s.state.Backend(), ctx: ctx}
+	out := &dumpWriter{w: w}
+	if err := schemastate.DumpTo(out, backend, s.state.SchemaManager().Schema(), opts); err != nil {
+		if !out.written {
+			s.handleError(w, r, err)
+			return
+		}
+		// The status has already been written, so the response is aborted,
+		// rather than leaving the client with what looks like a complete
+		// dump.
+		s.logger.Errorf("dumping database: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// dumpWriter writes the headers of the dump along with the first of its
+// output, so that the dump failing before then can still be reported as an
+// error response.
+type dumpWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (d *dumpWriter) Write(p []byte) (int, error) {
+	if !d.written {
+		d.written = true
+		d.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		d.w.Header().Set("Content-Disposition", `attachment; filename="dump.sql"`)
+	}
+	return d.w.Write(p)
+}
+
+// contextBackend runs the transactions of the schema package as read-only
+// transactions bound to the context, so that they're cancelled with the
+// request.
+type contextBackend struct {
+	state.Backend
+	ctx context.Context
+}
+
+func (b contextBackend) Run(fn func(context.Context, *sqlx.Tx) error) error {
+	return b.Backend.RunReadOnly(b.ctx, fn)
+}
+
+// SchemaManager reports on the schema applied to the database.
+type SchemaManager interface {
+	// Status compares the patches recorded in the database against the
+	// patches of the schema.
+	Status() (schemastate.Status, error)
+
+	// History returns the patches that have been applied to the database.
+	History() ([]schemastate.HistoryEntry, error)
+
+	// Diff compares the live database schema against the expected schema.
+	Diff() (schemastate.SchemaDiff, error)
+}
+
+// handleSchema reports the applied schema version and patches, along with any
+// drift from the expected schema. The schema is unavailable if it's not up to
+// date or has drifted.
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request, _ params) {
+	status, err := s.schemaMgr.Status()
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	history, err := s.schemaMgr.History()
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output := SchemaStatus{
+		Version:         status.Current,
+		ExpectedVersion: status.Expected,
+		UpToDate:        status.UpToDate(),
+		Patches:         make([]SchemaPatch, len(history)),
+		Unknown:         status.Unknown,
+		Drift:           schemaDrift(s.schemaMgr.Diff()),
+	}
+	for i, entry := range history {
+		output.Patches[i] = SchemaPatch{
+			Version: entry.Version,
+			Name:    entry.Name,
+		}
+		if !entry.UpdatedAt.IsZero() {
+			appliedAt := entry.UpdatedAt
+			output.Patches[i].AppliedAt = &appliedAt
+		}
+	}
+	for _, patch := range status.Missing {
+		output.Missing = append(output.Missing, SchemaPatch{
+			Version: patch.Version,
+			Name:    patch.Name,
+		})
+	}
+
+	code := http.StatusOK
+	if !output.UpToDate || output.Drift.Status == driftFound {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, output)
+}
+
+func schemaDrift(diff schemastate.SchemaDiff, err error) SchemaDrift {
+	if err != nil {
+		return SchemaDrift{
+			Status: driftUnknown,
+			Error:  err.Error(),
+		}
+	}
+	if diff.Empty() {
+		return SchemaDrift{Status: driftNone}
+	}
+
+	drift := SchemaDrift{
+		Status:       driftFound,
+		OnlyLive:     diff.OnlyLive,
+		OnlyExpected: diff.OnlyExpected,
+	}
+	for _, changed := range diff.Changed {
+		drift.Changed = append(drift.Changed, SchemaObjectChange{
+			Name:     changed.Name,
+			Live:     changed.Live,
+			Expected: changed.Expected,
+		})
+	}
+	return drift
+}
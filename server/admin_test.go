@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+)
+
+// doWithToken serves the request with the bearer token, if there is one.
+func doWithToken(t *testing.T, s *Server, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresAdminToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens map[string]Role
+		token  string
+		path   string
+		status int
+	}{
+		{"no tokens", nil, "", "/v1/admin/dump", http.StatusForbidden},
+		{"no tokens unversioned", nil, "", "/admin/dump", http.StatusForbidden},
+		{"no tokens extra slashes", nil, "", "/v1//admin/dump", http.StatusForbidden},
+		{"no tokens schema", nil, "", "/v1/admin/schema", http.StatusForbidden},
+		{"missing token", map[string]Role{"root": RoleAdmin}, "", "/v1/admin/dump", http.StatusUnauthorized},
+		{"read-write token", map[string]Role{"rw": RoleReadWrite}, "rw", "/v1/admin/dump", http.StatusForbidden},
+		{"read-write token extra slashes", map[string]Role{"rw": RoleReadWrite}, "rw", "//admin/dump", http.StatusForbidden},
+		{"admin token", map[string]Role{"root": RoleAdmin}, "root", "/v1/admin/dump", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetTokens(test.tokens)
+
+			rec := doWithToken(t, s, "GET", test.path, test.token)
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d, body %q", rec.Code, test.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminDumpRoundTrips(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"root": RoleAdmin})
+	added := addActionWithToken(t, s, "root")
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/dump", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	restored, err := db.NewInMemorySQLDatabase()
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	defer restored.Close()
+	if err := schemastate.Restore(strings.NewReader(rec.Body.String()), restored); err != nil {
+		t.Fatalf("loading dump: %v", err)
+	}
+
+	var tags []string
+	err = restored.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &tags, "SELECT tag FROM actions")
+	})
+	if err != nil {
+		t.Fatalf("reading restored actions: %v", err)
+	}
+	if len(tags) != 1 || tags[0] != added {
+		t.Fatalf("got restored actions %v, want %q", tags, added)
+	}
+}
+
+func TestAdminDumpFailingBeforeOutput(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"root": RoleAdmin})
+
+	// The client has gone away before anything was dumped, so the dump
+	// fails with an error response, rather than aborting the response.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/v1/admin/dump", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer root")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusOK {
+		t.Fatalf("got status %d, body %q, want an error", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code == "" {
+		t.Fatalf("got error %+v, want it coded", resp.Error)
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != "" {
+		t.Fatalf("got the dump headers %q on an error response", disposition)
+	}
+}
+
+// addActionWithToken adds an action with the bearer token, returning its tag.
+func addActionWithToken(t *testing.T, s *Server, token string) string {
+	t.Helper()
+
+	rec := postAction(t, s, "Bearer "+token)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("adding action: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputAction
+	decode(t, rec, &output)
+	return output.Tag
+}
+
+func TestAdminSchemaWithoutDrift(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"root": RoleAdmin})
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/schema", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var status SchemaStatus
+	decode(t, rec, &status)
+	if !status.UpToDate || status.Drift.Status != driftNone {
+		t.Fatalf("got schema status %+v, want up to date without drift", status)
+	}
+}
+
+func TestAdminDump(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	s.SetTokens(map[string]Role{"root": RoleAdmin})
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/dump", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, "dump.sql") {
+		t.Errorf("got Content-Disposition %q, want a dump.sql attachment", got)
+	}
+	dump := rec.Body.String()
+	if !strings.Contains(dump, "CREATE TABLE actions") || !strings.Contains(dump, added.Tag) {
+		t.Fatalf("got dump %q, want the actions table and %q", dump, added.Tag)
+	}
+
+	rec = doWithToken(t, s, "GET", "/v1/admin/dump?schema-only=true", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if dump := rec.Body.String(); strings.Contains(dump, added.Tag) {
+		t.Fatalf("got rows in a schema only dump %q", dump)
+	}
+
+	rec = doWithToken(t, s, "GET", "/v1/admin/dump?schema-only=maybe", "root")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAdminSchemaDrift(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"root": RoleAdmin})
+	err := s.state.Backend().Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "CREATE TABLE stray (id INTEGER PRIMARY KEY)")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("creating table: %v", err)
+	}
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/schema", "root")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d, body %q", rec.Code, http.StatusServiceUnavailable, rec.Body.String())
+	}
+	var status SchemaStatus
+	decode(t, rec, &status)
+	if status.Drift.Status != driftFound || len(status.Drift.OnlyLive) != 1 || status.Drift.OnlyLive[0] != "table stray" {
+		t.Fatalf("got drift %+v, want the stray table", status.Drift)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Role is the access granted to a token.
+type Role string
+
+const (
+	// RoleReadOnly tokens may only read, with GET requests.
+	RoleReadOnly Role = "read-only"
+
+	// RoleReadWrite tokens may also change the state, with POST and DELETE
+	// requests.
+	RoleReadWrite Role = "read-write"
+
+	// RoleAdmin tokens may also use the admin endpoints.
+	RoleAdmin Role = "admin"
+)
+
+// adminPathSegment is the first segment of the paths that require the admin
+// role.
+const adminPathSegment = "admin"
+
+// publicPaths are served without a token, so that probes don't need
+// credentials.
+var publicPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// SetTokens sets the bearer tokens that are allowed to use the API, along
+// with the role of each token. Without any tokens, the API is unauthenticated,
+// although the admin endpoints are refused. It must be called before Serve.
+func (s *Server) SetTokens(tokens map[string]Role) {
+	s.tokens = tokens
+}
+
+// withAuth rejects requests without a valid bearer token, requests with a
+// read-only token that would change the state, and requests for the admin
+// endpoints without an admin token. Without any tokens, only the admin
+// endpoints are refused, as they can't be used without an admin token.
+func (s *Server) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[unversionedPath(r.URL.Path)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(s.tokens) == 0 {
+			if isAdminPath(r) {
+				writeError(w, http.StatusForbidden, ErrorBody{
+					Code:    codeForbidden,
+					Message: "the admin endpoints require an admin token",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role, ok := s.tokenRole(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nu-juju-data"`)
+			writeError(w, http.StatusUnauthorized, ErrorBody{
+				Code:    codeUnauthorized,
+				Message: "missing or invalid bearer token",
+			})
+			return
+		}
+		if !role.allows(r) {
+			writeError(w, http.StatusForbidden, ErrorBody{
+				Code:    codeForbidden,
+				Message: "token is not allowed to " + r.Method + " " + r.URL.Path,
+			})
+			return
+		}
+		next.ServeHTTP(w, withToken(r, bearerToken(r)))
+	})
+}
+
+// allows returns true if the role is allowed to make the request.
+func (role Role) allows(r *http.Request) bool {
+	switch {
+	case role == RoleAdmin:
+		return true
+	case isAdminPath(r):
+		return false
+	case role == RoleReadWrite:
+		return true
+	}
+	return isReadOnlyMethod(r.Method)
+}
+
+// isAdminPath returns true if the request is for one of the admin endpoints.
+// The path is split as the router splits it, so that extra slashes don't
+// hide the admin prefix.
+func isAdminPath(r *http.Request) bool {
+	return splitPath(unversionedPath(r.URL.Path))[0] == adminPathSegment
+}
+
+// tokenRole returns the role of the bearer token of the request. Every token
+// is compared in constant time, so that the response time doesn't leak how
+// much of a token matched.
+func (s *Server) tokenRole(r *http.Request) (Role, bool) {
+	token := []byte(bearerToken(r))
+	if len(token) == 0 {
+		return "", false
+	}
+
+	var (
+		role  Role
+		found bool
+	)
+	for candidate, candidateRole := range s.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(candidate)) == 1 {
+			role, found = candidateRole, true
+		}
+	}
+	return role, found
+}
+
+// bearerToken returns the bearer token of the request, if there is one.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return header[len(prefix):]
+}
+
+func isReadOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
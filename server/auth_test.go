@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMatrix(t *testing.T) {
+	tokens := map[string]Role{
+		"ro":   RoleReadOnly,
+		"rw":   RoleReadWrite,
+		"root": RoleAdmin,
+	}
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/v1/actions"},
+		{"HEAD", "/v1/actions"},
+		{"OPTIONS", "/v1/actions"},
+		{"POST", "/v1/actions"},
+		{"DELETE", "/v1/actions/1"},
+		{"GET", "/v1/admin/schema"},
+	}
+	// allowed holds the requests each token is allowed to make, by index of
+	// the requests.
+	allowed := map[string][]bool{
+		"":      {false, false, false, false, false, false},
+		"wrong": {false, false, false, false, false, false},
+		"ro":    {true, true, true, false, false, false},
+		"rw":    {true, true, true, true, true, false},
+		"root":  {true, true, true, true, true, true},
+	}
+
+	s := newTestServer(t)
+	s.SetTokens(tokens)
+	for token, allows := range allowed {
+		for i, req := range requests {
+			rec := doWithToken(t, s, req.method, req.path, token)
+			switch {
+			case allows[i]:
+				if rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden {
+					t.Errorf("token %q: %s %s: got status %d, want it allowed", token, req.method, req.path, rec.Code)
+				}
+			case tokens[token] == "":
+				if rec.Code != http.StatusUnauthorized {
+					t.Errorf("token %q: %s %s: got status %d, want %d", token, req.method, req.path, rec.Code, http.StatusUnauthorized)
+				}
+			default:
+				if rec.Code != http.StatusForbidden {
+					t.Errorf("token %q: %s %s: got status %d, want %d", token, req.method, req.path, rec.Code, http.StatusForbidden)
+				}
+			}
+		}
+	}
+}
+
+func TestAuthUnauthorized(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"rw": RoleReadWrite})
+
+	rec := doWithToken(t, s, "GET", "/v1/actions", "wrong")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); got != `Bearer realm="nu-juju-data"` {
+		t.Fatalf("got WWW-Authenticate %q, want the bearer challenge", got)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeUnauthorized {
+		t.Fatalf("got error %+v, want unauthorized", resp.Error)
+	}
+
+	rec = doWithToken(t, s, "POST", "/v1/actions/1/abort", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthForbidden(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"ro": RoleReadOnly})
+
+	rec := doWithToken(t, s, "POST", "/v1/actions", "ro")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeForbidden || resp.Error.Message != "token is not allowed to POST /v1/actions" {
+		t.Fatalf("got error %+v, want forbidden", resp.Error)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"ro": RoleReadOnly})
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Bearer ro", http.StatusOK},
+		{"bearer ro", http.StatusOK},
+		{"BEARER ro", http.StatusOK},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer ro ", http.StatusUnauthorized},
+		{"Bearer r", http.StatusUnauthorized},
+		{"Basic cm86", http.StatusUnauthorized},
+		{"ro", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v1/actions", nil)
+		req.Header.Set("Authorization", test.header)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("Authorization %q: got status %d, want %d", test.header, rec.Code, test.status)
+		}
+	}
+}
+
+func TestAuthWithoutTokens(t *testing.T) {
+	s := newTestServer(t)
+
+	// Without any tokens the API is open, apart from the admin endpoints.
+	if rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "unit-mysql-0", Name: "backup"}); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec := doWithToken(t, s, "GET", "/v1/admin/schema", "anything"); rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxDrainSize is the most of an unread request body that's drained, so that
+// the connection can be reused. Larger bodies are left for the server to
+// close the connection.
+const maxDrainSize = 64 << 10
+
+// withBody limits the size of the request bodies, and drains and closes every
+// body once the request has been served.
+func (s *Server) withBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodySize)
+		defer func() {
+			_, _ = io.Copy(io.Discard, io.LimitReader(r.Body, maxDrainSize))
+			_ = r.Body.Close()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeBody decodes the JSON request body into the input, rejecting unknown
+// fields. If the body can't be decoded, the error response is written and
+// false is returned.
+func decodeBody(w http.ResponseWriter, r *http.Request, input interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != jsonContentType {
+		writeError(w, http.StatusUnsupportedMediaType, ErrorBody{
+			Code:    codeUnsupportedMediaType,
+			Message: "expected Content-Type " + jsonContentType,
+		})
+		return false
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(input)
+	switch {
+	case err == nil:
+		return true
+	case err == io.EOF:
+		badRequest(w, "", "missing request body")
+	case isBodyTooLarge(err):
+		writeError(w, http.StatusRequestEntityTooLarge, ErrorBody{
+			Code:    codeTooLarge,
+			Message: err.Error(),
+		})
+	default:
+		decodeError(w, err)
+	}
+	return false
+}
+
+// isBodyTooLarge returns true if the error is from reading beyond the limit
+// of a http.MaxBytesReader, which doesn't export a type for the error.
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
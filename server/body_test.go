@@ -0,0 +1,150 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBody serves the POST request with the body and content type.
+func postBody(t *testing.T, s *Server, path, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"receiver": "unit-mysql-0", "name": "backup", "parameters": {"path": "/var/backups"}}`
+	s.SetMaxBodySize(int64(len(body)))
+
+	if rec := postBody(t, s, "/v1/actions", jsonContentType, body); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d for a body at the limit, body %q", rec.Code, rec.Body.String())
+	}
+
+	// Every endpoint decoding a body shares the limit.
+	large := strings.Replace(body, "/var/backups", "/var/backups/mysql", 1)
+	for _, path := range []string{"/v1/actions", "/v1/actions/batch", "/v1/operations", "/v1/actions/1/logs"} {
+		rec := postBody(t, s, path, jsonContentType, large)
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s: got status %d, body %q", path, rec.Code, rec.Body.String())
+			continue
+		}
+		var resp ErrorResponse
+		decode(t, rec, &resp)
+		if resp.Error.Code != codeTooLarge {
+			t.Errorf("POST %s: got error %+v, want too large", path, resp.Error)
+		}
+	}
+}
+
+func TestBodyContentType(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"receiver": "unit-mysql-0", "name": "backup"}`
+
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/json", http.StatusCreated},
+		{"application/json; charset=utf-8", http.StatusCreated},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json; charset", http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		rec := postBody(t, s, "/v1/actions", test.contentType, body)
+		if rec.Code != test.status {
+			t.Errorf("Content-Type %q: got status %d, want %d", test.contentType, rec.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusUnsupportedMediaType {
+			continue
+		}
+		var resp ErrorResponse
+		decode(t, rec, &resp)
+		if resp.Error.Code != codeUnsupportedMediaType {
+			t.Errorf("Content-Type %q: got error %+v, want unsupported media type", test.contentType, resp.Error)
+		}
+	}
+}
+
+func TestBodyDecodeErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"empty", "", ""},
+		{"malformed", `{"receiver": `, ""},
+		{"unknown field", `{"receiver": "unit-mysql-0", "name": "backup", "priority": 1}`, "priority"},
+		{"wrong type", `{"receiver": "unit-mysql-0", "name": 42}`, "name"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := postBody(t, s, "/v1/actions", jsonContentType, test.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+			}
+			var resp ErrorResponse
+			decode(t, rec, &resp)
+			if resp.Error.Code != codeBadRequest || resp.Error.Field != test.field {
+				t.Fatalf("got error %+v, want a bad request for %q", resp.Error, test.field)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from it, and whether it was closed.
+type countingReader struct {
+	io.Reader
+	read   int
+	closed bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestBodyDrained(t *testing.T) {
+	s := &Server{maxBodySize: defaultMaxBodySize}
+
+	tests := []struct {
+		size    int
+		drained int
+	}{
+		{size: 100, drained: 100},
+		// Larger bodies are only drained up to the limit.
+		{size: 2 * maxDrainSize, drained: maxDrainSize},
+	}
+	for _, test := range tests {
+		body := &countingReader{Reader: strings.NewReader(strings.Repeat("a", test.size))}
+		req := httptest.NewRequest("POST", "/v1/actions/1/abort", nil)
+		req.Body = body
+
+		// The handler doesn't read the body.
+		handler := s.withBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if body.read < test.drained || body.read > test.drained+512 || !body.closed {
+			t.Errorf("body of %d bytes: got %d bytes drained, closed %v, want %d drained and closed", test.size, body.read, body.closed, test.drained)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/juju/errors"
+)
+
+// forwardedHeader marks a request that has been proxied to the leader, so
+// that it's never proxied again if leadership has moved in the meantime.
+const forwardedHeader = "X-Forwarded-To-Leader"
+
+// Cluster reports the leader of the database cluster.
+type Cluster interface {
+	// Address returns the database address of the local node.
+	Address() string
+
+	// LeaderAddress returns the database address of the leader.
+	LeaderAddress(context.Context) (string, error)
+}
+
+// ClusterMembers reports and manages the nodes of the database cluster.
+type ClusterMembers interface {
+	// Members returns the nodes of the cluster, along with the database
+	// address of the leader. A NotProvisioned error means the leader can't
+	// be reached.
+	Members(context.Context) ([]ClusterMember, string, error)
+
+	// RemoveMember permanently removes the node from the cluster, handing
+	// over leadership first if needed. It returns the removed node, along
+	// with warnings about the state the cluster is left in. A NotFound
+	// error means there is no such node, and a Forbidden error means the
+	// node can't be removed.
+	RemoveMember(ctx context.Context, id uint64) (ClusterMember, []string, error)
+}
+
+// ClusterRoleReporter reports how the roles of the nodes of the cluster are
+// managed.
+type ClusterRoleReporter interface {
+	// Roles returns the target number of voters and the recent changes of
+	// roles.
+	Roles() ClusterRoles
+}
+
+// APIAddressFunc returns the API address of the node with the database
+// address. A NotFound error means the API address isn't known, in which case
+// the request is served locally.
+type APIAddressFunc func(dbAddress string) (string, error)
+
+// SetCluster sends the requests that change the state to the leader of the
+// cluster, as only the leader can write efficiently. Requests to a follower
+// are redirected to the leader, or proxied to the leader if proxy is true.
+// Reads are always served locally. It must be called before Serve.
+func (s *Server) SetCluster(cluster Cluster, apiAddress APIAddressFunc, proxy bool) {
+	s.cluster = cluster
+	s.apiAddress = apiAddress
+	s.proxyToLeader = proxy
+}
+
+// withLeader redirects or proxies the requests that change the state to the
+// leader, when the local node isn't the leader.
+func (s *Server) withLeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil || isReadOnlyMethod(r.Method) || r.Header.Get(forwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		leader, err := s.leaderURL(r)
+		if err != nil {
+			s.handleError(w, r, err)
+			return
+		}
+		if leader == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.proxyToLeader {
+			proxy := httputil.NewSingleHostReverseProxy(leader)
+			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				s.handleError(w, r, errors.NewNotProvisioned(err, "proxying to the leader"))
+			}
+			r.Header.Set(forwardedHeader, s.cluster.Address())
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		location := *leader
+		location.Path = r.URL.Path
+		location.RawQuery = r.URL.RawQuery
+		http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+	})
+}
+
+// leaderURL returns the URL of the leader's API, or nil if the request should
+// be served locally.
+func (s *Server) leaderURL(r *http.Request) (*url.URL, error) {
+	leader, err := s.cluster.LeaderAddress(r.Context())
+	if err != nil {
+		// Without a leader there's nowhere to send the request, and the
+		// write would fail locally anyway.
+		return nil, errors.NewNotProvisioned(err, "cluster leader")
+	}
+	if leader == s.cluster.Address() {
+		return nil, nil
+	}
+
+	address, err := s.apiAddress(leader)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "API address of leader %q", leader)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: address}, nil
+}
+
+// SetClusterMembers reports the nodes of the cluster from the admin
+// endpoints. It must be called before Serve.
+func (s *Server) SetClusterMembers(members ClusterMembers) {
+	s.members = members
+}
+
+// SetClusterRoles reports how the roles of the nodes are managed from the
+// cluster status. It must be called before Serve.
+func (s *Server) SetClusterRoles(roles ClusterRoleReporter) {
+	s.roles = roles
+}
+
+// handleRemoveClusterNode permanently removes a node from the cluster.
+func (s *Server) handleRemoveClusterNode(w http.ResponseWriter, r *http.Request, p params) {
+	if s.members == nil {
+		s.handleError(w, r, stateerrors.NotFoundf("cluster status"))
+		return
+	}
+
+	id, err := strconv.ParseUint(p["id"], 10, 64)
+	if err != nil {
+		badRequest(w, "id", "invalid node id %q", p["id"])
+		return
+	}
+
+	member, warnings, err := s.members.RemoveMember(r.Context(), id)
+	if err != nil {
+		s.handleError(w, r, errors.Annotatef(err, "removing node %d", id))
+		return
+	}
+	encodeJSON(w, ClusterNodeRemoval{
+		Node:     member,
+		Warnings: warnings,
+	})
+}
+
+// handleClusterStatus lists the nodes of the cluster and the leader. The
+// cluster status is unavailable if the leader can't be reached.
+func (s *Server) handleClusterStatus(w http.ResponseWriter, r *http.Request, _ params) {
+	if s.members == nil {
+		s.handleError(w, r, stateerrors.NotFoundf("cluster status"))
+		return
+	}
+
+	members, leader, err := s.members.Members(r.Context())
+	if err != nil {
+		s.handleError(w, r, errors.Annotate(err, "cluster status"))
+		return
+	}
+
+	output := ClusterStatus{
+		Leader: leader,
+		Nodes:  make([]ClusterMember, len(members)),
+	}
+	for i, member := range members {
+		member.Leader = member.Address == leader
+		output.Nodes[i] = member
+	}
+	if s.roles != nil {
+		roles := s.roles.Roles()
+		output.Roles = &roles
+	}
+	encodeJSON(w, output)
+}
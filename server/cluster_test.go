@@ -0,0 +1,406 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// fakeMembers is a cluster of nodes reported to the admin endpoints.
+type fakeMembers struct {
+	members []ClusterMember
+	leader  string
+	err     error
+
+	removed  []uint64
+	warnings []string
+	// removeErr is the error removing the node with the id.
+	removeErr map[uint64]error
+}
+
+func (m *fakeMembers) Members(context.Context) ([]ClusterMember, string, error) {
+	if m.err != nil {
+		return nil, "", m.err
+	}
+	return append([]ClusterMember(nil), m.members...), m.leader, nil
+}
+
+func (m *fakeMembers) RemoveMember(_ context.Context, id uint64) (ClusterMember, []string, error) {
+	if err := m.removeErr[id]; err != nil {
+		return ClusterMember{}, nil, err
+	}
+	for _, member := range m.members {
+		if member.ID == id {
+			m.removed = append(m.removed, id)
+			return member, m.warnings, nil
+		}
+	}
+	return ClusterMember{}, nil, errors.NotFoundf("node %d", id)
+}
+
+// fakeRoles reports the roles managed by the leader.
+type fakeRoles struct {
+	roles ClusterRoles
+}
+
+func (r fakeRoles) Roles() ClusterRoles {
+	return r.roles
+}
+
+// newClusterMembers returns a cluster of two voters and an offline stand-by,
+// led by the first voter.
+func newClusterMembers() *fakeMembers {
+	return &fakeMembers{
+		members: []ClusterMember{
+			{ID: 1, Address: "10.0.0.1:9000", Role: "voter", Online: true},
+			{ID: 2, Address: "10.0.0.2:9000", Role: "voter", Online: true},
+			{ID: 3, Address: "10.0.0.3:9000", Role: "stand-by"},
+		},
+		leader: "10.0.0.1:9000",
+	}
+}
+
+// newAdminServer returns a test server accepting the "root" admin token.
+func newAdminServer(t *testing.T) *Server {
+	t.Helper()
+
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"root": RoleAdmin})
+	return s
+}
+
+func TestClusterStatus(t *testing.T) {
+	s := newAdminServer(t)
+	s.SetClusterMembers(newClusterMembers())
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/cluster", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var status ClusterStatus
+	decode(t, rec, &status)
+
+	want := ClusterStatus{
+		Leader: "10.0.0.1:9000",
+		Nodes: []ClusterMember{
+			{ID: 1, Address: "10.0.0.1:9000", Role: "voter", Leader: true, Online: true},
+			{ID: 2, Address: "10.0.0.2:9000", Role: "voter", Online: true},
+			{ID: 3, Address: "10.0.0.3:9000", Role: "stand-by"},
+		},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Fatalf("got cluster status %+v, want %+v", status, want)
+	}
+	if strings.Contains(rec.Body.String(), `"roles"`) {
+		t.Fatalf("got roles reported without a role manager: %s", rec.Body.String())
+	}
+}
+
+func TestClusterStatusWithRoles(t *testing.T) {
+	checked := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	roles := ClusterRoles{
+		Voters:  3,
+		Checked: &checked,
+		Changes: []ClusterRoleChange{
+			{ID: 3, Address: "10.0.0.3:9000", From: "stand-by", To: "voter", Time: checked},
+		},
+	}
+
+	s := newAdminServer(t)
+	s.SetClusterMembers(newClusterMembers())
+	s.SetClusterRoles(fakeRoles{roles: roles})
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/cluster", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var status ClusterStatus
+	decode(t, rec, &status)
+	if status.Roles == nil {
+		t.Fatalf("got no roles, want the managed roles")
+	}
+	if status.Roles.Voters != roles.Voters || !status.Roles.Checked.Equal(checked) || len(status.Roles.Changes) != 1 {
+		t.Fatalf("got roles %+v, want %+v", *status.Roles, roles)
+	}
+	if change := status.Roles.Changes[0]; change.ID != 3 || change.From != "stand-by" || change.To != "voter" || !change.Time.Equal(checked) {
+		t.Fatalf("got change %+v, want %+v", change, roles.Changes[0])
+	}
+}
+
+func TestClusterStatusLeaderUnreachable(t *testing.T) {
+	members := newClusterMembers()
+	members.err = errors.NewNotProvisioned(errors.New("no leader"), "cluster leader unreachable")
+
+	s := newAdminServer(t)
+	s.SetClusterMembers(members)
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/cluster", "root")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("got no Retry-After header")
+	}
+	var body ErrorResponse
+	decode(t, rec, &body)
+	if body.Error.Code != codeRetryLater || !strings.Contains(body.Error.Message, "cluster leader unreachable") {
+		t.Fatalf("got error %+v, want the leader unreachable", body.Error)
+	}
+}
+
+func TestClusterStatusWithoutCluster(t *testing.T) {
+	s := newAdminServer(t)
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/cluster", "root")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestClusterStatusRequiresAdminToken(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"rw": RoleReadWrite})
+	s.SetClusterMembers(newClusterMembers())
+
+	rec := doWithToken(t, s, "GET", "/v1/admin/cluster", "rw")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRemoveClusterNode(t *testing.T) {
+	members := newClusterMembers()
+	members.warnings = []string{"the cluster is left with 1 voter(s)"}
+
+	s := newAdminServer(t)
+	s.SetClusterMembers(members)
+
+	rec := doWithToken(t, s, "DELETE", "/v1/admin/cluster/nodes/2", "root")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var removal ClusterNodeRemoval
+	decode(t, rec, &removal)
+
+	want := ClusterNodeRemoval{
+		Node:     ClusterMember{ID: 2, Address: "10.0.0.2:9000", Role: "voter", Online: true},
+		Warnings: members.warnings,
+	}
+	if !reflect.DeepEqual(removal, want) {
+		t.Fatalf("got removal %+v, want %+v", removal, want)
+	}
+	if !reflect.DeepEqual(members.removed, []uint64{2}) {
+		t.Fatalf("got removed %v, want node 2", members.removed)
+	}
+}
+
+func TestRemoveClusterNodeFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		err    error
+		status int
+		code   string
+	}{
+		{"invalid id", "/v1/admin/cluster/nodes/two", nil, http.StatusBadRequest, codeBadRequest},
+		{"unknown node", "/v1/admin/cluster/nodes/7", nil, http.StatusNotFound, codeNotFound},
+		{"last voter", "/v1/admin/cluster/nodes/1", errors.NewForbidden(nil, "node 1 is the last voter"), http.StatusForbidden, codeForbidden},
+		{"leader unreachable", "/v1/admin/cluster/nodes/1", errors.NewNotProvisioned(nil, "cluster leader unreachable"), http.StatusServiceUnavailable, codeRetryLater},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			members := newClusterMembers()
+			members.removeErr = map[uint64]error{1: test.err}
+
+			s := newAdminServer(t)
+			s.SetClusterMembers(members)
+
+			rec := doWithToken(t, s, "DELETE", test.path, "root")
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d, body %q", rec.Code, test.status, rec.Body.String())
+			}
+			var body ErrorResponse
+			decode(t, rec, &body)
+			if body.Error.Code != test.code {
+				t.Fatalf("got error %+v, want code %q", body.Error, test.code)
+			}
+			if len(members.removed) != 0 {
+				t.Fatalf("got removed %v, want none", members.removed)
+			}
+		})
+	}
+}
+
+func TestRemoveClusterNodeRequiresAdminToken(t *testing.T) {
+	members := newClusterMembers()
+
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"rw": RoleReadWrite})
+	s.SetClusterMembers(members)
+
+	rec := doWithToken(t, s, "DELETE", "/v1/admin/cluster/nodes/2", "rw")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if len(members.removed) != 0 {
+		t.Fatalf("got removed %v, want none", members.removed)
+	}
+}
+
+// fakeCluster is a node of the cluster, with the leader at leader.
+type fakeCluster struct {
+	address string
+	leader  string
+	err     error
+}
+
+func (c fakeCluster) Address() string {
+	return c.address
+}
+
+func (c fakeCluster) LeaderAddress(context.Context) (string, error) {
+	return c.leader, c.err
+}
+
+// apiAddresses returns the API addresses of the nodes of the cluster.
+func apiAddresses(addresses map[string]string) APIAddressFunc {
+	return func(dbAddress string) (string, error) {
+		address, ok := addresses[dbAddress]
+		if !ok {
+			return "", errors.NotFoundf("API address of %q", dbAddress)
+		}
+		return address, nil
+	}
+}
+
+func TestLeaderRedirect(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCluster(fakeCluster{address: "10.0.0.2:9000", leader: "10.0.0.1:9000"}, apiAddresses(map[string]string{
+		"10.0.0.1:9000": "10.0.0.1:8080",
+	}), false)
+
+	// Writes on a follower are redirected to the leader, keeping the method
+	// and body with a 307.
+	rec := do(t, s, "POST", "/v1/actions?pretty", InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got, want := rec.Header().Get("Location"), "http://10.0.0.1:8080/v1/actions?pretty"; got != want {
+		t.Fatalf("got Location %q, want %q", got, want)
+	}
+
+	// Reads are served locally.
+	if rec := do(t, s, "GET", "/v1/actions", nil); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLeaderServesLocally(t *testing.T) {
+	tests := []struct {
+		name    string
+		cluster fakeCluster
+	}{
+		{"leader", fakeCluster{address: "10.0.0.1:9000", leader: "10.0.0.1:9000"}},
+		{"unknown API address", fakeCluster{address: "10.0.0.2:9000", leader: "10.0.0.3:9000"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SetCluster(test.cluster, apiAddresses(map[string]string{
+				"10.0.0.1:9000": "10.0.0.1:8080",
+			}), false)
+
+			rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestLeaderUnknown(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCluster(fakeCluster{address: "10.0.0.2:9000", err: errors.New("no leader")}, apiAddresses(nil), false)
+
+	rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeRetryLater || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("got error %+v, want to retry later", resp.Error)
+	}
+}
+
+func TestLeaderProxy(t *testing.T) {
+	leader := newTestServer(t)
+	var forwarded string
+	leaderServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(forwardedHeader)
+		leader.Handler().ServeHTTP(w, r)
+	}))
+	defer leaderServer.Close()
+
+	s := newTestServer(t)
+	s.SetCluster(fakeCluster{address: "10.0.0.2:9000", leader: "10.0.0.1:9000"}, apiAddresses(map[string]string{
+		"10.0.0.1:9000": strings.TrimPrefix(leaderServer.URL, "http://"),
+	}), true)
+
+	rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if forwarded != "10.0.0.2:9000" {
+		t.Fatalf("got %s %q, want the follower's address", forwardedHeader, forwarded)
+	}
+
+	// The action was added on the leader, not the follower.
+	if list := listActions(t, leader, "/v1/actions"); list.Total != 1 {
+		t.Fatalf("got %d actions on the leader, want 1", list.Total)
+	}
+	if list := listActions(t, s, "/v1/actions"); list.Total != 0 {
+		t.Fatalf("got %d actions on the follower, want none", list.Total)
+	}
+}
+
+func TestLeaderProxyForwardedOnce(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCluster(fakeCluster{address: "10.0.0.2:9000", leader: "10.0.0.1:9000"}, apiAddresses(map[string]string{
+		"10.0.0.1:9000": "10.0.0.1:8080",
+	}), true)
+
+	// A request that has already been forwarded is served locally, even if
+	// leadership has moved since.
+	body := strings.NewReader(`{"receiver": "unit-mysql-0", "name": "backup"}`)
+	req := httptest.NewRequest("POST", "/v1/actions", body)
+	req.Header.Set("Content-Type", jsonContentType)
+	req.Header.Set(forwardedHeader, "10.0.0.3:9000")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLeaderProxyUnreachable(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	address := strings.TrimPrefix(unreachable.URL, "http://")
+	unreachable.Close()
+
+	s := newTestServer(t)
+	s.SetCluster(fakeCluster{address: "10.0.0.2:9000", leader: "10.0.0.1:9000"}, apiAddresses(map[string]string{
+		"10.0.0.1:9000": address,
+	}), true)
+
+	rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
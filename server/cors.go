@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the cross-origin requests allowed from browsers.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to make requests. The origin
+	// "*" allows any origin, which is only intended for development.
+	AllowedOrigins []string
+
+	// AllowedMethods are the methods allowed in cross-origin requests. If
+	// empty, GET, POST and DELETE are allowed.
+	AllowedMethods []string
+
+	// AllowedHeaders are the request headers allowed in cross-origin
+	// requests. If empty, the headers used by the API are allowed.
+	AllowedHeaders []string
+
+	// MaxAge is how long browsers may cache the result of a preflight
+	// request.
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-None-Match"}
+
+	// corsExposedHeaders are the response headers browsers may read.
+	corsExposedHeaders = []string{"ETag", "Retry-After", "Location"}
+)
+
+// SetCORS allows cross-origin requests from browsers, as configured. CORS is
+// disabled by default. It must be called before Serve.
+func (s *Server) SetCORS(config CORSConfig) {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = defaultCORSMethods
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = defaultCORSHeaders
+	}
+	s.cors = &config
+}
+
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSConfig) allowsMethod(method string) bool {
+	for _, allowed := range c.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds the CORS headers to the responses for allowed origins, and
+// answers the preflight requests for every path. Preflight requests are
+// answered before authentication, as browsers never send credentials with
+// them.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if s.cors == nil || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !s.cors.allowsOrigin(origin) {
+			if preflight {
+				writeError(w, http.StatusForbidden, ErrorBody{
+					Code:    codeForbidden,
+					Message: "origin " + origin + " is not allowed",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header.Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if method := r.Header.Get("Access-Control-Request-Method"); !s.cors.allowsMethod(method) {
+			writeError(w, http.StatusForbidden, ErrorBody{
+				Code:    codeForbidden,
+				Message: "method " + method + " is not allowed",
+			})
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(s.cors.AllowedMethods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(s.cors.AllowedHeaders, ", "))
+		if s.cors.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cors.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// doCORS serves the request from the origin, as a preflight request for the
+// method if there is one.
+func doCORS(t *testing.T, s *Server, method, path, origin, preflightMethod string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if preflightMethod != "" {
+		req.Header.Set("Access-Control-Request-Method", preflightMethod)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s := newTestServer(t)
+	// Preflight requests are answered without credentials.
+	s.SetTokens(map[string]Role{"rw": RoleReadWrite})
+	s.SetCORS(CORSConfig{
+		AllowedOrigins: []string{"https://dashboard.example.com"},
+		MaxAge:         10 * time.Minute,
+	})
+
+	rec := doCORS(t, s, "OPTIONS", "/v1/actions/42", "https://dashboard.example.com", "DELETE")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://dashboard.example.com",
+		"Access-Control-Allow-Methods": "GET, POST, DELETE",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type, Idempotency-Key, If-Match, If-None-Match",
+		"Access-Control-Max-Age":       "600",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("got %s %q, want %q", name, got, value)
+		}
+	}
+	if got, want := rec.Header().Values("Vary"), []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Vary %q, want %q", got, want)
+	}
+}
+
+func TestCORSPreflightRefused(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCORS(CORSConfig{
+		AllowedOrigins: []string{"https://dashboard.example.com"},
+		AllowedMethods: []string{"GET"},
+	})
+
+	tests := []struct {
+		origin string
+		method string
+	}{
+		{"https://evil.example.com", "GET"},
+		{"https://dashboard.example.com", "DELETE"},
+	}
+	for _, test := range tests {
+		rec := doCORS(t, s, "OPTIONS", "/v1/actions", test.origin, test.method)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s from %s: got status %d, want %d", test.method, test.origin, rec.Code, http.StatusForbidden)
+			continue
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+			t.Errorf("%s from %s: got Access-Control-Allow-Methods %q, want none", test.method, test.origin, got)
+		}
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCORS(CORSConfig{AllowedOrigins: []string{"https://dashboard.example.com"}})
+
+	rec := doCORS(t, s, "GET", "/v1/actions", "https://dashboard.example.com", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+		t.Fatalf("got Access-Control-Allow-Origin %q", got)
+	}
+	if got, want := rec.Header().Get("Access-Control-Expose-Headers"), "ETag, Retry-After, Location"; got != want {
+		t.Fatalf("got Access-Control-Expose-Headers %q, want %q", got, want)
+	}
+
+	// Other origins are still served, but without the headers that would
+	// let a browser read the response.
+	rec = doCORS(t, s, "GET", "/v1/actions", "https://evil.example.com", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("got status %d, Access-Control-Allow-Origin %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	s := newTestServer(t)
+	s.SetCORS(CORSConfig{AllowedOrigins: []string{"*"}})
+
+	// The origin is echoed, rather than "*", so that credentials can be
+	// sent.
+	rec := doCORS(t, s, "OPTIONS", "/v1/actions", "http://localhost:3000", "POST")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3000" {
+		t.Fatalf("got status %d, Access-Control-Allow-Origin %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	s := newTestServer(t)
+
+	// Without CORS, an OPTIONS request is answered by the router.
+	rec := doCORS(t, s, "OPTIONS", "/v1/actions", "https://dashboard.example.com", "POST")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Allow") == "" {
+		t.Fatalf("got status %d with headers %v, want the router's OPTIONS response", rec.Code, rec.Header())
+	}
+}
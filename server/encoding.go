@@ -0,0 +1,178 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+const (
+	jsonContentType = "application/json"
+
+	// minGzipSize is the size a response must reach before it's compressed,
+	// as compressing small responses costs more than it saves.
+	minGzipSize = 1024
+)
+
+// withGzip compresses the responses for clients that accept gzip encoding.
+// Responses smaller than minGzipSize and error responses are never
+// compressed.
+func (s *Server) withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter buffers the start of a response, until it's known whether the
+// response is large enough to compress.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+
+	// passthrough is set once the response is known to be written
+	// uncompressed.
+	passthrough bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	// Errors and responses without a body are never compressed.
+	if status >= http.StatusBadRequest || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.passthrough:
+		return w.ResponseWriter.Write(b)
+	case w.gz != nil:
+		return w.gz.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) < minGzipSize {
+		return len(b), nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// start writes the buffered response, compressing it unless the handler has
+// already encoded it.
+func (w *gzipWriter) start() error {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		w.passthrough = true
+	} else {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// close writes any response that was too small to compress, or finishes the
+// compressed response.
+func (w *gzipWriter) close() {
+	switch {
+	case w.gz != nil:
+		_ = w.gz.Close()
+	case !w.passthrough:
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(w.status)
+		if len(w.buf) > 0 {
+			_, _ = w.ResponseWriter.Write(w.buf)
+		}
+	}
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header of the request
+// includes the encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, candidate := range strings.Split(value, ",") {
+			name, rejected := parseQuality(candidate)
+			if !rejected && (name == encoding || name == "*") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsContentType returns true if the Accept header of the request allows
+// the content type. A request without the header accepts any content type.
+func acceptsContentType(r *http.Request, contentType string) bool {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return true
+	}
+
+	mainType := contentType
+	if i := strings.Index(contentType, "/"); i >= 0 {
+		mainType = contentType[:i]
+	}
+	for _, value := range values {
+		for _, candidate := range strings.Split(value, ",") {
+			mediaRange, rejected := parseQuality(candidate)
+			if rejected {
+				continue
+			}
+			if mediaRange == "*/*" || mediaRange == contentType || mediaRange == mainType+"/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseQuality returns the value of an element of an Accept style header,
+// without its parameters, and whether the element was rejected with a
+// quality of zero.
+func parseQuality(element string) (string, bool) {
+	parts := strings.Split(element, ";")
+	value := strings.ToLower(strings.TrimSpace(parts[0]))
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		quality := strings.TrimRight(strings.TrimPrefix(param, "q="), "0")
+		if quality == "" || quality == "0." || quality == "0" {
+			return value, true
+		}
+	}
+	return value, false
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveGzip serves the response written by the handler through withGzip.
+func serveGzip(t *testing.T, acceptEncoding string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/v1/actions", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	(&Server{}).withGzip(handler).ServeHTTP(rec, req)
+	return rec
+}
+
+// gunzip returns the decompressed body of the response.
+func gunzip(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("reading compressed body: %v", err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading compressed body: %v", err)
+	}
+	return string(body)
+}
+
+func TestGzipLargeResponse(t *testing.T) {
+	large := strings.Repeat("a", minGzipSize)
+	rec := serveGzip(t, "deflate, gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2048")
+		w.WriteHeader(http.StatusCreated)
+		// The response is written in pieces, straddling the threshold.
+		for i := 0; i < len(large); i += 100 {
+			end := i + 100
+			if end > len(large) {
+				end = len(large)
+			}
+			_, _ = w.Write([]byte(large[i:end]))
+		}
+	})
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Fatalf("got Content-Length %q, want it removed", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Fatalf("got Vary %q, want Accept-Encoding", got)
+	}
+	if got := gunzip(t, rec); got != large {
+		t.Fatalf("got body of %d bytes, want %d", len(got), len(large))
+	}
+}
+
+func TestGzipUncompressed(t *testing.T) {
+	large := strings.Repeat("a", minGzipSize)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		status         int
+		encoding       string
+		body           string
+	}{
+		{"small", "gzip", http.StatusOK, "", "small"},
+		{"not accepted", "", http.StatusOK, "", large},
+		{"rejected", "gzip;q=0, identity", http.StatusOK, "", large},
+		{"error", "gzip", http.StatusNotFound, "", large},
+		{"already encoded", "gzip", http.StatusOK, "br", large},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serveGzip(t, test.acceptEncoding, func(w http.ResponseWriter, r *http.Request) {
+				if test.encoding != "" {
+					w.Header().Set("Content-Encoding", test.encoding)
+				}
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.body))
+			})
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d", rec.Code, test.status)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Fatalf("got Content-Encoding %q, want %q", got, test.encoding)
+			}
+			if rec.Body.String() != test.body {
+				t.Fatalf("got body of %d bytes, want %d", rec.Body.Len(), len(test.body))
+			}
+		})
+	}
+}
+
+func TestGzipImplicitStatus(t *testing.T) {
+	// A handler that writes nothing still sends its status.
+	rec := serveGzip(t, "gzip", func(w http.ResponseWriter, r *http.Request) {})
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGzipListActions(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 20; i++ {
+		addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	}
+
+	req := httptest.NewRequest("GET", "/v1/actions", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got status %d, Content-Encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if body := gunzip(t, rec); !strings.Contains(body, `"total":20`) {
+		t.Fatalf("got body %q, want the list of actions", body)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header  string
+		accepts bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"deflate", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v1/actions", nil)
+		if test.header != "" {
+			req.Header.Set("Accept-Encoding", test.header)
+		}
+		if got := acceptsEncoding(req, "gzip"); got != test.accepts {
+			t.Errorf("Accept-Encoding %q: got %v, want %v", test.header, got, test.accepts)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/juju/names"
 )
 
 // ActionMessage represents a progress message logged by an action.
@@ -12,6 +16,16 @@ type ActionMessage struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// FromModel converts a model action message into an entity.
+func (o ActionMessage) FromModel(m model.ActionMessage) ActionMessage {
+	o.Message = m.Message
+	o.Timestamp = m.Timestamp
+	return o
+}
+
+// OutputAction represents an action. Times that haven't happened yet, such as
+// the start of a pending action, and empty messages are omitted, rather than
+// being sent as zero values.
 type OutputAction struct {
 	ID  int64  `json:"id"`
 	Tag string `json:"tag"`
@@ -32,10 +46,10 @@ type OutputAction struct {
 	Enqueued time.Time `json:"enqueued"`
 
 	// Started reflects the time the action began running.
-	Started time.Time `json:"started"`
+	Started *time.Time `json:"started,omitempty"`
 
 	// Completed reflects the time that the action was finished.
-	Completed time.Time `json:"completed"`
+	Completed *time.Time `json:"completed,omitempty"`
 
 	// Operation is the parent operation of the action.
 	Operation string `json:"operation"`
@@ -46,7 +60,23 @@ type OutputAction struct {
 	Status string `json:"status"`
 
 	// Message captures any error returned by the action.
-	Message string `json:"message"`
+	Message string `json:"message,omitempty"`
+
+	// RequestedBy is the tag of the user or client that enqueued the action.
+	RequestedBy string `json:"requested-by,omitempty"`
+
+	// Source describes where the action was enqueued from.
+	Source string `json:"source,omitempty"`
+
+	// ExpiresAt is the time the action fails if it's still pending.
+	ExpiresAt *time.Time `json:"expires-at,omitempty"`
+
+	// Generation is incremented every time the action changes. It's also
+	// returned as the ETag of the action.
+	Generation int64 `json:"generation"`
+
+	// Results holds the results of the action, when requested.
+	Results map[string]interface{} `json:"results,omitempty"`
 }
 
 func (o OutputAction) FromModel(a model.Action) OutputAction {
@@ -56,14 +86,334 @@ func (o OutputAction) FromModel(a model.Action) OutputAction {
 	o.Name = a.Name
 	o.Parameters = a.Parameters
 	o.Enqueued = a.Enqueued
-	o.Started = a.Started
-	o.Completed = a.Completed
+	o.Started = optionalTime(a.Started)
+	o.Completed = optionalTime(a.Completed)
 	o.Operation = a.Operation
 	o.Status = string(a.Status)
 	o.Message = a.Message
+	o.RequestedBy = a.RequestedBy
+	o.Source = a.Source
+	o.ExpiresAt = optionalTime(a.ExpiresAt)
+	o.Generation = a.Generation
+	o.Results = a.Results
+	return o
+}
+
+// OutputOperation represents an operation, along with the actions enqueued
+// under it. As with actions, times that haven't happened yet are omitted.
+type OutputOperation struct {
+	ID int64 `json:"id"`
+
+	// Summary describes the operation.
+	Summary string `json:"summary"`
+
+	// Enqueued is the time the operation was added.
+	Enqueued time.Time `json:"enqueued"`
+
+	// Started reflects the time the operation began running.
+	Started *time.Time `json:"started,omitempty"`
+
+	// Completed reflects the time that the operation was finished.
+	Completed *time.Time `json:"completed,omitempty"`
+
+	// Status represents the state of the operation.
+	Status string `json:"status"`
+
+	// ExpectedActions is the number of actions enqueued under the operation.
+	ExpectedActions int `json:"expected-actions"`
+
+	// ActionCounts holds the number of actions enqueued under the operation
+	// for each status.
+	ActionCounts map[string]int `json:"action-counts,omitempty"`
+
+	// Actions holds the actions enqueued under the operation.
+	Actions []OutputAction `json:"actions,omitempty"`
+}
+
+func (o OutputOperation) FromModel(op model.Operation, actions []model.Action) OutputOperation {
+	o.ID = op.ID
+	o.Summary = op.Summary
+	o.Enqueued = op.Enqueued
+	o.Started = optionalTime(op.Started)
+	o.Completed = optionalTime(op.Completed)
+	o.Status = string(op.Status)
+	o.ExpectedActions = op.ExpectedActions
+	if len(op.ActionCounts) > 0 {
+		o.ActionCounts = make(map[string]int, len(op.ActionCounts))
+		for status, count := range op.ActionCounts {
+			o.ActionCounts[string(status)] = count
+		}
+	}
+	o.Actions = make([]OutputAction, len(actions))
+	for i, action := range actions {
+		o.Actions[i] = OutputAction{}.FromModel(action)
+	}
 	return o
 }
 
+// optionalTime returns nil for the zero time, so that it's omitted from the
+// output.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// InputOperation enqueues the same action for a set of receivers under one
+// operation.
+type InputOperation struct {
+	// Summary describes the operation. If empty, a summary is generated from
+	// the action name.
+	Summary string `json:"summary"`
+
+	// Receivers are the tags of the units or other ActionReceivers the
+	// action is queued for.
+	Receivers []string `json:"receivers"`
+
+	// Name identifies the action that should be run.
+	Name string `json:"name"`
+
+	// Parameters holds the action's parameters, if any.
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// Validate checks the receivers and the name of the action, returning every
+// invalid field. The field errors of the receivers are indexed by the
+// receiver they belong to.
+func (o InputOperation) Validate() error {
+	var fields []FieldError
+	if len(o.Receivers) == 0 {
+		fields = append(fields, FieldError{
+			Field:   "receivers",
+			Message: "required",
+		})
+	}
+	for i, receiver := range o.Receivers {
+		index := i
+		if msg := validateReceiver(receiver); msg != "" {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("receivers[%d]", i),
+				Message: msg,
+				Index:   &index,
+			})
+		}
+	}
+	if msg := validateActionName(o.Name); msg != "" {
+		fields = append(fields, FieldError{
+			Field:   "name",
+			Message: msg,
+		})
+	}
+
+	if len(fields) > 0 {
+		return &validationError{fields: fields}
+	}
+	return nil
+}
+
+// InputBatch enqueues a batch of actions under one operation.
+type InputBatch struct {
+	// Summary describes the operation. If empty, a summary is generated from
+	// the number of actions.
+	Summary string `json:"summary"`
+
+	// Actions holds the actions to enqueue.
+	Actions []InputAction `json:"actions"`
+}
+
+// Validate checks every action of the batch, so that one invalid action
+// rejects the whole batch. The field errors are indexed by the action they
+// belong to.
+func (b InputBatch) Validate() error {
+	if len(b.Actions) == 0 {
+		return &validationError{fields: []FieldError{{
+			Field:   "actions",
+			Message: "required",
+		}}}
+	}
+
+	var fields []FieldError
+	for i, action := range b.Actions {
+		index := i
+		if action.Operation != "" {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("actions[%d].operation", i),
+				Message: "not allowed, the batch is enqueued under a new operation",
+				Index:   &index,
+			})
+		}
+		err := action.Validate()
+		verr, ok := err.(*validationError)
+		if !ok {
+			continue
+		}
+		for _, field := range verr.fields {
+			field.Field = fmt.Sprintf("actions[%d].%s", i, field.Field)
+			field.Index = &index
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > 0 {
+		return &validationError{fields: fields}
+	}
+	return nil
+}
+
+// ActionList is a page of actions.
+type ActionList struct {
+	Actions []OutputAction `json:"actions"`
+
+	// Total is the number of actions matching the filters, across all the
+	// pages.
+	Total int `json:"total"`
+
+	// Next is the path of the next page, if there is one.
+	Next string `json:"next,omitempty"`
+}
+
+// OperationList is a page of operations.
+type OperationList struct {
+	Operations []OutputOperation `json:"operations"`
+
+	// Total is the number of operations matching the filters, across all the
+	// pages.
+	Total int `json:"total"`
+
+	// Next is the path of the next page, if there is one.
+	Next string `json:"next,omitempty"`
+}
+
+// ActionSummary holds the number of actions for a group of column values.
+type ActionSummary struct {
+	Key   map[string]string `json:"key"`
+	Count int64             `json:"count"`
+}
+
+// SchemaStatus describes the schema applied to the database, compared to the
+// schema expected by the server.
+type SchemaStatus struct {
+	// Version is the highest schema version applied to the database.
+	Version int `json:"version"`
+
+	// ExpectedVersion is the version the database is at once all the
+	// patches have been applied.
+	ExpectedVersion int `json:"expected-version"`
+
+	// UpToDate is true if all the patches have been applied, and there are
+	// no unknown versions.
+	UpToDate bool `json:"up-to-date"`
+
+	// Patches holds the patches applied to the database, in version order.
+	Patches []SchemaPatch `json:"patches"`
+
+	// Missing holds the patches that haven't been applied.
+	Missing []SchemaPatch `json:"missing,omitempty"`
+
+	// Unknown holds the applied versions that don't match a known patch.
+	Unknown []int `json:"unknown,omitempty"`
+
+	// Drift describes how the live schema differs from the expected schema.
+	Drift SchemaDrift `json:"drift"`
+}
+
+// SchemaPatch identifies a schema patch, along with when it was applied.
+type SchemaPatch struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name,omitempty"`
+	AppliedAt *time.Time `json:"applied-at,omitempty"`
+}
+
+// The statuses of the schema drift.
+const (
+	driftNone    = "none"
+	driftFound   = "drifted"
+	driftUnknown = "unknown"
+)
+
+// SchemaDrift describes the objects of the live schema that differ from the
+// expected schema.
+type SchemaDrift struct {
+	// Status is none, drifted, or unknown if the schemas couldn't be
+	// compared.
+	Status string `json:"status"`
+
+	OnlyLive     []string             `json:"only-live,omitempty"`
+	OnlyExpected []string             `json:"only-expected,omitempty"`
+	Changed      []SchemaObjectChange `json:"changed,omitempty"`
+
+	// Error describes why the schemas couldn't be compared.
+	Error string `json:"error,omitempty"`
+}
+
+// SchemaObjectChange describes an object that is defined differently in the
+// live and expected schemas.
+type SchemaObjectChange struct {
+	Name     string `json:"name"`
+	Live     string `json:"live"`
+	Expected string `json:"expected"`
+}
+
+// actionNamePattern matches the valid names of actions.
+var actionNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// validateReceiver returns why the receiver of an action is invalid, or
+// empty if it's valid.
+func validateReceiver(receiver string) string {
+	if receiver == "" {
+		return "required"
+	}
+	tag, err := names.ParseTag(receiver)
+	if err != nil {
+		return fmt.Sprintf("%q is not a valid tag", receiver)
+	}
+	if kind := tag.Kind(); kind != names.UnitTagKind && kind != names.MachineTagKind {
+		return fmt.Sprintf("expected a unit or machine tag, got %s", kind)
+	}
+	return ""
+}
+
+// validateActionName returns why the name of an action is invalid, or empty
+// if it's valid.
+func validateActionName(name string) string {
+	if name == "" {
+		return "required"
+	}
+	if !actionNamePattern.MatchString(name) {
+		return fmt.Sprintf("%q is not a valid action name", name)
+	}
+	return ""
+}
+
+// Validate checks the fields of the action, returning every invalid field.
+func (i InputAction) Validate() error {
+	var fields []FieldError
+	invalid := func(field, format string, args ...interface{}) {
+		fields = append(fields, FieldError{
+			Field:   field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if msg := validateReceiver(i.Receiver); msg != "" {
+		invalid("receiver", "%s", msg)
+	}
+	if msg := validateActionName(i.Name); msg != "" {
+		invalid("name", "%s", msg)
+	}
+
+	if i.Operation != "" {
+		if _, err := strconv.ParseInt(i.Operation, 10, 64); err != nil {
+			invalid("operation", "%q is not a valid operation id", i.Operation)
+		}
+	}
+
+	if len(fields) > 0 {
+		return &validationError{fields: fields}
+	}
+	return nil
+}
+
 type InputAction struct {
 	// Receiver is the Name of the Unit or any other ActionReceiver for
 	// which this Action is queued.
@@ -77,6 +427,79 @@ type InputAction struct {
 	// against the schema defined by the named action in the unit's charm.
 	Parameters map[string]interface{} `json:"parameters"`
 
-	// Operation is the parent operation of the action.
+	// Operation is the id of the existing operation to enqueue the action
+	// under. If it's empty, a new operation is created for the action. It
+	// used to be any string, recorded as is, but as operations now have
+	// their own table, a value that isn't a numeric id is rejected as a bad
+	// request.
 	Operation string `json:"operation"`
+
+	// RequestedBy is the tag of the user or client enqueuing the action.
+	RequestedBy string `json:"requested-by"`
+
+	// Source describes where the action is enqueued from.
+	Source string `json:"source"`
+
+	// ExpiresAt is the time the action fails if it's still pending.
+	ExpiresAt time.Time `json:"expires-at"`
+}
+
+// ClusterStatus lists the nodes of the database cluster.
+type ClusterStatus struct {
+	// Leader is the database address of the leader.
+	Leader string `json:"leader"`
+
+	// Nodes holds the nodes of the cluster.
+	Nodes []ClusterMember `json:"nodes"`
+
+	// Roles describes how the roles of the nodes are managed, if they are.
+	Roles *ClusterRoles `json:"roles,omitempty"`
+}
+
+// ClusterMember describes a node of the database cluster.
+type ClusterMember struct {
+	ID      uint64 `json:"id"`
+	Address string `json:"address"`
+
+	// Role is the role of the node; voter, stand-by or spare.
+	Role string `json:"role"`
+
+	// Leader is true for the leader of the cluster.
+	Leader bool `json:"leader"`
+
+	// Online is true if the node could be reached.
+	Online bool `json:"online"`
+}
+
+// ClusterRoles describes how the roles of the nodes are managed, as seen by
+// the local node. The roles are only managed by the leader, so the changes
+// are only reported by the leader.
+type ClusterRoles struct {
+	// Voters is the target number of online voters. Stand-bys are
+	// promoted to voters whilst fewer voters are online.
+	Voters int `json:"voters"`
+
+	// Checked is the time the roles were last checked by the local node.
+	Checked *time.Time `json:"checked,omitempty"`
+
+	// Changes holds the most recent changes of roles, oldest first.
+	Changes []ClusterRoleChange `json:"changes,omitempty"`
+}
+
+// ClusterRoleChange describes a change of the role of a node.
+type ClusterRoleChange struct {
+	ID      uint64    `json:"id"`
+	Address string    `json:"address"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Time    time.Time `json:"time"`
+}
+
+// ClusterNodeRemoval describes a node removed from the database cluster.
+type ClusterNodeRemoval struct {
+	Node ClusterMember `json:"node"`
+
+	// Warnings describe the risks to the cluster now that the node has been
+	// removed, such as no longer tolerating the failure of a voter.
+	Warnings []string `json:"warnings,omitempty"`
 }
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/juju/names"
+)
+
+func TestInputActionValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  InputAction
+		fields []FieldError
+	}{{
+		name:  "valid unit",
+		input: InputAction{Receiver: "unit-mysql-0", Name: "backup"},
+	}, {
+		name:  "valid machine with operation",
+		input: InputAction{Receiver: "machine-0", Name: "pre-upgrade-check", Operation: "7"},
+	}, {
+		name:  "missing fields",
+		input: InputAction{},
+		fields: []FieldError{
+			{Field: "receiver", Message: "required"},
+			{Field: "name", Message: "required"},
+		},
+	}, {
+		name:   "malformed receiver",
+		input:  InputAction{Receiver: "mysql/0", Name: "backup"},
+		fields: []FieldError{{Field: "receiver", Message: `"mysql/0" is not a valid tag`}},
+	}, {
+		name:   "receiver of the wrong kind",
+		input:  InputAction{Receiver: "user-admin", Name: "backup"},
+		fields: []FieldError{{Field: "receiver", Message: "expected a unit or machine tag, got user"}},
+	}, {
+		name:   "invalid name",
+		input:  InputAction{Receiver: "unit-mysql-0", Name: "Back Up"},
+		fields: []FieldError{{Field: "name", Message: `"Back Up" is not a valid action name`}},
+	}, {
+		name:   "name with a trailing hyphen",
+		input:  InputAction{Receiver: "unit-mysql-0", Name: "backup-"},
+		fields: []FieldError{{Field: "name", Message: `"backup-" is not a valid action name`}},
+	}, {
+		name:   "invalid operation",
+		input:  InputAction{Receiver: "unit-mysql-0", Name: "backup", Operation: "seven"},
+		fields: []FieldError{{Field: "operation", Message: `"seven" is not a valid operation id`}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.input.Validate()
+			if test.fields == nil {
+				if err != nil {
+					t.Fatalf("got error %v, want it valid", err)
+				}
+				return
+			}
+			verr, ok := err.(*validationError)
+			if !ok {
+				t.Fatalf("got error %#v, want a validation error", err)
+			}
+			if !reflect.DeepEqual(verr.fields, test.fields) {
+				t.Fatalf("got fields %+v, want %+v", verr.fields, test.fields)
+			}
+		})
+	}
+}
+
+func TestAddActionValidation(t *testing.T) {
+	s := newTestServer(t)
+
+	// Every invalid field is reported at once.
+	rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "user-admin", Name: "Back Up"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	want := []FieldError{
+		{Field: "receiver", Message: "expected a unit or machine tag, got user"},
+		{Field: "name", Message: `"Back Up" is not a valid action name`},
+	}
+	if resp.Error.Code != codeBadRequest || !reflect.DeepEqual(resp.Error.Fields, want) {
+		t.Fatalf("got error %+v, want fields %+v", resp.Error, want)
+	}
+
+	// Nothing was enqueued.
+	if list := listActions(t, s, "/v1/actions"); list.Total != 0 {
+		t.Fatalf("got %d actions, want none", list.Total)
+	}
+}
+
+func TestAddActionParametersNotAnObject(t *testing.T) {
+	s := newTestServer(t)
+
+	body := `{"receiver": "unit-mysql-0", "name": "backup", "parameters": ["full"]}`
+	req := httptest.NewRequest("POST", "/v1/actions", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeBadRequest || resp.Error.Field != "parameters" {
+		t.Fatalf("got error %+v, want the parameters rejected", resp.Error)
+	}
+}
+
+func TestOutputActionJSON(t *testing.T) {
+	enqueued := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	tag := names.NewActionTag("f47ac10b-58cc-4372-a567-0e02b2c3d479")
+
+	tests := []struct {
+		name   string
+		action model.Action
+		want   string
+	}{{
+		name: "pending",
+		action: model.Action{
+			ID:         1,
+			Tag:        tag,
+			Receiver:   "unit-mysql-0",
+			Name:       "backup",
+			Enqueued:   enqueued,
+			Status:     model.ActionPending,
+			Generation: 1,
+		},
+		want: `{"id":1,"tag":"action-f47ac10b-58cc-4372-a567-0e02b2c3d479","receiver":"unit-mysql-0","name":"backup",` +
+			`"parameters":null,"enqueued":"2021-06-01T10:00:00Z","operation":"","status":"pending","generation":1}`,
+	}, {
+		name: "completed",
+		action: model.Action{
+			ID:         1,
+			Tag:        tag,
+			Receiver:   "unit-mysql-0",
+			Name:       "backup",
+			Parameters: map[string]interface{}{"full": true},
+			Enqueued:   enqueued,
+			Started:    enqueued.Add(time.Minute),
+			Completed:  enqueued.Add(2*time.Minute + 500*time.Millisecond),
+			Operation:  "7",
+			Status:     model.ActionFailed,
+			Message:    "disk full",
+			Generation: 3,
+		},
+		want: `{"id":1,"tag":"action-f47ac10b-58cc-4372-a567-0e02b2c3d479","receiver":"unit-mysql-0","name":"backup",` +
+			`"parameters":{"full":true},"enqueued":"2021-06-01T10:00:00Z","started":"2021-06-01T10:01:00Z",` +
+			`"completed":"2021-06-01T10:02:00.5Z","operation":"7","status":"failed","message":"disk full","generation":3}`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := json.Marshal(OutputAction{}.FromModel(test.action))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.want {
+				t.Fatalf("got JSON\n%s\nwant\n%s", data, test.want)
+			}
+		})
+	}
+}
+
+func TestOutputOperationJSON(t *testing.T) {
+	operation := model.Operation{
+		ID:              7,
+		Summary:         "backup",
+		Enqueued:        time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		Status:          model.ActionPending,
+		ExpectedActions: 2,
+	}
+
+	data, err := json.Marshal(OutputOperation{}.FromModel(operation, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":7,"summary":"backup","enqueued":"2021-06-01T10:00:00Z","status":"pending","expected-actions":2}`
+	if string(data) != want {
+		t.Fatalf("got JSON\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestGetActionOmitsUnsetFields(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	rec := do(t, s, "GET", "/v1/actions/"+strconv.FormatInt(added.ID, 10), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var raw map[string]interface{}
+	decode(t, rec, &raw)
+	for _, field := range []string{"started", "completed", "message", "expires-at"} {
+		if value, ok := raw[field]; ok {
+			t.Errorf("got %s %v, want it omitted", field, value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, raw["enqueued"].(string)); err != nil {
+		t.Errorf("got enqueued %v, want an RFC 3339 time", raw["enqueued"])
+	}
+}
+
+func TestInputOperationValidate(t *testing.T) {
+	first, second := 0, 1
+	tests := []struct {
+		name   string
+		input  InputOperation
+		fields []FieldError
+	}{{
+		name:  "valid",
+		input: InputOperation{Receivers: []string{"unit-mysql-0", "machine-1"}, Name: "backup"},
+	}, {
+		name:  "missing everything",
+		input: InputOperation{},
+		fields: []FieldError{
+			{Field: "receivers", Message: "required"},
+			{Field: "name", Message: "required"},
+		},
+	}, {
+		name:  "invalid receivers",
+		input: InputOperation{Receivers: []string{"unit-mysql", "user-admin", "unit-mysql-0"}, Name: "backup"},
+		fields: []FieldError{
+			{Field: "receivers[0]", Message: `"unit-mysql" is not a valid tag`, Index: &first},
+			{Field: "receivers[1]", Message: "expected a unit or machine tag, got user", Index: &second},
+		},
+	}, {
+		name:   "invalid name",
+		input:  InputOperation{Receivers: []string{"unit-mysql-0"}, Name: "Back Up"},
+		fields: []FieldError{{Field: "name", Message: `"Back Up" is not a valid action name`}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.input.Validate()
+			if test.fields == nil {
+				if err != nil {
+					t.Fatalf("got error %v, want it valid", err)
+				}
+				return
+			}
+			verr, ok := err.(*validationError)
+			if !ok {
+				t.Fatalf("got error %#v, want a validation error", err)
+			}
+			if !reflect.DeepEqual(verr.fields, test.fields) {
+				t.Fatalf("got fields %+v, want %+v", verr.fields, test.fields)
+			}
+		})
+	}
+}
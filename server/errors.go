@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/juju/errors"
+)
+
+// The codes of the errors returned by the API.
+const (
+	codeNotFound             = "not-found"
+	codeBadRequest           = "bad-request"
+	codeTooLarge             = "too-large"
+	codeConflict             = "conflict"
+	codeRetryLater           = "retry-later"
+	codeRateLimited          = "rate-limited"
+	codeMethodNotAllowed     = "method-not-allowed"
+	codeNotAcceptable        = "not-acceptable"
+	codeUnsupportedMediaType = "unsupported-media-type"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codePreconditionFailed   = "precondition-failed"
+	codePreconditionRequired = "precondition-required"
+	codeInternal             = "internal"
+)
+
+// retryAfter is the number of seconds clients are asked to wait before
+// retrying a request that failed with a transient error.
+const retryAfter = "1"
+
+// ErrorResponse is the envelope of every error returned by the API.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody describes an error, so that clients can distinguish the kinds of
+// errors without parsing the message.
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// RequestID identifies the request that failed, for correlating the
+	// error with the server logs.
+	RequestID string `json:"request-id,omitempty"`
+
+	// Field is the request field that caused the error, if any.
+	Field string `json:"field,omitempty"`
+
+	// Fields holds an entry for every invalid field of a request that
+	// failed validation.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes why a request field is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+
+	// Index is the index of the invalid element of a batch request.
+	Index *int `json:"index,omitempty"`
+}
+
+// validationError is returned when a request fails validation.
+type validationError struct {
+	fields []FieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, len(e.fields))
+	for i, field := range e.fields {
+		messages[i] = field.Field + ": " + field.Message
+	}
+	return "invalid request: " + strings.Join(messages, ", ")
+}
+
+// preconditionError is returned when the If-Match header of a request is
+// missing or doesn't match the current ETag.
+type preconditionError struct {
+	missing bool
+	message string
+}
+
+func (e *preconditionError) Error() string {
+	return e.message
+}
+
+// handleError writes the error response for the error, classified by the
+// typed state errors.
+func (s *Server) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if verr, ok := errors.Cause(err).(*validationError); ok {
+		writeError(w, http.StatusBadRequest, ErrorBody{
+			Code:    codeBadRequest,
+			Message: verr.Error(),
+			Fields:  verr.fields,
+		})
+		return
+	}
+
+	if perr, ok := errors.Cause(err).(*preconditionError); ok {
+		status, code := http.StatusPreconditionFailed, codePreconditionFailed
+		if perr.missing {
+			status, code = http.StatusPreconditionRequired, codePreconditionRequired
+		}
+		writeError(w, status, ErrorBody{
+			Code:    code,
+			Message: perr.Error(),
+		})
+		return
+	}
+
+	status, code := http.StatusInternalServerError, codeInternal
+	switch {
+	case stateerrors.IsNotFound(err):
+		status, code = http.StatusNotFound, codeNotFound
+	case stateerrors.IsAlreadyExists(err),
+		stateerrors.IsInvalidTransition(err),
+		stateerrors.IsConflict(err):
+		status, code = http.StatusConflict, codeConflict
+	case stateerrors.IsRetryLater(err),
+		errors.IsNotProvisioned(err),
+		errors.Cause(err) == context.DeadlineExceeded:
+		status, code = http.StatusServiceUnavailable, codeRetryLater
+		w.Header().Set("Retry-After", retryAfter)
+	case stateerrors.IsTooLarge(err):
+		status, code = http.StatusRequestEntityTooLarge, codeTooLarge
+	case stateerrors.IsBadRequest(err):
+		status, code = http.StatusBadRequest, codeBadRequest
+	case errors.IsForbidden(err):
+		status, code = http.StatusForbidden, codeForbidden
+	}
+	writeError(w, status, ErrorBody{
+		Code:    code,
+		Message: err.Error(),
+	})
+}
+
+// badRequest writes a bad request error response for the field.
+func badRequest(w http.ResponseWriter, field, format string, args ...interface{}) {
+	writeError(w, http.StatusBadRequest, ErrorBody{
+		Code:    codeBadRequest,
+		Message: fmt.Sprintf(format, args...),
+		Field:   field,
+	})
+}
+
+// decodeError writes the error response for a request body that couldn't be
+// decoded, identifying the field at fault where possible.
+func decodeError(w http.ResponseWriter, err error) {
+	var field string
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		field = e.Field
+		err = fmt.Errorf("expected %s for %q", e.Type, e.Field)
+	default:
+		// The json package doesn't export a type for unknown fields.
+		if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+			field = strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+		}
+	}
+	badRequest(w, field, "%v", err)
+}
+
+func writeError(w http.ResponseWriter, status int, body ErrorBody) {
+	if body.RequestID == "" {
+		body.RequestID = w.Header().Get(requestIDHeader)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: body})
+}
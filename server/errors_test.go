@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/juju/errors"
+)
+
+func TestHandleError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		retryAfter bool
+	}{
+		{"not found", stateerrors.NotFoundf("action 42"), http.StatusNotFound, codeNotFound, false},
+		{"already exists", errors.NewAlreadyExists(nil, "action"), http.StatusConflict, codeConflict, false},
+		{"invalid transition", stateerrors.InvalidTransitionf("action 42 from %q to %q", "completed", "running"), http.StatusConflict, codeConflict, false},
+		{"retry later", stateerrors.NewRetryLater(errors.New("locked"), "database is locked"), http.StatusServiceUnavailable, codeRetryLater, true},
+		{"not provisioned", errors.NotProvisionedf("leader"), http.StatusServiceUnavailable, codeRetryLater, true},
+		{"deadline exceeded", errors.Annotate(context.DeadlineExceeded, "running query"), http.StatusServiceUnavailable, codeRetryLater, true},
+		{"too large", stateerrors.TooLargef("parameters"), http.StatusRequestEntityTooLarge, codeTooLarge, false},
+		{"bad request", errors.BadRequestf("sorting by %q", "message"), http.StatusBadRequest, codeBadRequest, false},
+		{"forbidden", errors.Forbiddenf("removing the last voter"), http.StatusForbidden, codeForbidden, false},
+		{"internal", errors.New("disk on fire"), http.StatusInternalServerError, codeInternal, false},
+		// The classification survives annotations.
+		{"annotated", errors.Annotate(stateerrors.NotFoundf("action 42"), "getting action"), http.StatusNotFound, codeNotFound, false},
+	}
+	s := newTestServer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleError(rec, httptest.NewRequest("GET", "/v1/actions/42", nil), test.err)
+
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d", rec.Code, test.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != jsonContentType {
+				t.Fatalf("got content type %q, want %q", got, jsonContentType)
+			}
+			if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Fatalf("got X-Content-Type-Options %q, want nosniff", got)
+			}
+			if got := rec.Header().Get("Retry-After") != ""; got != test.retryAfter {
+				t.Fatalf("got Retry-After %q, want it set %v", rec.Header().Get("Retry-After"), test.retryAfter)
+			}
+
+			var body ErrorResponse
+			decode(t, rec, &body)
+			want := ErrorBody{Code: test.code, Message: test.err.Error()}
+			if !reflect.DeepEqual(body.Error, want) {
+				t.Fatalf("got error %+v, want %+v", body.Error, want)
+			}
+		})
+	}
+}
+
+func TestHandleValidationError(t *testing.T) {
+	s := newTestServer(t)
+	index := 1
+	err := &validationError{fields: []FieldError{
+		{Field: "receiver", Message: "missing receiver"},
+		{Field: "name", Message: "missing name", Index: &index},
+	}}
+
+	rec := httptest.NewRecorder()
+	s.handleError(rec, httptest.NewRequest("POST", "/v1/actions", nil), errors.Trace(err))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var body ErrorResponse
+	decode(t, rec, &body)
+	want := ErrorBody{
+		Code:    codeBadRequest,
+		Message: "invalid request: receiver: missing receiver, name: missing name",
+		Fields:  err.fields,
+	}
+	if !reflect.DeepEqual(body.Error, want) {
+		t.Fatalf("got error %+v, want %+v", body.Error, want)
+	}
+}
+
+func TestHandlePreconditionError(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		err    *preconditionError
+		status int
+		code   string
+	}{
+		{&preconditionError{missing: true, message: "missing If-Match"}, http.StatusPreconditionRequired, codePreconditionRequired},
+		{&preconditionError{message: "action has changed"}, http.StatusPreconditionFailed, codePreconditionFailed},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.handleError(rec, httptest.NewRequest("POST", "/v1/actions/42/abort", nil), test.err)
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.err.message, rec.Code, test.status)
+			continue
+		}
+		var body ErrorResponse
+		decode(t, rec, &body)
+		if body.Error.Code != test.code || body.Error.Message != test.err.message {
+			t.Errorf("got error %+v, want %q with %q", body.Error, test.code, test.err.message)
+		}
+	}
+}
+
+func TestErrorEnvelopeThroughHandler(t *testing.T) {
+	s := newTestServer(t)
+
+	// Errors from the handlers, the router and the middleware share the
+	// envelope.
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   string
+	}{
+		{"GET", "/v1/actions/42", http.StatusNotFound, codeNotFound},
+		{"GET", "/v1/unknown", http.StatusNotFound, codeNotFound},
+		{"PUT", "/v1/actions", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"GET", "/v1/actions?limit=0", http.StatusBadRequest, codeBadRequest},
+	}
+	for _, test := range tests {
+		rec := do(t, s, test.method, test.path, nil)
+		if rec.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, rec.Code, test.status)
+			continue
+		}
+		var body ErrorResponse
+		decode(t, rec, &body)
+		if body.Error.Code != test.code || body.Error.Message == "" || body.Error.RequestID == "" {
+			t.Errorf("%s %s: got error %+v, want %q with a message and request id", test.method, test.path, body.Error, test.code)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// actionFields are the fields of an OutputAction that can be selected with
+// the fields query parameter.
+var actionFields = map[string]bool{
+	"id":           true,
+	"tag":          true,
+	"receiver":     true,
+	"name":         true,
+	"parameters":   true,
+	"enqueued":     true,
+	"started":      true,
+	"completed":    true,
+	"operation":    true,
+	"status":       true,
+	"message":      true,
+	"requested-by": true,
+	"source":       true,
+	"expires-at":   true,
+	"generation":   true,
+	"results":      true,
+}
+
+// parseFields parses the fields query parameter, writing a bad request and
+// returning false if any of the fields are unknown. No fields means that
+// the whole action is selected.
+func parseFields(w http.ResponseWriter, values url.Values) ([]string, bool) {
+	var fields []string
+	for _, value := range values["fields"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			if !actionFields[field] {
+				badRequest(w, "fields", "unknown field %q", field)
+				return nil, false
+			}
+			fields = append(fields, field)
+		}
+	}
+	return fields, true
+}
+
+// actionProjection is an action restricted to the selected fields. The
+// fields are kept in their encoded form, so they're written exactly as the
+// whole action would be, including omitting unset times.
+type actionProjection map[string]json.RawMessage
+
+// projectAction restricts the action to the fields.
+func projectAction(action OutputAction, fields []string) (actionProjection, error) {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var all actionProjection
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, errors.Trace(err)
+	}
+	projection := make(actionProjection, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			projection[field] = value
+		}
+	}
+	return projection, nil
+}
+
+// projectedActionList is a page of actions restricted to the selected
+// fields.
+type projectedActionList struct {
+	Actions []actionProjection `json:"actions"`
+	Total   int                `json:"total"`
+	Next    string             `json:"next,omitempty"`
+}
+
+// projectActionList restricts every action in the list to the fields.
+func projectActionList(list ActionList, fields []string) (projectedActionList, error) {
+	output := projectedActionList{
+		Actions: make([]actionProjection, len(list.Actions)),
+		Total:   list.Total,
+		Next:    list.Next,
+	}
+	for i, action := range list.Actions {
+		projection, err := projectAction(action, fields)
+		if err != nil {
+			return projectedActionList{}, errors.Trace(err)
+		}
+		output.Actions[i] = projection
+	}
+	return output, nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// fieldNames returns the sorted names of the fields of the JSON object.
+func fieldNames(object map[string]json.RawMessage) []string {
+	var names []string
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestGetActionFields(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"?fields=id,tag,status", []string{"id", "status", "tag"}},
+		{"?fields=id&fields=name", []string{"id", "name"}},
+		{"?fields=+id+,+name+,", []string{"id", "name"}},
+		// Unset fields are still omitted.
+		{"?fields=id,started,message", []string{"id"}},
+	}
+	for _, test := range tests {
+		rec := do(t, s, "GET", path+test.query, nil)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d, body %q", test.query, rec.Code, rec.Body.String())
+			continue
+		}
+		var object map[string]json.RawMessage
+		decode(t, rec, &object)
+		if got := fieldNames(object); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GET %s: got fields %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	// The selected fields are encoded as they are in the whole action.
+	rec := do(t, s, "GET", path+"?fields=id,tag,enqueued", nil)
+	var projection OutputAction
+	decode(t, rec, &projection)
+	want := OutputAction{ID: added.ID, Tag: added.Tag, Enqueued: added.Enqueued}
+	if !reflect.DeepEqual(projection, want) {
+		t.Fatalf("got action %+v, want %+v", projection, want)
+	}
+}
+
+func TestListActionsFields(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 3; i++ {
+		addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	}
+
+	rec := do(t, s, "GET", "/v1/actions?fields=id,name&limit=2", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var list struct {
+		Actions []map[string]json.RawMessage `json:"actions"`
+		Total   int                          `json:"total"`
+		Next    string                       `json:"next"`
+	}
+	decode(t, rec, &list)
+	if len(list.Actions) != 2 || list.Total != 3 {
+		t.Fatalf("got %d of %d actions, want 2 of 3", len(list.Actions), list.Total)
+	}
+	for _, action := range list.Actions {
+		if got, want := fieldNames(action), []string{"id", "name"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got fields %v, want %v", got, want)
+		}
+	}
+
+	// The next page keeps the selected fields.
+	next := listActions(t, s, list.Next)
+	if len(next.Actions) != 1 || next.Actions[0].Status != "" {
+		t.Fatalf("got next page %+v, want 1 action with the selected fields", next.Actions)
+	}
+}
+
+func TestActionFieldsUnknown(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	for _, path := range []string{"/v1/actions?fields=id,priority", "/v1/actions/" + strconv.FormatInt(added.ID, 10) + "?fields=Status"} {
+		rec := do(t, s, "GET", path, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %d, want %d", path, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		var resp ErrorResponse
+		decode(t, rec, &resp)
+		if resp.Error.Field != "fields" {
+			t.Errorf("GET %s: got error %+v, want the fields rejected", path, resp.Error)
+		}
+	}
+}
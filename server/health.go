@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/SimonRichardson/nu-juju-data/state"
+)
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// HealthResponse is the body of the health and readiness endpoints.
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of a single health check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// ReadinessCheck returns an error if the server isn't ready to serve
+// requests.
+type ReadinessCheck func(context.Context) error
+
+type readinessCheck struct {
+	name  string
+	check ReadinessCheck
+}
+
+// AddReadinessCheck adds a check to the readiness endpoint, along with the
+// health of the state. It must be called before Serve.
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.readinessChecks = append(s.readinessChecks, readinessCheck{
+		name:  name,
+		check: check,
+	})
+}
+
+// handleHealth reports whether the process is alive and can reach the
+// backend.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request, _ params) {
+	writeHealth(w, []state.HealthCheck{{
+		Name: "backend",
+		Err:  s.state.Ping(r.Context()),
+	}})
+}
+
+// handleReady reports whether the schema is up to date, the managers are
+// healthy and every readiness check passes.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request, _ params) {
+	checks := s.state.Health(r.Context()).Checks
+	for _, readiness := range s.readinessChecks {
+		checks = append(checks, state.HealthCheck{
+			Name: readiness.name,
+			Err:  readiness.check(r.Context()),
+		})
+	}
+	writeHealth(w, checks)
+}
+
+func writeHealth(w http.ResponseWriter, checks []state.HealthCheck) {
+	response := HealthResponse{
+		Status: statusOK,
+		Checks: make([]HealthCheck, len(checks)),
+	}
+	for i, check := range checks {
+		response.Checks[i] = HealthCheck{
+			Name:   check.Name,
+			Status: statusOK,
+		}
+		if check.Err != nil {
+			response.Checks[i].Status = statusUnavailable
+			response.Checks[i].Message = check.Err.Error()
+			response.Status = statusUnavailable
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if response.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, response)
+}
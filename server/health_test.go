@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+// health returns the status and body of a health endpoint.
+func health(t *testing.T, s *Server, path string) (int, HealthResponse) {
+	t.Helper()
+
+	rec := do(t, s, "GET", path, nil)
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("got Cache-Control %q, want no-store", got)
+	}
+	var resp HealthResponse
+	decode(t, rec, &resp)
+	return rec.Code, resp
+}
+
+// findCheck returns the named check of the response.
+func findCheck(t *testing.T, resp HealthResponse, name string) HealthCheck {
+	t.Helper()
+
+	for _, check := range resp.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("check %q not found in %+v", name, resp.Checks)
+	return HealthCheck{}
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t)
+
+	status, resp := health(t, s, "/healthz")
+	if status != http.StatusOK || resp.Status != statusOK {
+		t.Fatalf("got status %d with %+v, want healthy", status, resp)
+	}
+	if check := findCheck(t, resp, "backend"); check.Status != statusOK {
+		t.Fatalf("got backend check %+v, want ok", check)
+	}
+}
+
+func TestReadyFlips(t *testing.T) {
+	s := newTestServer(t)
+	var failing int32
+	s.AddReadinessCheck("leader", func(context.Context) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return errors.NotProvisionedf("leader")
+		}
+		return nil
+	})
+
+	status, resp := health(t, s, "/readyz")
+	if status != http.StatusOK || resp.Status != statusOK {
+		t.Fatalf("got status %d with %+v, want ready", status, resp)
+	}
+	for _, name := range []string{"backend", "schema", "leader"} {
+		if check := findCheck(t, resp, name); check.Status != statusOK || check.Message != "" {
+			t.Fatalf("got check %+v, want ok", check)
+		}
+	}
+
+	// A single failing check makes the server unready, and reports why.
+	atomic.StoreInt32(&failing, 1)
+	status, resp = health(t, s, "/readyz")
+	if status != http.StatusServiceUnavailable || resp.Status != statusUnavailable {
+		t.Fatalf("got status %d with %+v, want unready", status, resp)
+	}
+	want := HealthCheck{Name: "leader", Status: statusUnavailable, Message: "leader not provisioned"}
+	if check := findCheck(t, resp, "leader"); check != want {
+		t.Fatalf("got check %+v, want %+v", check, want)
+	}
+	if check := findCheck(t, resp, "schema"); check.Status != statusOK {
+		t.Fatalf("got check %+v, want the other checks unaffected", check)
+	}
+
+	// Liveness doesn't depend on the readiness checks.
+	if status, _ := health(t, s, "/healthz"); status != http.StatusOK {
+		t.Fatalf("got health status %d, want %d", status, http.StatusOK)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	if status, _ := health(t, s, "/readyz"); status != http.StatusOK {
+		t.Fatalf("got status %d, want ready again", status)
+	}
+}
+
+func TestHealthIsPublic(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{"secret": RoleReadWrite})
+
+	// Probes don't need a token, unlike the rest of the API.
+	for _, path := range []string{"/healthz", "/readyz", "/v1/healthz", "/v1/readyz"} {
+		if status, _ := health(t, s, path); status != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want %d", path, status, http.StatusOK)
+		}
+	}
+	if rec := do(t, s, "GET", "/v1/actions", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// inMemoryStopTimeout is the time the managers of an in-memory server are
+// given to stop, which is far shorter than the default as nothing is
+// replicated.
+const inMemoryStopTimeout = 5 * time.Second
+
+// NewInMemory creates a Server over a state backed by a private in-memory
+// sqlite database, with the schema applied. It allows the handlers to be
+// exercised with httptest, without standing up dqlite. The returned function
+// stops the state and discards the database.
+func NewInMemory(ctx context.Context, clock clock.Clock) (*Server, func() error, error) {
+	backend, err := db.NewInMemorySQLDatabase()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	st := state.NewState(backend, noopLogger{}, clock, nil)
+	st.SetStopTimeout(inMemoryStopTimeout)
+	if err := st.StartUp(ctx); err != nil {
+		_ = backend.Close()
+		return nil, nil, errors.Trace(err)
+	}
+
+	s, err := New(st, nil)
+	if err != nil {
+		_ = st.Stop()
+		_ = backend.Close()
+		return nil, nil, errors.Trace(err)
+	}
+	s.SetClock(clock)
+
+	closer := func() error {
+		err := st.Stop()
+		if closeErr := backend.Close(); err == nil {
+			err = closeErr
+		}
+		return errors.Trace(err)
+	}
+	return s, closer, nil
+}
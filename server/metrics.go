@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram buckets.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// unmatchedRoute is the route label of the requests that didn't match a
+// route.
+const unmatchedRoute = "unmatched"
+
+// Metrics records the metrics of the requests served by the API, and writes
+// them in the Prometheus text exposition format.
+type Metrics struct {
+	mutex     sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+	inFlight  int64
+}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics creates a new metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.inFlight++
+}
+
+func (m *Metrics) observe(route, method string, status int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inFlight--
+	m.requests[requestKey{route: route, method: method, status: status}]++
+
+	h, ok := m.durations[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[route] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# HELP http_requests_total The number of requests served, by route, method and status.\n")
+	b.WriteString("# TYPE http_requests_total counter\n")
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "http_requests_total{method=%q,route=%q,status=\"%d\"} %d\n", key.method, key.route, key.status, m.requests[key])
+	}
+
+	b.WriteString("# HELP http_request_duration_seconds The time taken to serve requests, by route.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	routes := make([]string, 0, len(m.durations))
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.durations[route]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{route=%q,le=\"%g\"} %d\n", route, bound, h.counts[i])
+		}
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	b.WriteString("# HELP http_requests_in_flight The number of requests currently being served.\n")
+	b.WriteString("# TYPE http_requests_in_flight gauge\n")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", m.inFlight)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// routeKey is the context key of the pattern of the route that matched a
+// request, which is set by the router.
+type routeKey struct{}
+
+// setRoute records the pattern of the route that matched the request, if the
+// request is being measured.
+func setRoute(r *http.Request, pattern string) {
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*route = pattern
+	}
+}
+
+// withMetrics records the metrics of every request.
+func (s *Server) withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unmatchedRoute
+		r = r.WithContext(context.WithValue(r.Context(), routeKey{}, &route))
+
+		start := time.Now()
+		s.metrics.start()
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			s.metrics.observe(route, r.Method, recorder.statusCode(), time.Since(start))
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// MetricsProvider provides metrics beyond those of the API, such as the
+// metrics of the node or the process.
+type MetricsProvider interface {
+	// WriteMetrics writes the metrics in the Prometheus text exposition
+	// format.
+	WriteMetrics(io.Writer) error
+}
+
+// AddMetricsProvider adds the metrics of the provider to the metrics
+// endpoint, after the metrics of the API. It must be called before Serve.
+func (s *Server) AddMetricsProvider(provider MetricsProvider) {
+	s.metricsProviders = append(s.metricsProviders, provider)
+}
+
+// WriteGauge writes a gauge in the Prometheus text exposition format.
+func WriteGauge(w io.Writer, name, help string, value float64) error {
+	return writeMetric(w, name, "gauge", help, value)
+}
+
+// WriteCounter writes a counter in the Prometheus text exposition format.
+func WriteCounter(w io.Writer, name, help string, value float64) error {
+	return writeMetric(w, name, "counter", help, value)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	return err
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request, _ params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := s.metrics.WriteTo(w); err != nil {
+		s.logger.Warningf("writing metrics: %v", err)
+		return
+	}
+	for _, provider := range s.metricsProviders {
+		if err := provider.WriteMetrics(w); err != nil {
+			s.logger.Warningf("writing metrics: %v", err)
+			return
+		}
+	}
+}
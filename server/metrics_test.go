@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// scrape returns the metrics served by the server.
+func scrape(t *testing.T, s *Server) string {
+	t.Helper()
+
+	rec := do(t, s, "GET", "/metrics", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Fatalf("got content type %q, want text", got)
+	}
+	return rec.Body.String()
+}
+
+func assertMetric(t *testing.T, metrics, want string) {
+	t.Helper()
+
+	for _, line := range strings.Split(metrics, "\n") {
+		if line == want {
+			return
+		}
+	}
+	t.Fatalf("metric %q not found in:\n%s", want, metrics)
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+	do(t, s, "GET", path, nil)
+	do(t, s, "GET", path, nil)
+	do(t, s, "GET", "/v1/actions/4242", nil)
+	do(t, s, "GET", "/unknown", nil)
+
+	// Requests are labelled by the route they matched, rather than their
+	// path, so the ids don't multiply the series.
+	metrics := scrape(t, s)
+	for _, want := range []string{
+		`http_requests_total{method="POST",route="/actions",status="201"} 1`,
+		`http_requests_total{method="GET",route="/actions/{id}",status="200"} 2`,
+		`http_requests_total{method="GET",route="/actions/{id}",status="404"} 1`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_bucket{route="/actions/{id}",le="+Inf"} 3`,
+		`http_request_duration_seconds_count{route="/actions/{id}"} 3`,
+		// The scrape is in flight whilst the metrics are written.
+		`http_requests_in_flight 1`,
+	} {
+		assertMetric(t, metrics, want)
+	}
+	if strings.Contains(metrics, path) {
+		t.Fatalf("got metrics labelled by path:\n%s", metrics)
+	}
+
+	// The scrape itself is counted by the next scrape.
+	assertMetric(t, scrape(t, s), `http_requests_total{method="GET",route="/metrics",status="200"} 1`)
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := NewMetrics()
+	for _, d := range []time.Duration{time.Millisecond, 20 * time.Millisecond, 20 * time.Second} {
+		m.start()
+		m.observe("/actions", "GET", http.StatusOK, d)
+	}
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	// The buckets are cumulative.
+	for _, want := range []string{
+		`http_request_duration_seconds_bucket{route="/actions",le="0.005"} 1`,
+		`http_request_duration_seconds_bucket{route="/actions",le="0.025"} 2`,
+		`http_request_duration_seconds_bucket{route="/actions",le="10"} 2`,
+		`http_request_duration_seconds_bucket{route="/actions",le="+Inf"} 3`,
+		`http_request_duration_seconds_count{route="/actions"} 3`,
+		`http_requests_in_flight 0`,
+	} {
+		assertMetric(t, b.String(), want)
+	}
+}
+
+type fakeMetricsProvider struct {
+	err error
+}
+
+func (p fakeMetricsProvider) WriteMetrics(w io.Writer) error {
+	if p.err != nil {
+		return p.err
+	}
+	return WriteGauge(w, "dqlite_nodes", "The number of nodes in the cluster.", 3)
+}
+
+func TestMetricsProviders(t *testing.T) {
+	s := newTestServer(t)
+	logger := newRecordingLogger()
+	s.SetLogger(logger)
+	s.AddMetricsProvider(fakeMetricsProvider{})
+	s.AddMetricsProvider(fakeMetricsProvider{err: errors.New("node gone")})
+
+	metrics := scrape(t, s)
+	assertMetric(t, metrics, "# TYPE dqlite_nodes gauge")
+	assertMetric(t, metrics, "dqlite_nodes 3")
+
+	// A failing provider is logged, without losing the metrics written
+	// before it.
+	if got, want := fmt.Sprint(logger.logged("warning")), "[writing metrics: node gone]"; got != want {
+		t.Fatalf("got warnings %s, want %s", got, want)
+	}
+}
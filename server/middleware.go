@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+)
+
+// withTimeout cancels the context of each request once the request timeout
+// has passed. Long running requests can opt out with withoutRequestTimeout.
+func (s *Server) withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), untimedKey{}, r.Context())
+		ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// withAccessLog logs every request once it has been served.
+func (s *Server) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.accessLogging {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		s.logger.Infof("%s %s %d %s %dB %s request-id=%s",
+			r.Method, r.URL.Path, recorder.statusCode(), time.Since(start), recorder.bytes, r.RemoteAddr, db.RequestID(r.Context()))
+	})
+}
+
+// withRecovery recovers a panicking handler, logging the stack and responding
+// with an internal error.
+func (s *Server) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.panicRecovery {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// The http server uses ErrAbortHandler to abort a response
+			// without logging, so it's passed on.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			s.logger.Errorf("panic serving %s %s (request-id=%s): %v\n%s", r.Method, r.URL.Path, db.RequestID(r.Context()), v, debug.Stack())
+			writeError(w, http.StatusInternalServerError, ErrorBody{
+				Code:    codeInternal,
+				Message: "internal server error",
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder records the status code and number of bytes written in a
+// response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// noopLogger discards all log messages.
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...interface{})   {}
+func (noopLogger) Infof(string, ...interface{})    {}
+func (noopLogger) Warningf(string, ...interface{}) {}
+func (noopLogger) Errorf(string, ...interface{})   {}
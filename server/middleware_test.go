@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger records the messages logged at each level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{messages: make(map[string][]string)}
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", format, args...)
+}
+
+func (l *recordingLogger) Warningf(format string, args ...interface{}) {
+	l.record("warning", format, args...)
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", format, args...)
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) logged(level string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages[level]...)
+}
+
+func TestAccessLog(t *testing.T) {
+	s := newTestServer(t)
+	logger := newRecordingLogger()
+	s.SetLogger(logger)
+
+	rec := do(t, s, "GET", "/v1/actions/42", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	logged := logger.logged("info")
+	if len(logged) != 1 {
+		t.Fatalf("got access logs %q, want one", logged)
+	}
+	requestID := rec.Header().Get(requestIDHeader)
+	for _, want := range []string{"GET /v1/actions/42 404 ", "request-id=" + requestID} {
+		if !strings.Contains(logged[0], want) {
+			t.Fatalf("got access log %q, want it to contain %q", logged[0], want)
+		}
+	}
+
+	// Access logs can be turned off.
+	s.SetAccessLogging(false)
+	do(t, s, "GET", "/v1/actions/42", nil)
+	if logged := logger.logged("info"); len(logged) != 1 {
+		t.Fatalf("got access logs %q, want them turned off", logged)
+	}
+}
+
+func TestAccessLogRecordsImplicitStatus(t *testing.T) {
+	logger := newRecordingLogger()
+	s := &Server{logger: logger, accessLogging: true}
+	handler := s.withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	logged := logger.logged("info")
+	if len(logged) != 1 || !strings.Contains(logged[0], "GET /healthz 200 ") || !strings.Contains(logged[0], " 5B ") {
+		t.Fatalf("got access logs %q, want the implicit status and size", logged)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	logger := newRecordingLogger()
+	s := &Server{logger: logger, panicRecovery: true}
+	handler := s.withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/actions", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeInternal || strings.Contains(resp.Error.Message, "boom") {
+		t.Fatalf("got error %+v, want an internal error without the panic", resp.Error)
+	}
+
+	// The panic and its stack are logged, rather than sent to the client.
+	logged := logger.logged("error")
+	if len(logged) != 1 || !strings.Contains(logged[0], "panic serving GET /v1/actions") || !strings.Contains(logged[0], "goroutine ") {
+		t.Fatalf("got errors %q, want the panic with its stack", logged)
+	}
+}
+
+func TestPanicRecoveryPassesOnAbort(t *testing.T) {
+	s := &Server{logger: newRecordingLogger(), panicRecovery: true}
+	handler := s.withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Fatalf("got panic %v, want the abort passed on", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/actions/42/watch", nil))
+}
+
+func TestPanicRecoveryDisabled(t *testing.T) {
+	s := &Server{logger: newRecordingLogger()}
+	handler := s.withRecovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Fatalf("got panic %v, want the panic passed on", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/actions", nil))
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/SimonRichardson/nu-juju-data/state/operationstate"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// operationListParams are the query parameters accepted when listing
+// operations.
+var operationListParams = map[string]bool{
+	"status": true,
+	"limit":  true,
+	"offset": true,
+	"pretty": true,
+}
+
+// operationHandler parses the id segment of the path, before calling the
+// handler with the id of the operation.
+func (s *Server) operationHandler(handler func(http.ResponseWriter, *http.Request, int64)) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, p params) {
+		id, err := strconv.ParseInt(p["id"], 10, 64)
+		if err != nil {
+			badRequest(w, "id", "invalid operation id %q", p["id"])
+			return
+		}
+		handler(w, r, id)
+	}
+}
+
+// handleListOperations returns a page of the operations, optionally filtered
+// by status.
+func (s *Server) handleListOperations(w http.ResponseWriter, r *http.Request, _ params) {
+	values := r.URL.Query()
+	for name := range values {
+		if !operationListParams[name] {
+			badRequest(w, name, "unknown query parameter %q", name)
+			return
+		}
+	}
+
+	filter := operationstate.ListFilter{
+		Limit: defaultListLimit,
+	}
+	for _, value := range values["status"] {
+		for _, status := range strings.Split(value, ",") {
+			filter.Statuses = append(filter.Statuses, model.ActionStatus(status))
+		}
+	}
+	if !parsePage(w, values, &filter.Limit, &filter.Offset) {
+		return
+	}
+
+	var (
+		operations []model.Operation
+		total      int
+	)
+	err := s.state.View(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		operations, total, err = s.operationMgr.ListOperations(tx, filter)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output := OperationList{
+		Operations: make([]OutputOperation, len(operations)),
+		Total:      total,
+	}
+	for i, operation := range operations {
+		output.Operations[i] = OutputOperation{}.FromModel(operation, nil)
+	}
+	if next := filter.Offset + len(operations); next < total {
+		values.Set("offset", strconv.Itoa(next))
+		output.Next = r.URL.Path + "?" + values.Encode()
+	}
+	encodeJSON(w, output)
+}
+
+// handleGetOperation returns the operation, along with the number of actions
+// for each status and the actions enqueued under it.
+func (s *Server) handleGetOperation(w http.ResponseWriter, r *http.Request, id int64) {
+	operation, actions, err := s.operationWithActions(r.Context(), id)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	encodeJSON(w, OutputOperation{}.FromModel(operation, actions))
+}
+
+// handleOperationActions returns the actions enqueued under the operation.
+// A missing operation is not found, rather than having no actions.
+func (s *Server) handleOperationActions(w http.ResponseWriter, r *http.Request, id int64) {
+	_, actions, err := s.operationWithActions(r.Context(), id)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output := make([]OutputAction, len(actions))
+	for i, action := range actions {
+		output[i] = OutputAction{}.FromModel(action)
+	}
+	encodeJSON(w, output)
+}
+
+func (s *Server) operationWithActions(ctx context.Context, id int64) (model.Operation, []model.Action, error) {
+	var (
+		operation model.Operation
+		actions   []model.Action
+	)
+	err := s.state.View(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		if operation, err = s.operationMgr.OperationByID(tx, id); err != nil {
+			return errors.Trace(err)
+		}
+		actions, err = s.actionMgr.ActionsByOperation(tx, strconv.FormatInt(id, 10))
+		return errors.Trace(err)
+	})
+	return operation, actions, errors.Trace(err)
+}
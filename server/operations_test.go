@@ -0,0 +1,166 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+)
+
+// addOperation enqueues the action for each of the receivers under a new
+// operation.
+func addOperation(t *testing.T, s *Server, name string, receivers ...string) OutputOperation {
+	t.Helper()
+
+	rec := do(t, s, "POST", "/v1/operations", InputOperation{Receivers: receivers, Name: name})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("adding operation: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputOperation
+	decode(t, rec, &output)
+	return output
+}
+
+func listOperations(t *testing.T, s *Server, path string) OperationList {
+	t.Helper()
+
+	rec := do(t, s, "GET", path, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing %s: got status %d, body %q", path, rec.Code, rec.Body.String())
+	}
+	var list OperationList
+	decode(t, rec, &list)
+	return list
+}
+
+func operationIDs(list OperationList) []int64 {
+	ids := make([]int64, len(list.Operations))
+	for i, operation := range list.Operations {
+		ids[i] = operation.ID
+	}
+	return ids
+}
+
+func TestListOperations(t *testing.T) {
+	s := newTestServer(t)
+	first := addOperation(t, s, "backup", "unit-mysql-0")
+	second := addOperation(t, s, "backup", "unit-mysql-1")
+	third := addOperation(t, s, "restore", "unit-mysql-0", "unit-mysql-1")
+	beginAction(t, s, second.Actions[0].ID)
+
+	list := listOperations(t, s, "/v1/operations")
+	if got, want := operationIDs(list), []int64{first.ID, second.ID, third.ID}; list.Total != 3 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got operations %v of %d, want %v", got, list.Total, want)
+	}
+
+	// The status filter matches the status derived from the actions.
+	list = listOperations(t, s, "/v1/operations?status=running")
+	if got, want := operationIDs(list), []int64{second.ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got running operations %v, want %v", got, want)
+	}
+	list = listOperations(t, s, "/v1/operations?status=pending,running")
+	if list.Total != 3 {
+		t.Fatalf("got %d pending or running operations, want 3", list.Total)
+	}
+}
+
+func TestListOperationsPages(t *testing.T) {
+	s := newTestServer(t)
+	var want []int64
+	for i := 0; i < 5; i++ {
+		want = append(want, addOperation(t, s, "backup", "unit-mysql-0").ID)
+	}
+
+	var got []int64
+	path := "/v1/operations?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == 3 {
+			t.Fatalf("got more than 3 pages")
+		}
+		list := listOperations(t, s, path)
+		if list.Total != 5 {
+			t.Fatalf("got a total of %d operations, want 5", list.Total)
+		}
+		got = append(got, operationIDs(list)...)
+		path = list.Next
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got operations %v across the pages, want %v", got, want)
+	}
+}
+
+func TestListOperationsInvalid(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, query := range []string{"?limit=0", "?offset=-1", "?receiver=unit-mysql-0"} {
+		if rec := do(t, s, "GET", "/v1/operations"+query, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /v1/operations%s: got status %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetOperation(t *testing.T) {
+	s := newTestServer(t)
+	added := addOperation(t, s, "backup", "unit-mysql-0", "unit-mysql-1", "unit-mysql-2")
+	beginAction(t, s, added.Actions[0].ID)
+
+	rec := do(t, s, "GET", "/v1/operations/"+strconv.FormatInt(added.ID, 10), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputOperation
+	decode(t, rec, &output)
+	if output.Status != string(model.ActionRunning) || output.ExpectedActions != 3 || len(output.Actions) != 3 {
+		t.Fatalf("got operation %+v, want 3 actions with one running", output)
+	}
+	want := map[string]int{
+		string(model.ActionPending): 2,
+		string(model.ActionRunning): 1,
+	}
+	if !reflect.DeepEqual(output.ActionCounts, want) {
+		t.Fatalf("got action counts %v, want %v", output.ActionCounts, want)
+	}
+}
+
+func TestOperationActions(t *testing.T) {
+	s := newTestServer(t)
+	added := addOperation(t, s, "backup", "unit-mysql-0", "unit-mysql-1")
+	addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "restore"})
+
+	rec := do(t, s, "GET", "/v1/operations/"+strconv.FormatInt(added.ID, 10)+"/actions", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var actions []OutputAction
+	decode(t, rec, &actions)
+	if len(actions) != 2 {
+		t.Fatalf("got actions %+v, want the 2 actions of the operation", actions)
+	}
+	for _, action := range actions {
+		if action.Operation != strconv.FormatInt(added.ID, 10) {
+			t.Fatalf("got action %+v under another operation", action)
+		}
+	}
+}
+
+func TestOperationNotFound(t *testing.T) {
+	s := newTestServer(t)
+
+	// A missing operation is not found, rather than having no actions.
+	for _, path := range []string{"/v1/operations/4242", "/v1/operations/4242/actions"} {
+		if rec := do(t, s, "GET", path, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+	rec := do(t, s, "GET", "/v1/operations/backup", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Field != "id" {
+		t.Fatalf("got error %+v, want the id rejected", resp.Error)
+	}
+}
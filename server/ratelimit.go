@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/clock"
+)
+
+// bucketIdleTimeout is how long a client's bucket is kept once it's full, so
+// that the limiter's memory is bounded by the number of active clients.
+const bucketIdleTimeout = time.Minute
+
+// maxBuckets is the most clients the limiter tracks separately. Once there
+// are as many clients, any new client shares the overflow bucket.
+const maxBuckets = 10000
+
+// overflowKey is the key of the bucket shared by the clients that aren't
+// tracked separately.
+const overflowKey = "overflow"
+
+// rateLimiter is a token bucket rate limiter, keyed by client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the client's bucket at the time now. If the
+// bucket is empty, the time until the next token is available is returned.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastSweep) >= bucketIdleTimeout {
+		l.sweep(now, bucketIdleTimeout)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxBuckets {
+		// Any refilled bucket is no different to a new bucket, however
+		// recently it was used.
+		l.sweep(now, 0)
+		if len(l.buckets) >= maxBuckets {
+			key = overflowKey
+			b, ok = l.buckets[key]
+		}
+	}
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// sweep removes the buckets that have refilled and been idle for the idle
+// time, as they're no different to a new bucket.
+func (l *rateLimiter) sweep(now time.Time, idle time.Duration) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= idle && l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// SetRateLimit limits the rate of requests that change the state for each
+// client, to the rate of requests per second with bursts of up to burst
+// requests. Clients are identified by their bearer token once it has been
+// authenticated, otherwise by their address. A rate of zero disables the
+// limit. It must be called before Serve.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		s.rateLimiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	s.rateLimiter = newRateLimiter(rate, burst)
+}
+
+// SetClock sets the clock used by the server. It must be called before
+// Serve.
+func (s *Server) SetClock(clock clock.Clock) {
+	s.clock = clock
+}
+
+// withRateLimit rejects the requests that change the state from clients that
+// have exceeded their rate limit.
+func (s *Server) withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimiter == nil || isReadOnlyMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, wait := s.rateLimiter.allow(clientKey(r), s.clock.Now())
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, ErrorBody{
+				Code:    codeRateLimited,
+				Message: "too many requests, retry after " + wait.Round(time.Millisecond).String(),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenKey is the context key of the bearer token of a request, once it has
+// been authenticated.
+type tokenKey struct{}
+
+// withToken returns the request with its authenticated bearer token.
+func withToken(r *http.Request, token string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenKey{}, token))
+}
+
+// clientKey identifies the client of a request, by its bearer token once it
+// has been authenticated, otherwise by its address. An unauthenticated token
+// can't be trusted, as the client can change it for every request.
+func clientKey(r *http.Request) string {
+	if token, ok := r.Context().Value(tokenKey{}).(string); ok && token != "" {
+		return "token:" + token
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
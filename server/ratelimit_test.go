@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/juju/clock/testclock"
+)
+
+// postAction adds an action with the authorization header, if there is one,
+// returning the response.
+func postAction(t *testing.T, s *Server, authorization string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := bytes.NewBufferString(`{"receiver":"unit-mysql-0","name":"backup"}`)
+	req := httptest.NewRequest("POST", "/v1/actions", body)
+	req.Header.Set("Content-Type", jsonContentType)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	// The clock is set after the rate limit, and still used by it.
+	s.SetRateLimit(1, 2)
+	clock := testclock.NewClock(time.Now())
+	s.SetClock(clock)
+
+	for i := 0; i < 2; i++ {
+		if rec := postAction(t, s, ""); rec.Code != http.StatusCreated {
+			t.Fatalf("request %d: got status %d, body %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	rec := postAction(t, s, "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want 1", got)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeRateLimited {
+		t.Errorf("got error code %q, want %q", resp.Error.Code, codeRateLimited)
+	}
+
+	// Reads aren't limited.
+	if rec := do(t, s, "GET", "/v1/actions", nil); rec.Code != http.StatusOK {
+		t.Errorf("got status %d for a read, want %d", rec.Code, http.StatusOK)
+	}
+
+	// Without authentication the token isn't trusted, so a new token doesn't
+	// get a new bucket.
+	if rec := postAction(t, s, "Bearer another"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d with an unauthenticated token, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	clock.Advance(time.Second)
+	if rec := postAction(t, s, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d once a token has refilled, body %q", rec.Code, rec.Body.String())
+	}
+	if rec := postAction(t, s, ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestRateLimitByAuthenticatedToken(t *testing.T) {
+	s := newTestServer(t)
+	s.SetTokens(map[string]Role{
+		"alpha": RoleReadWrite,
+		"beta":  RoleReadWrite,
+	})
+	s.SetRateLimit(1, 1)
+	s.SetClock(testclock.NewClock(time.Now()))
+
+	if rec := postAction(t, s, "Bearer alpha"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec := postAction(t, s, "Bearer alpha"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// Each authenticated token has its own bucket.
+	if rec := postAction(t, s, "Bearer beta"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d for another token, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRateLimiterBucketsAreCapped(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+
+	for i := 0; i < maxBuckets+10; i++ {
+		if allowed, _ := l.allow("addr:"+strconv.Itoa(i), now); !allowed && i < maxBuckets {
+			t.Fatalf("client %d: got limited, want its own bucket", i)
+		}
+	}
+	if n := len(l.buckets); n > maxBuckets+1 {
+		t.Fatalf("got %d buckets, want at most %d", n, maxBuckets+1)
+	}
+	// The clients beyond the cap share a bucket.
+	if allowed, _ := l.allow("addr:new", now); allowed {
+		t.Fatalf("got a client beyond the cap allowed, want it to share the empty overflow bucket")
+	}
+
+	// Refilled buckets make room for new clients.
+	now = now.Add(time.Second)
+	if allowed, _ := l.allow("addr:new", now); !allowed {
+		t.Fatalf("got limited once the buckets have refilled")
+	}
+	if _, ok := l.buckets["addr:new"]; !ok {
+		t.Fatalf("got no bucket for the new client once the buckets have refilled")
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/juju/utils"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLength is the longest request ID accepted from a client.
+	maxRequestIDLength = 128
+)
+
+// withRequestID identifies every request, using the ID supplied by the client
+// in the X-Request-ID header if it's valid, or generating a new ID. The ID is
+// returned in the response header, and carried by the request context so that
+// it reaches the transactions run for the request.
+func (s *Server) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			uuid, err := utils.NewUUID()
+			if err != nil {
+				s.logger.Warningf("generating request ID: %v", err)
+			} else {
+				id = uuid.String()
+			}
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(db.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID returns true if the ID is short and only contains printable
+// ASCII characters, so that it's safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/juju/utils"
+)
+
+func TestRequestIDEchoed(t *testing.T) {
+	s := newTestServer(t)
+	logger := newRecordingLogger()
+	s.SetLogger(logger)
+
+	req := httptest.NewRequest("GET", "/v1/actions/4242", nil)
+	req.Header.Set(requestIDHeader, "trace-1234")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(requestIDHeader); got != "trace-1234" {
+		t.Fatalf("got %s %q, want the client's ID", requestIDHeader, got)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.RequestID != "trace-1234" {
+		t.Fatalf("got error %+v, want the client's request ID", resp.Error)
+	}
+	logged := logger.logged("info")
+	if len(logged) != 1 || !strings.Contains(logged[0], "request-id=trace-1234") {
+		t.Fatalf("got access logs %q, want the client's request ID", logged)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	s := newTestServer(t)
+
+	// Missing and invalid IDs are replaced with a generated ID.
+	for _, id := range []string{"", "has spaces", "café", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest("GET", "/v1/actions/4242", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+
+		got := rec.Header().Get(requestIDHeader)
+		if !utils.IsValidUUIDString(got) {
+			t.Errorf("%s %q: got %q, want a generated UUID", requestIDHeader, id, got)
+			continue
+		}
+		var resp ErrorResponse
+		decode(t, rec, &resp)
+		if resp.Error.RequestID != got {
+			t.Errorf("%s %q: got error request ID %q, want %q", requestIDHeader, id, resp.Error.RequestID, got)
+		}
+	}
+}
+
+func TestRequestIDInContext(t *testing.T) {
+	s := &Server{logger: noopLogger{}}
+
+	// The ID reaches the handlers, and through them the transactions, via
+	// the request context.
+	var got string
+	handler := s.withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = db.RequestID(r.Context())
+	}))
+	req := httptest.NewRequest("GET", "/v1/actions", nil)
+	req.Header.Set(requestIDHeader, strings.Repeat("a", maxRequestIDLength))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != strings.Repeat("a", maxRequestIDLength) {
+		t.Fatalf("got request ID %q in the context, want the client's ID", got)
+	}
+}
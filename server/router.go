@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// params holds the values of the named segments of a matched route.
+type params map[string]string
+
+// handlerFunc handles a request for a route, along with the values of the
+// named segments of the route.
+type handlerFunc func(http.ResponseWriter, *http.Request, params)
+
+// router routes requests by method and path. Paths are matched segment by
+// segment, where a segment of the form {name} matches any value. Routes are
+// matched in the order they're added, so literal routes should be added
+// before the routes they overlap with. Requests that don't accept the content
+// type produced by a route are not acceptable.
+//
+// HEAD is served by the GET handler of a route, without the body, and OPTIONS
+// is answered with the methods allowed for the route.
+//
+// Every route is served under the API version prefix, with the unversioned
+// paths kept as aliases whilst clients migrate. The pretty query parameter
+// indents the JSON responses.
+type router struct {
+	routes []*route
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	handlers map[string]handlerFunc
+	produces map[string]string
+}
+
+// handle adds the handler for the method and pattern, which produces JSON.
+func (rt *router) handle(method, pattern string, handler handlerFunc) {
+	rt.handleContent(method, pattern, jsonContentType, handler)
+}
+
+// handleContent adds the handler for the method and pattern, which produces
+// the content type.
+func (rt *router) handleContent(method, pattern, contentType string, handler handlerFunc) {
+	segments := splitPath(pattern)
+	for _, r := range rt.routes {
+		if equalSegments(r.segments, segments) {
+			r.handlers[method] = handler
+			r.produces[method] = contentType
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		pattern:  pattern,
+		segments: segments,
+		handlers: map[string]handlerFunc{method: handler},
+		produces: map[string]string{method: contentType},
+	})
+}
+
+// ServeHTTP implements http.Handler. Unknown paths are not found, and known
+// paths with the wrong method are not allowed, listing the allowed methods.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		w = prettyResponseWriter{ResponseWriter: w}
+	}
+
+	path := splitPath(unversionedPath(r.URL.Path))
+	for _, route := range rt.routes {
+		values, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		setRoute(r, route.pattern)
+
+		method := r.Method
+		if method == http.MethodOptions {
+			w.Header().Set("Allow", strings.Join(route.methods(), ", "))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if _, ok := route.handlers[method]; !ok && method == http.MethodHead {
+			method = http.MethodGet
+			w = headResponseWriter{ResponseWriter: w}
+		}
+
+		handler, ok := route.handlers[method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(route.methods(), ", "))
+			writeError(w, http.StatusMethodNotAllowed, ErrorBody{
+				Code:    codeMethodNotAllowed,
+				Message: fmt.Sprintf("method %s not allowed", r.Method),
+			})
+			return
+		}
+		if contentType := route.produces[method]; !acceptsContentType(r, contentType) {
+			writeError(w, http.StatusNotAcceptable, ErrorBody{
+				Code:    codeNotAcceptable,
+				Message: fmt.Sprintf("path %q only produces %s", r.URL.Path, contentType),
+			})
+			return
+		}
+		handler(w, r, values)
+		return
+	}
+	writeError(w, http.StatusNotFound, ErrorBody{
+		Code:    codeNotFound,
+		Message: fmt.Sprintf("path %q not found", r.URL.Path),
+	})
+}
+
+func (r *route) match(path []string) (params, bool) {
+	if len(path) != len(r.segments) {
+		return nil, false
+	}
+	values := make(params)
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if path[i] == "" {
+				return nil, false
+			}
+			values[segment[1:len(segment)-1]] = path[i]
+			continue
+		}
+		if path[i] != segment {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// methods returns the methods allowed for the route, including HEAD for the
+// routes that can be read and OPTIONS.
+func (r *route) methods() []string {
+	methods := []string{http.MethodOptions}
+	for method := range r.handlers {
+		methods = append(methods, method)
+	}
+	if _, ok := r.handlers[http.MethodGet]; ok {
+		if _, ok := r.handlers[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// headResponseWriter discards the body of a response, so that a GET handler
+// can serve a HEAD request.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// apiVersionPrefix is the path prefix of the current version of the API.
+const apiVersionPrefix = "/v1"
+
+// unversionedPath returns the path without the API version prefix, so that
+// the versioned paths and their unversioned aliases are treated the same.
+func unversionedPath(path string) string {
+	if path == apiVersionPrefix {
+		return "/"
+	}
+	if strings.HasPrefix(path, apiVersionPrefix+"/") {
+		return path[len(apiVersionPrefix):]
+	}
+	return path
+}
+
+// prettyResponseWriter marks a response that should be indented.
+type prettyResponseWriter struct {
+	http.ResponseWriter
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+func equalSegments(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
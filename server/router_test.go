@@ -0,0 +1,264 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestRouter returns a router whose handlers write the name of the route
+// and the values of its segments.
+func newTestRouter() *router {
+	named := func(name string) handlerFunc {
+		return func(w http.ResponseWriter, r *http.Request, values params) {
+			var keys []string
+			for key, value := range values {
+				keys = append(keys, key+"="+value)
+			}
+			sort.Strings(keys)
+			fmt.Fprint(w, strings.TrimSpace(name+" "+strings.Join(keys, " ")))
+		}
+	}
+
+	rt := &router{}
+	rt.handle("GET", "/actions", named("list"))
+	rt.handle("POST", "/actions", named("add"))
+	rt.handle("GET", "/actions/search", named("search"))
+	rt.handle("GET", "/actions/{id}", named("get"))
+	rt.handle("DELETE", "/actions/{id}", named("cancel"))
+	rt.handle("POST", "/actions/{id}/abort", named("abort"))
+	rt.handle("GET", "/operations/{id}/actions/{action}", named("operation action"))
+	return rt
+}
+
+func serve(rt *router, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func TestRouterMatches(t *testing.T) {
+	rt := newTestRouter()
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/actions", "list"},
+		{"GET", "/actions/", "list"},
+		{"POST", "/actions", "add"},
+		// Literal routes added before an overlapping route take precedence.
+		{"GET", "/actions/search", "search"},
+		{"GET", "/actions/42", "get id=42"},
+		{"DELETE", "/actions/42", "cancel id=42"},
+		{"POST", "/actions/42/abort", "abort id=42"},
+		{"GET", "/operations/7/actions/42", "operation action action=42 id=7"},
+	}
+	for _, test := range tests {
+		// Every route is served with and without the version prefix.
+		for _, path := range []string{test.path, apiVersionPrefix + test.path} {
+			rec := serve(rt, test.method, path)
+			if rec.Code != http.StatusOK || rec.Body.String() != test.want {
+				t.Errorf("%s %s: got status %d body %q, want %q", test.method, path, rec.Code, rec.Body.String(), test.want)
+			}
+		}
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	rt := newTestRouter()
+
+	for _, path := range []string{"/", "/v1", "/v2/actions", "/unknown", "/actions/42/unknown", "/actions//abort", "/operations/7/actions"} {
+		rec := serve(rt, "GET", path)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got status %d, body %q", path, rec.Code, rec.Body.String())
+			continue
+		}
+		var body ErrorResponse
+		decode(t, rec, &body)
+		if body.Error.Code != codeNotFound {
+			t.Errorf("GET %s: got error %+v, want not found", path, body.Error)
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	rt := newTestRouter()
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"DELETE", "/actions", "GET, HEAD, OPTIONS, POST"},
+		{"PUT", "/actions/42", "DELETE, GET, HEAD, OPTIONS"},
+		{"GET", "/v1/actions/42/abort", "OPTIONS, POST"},
+	}
+	for _, test := range tests {
+		rec := serve(rt, test.method, test.path)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: got status %d, body %q", test.method, test.path, rec.Code, rec.Body.String())
+			continue
+		}
+		if got := rec.Header().Get("Allow"); got != test.allow {
+			t.Errorf("%s %s: got Allow %q, want %q", test.method, test.path, got, test.allow)
+		}
+		var body ErrorResponse
+		decode(t, rec, &body)
+		if body.Error.Code != codeMethodNotAllowed {
+			t.Errorf("%s %s: got error %+v, want method not allowed", test.method, test.path, body.Error)
+		}
+	}
+}
+
+func TestRouterHeadAndOptions(t *testing.T) {
+	rt := newTestRouter()
+
+	rec := serve(rt, "HEAD", "/actions/42")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("got status %d body %q, want the GET handler without a body", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(rt, "OPTIONS", "/v1/actions/42")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got, want := rec.Header().Get("Allow"), "DELETE, GET, HEAD, OPTIONS"; got != want {
+		t.Fatalf("got Allow %q, want %q", got, want)
+	}
+}
+
+func TestRouterNotAcceptable(t *testing.T) {
+	rt := newTestRouter()
+
+	tests := []struct {
+		accept string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"application/json", http.StatusOK},
+		{"application/*", http.StatusOK},
+		{"text/html, */*;q=0.1", http.StatusOK},
+		{"text/html", http.StatusNotAcceptable},
+		{"application/json;q=0", http.StatusNotAcceptable},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/actions", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("Accept %q: got status %d, want %d", test.accept, rec.Code, test.status)
+		}
+	}
+}
+
+func TestActionsMethods(t *testing.T) {
+	s := newTestServer(t)
+	addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	tests := []struct {
+		method string
+		status int
+		allow  string
+	}{
+		{"GET", http.StatusOK, ""},
+		{"HEAD", http.StatusOK, ""},
+		{"OPTIONS", http.StatusNoContent, "GET, HEAD, OPTIONS, POST"},
+		{"PUT", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST"},
+		{"PATCH", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST"},
+		{"DELETE", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST"},
+	}
+	for _, test := range tests {
+		rec := do(t, s, test.method, "/v1/actions", nil)
+		if rec.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.method, rec.Code, test.status)
+			continue
+		}
+		if got := rec.Header().Get("Allow"); got != test.allow {
+			t.Errorf("%s: got Allow %q, want %q", test.method, got, test.allow)
+		}
+	}
+}
+
+func TestActionsHead(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	// HEAD is GET without the body.
+	get := do(t, s, "GET", path, nil)
+	head := do(t, s, "HEAD", path, nil)
+	if head.Code != get.Code || head.Body.Len() != 0 {
+		t.Fatalf("got status %d with a body of %d bytes, want %d without a body", head.Code, head.Body.Len(), get.Code)
+	}
+	for _, name := range []string{"Content-Type", "ETag"} {
+		if got, want := head.Header().Get(name), get.Header().Get(name); got != want || got == "" {
+			t.Errorf("got %s %q, want %q", name, got, want)
+		}
+	}
+
+	if rec := do(t, s, "HEAD", "/v1/actions/4242", nil); rec.Code != http.StatusNotFound || rec.Body.Len() != 0 {
+		t.Fatalf("got status %d with body %q, want %d without a body", rec.Code, rec.Body.String(), http.StatusNotFound)
+	}
+}
+
+func TestVersionedAndUnversionedPathsMatch(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	addOperation(t, s, "restore", "unit-mysql-1")
+
+	for _, path := range []string{
+		"/actions",
+		"/actions/" + strconv.FormatInt(added.ID, 10),
+		"/actions/summary?by=status",
+		"/operations",
+	} {
+		versioned := do(t, s, "GET", apiVersionPrefix+path, nil)
+		unversioned := do(t, s, "GET", path, nil)
+		if versioned.Code != http.StatusOK || unversioned.Code != http.StatusOK {
+			t.Errorf("GET %s: got statuses %d and %d, want %d", path, versioned.Code, unversioned.Code, http.StatusOK)
+			continue
+		}
+		if versioned.Body.String() != unversioned.Body.String() {
+			t.Errorf("GET %s: got payloads\n%s\nand\n%s\nwant them identical", path, versioned.Body.String(), unversioned.Body.String())
+		}
+	}
+}
+
+func TestPrettyResponses(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	tests := []struct {
+		query  string
+		pretty bool
+	}{
+		{"", false},
+		{"?pretty=false", false},
+		{"?pretty=true", true},
+		{"?pretty=1", true},
+		{"?pretty", false},
+	}
+	for _, test := range tests {
+		for _, target := range []string{path, "/v1/actions"} {
+			rec := do(t, s, "GET", target+test.query, nil)
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET %s%s: got status %d, body %q", target, test.query, rec.Code, rec.Body.String())
+				continue
+			}
+			body := strings.TrimSuffix(rec.Body.String(), "\n")
+			if got := strings.Contains(body, "\n    \""); got != test.pretty {
+				t.Errorf("GET %s%s: got body %q, want indented %v", target, test.query, body, test.pretty)
+			}
+		}
+	}
+}
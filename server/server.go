@@ -2,127 +2,851 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/SimonRichardson/nu-juju-data/model"
 	"github.com/SimonRichardson/nu-juju-data/state"
 	"github.com/SimonRichardson/nu-juju-data/state/actionstate"
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/SimonRichardson/nu-juju-data/state/operationstate"
 	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
 	"github.com/juju/errors"
 	"github.com/juju/names"
+	"github.com/juju/utils"
 )
 
 type Server struct {
-	state     *state.State
-	actionMgr *actionstate.ActionManager
+	state        *state.State
+	actionMgr    *actionstate.ActionManager
+	operationMgr *operationstate.OperationManager
+	schemaMgr    SchemaManager
+	httpServer   *http.Server
+	metrics      *Metrics
+	tlsConfig    *tls.Config
+	tokens       map[string]Role
+	clock        clock.Clock
+	rateLimiter  *rateLimiter
+
+	cluster       Cluster
+	apiAddress    APIAddressFunc
+	proxyToLeader bool
+	members       ClusterMembers
+	roles         ClusterRoleReporter
+
+	cors *CORSConfig
+
+	readinessChecks []readinessCheck
+
+	// metricsProviders provide the metrics beyond those of the API.
+	metricsProviders []MetricsProvider
+
+	// shutdown is closed once the server starts shutting down, to release
+	// the parked watch requests.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	logger         Logger
+	requestTimeout time.Duration
+	accessLogging  bool
+	maxBatchSize   int
+	maxBodySize    int64
+	panicRecovery  bool
+
+	requirePreconditions bool
+}
+
+// Logger is the logging interface used by the server.
+type Logger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warningf(string, ...interface{})
+	Errorf(string, ...interface{})
 }
 
-func New(state *state.State) *Server {
-	return &Server{
-		state:     state,
-		actionMgr: state.ActionManager(),
+// defaultRequestTimeout is the time a request is given to complete, before
+// its context is cancelled.
+const defaultRequestTimeout = 5 * time.Second
+
+// defaultMaxBatchSize is the number of actions a batch can hold.
+const defaultMaxBatchSize = 100
+
+// defaultMaxBodySize is the size in bytes a request body can be.
+const defaultMaxBodySize = 4 << 20
+
+// New creates a new Server for the state. The state must be ready, so that the
+// handlers never run against a database without the schema. The metrics of
+// the requests are recorded in the registry, if one is given.
+func New(state *state.State, metrics *Metrics) (*Server, error) {
+	if !state.Ready() {
+		return nil, errors.NotProvisionedf("state")
 	}
+	s := &Server{
+		state:          state,
+		actionMgr:      state.ActionManager(),
+		operationMgr:   state.OperationManager(),
+		schemaMgr:      state.SchemaManager(),
+		metrics:        metrics,
+		clock:          clock.WallClock,
+		logger:         noopLogger{},
+		requestTimeout: defaultRequestTimeout,
+		maxBatchSize:   defaultMaxBatchSize,
+		maxBodySize:    defaultMaxBodySize,
+		accessLogging:  true,
+		panicRecovery:  true,
+		shutdown:       make(chan struct{}),
+	}
+	if s.metrics == nil {
+		s.metrics = NewMetrics()
+	}
+	s.httpServer = &http.Server{
+		Handler: s.handler(),
+	}
+	return s, nil
 }
 
-func (s Server) Serve(address string) (net.Listener, error) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		parts := strings.Split(strings.TrimLeft(r.URL.Path, "/"), "/")
-		if len(parts) == 0 {
-			http.Error(w, "empty collection", http.StatusBadRequest)
-			return
-		}
-		switch parts[0] {
-		case "actions":
-			s.handleActions(w, r)
-		default:
-			http.Error(w, fmt.Sprintf("unexpected collection %q", parts[0]), http.StatusBadRequest)
-		}
-	})
+// Handler returns the handler serving the API, for serving it without a
+// listener, such as with httptest.
+func (s *Server) Handler() http.Handler {
+	return s.httpServer.Handler
+}
+
+// handler returns the routes wrapped in the middleware. The middleware is
+// listed from the outermost, which sees every request first, to the
+// innermost.
+func (s *Server) handler() http.Handler {
+	middleware := []func(http.Handler) http.Handler{
+		s.withRequestID,
+		s.withMetrics,
+		s.withAccessLog,
+		s.withCORS,
+		s.withGzip,
+		s.withRecovery,
+		s.withAuth,
+		s.withRateLimit,
+		s.withLeader,
+		s.withBody,
+		s.withTimeout,
+	}
+	var handler http.Handler = s.routes()
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// SetLogger sets the logger used for access logs and handler panics. It must
+// be called before Serve.
+func (s *Server) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// SetAccessLogging sets whether every request is logged. It must be called
+// before Serve.
+func (s *Server) SetAccessLogging(enabled bool) {
+	s.accessLogging = enabled
+}
+
+// SetPanicRecovery sets whether a panicking handler is recovered, responding
+// with an internal error, rather than dropping the connection. It must be
+// called before Serve.
+func (s *Server) SetPanicRecovery(enabled bool) {
+	s.panicRecovery = enabled
+}
+
+// SetMaxBatchSize sets the number of actions a batch, or an operation across
+// many receivers, can hold before it's rejected as too large. It must be
+// called before Serve.
+func (s *Server) SetMaxBatchSize(size int) {
+	s.maxBatchSize = size
+}
 
+// SetMaxBodySize sets the size in bytes a request body can be, before it's
+// rejected as too large. It must be called before Serve.
+func (s *Server) SetMaxBodySize(size int64) {
+	s.maxBodySize = size
+}
+
+// SetRequirePreconditions sets whether requests that change an action must
+// supply the ETag of the action in the If-Match header. It must be called
+// before Serve.
+func (s *Server) SetRequirePreconditions(required bool) {
+	s.requirePreconditions = required
+}
+
+// SetRequestTimeout sets the time a request is given to complete, before its
+// context, and so any transaction it's running, is cancelled. It must be
+// called before Serve.
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.requestTimeout = timeout
+}
+
+// Serve serves the API on the address, over TLS if a TLS config has been
+// set. The returned channel receives the error if serving fails, and is
+// closed once the server has stopped.
+func (s *Server) Serve(address string) (<-chan error, error) {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, err
 	}
+	return s.serve(listener), nil
+}
+
+// serve serves the API on the listener, as Serve does.
+func (s *Server) serve(listener net.Listener) <-chan error {
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
 
-	go http.Serve(listener, nil)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		if err := s.httpServer.Serve(listener); err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+	return errs
+}
 
-	return listener, err
+// Shutdown stops accepting new requests and waits for the in-flight requests
+// to complete, until the context is done. Parked watch requests return
+// straight away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+	return errors.Trace(s.httpServer.Shutdown(ctx))
 }
 
-func (s Server) handleActions(w http.ResponseWriter, r *http.Request) {
-	var output OutputAction
-	switch r.Method {
-	case "POST":
-		defer r.Body.Close()
+// routes returns the router for the API.
+func (s *Server) routes() *router {
+	rt := new(router)
+	rt.handle("GET", "/actions", s.handleListActions)
+	rt.handle("POST", "/actions", s.handleAddAction)
+	rt.handle("GET", "/actions/summary", s.handleActionSummary)
+	rt.handle("GET", "/actions/search", s.handleActionSearch)
+	rt.handle("POST", "/actions/batch", s.handleAddBatch)
+	rt.handle("GET", "/actions/{id}", s.actionHandler(s.handleGetAction))
+	rt.handle("DELETE", "/actions/{id}", s.actionHandler(s.handleCancelAction))
+	rt.handle("POST", "/actions/{id}/abort", s.actionHandler(s.handleAbortAction))
+	rt.handle("GET", "/actions/{id}/logs", s.actionHandler(s.handleActionLogs))
+	rt.handle("POST", "/actions/{id}/logs", s.actionHandler(s.handleLogMessage))
+	rt.handle("GET", "/actions/{id}/result", s.actionHandler(s.handleActionResult))
+	rt.handle("GET", "/actions/{id}/watch", s.actionHandler(s.handleWatchAction))
+	rt.handle("GET", "/operations", s.handleListOperations)
+	rt.handle("POST", "/operations", s.handleAddOperation)
+	rt.handle("GET", "/operations/{id}", s.operationHandler(s.handleGetOperation))
+	rt.handle("GET", "/operations/{id}/actions", s.operationHandler(s.handleOperationActions))
+	rt.handleContent("GET", "/metrics", "text/plain", s.handleMetrics)
+	rt.handleContent("GET", "/admin/dump", "text/plain", s.handleDump)
+	rt.handle("GET", "/admin/schema", s.handleSchema)
+	rt.handle("GET", "/admin/cluster", s.handleClusterStatus)
+	rt.handle("DELETE", "/admin/cluster/nodes/{id}", s.handleRemoveClusterNode)
+	rt.handle("GET", "/healthz", s.handleHealth)
+	rt.handle("GET", "/readyz", s.handleReady)
+	return rt
+}
 
-		var input InputAction
-		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+// actionHandler resolves the action referenced by the id segment of the path,
+// before calling the handler with the id of the action.
+func (s *Server) actionHandler(handler func(http.ResponseWriter, *http.Request, int64)) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, p params) {
+		id, err := s.actionID(r.Context(), p["id"])
+		if err != nil {
+			s.handleError(w, r, err)
 			return
 		}
+		handler(w, r, id)
+	}
+}
+
+func (s *Server) handleAddAction(w http.ResponseWriter, r *http.Request, _ params) {
+	var input InputAction
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	if err := input.Validate(); err != nil {
+		s.handleError(w, r, err)
+		return
+	}
 
+	output, created, err := s.insertAction(r.Context(), input, r.Header.Get("Idempotency-Key"))
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, output)
+}
+
+func (s *Server) handleGetAction(w http.ResponseWriter, r *http.Request, id int64) {
+	values := r.URL.Query()
+	fields, ok := parseFields(w, values)
+	if !ok {
+		return
+	}
+
+	output, err := s.getActionByID(r.Context(), id, values.Get("include") == "result")
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", actionETag(output))
+	if len(fields) == 0 {
+		encodeJSON(w, output)
+		return
+	}
+	projection, err := projectAction(output, fields)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	encodeJSON(w, projection)
+}
+
+func (s *Server) handleCancelAction(w http.ResponseWriter, r *http.Request, id int64) {
+	output, err := s.updateAction(r.Context(), id, r.Header.Get("If-Match"), s.actionMgr.CancelAction)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", actionETag(output))
+	encodeJSON(w, output)
+}
+
+func (s *Server) handleAbortAction(w http.ResponseWriter, r *http.Request, id int64) {
+	output, err := s.updateAction(r.Context(), id, r.Header.Get("If-Match"), s.actionMgr.AbortAction)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", actionETag(output))
+	encodeJSON(w, output)
+}
+
+func (s *Server) handleAddOperation(w http.ResponseWriter, r *http.Request, _ params) {
+	var input InputOperation
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	if len(input.Receivers) > s.maxBatchSize {
+		s.handleError(w, r, stateerrors.TooLargef("operation with %d receivers (limit %d actions)", len(input.Receivers), s.maxBatchSize))
+		return
+	}
+	if err := input.Validate(); err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output, err := s.insertOperation(r.Context(), input)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, output)
+}
+
+// insertOperation enqueues an action for each of the receivers under a new
+// operation, within a single transaction.
+func (s *Server) insertOperation(ctx context.Context, input InputOperation) (OutputOperation, error) {
+	receivers := make([]names.Tag, len(input.Receivers))
+	for i, receiver := range input.Receivers {
+		tag, err := names.ParseTag(receiver)
+		if err != nil {
+			return OutputOperation{}, errors.NewBadRequest(err, "receiver tag")
+		}
+		receivers[i] = tag
+	}
+
+	summary := input.Summary
+	if summary == "" {
+		summary = fmt.Sprintf("%s run on %d receivers", input.Name, len(receivers))
+	}
+
+	var (
+		operation model.Operation
+		actions   []model.Action
+	)
+	err := s.state.Backend().RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
 		var err error
-		output, err = s.insertAction(input)
+		if operation, err = s.operationMgr.AddOperation(tx, summary); err != nil {
+			return errors.Trace(err)
+		}
+
+		actions, err = s.actionMgr.AddActions(tx, strconv.FormatInt(operation.ID, 10), receivers, input.Name, input.Parameters)
 		if err != nil {
-			s.handleError(w, r, err)
-			return
+			return errors.Trace(err)
 		}
 
-	case "GET":
-		reqValue, ok := getActionReqValue(r)
-		if !ok {
-			http.Error(w, fmt.Sprintf("id %q not found", reqValue), http.StatusNotFound)
-			return
+		if err := s.operationMgr.SetExpectedActions(tx, operation.ID, len(actions)); err != nil {
+			return errors.Trace(err)
 		}
-		id, err := strconv.ParseInt(reqValue, 10, 64)
+		operation, err = s.operationMgr.OperationByID(tx, operation.ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return OutputOperation{}, errors.Trace(err)
+	}
+
+	return OutputOperation{}.FromModel(operation, actions), nil
+}
+
+// handleAddBatch enqueues a batch of actions under a new operation. The batch
+// is added atomically, so if any of the actions are invalid none of them are
+// added.
+func (s *Server) handleAddBatch(w http.ResponseWriter, r *http.Request, _ params) {
+	var input InputBatch
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	if len(input.Actions) > s.maxBatchSize {
+		s.handleError(w, r, stateerrors.TooLargef("batch of %d actions (limit %d actions)", len(input.Actions), s.maxBatchSize))
+		return
+	}
+	if err := input.Validate(); err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output, err := s.insertBatch(r.Context(), input)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, output)
+}
+
+// insertBatch enqueues the actions of the batch under a new operation, within
+// a single transaction.
+func (s *Server) insertBatch(ctx context.Context, input InputBatch) (OutputOperation, error) {
+	specs := make([]actionstate.ActionSpec, len(input.Actions))
+	for i, action := range input.Actions {
+		receiver, err := names.ParseTag(action.Receiver)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("invalid id %q", reqValue), http.StatusBadRequest)
+			return OutputOperation{}, errors.NewBadRequest(err, fmt.Sprintf("receiver tag of action %d", i))
+		}
+		specs[i] = actionstate.ActionSpec{
+			Receiver:   receiver,
+			Name:       action.Name,
+			Parameters: action.Parameters,
+			Options: []actionstate.AddActionOption{
+				actionstate.RequestedBy(action.RequestedBy),
+				actionstate.Source(action.Source),
+				actionstate.ExpiresAt(action.ExpiresAt),
+			},
+		}
+	}
+
+	summary := input.Summary
+	if summary == "" {
+		summary = fmt.Sprintf("batch of %d actions", len(specs))
+	}
+
+	var (
+		operation model.Operation
+		actions   []model.Action
+	)
+	err := s.state.Backend().RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		if operation, err = s.operationMgr.AddOperation(tx, summary); err != nil {
+			return errors.Trace(err)
+		}
+
+		if actions, err = s.actionMgr.AddActionBatch(tx, strconv.FormatInt(operation.ID, 10), specs); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := s.operationMgr.SetExpectedActions(tx, operation.ID, len(actions)); err != nil {
+			return errors.Trace(err)
+		}
+		operation, err = s.operationMgr.OperationByID(tx, operation.ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return OutputOperation{}, errors.Trace(err)
+	}
+
+	return OutputOperation{}.FromModel(operation, actions), nil
+}
+
+// handleLogMessage records a progress message for an action.
+func (s *Server) handleLogMessage(w http.ResponseWriter, r *http.Request, id int64) {
+	var input ActionMessage
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	if input.Timestamp.IsZero() {
+		input.Timestamp = s.clock.Now()
+	}
+
+	err := s.state.Backend().RunContext(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		return errors.Trace(s.actionMgr.LogMessage(tx, id, input.Message, input.Timestamp))
+	})
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	encodeJSON(w, input)
+}
+
+// handleActionLogs returns the progress messages of an action. Messages can
+// be polled incrementally using the since query parameter.
+func (s *Server) handleActionLogs(w http.ResponseWriter, r *http.Request, id int64) {
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			badRequest(w, "since", "invalid since %q", value)
 			return
 		}
+	}
 
-		output, err = s.getActionByID(id)
-		if err != nil {
-			s.handleError(w, r, err)
+	var messages []model.ActionMessage
+	err := s.state.View(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		messages, err = s.actionMgr.ActionLogsSince(tx, id, since)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output := make([]ActionMessage, len(messages))
+	for k, message := range messages {
+		output[k] = ActionMessage{}.FromModel(message)
+	}
+	encodeJSON(w, output)
+}
+
+const (
+	// defaultListLimit is the number of actions in a page, unless the limit
+	// query parameter is given.
+	defaultListLimit = 50
+
+	// maxListLimit is the largest number of actions in a page.
+	maxListLimit = 1000
+)
+
+// listParams are the query parameters accepted when listing actions.
+var listParams = map[string]bool{
+	"status":       true,
+	"receiver":     true,
+	"name":         true,
+	"operation":    true,
+	"requested-by": true,
+	"source":       true,
+	"limit":        true,
+	"offset":       true,
+	"sort":         true,
+	"fields":       true,
+	"pretty":       true,
+}
+
+// handleListActions returns a page of the actions matching the filters in
+// the query parameters.
+func (s *Server) handleListActions(w http.ResponseWriter, r *http.Request, _ params) {
+	values := r.URL.Query()
+	for name := range values {
+		if !listParams[name] {
+			badRequest(w, name, "unknown query parameter %q", name)
 			return
 		}
+	}
 
-	default:
-		http.Error(w, fmt.Sprintf("invalid method %q", r.Method), http.StatusBadRequest)
+	filter := actionstate.ListFilter{
+		Receiver:    values.Get("receiver"),
+		Name:        values.Get("name"),
+		Operation:   values.Get("operation"),
+		RequestedBy: values.Get("requested-by"),
+		Source:      values.Get("source"),
+		Sort:        values.Get("sort"),
+		Limit:       defaultListLimit,
+	}
+	for _, value := range values["status"] {
+		for _, status := range strings.Split(value, ",") {
+			filter.Statuses = append(filter.Statuses, model.ActionStatus(status))
+		}
+	}
+	if !parsePage(w, values, &filter.Limit, &filter.Offset) {
+		return
+	}
+	fields, ok := parseFields(w, values)
+	if !ok {
+		return
+	}
+
+	var (
+		actions []model.Action
+		total   int
+	)
+	err := s.state.View(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		actions, total, err = s.actionMgr.ListActions(tx, filter)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		s.handleError(w, r, err)
+		return
 	}
 
-	encoder := json.NewEncoder(w)
-	encoder.SetIndent("", "    ")
-	if err := encoder.Encode(output); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	output := ActionList{
+		Actions: make([]OutputAction, len(actions)),
+		Total:   total,
+	}
+	for i, action := range actions {
+		output.Actions[i] = OutputAction{}.FromModel(action)
 	}
+	if next := filter.Offset + len(actions); next < total {
+		values.Set("offset", strconv.Itoa(next))
+		output.Next = r.URL.Path + "?" + values.Encode()
+	}
+	if len(fields) == 0 {
+		encodeJSON(w, output)
+		return
+	}
+	projection, err := projectActionList(output, fields)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	encodeJSON(w, projection)
 }
 
-func (s Server) handleError(w http.ResponseWriter, r *http.Request, err error) {
-	status := http.StatusInternalServerError
-	switch {
-	case errors.IsNotFound(err):
-		status = http.StatusNotFound
-	case errors.IsBadRequest(err):
-		status = http.StatusBadRequest
+// parsePage parses the limit and offset query parameters, writing a bad
+// request and returning false if either is invalid.
+func parsePage(w http.ResponseWriter, values url.Values, limit, offset *int) bool {
+	for _, param := range []struct {
+		name  string
+		value *int
+		max   int
+	}{
+		{name: "limit", value: limit, max: maxListLimit},
+		{name: "offset", value: offset},
+	} {
+		value := values.Get(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || (param.max > 0 && (n == 0 || n > param.max)) {
+			badRequest(w, param.name, "invalid %s %q", param.name, value)
+			return false
+		}
+		*param.value = n
 	}
-	http.Error(w, err.Error(), status)
+	return true
 }
 
-func (s Server) insertAction(input InputAction) (OutputAction, error) {
-	receiverTag, err := names.ParseTag(input.Operation)
+// defaultSearchLimit is the number of actions returned by a search, unless
+// the limit query parameter is given.
+const defaultSearchLimit = 50
+
+// handleActionSearch returns the actions matching the q query parameter.
+func (s *Server) handleActionSearch(w http.ResponseWriter, r *http.Request, _ params) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		badRequest(w, "q", "missing search query")
+		return
+	}
+	limit := defaultSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			badRequest(w, "limit", "invalid limit %q", value)
+			return
+		}
+	}
+
+	var actions []model.Action
+	err := s.state.View(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		actions, err = s.actionMgr.SearchActions(tx, query, limit)
+		return errors.Trace(err)
+	})
 	if err != nil {
-		return OutputAction{}, errors.NewBadRequest(err, "receiver tag")
+		s.handleError(w, r, err)
+		return
 	}
 
+	output := make([]OutputAction, len(actions))
+	for i, action := range actions {
+		output[i] = OutputAction{}.FromModel(action)
+	}
+	encodeJSON(w, output)
+}
+
+// handleActionSummary returns the number of actions, grouped by the columns
+// in the by query parameter.
+func (s *Server) handleActionSummary(w http.ResponseWriter, r *http.Request, _ params) {
+	var groupBy []string
+	if by := r.URL.Query().Get("by"); by != "" {
+		groupBy = strings.Split(by, ",")
+	}
+
+	var summaries []model.ActionSummary
+	err := s.state.View(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		summaries, err = s.actionMgr.Summary(tx, groupBy...)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+
+	output := make([]ActionSummary, len(summaries))
+	for i, summary := range summaries {
+		output[i] = ActionSummary{
+			Key:   summary.Key,
+			Count: summary.Count,
+		}
+	}
+	encodeJSON(w, output)
+}
+
+// handleActionResult returns the results of an action.
+func (s *Server) handleActionResult(w http.ResponseWriter, r *http.Request, id int64) {
+	var results map[string]interface{}
+	err := s.state.View(r.Context(), func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		results, err = s.actionMgr.ActionResult(tx, id)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	encodeJSON(w, results)
+}
+
+func encodeJSON(w http.ResponseWriter, output interface{}) {
+	writeJSON(w, http.StatusOK, output)
+}
+
+// writeJSON writes the output as the JSON response, with the status. The
+// output is compact, unless the request asked for it to be indented. The
+// output is encoded before anything is written, so that an encoding error
+// can still be reported.
+func writeJSON(w http.ResponseWriter, status int, output interface{}) {
+	var (
+		data []byte
+		err  error
+	)
+	if _, pretty := w.(prettyResponseWriter); pretty {
+		data, err = json.MarshalIndent(output, "", "    ")
+	} else {
+		data, err = json.Marshal(output)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorBody{
+			Code:    codeInternal,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// insertAction adds the action, returning whether it was created. If the
+// idempotency key has already been used, the existing action is returned
+// instead.
+func (s *Server) insertAction(ctx context.Context, input InputAction, idempotencyKey string) (OutputAction, bool, error) {
+	receiverTag, err := names.ParseTag(input.Receiver)
+	if err != nil {
+		return OutputAction{}, false, errors.NewBadRequest(err, "receiver tag")
+	}
+
+	var operationID int64
+	if input.Operation != "" {
+		operationID, err = strconv.ParseInt(input.Operation, 10, 64)
+		if err != nil {
+			return OutputAction{}, false, errors.NewBadRequest(err, "operation id")
+		}
+	}
+
+	var (
+		action  model.Action
+		created bool
+	)
+	err = s.state.Backend().RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		// Check for an existing action first, so that a retried request
+		// doesn't create a new parent operation.
+		if idempotencyKey != "" {
+			var err error
+			action, err = s.actionMgr.ActionByIdempotencyKey(tx, idempotencyKey)
+			if err == nil || !stateerrors.IsNotFound(err) {
+				created = false
+				return errors.Trace(err)
+			}
+		}
+
+		operation, err := s.parentOperation(tx, operationID, input)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		action, err = s.actionMgr.AddAction(tx, receiverTag, strconv.FormatInt(operation.ID, 10), input.Name, input.Parameters,
+			actionstate.IdempotencyKey(idempotencyKey),
+			actionstate.RequestedBy(input.RequestedBy),
+			actionstate.Source(input.Source),
+			actionstate.ExpiresAt(input.ExpiresAt))
+		created = err == nil
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return OutputAction{}, false, errors.Trace(err)
+	}
+
+	// Convert to an action entity before sending.
+	return OutputAction{}.FromModel(action), created, nil
+}
+
+// parentOperation returns the operation the action is enqueued under. If no
+// operation was supplied, a new operation is created for the action.
+func (s *Server) parentOperation(tx *sqlx.Tx, id int64, input InputAction) (model.Operation, error) {
+	if id == 0 {
+		summary := fmt.Sprintf("%s run on %s", input.Name, input.Receiver)
+		operation, err := s.operationMgr.AddOperation(tx, summary)
+		return operation, errors.Trace(err)
+	}
+
+	operation, err := s.operationMgr.OperationByID(tx, id)
+	if errors.IsNotFound(err) {
+		return model.Operation{}, errors.NewBadRequest(err, "parent operation")
+	}
+	return operation, errors.Trace(err)
+}
+
+func (s *Server) getActionByID(ctx context.Context, id int64, includeResult bool) (OutputAction, error) {
 	var action model.Action
-	err = s.state.Backend().Run(func(ctx context.Context, tx *sqlx.Tx) error {
+	err := s.state.View(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
 		var err error
-		action, err = s.actionMgr.AddAction(tx, receiverTag, input.Operation, input.Name, input.Parameters)
+		action, err = s.actionMgr.ActionByID(tx, id)
+		if err != nil || !includeResult {
+			return errors.Trace(err)
+		}
+
+		// An action without a result yet is still returned.
+		action.Results, err = s.actionMgr.ActionResult(tx, id)
+		if stateerrors.IsNotFound(err) {
+			return nil
+		}
 		return errors.Trace(err)
 	})
 	if err != nil {
@@ -133,11 +857,34 @@ func (s Server) insertAction(input InputAction) (OutputAction, error) {
 	return OutputAction{}.FromModel(action), nil
 }
 
-func (s Server) getActionByID(id int64) (OutputAction, error) {
+// updateAction applies the update to the action, returning the updated
+// action. If the If-Match header is given, the update is only applied if it
+// matches the current ETag of the action, which is checked within the same
+// transaction as the update.
+func (s *Server) updateAction(ctx context.Context, id int64, ifMatch string, update func(*sqlx.Tx, int64) (model.Action, error)) (OutputAction, error) {
+	if ifMatch == "" && s.requirePreconditions {
+		return OutputAction{}, &preconditionError{
+			missing: true,
+			message: "If-Match header is required to change an action",
+		}
+	}
+
 	var action model.Action
-	err := s.state.Backend().Run(func(ctx context.Context, tx *sqlx.Tx) error {
+	err := s.state.Backend().RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if ifMatch != "" {
+			current, err := s.actionMgr.ActionByID(tx, id)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if etag := actionETag(OutputAction{}.FromModel(current)); !matchesETag(ifMatch, etag) {
+				return &preconditionError{
+					message: fmt.Sprintf("action %d has changed, current ETag is %s", id, etag),
+				}
+			}
+		}
+
 		var err error
-		action, err = s.actionMgr.ActionByID(tx, id)
+		action, err = update(tx, id)
 		return errors.Trace(err)
 	})
 	if err != nil {
@@ -148,13 +895,24 @@ func (s Server) getActionByID(id int64) (OutputAction, error) {
 	return OutputAction{}.FromModel(action), nil
 }
 
-func getActionReqValue(r *http.Request) (string, bool) {
-	parts := strings.Split(strings.TrimLeft(r.URL.Path, "/"), "/")
-	if len(parts) != 2 {
-		return "", false
+// actionID returns the id of the action referenced in a request path. The
+// reference is either the integer id of the action, or its tag, in either
+// the full "action-<uuid>" form or just the UUID.
+func (s *Server) actionID(ctx context.Context, ref string) (int64, error) {
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return id, nil
 	}
-	if parts[1] == "" {
-		return "", false
+
+	uuid := strings.TrimPrefix(ref, names.ActionTagKind+"-")
+	if !utils.IsValidUUIDString(uuid) {
+		return 0, errors.BadRequestf("invalid action %q", ref)
 	}
-	return parts[1], true
+
+	var id int64
+	err := s.state.View(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		action, err := s.actionMgr.ActionByTag(tx, names.NewActionTag(uuid))
+		id = action.ID
+		return errors.Trace(err)
+	})
+	return id, errors.Trace(err)
 }
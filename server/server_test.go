@@ -0,0 +1,1304 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// newTestServer returns a server over an in-memory state, which is stopped
+// when the test finishes.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	s, closer, err := NewInMemory(context.Background(), clock.WallClock)
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	t.Cleanup(func() {
+		start := time.Now()
+		if err := closer(); err != nil {
+			t.Errorf("closing server: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("closing server took %v", elapsed)
+		}
+	})
+	return s
+}
+
+// do serves the request, encoding the body as JSON if there is one.
+func do(t *testing.T, s *Server, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reader).Encode(body); err != nil {
+			t.Fatalf("encoding body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reader)
+	if body != nil {
+		req.Header.Set("Content-Type", jsonContentType)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// decode decodes the JSON body of the response into v.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding body %q: %v", rec.Body.String(), err)
+	}
+}
+
+// addAction adds an action through the API, returning it.
+func addAction(t *testing.T, s *Server, input InputAction) OutputAction {
+	t.Helper()
+
+	rec := do(t, s, "POST", "/v1/actions", input)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("adding action: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputAction
+	decode(t, rec, &output)
+	return output
+}
+
+func TestAddAction(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  InputAction
+		status int
+		code   string
+	}{{
+		name: "unit receiver",
+		input: InputAction{
+			Receiver:   "unit-mysql-0",
+			Name:       "backup",
+			Parameters: map[string]interface{}{"target": "/tmp"},
+		},
+		status: http.StatusCreated,
+	}, {
+		name: "machine receiver",
+		input: InputAction{
+			Receiver: "machine-0",
+			Name:     "reboot",
+		},
+		status: http.StatusCreated,
+	}, {
+		name: "missing receiver",
+		input: InputAction{
+			Name: "backup",
+		},
+		status: http.StatusBadRequest,
+		code:   codeBadRequest,
+	}, {
+		name: "application receiver",
+		input: InputAction{
+			Receiver: "application-mysql",
+			Name:     "backup",
+		},
+		status: http.StatusBadRequest,
+		code:   codeBadRequest,
+	}, {
+		name: "invalid name",
+		input: InputAction{
+			Receiver: "unit-mysql-0",
+			Name:     "not a name",
+		},
+		status: http.StatusBadRequest,
+		code:   codeBadRequest,
+	}, {
+		name: "invalid operation",
+		input: InputAction{
+			Receiver:  "unit-mysql-0",
+			Name:      "backup",
+			Operation: "op",
+		},
+		status: http.StatusBadRequest,
+		code:   codeBadRequest,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			rec := do(t, s, "POST", "/v1/actions", test.input)
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d, body %q", rec.Code, test.status, rec.Body.String())
+			}
+			if test.code != "" {
+				var resp ErrorResponse
+				decode(t, rec, &resp)
+				if resp.Error.Code != test.code {
+					t.Errorf("got error code %q, want %q", resp.Error.Code, test.code)
+				}
+				return
+			}
+
+			var output OutputAction
+			decode(t, rec, &output)
+			if output.ID == 0 || output.Tag == "" {
+				t.Errorf("got action without an id or tag: %+v", output)
+			}
+			if output.Receiver != test.input.Receiver || output.Name != test.input.Name {
+				t.Errorf("got action %+v, want receiver %q and name %q", output, test.input.Receiver, test.input.Name)
+			}
+		})
+	}
+}
+
+// addActionWithKey adds an action with the idempotency key, returning the
+// response.
+func addActionWithKey(t *testing.T, s *Server, input InputAction, key string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(input)
+	if err != nil {
+		t.Fatalf("encoding body: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/v1/actions", bytes.NewReader(body))
+	req.Header.Set("Content-Type", jsonContentType)
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAddActionIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		statuses []int
+		same     bool
+	}{
+		{"same key", []string{"retry-1", "retry-1"}, []int{http.StatusCreated, http.StatusOK}, true},
+		{"different keys", []string{"retry-1", "retry-2"}, []int{http.StatusCreated, http.StatusCreated}, false},
+		{"no key", []string{"", ""}, []int{http.StatusCreated, http.StatusCreated}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			input := InputAction{Receiver: "unit-mysql-0", Name: "backup"}
+
+			var outputs []OutputAction
+			for i, key := range test.keys {
+				rec := addActionWithKey(t, s, input, key)
+				if rec.Code != test.statuses[i] {
+					t.Fatalf("request %d: got status %d, want %d, body %q", i, rec.Code, test.statuses[i], rec.Body.String())
+				}
+				var output OutputAction
+				decode(t, rec, &output)
+				outputs = append(outputs, output)
+			}
+			if same := outputs[0].ID == outputs[1].ID; same != test.same {
+				t.Fatalf("got actions %d and %d, want the same action %v", outputs[0].ID, outputs[1].ID, test.same)
+			}
+
+			var list ActionList
+			decode(t, do(t, s, "GET", "/v1/actions", nil), &list)
+			want := 2
+			if test.same {
+				want = 1
+			}
+			if list.Total != want {
+				t.Fatalf("got %d actions, want %d", list.Total, want)
+			}
+		})
+	}
+}
+
+func TestAddActionMalformedBody(t *testing.T) {
+	s := newTestServer(t)
+
+	req := httptest.NewRequest("POST", "/v1/actions", bytes.NewBufferString("{"))
+	req.Header.Set("Content-Type", jsonContentType)
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeBadRequest {
+		t.Errorf("got error code %q, want %q", resp.Error.Code, codeBadRequest)
+	}
+}
+
+func TestAddActionNonNumericOperation(t *testing.T) {
+	s := newTestServer(t)
+
+	// Operations were once named by the client, they're now referred to by
+	// their id.
+	rec := do(t, s, "POST", "/v1/actions", InputAction{
+		Receiver:  "unit-mysql-0",
+		Name:      "backup",
+		Operation: "deploy-mysql",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d, body %q", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	want := []FieldError{{Field: "operation", Message: `"deploy-mysql" is not a valid operation id`}}
+	if resp.Error.Code != codeBadRequest || !reflect.DeepEqual(resp.Error.Fields, want) {
+		t.Fatalf("got error %+v, want fields %+v", resp.Error, want)
+	}
+
+	// Nothing was enqueued.
+	if list := listActions(t, s, "/v1/actions"); list.Total != 0 {
+		t.Fatalf("got %d actions, want none", list.Total)
+	}
+}
+
+func TestGetAction(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{
+		Receiver: "unit-mysql-0",
+		Name:     "backup",
+	})
+
+	rec := do(t, s, "GET", "/v1/actions/"+strconv.FormatInt(added.ID, 10), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("ETag") == "" {
+		t.Errorf("missing ETag header")
+	}
+	var output OutputAction
+	decode(t, rec, &output)
+	if output.ID != added.ID || output.Tag != added.Tag {
+		t.Errorf("got action %+v, want %+v", output, added)
+	}
+}
+
+func TestGetActionNotFound(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := do(t, s, "GET", "/v1/actions/42", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeNotFound {
+		t.Errorf("got error code %q, want %q", resp.Error.Code, codeNotFound)
+	}
+}
+
+func TestListActions(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"backup", "restore"} {
+		addAction(t, s, InputAction{
+			Receiver: "unit-mysql-0",
+			Name:     name,
+		})
+	}
+
+	rec := do(t, s, "GET", "/v1/actions", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if !bytes.Contains(rec.Body.Bytes(), []byte(`"backup"`)) || !bytes.Contains(rec.Body.Bytes(), []byte(`"restore"`)) {
+		t.Errorf("got body %q, want both actions", rec.Body.String())
+	}
+}
+
+// listActions lists the actions with the query, failing the test unless the
+// list succeeds.
+func listActions(t *testing.T, s *Server, path string) ActionList {
+	t.Helper()
+
+	rec := do(t, s, "GET", path, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing %s: got status %d, body %q", path, rec.Code, rec.Body.String())
+	}
+	var list ActionList
+	decode(t, rec, &list)
+	return list
+}
+
+// actionNames returns the names of the actions in the list.
+func actionNames(list ActionList) []string {
+	names := make([]string, len(list.Actions))
+	for i, action := range list.Actions {
+		names[i] = action.Name
+	}
+	return names
+}
+
+func TestListActionsPagination(t *testing.T) {
+	s := newTestServer(t)
+	want := []string{"a", "b", "c", "d", "e"}
+	for _, name := range want {
+		addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: name})
+	}
+
+	// Following the next links visits every action once.
+	var got []string
+	path := "/v1/actions?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > len(want) {
+			t.Fatalf("got more pages than actions, last page %s", path)
+		}
+		list := listActions(t, s, path)
+		if list.Total != len(want) {
+			t.Fatalf("%s: got total %d, want %d", path, list.Total, len(want))
+		}
+		if len(list.Actions) > 2 {
+			t.Fatalf("%s: got %d actions, want at most 2", path, len(list.Actions))
+		}
+		got = append(got, actionNames(list)...)
+		path = list.Next
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got actions %v, want %v", got, want)
+	}
+
+	// The last page has no next link.
+	if list := listActions(t, s, "/v1/actions?limit=2&offset=4"); list.Next != "" || len(list.Actions) != 1 {
+		t.Fatalf("got last page %+v, want one action without a next link", list)
+	}
+	if list := listActions(t, s, "/v1/actions?offset=10"); len(list.Actions) != 0 || list.Total != len(want) {
+		t.Fatalf("got page past the end %+v, want no actions", list)
+	}
+}
+
+func TestListActionsSortAndStatus(t *testing.T) {
+	s := newTestServer(t)
+	for _, name := range []string{"restore", "backup", "upgrade"} {
+		addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: name})
+	}
+	cancelled := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "cancelled"})
+	if rec := do(t, s, "DELETE", "/v1/actions/"+strconv.FormatInt(cancelled.ID, 10), nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancelling action: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"restore", "backup", "upgrade", "cancelled"}},
+		{"sort=-id", []string{"cancelled", "upgrade", "backup", "restore"}},
+		{"sort=name", []string{"backup", "cancelled", "restore", "upgrade"}},
+		{"sort=-name&limit=2", []string{"upgrade", "restore"}},
+		{"status=cancelled", []string{"cancelled"}},
+		{"status=pending&sort=name", []string{"backup", "restore", "upgrade"}},
+		{"status=pending,cancelled&sort=-name", []string{"upgrade", "restore", "cancelled", "backup"}},
+		{"status=pending&status=cancelled&sort=name&limit=1", []string{"backup"}},
+		{"status=running", []string{}},
+	}
+	for _, test := range tests {
+		list := listActions(t, s, "/v1/actions?"+test.query)
+		if got := actionNames(list); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got actions %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestListActionsInvalidQuery(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"limit=0", "limit"},
+		{"limit=ten", "limit"},
+		{"limit=1001", "limit"},
+		{"offset=-1", "offset"},
+		{"colour=red", "colour"},
+		{"sort=message", ""},
+	}
+	for _, test := range tests {
+		rec := do(t, s, "GET", "/v1/actions?"+test.query, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, body %q", test.query, rec.Code, rec.Body.String())
+			continue
+		}
+		var body ErrorResponse
+		decode(t, rec, &body)
+		if body.Error.Code != codeBadRequest || body.Error.Field != test.field {
+			t.Errorf("%s: got error %+v, want a bad request for %q", test.query, body.Error, test.field)
+		}
+	}
+}
+
+func TestListActionsByReceiverAndOperation(t *testing.T) {
+	s := newTestServer(t)
+	addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	addAction(t, s, InputAction{Receiver: "unit-mysql-1", Name: "backup"})
+
+	rec := do(t, s, "POST", "/v1/operations", InputOperation{
+		Receivers: []string{"unit-mysql-1", "unit-mysql-2"},
+		Name:      "restore",
+	})
+	var operation OutputOperation
+	decode(t, rec, &operation)
+	operationID := strconv.FormatInt(operation.ID, 10)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"receiver=unit-mysql-0", []string{"unit-mysql-0 backup"}},
+		{"receiver=unit-mysql-1&status=pending", []string{"unit-mysql-1 backup", "unit-mysql-1 restore"}},
+		{"operation=" + operationID, []string{"unit-mysql-1 restore", "unit-mysql-2 restore"}},
+		{"operation=" + operationID + "&receiver=unit-mysql-2", []string{"unit-mysql-2 restore"}},
+		{"receiver=unit-mysql-3", []string{}},
+	}
+	for _, test := range tests {
+		rec := do(t, s, "GET", "/v1/actions?"+test.query+"&sort=id", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, body %q", test.query, rec.Code, rec.Body.String())
+		}
+		var list ActionList
+		decode(t, rec, &list)
+
+		got := make([]string, len(list.Actions))
+		for i, action := range list.Actions {
+			got[i] = action.Receiver + " " + action.Name
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") || list.Total != len(test.want) {
+			t.Errorf("%s: got %d actions %v, want %v", test.query, list.Total, got, test.want)
+		}
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := do(t, s, "GET", "/v1/unknown", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAddOperation(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := do(t, s, "POST", "/v1/operations", InputOperation{
+		Receivers: []string{"unit-mysql-0", "unit-mysql-1"},
+		Name:      "backup",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputOperation
+	decode(t, rec, &output)
+	if output.ExpectedActions != 2 {
+		t.Errorf("got %d expected actions, want 2", output.ExpectedActions)
+	}
+
+	rec = do(t, s, "GET", "/v1/operations/"+strconv.FormatInt(output.ID, 10)+"/actions", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAddOperationWithoutReceivers(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := do(t, s, "POST", "/v1/operations", InputOperation{
+		Name: "backup",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeBadRequest {
+		t.Errorf("got error code %q, want %q", resp.Error.Code, codeBadRequest)
+	}
+}
+
+func TestAddOperationValidation(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := do(t, s, "POST", "/v1/operations", InputOperation{
+		Receivers: []string{"unit-mysql-0", "user-admin"},
+		Name:      "Back Up",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	index := 1
+	want := []FieldError{
+		{Field: "receivers[1]", Message: "expected a unit or machine tag, got user", Index: &index},
+		{Field: "name", Message: `"Back Up" is not a valid action name`},
+	}
+	if !reflect.DeepEqual(resp.Error.Fields, want) {
+		t.Fatalf("got fields %+v, want %+v", resp.Error.Fields, want)
+	}
+	var operations OperationList
+	decode(t, do(t, s, "GET", "/v1/operations", nil), &operations)
+	if operations.Total != 0 {
+		t.Fatalf("got operations %+v, want none added", operations.Operations)
+	}
+}
+
+func TestAddOperationTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	s.SetMaxBatchSize(2)
+
+	input := InputOperation{
+		Receivers: []string{"unit-mysql-0", "unit-mysql-1", "unit-mysql-2"},
+		Name:      "backup",
+	}
+	rec := do(t, s, "POST", "/v1/operations", input)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeTooLarge {
+		t.Fatalf("got error %+v, want too large", resp.Error)
+	}
+
+	input.Receivers = input.Receivers[:2]
+	if rec := do(t, s, "POST", "/v1/operations", input); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAddOperationRollsBack(t *testing.T) {
+	s := newTestServer(t)
+	s.actionMgr.SetReceiverKinds("unit")
+
+	// The machine isn't a valid receiver, so neither the operation nor any
+	// of its actions are added.
+	rec := do(t, s, "POST", "/v1/operations", InputOperation{
+		Receivers: []string{"unit-mysql-0", "machine-0", "unit-mysql-1"},
+		Name:      "backup",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	var actions ActionList
+	decode(t, do(t, s, "GET", "/v1/actions", nil), &actions)
+	if actions.Total != 0 {
+		t.Fatalf("got actions %+v, want none added", actions.Actions)
+	}
+	var operations OperationList
+	decode(t, do(t, s, "GET", "/v1/operations", nil), &operations)
+	if operations.Total != 0 {
+		t.Fatalf("got operations %+v, want none added", operations.Operations)
+	}
+}
+
+func TestGetActionByReference(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{
+		Receiver: "unit-mysql-0",
+		Name:     "backup",
+	})
+	uuid := strings.TrimPrefix(added.Tag, "action-")
+
+	tests := []struct {
+		name string
+		ref  string
+	}{
+		{"id", strconv.FormatInt(added.ID, 10)},
+		{"uuid", uuid},
+		{"tag", added.Tag},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := do(t, s, "GET", "/v1/actions/"+test.ref, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+			}
+			var output OutputAction
+			decode(t, rec, &output)
+			if output.ID != added.ID || output.Tag != added.Tag {
+				t.Errorf("got action %d %q, want %d %q", output.ID, output.Tag, added.ID, added.Tag)
+			}
+		})
+	}
+}
+
+func TestGetActionByInvalidReference(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		ref    string
+		status int
+		code   string
+	}{
+		{"malformed", "not-an-action", http.StatusBadRequest, codeBadRequest},
+		{"malformed tag", "action-1234", http.StatusBadRequest, codeBadRequest},
+		{"unknown uuid", "6ba7b810-9dad-41d1-80b4-00c04fd430c8", http.StatusNotFound, codeNotFound},
+		{"unknown tag", "action-6ba7b810-9dad-41d1-80b4-00c04fd430c8", http.StatusNotFound, codeNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := do(t, s, "GET", "/v1/actions/"+test.ref, nil)
+			if rec.Code != test.status {
+				t.Fatalf("got status %d, want %d, body %q", rec.Code, test.status, rec.Body.String())
+			}
+			var resp ErrorResponse
+			decode(t, rec, &resp)
+			if resp.Error.Code != test.code {
+				t.Errorf("got error code %q, want %q", resp.Error.Code, test.code)
+			}
+		})
+	}
+}
+
+// beginAction moves the action to running, as its runner would.
+func beginAction(t *testing.T, s *Server, id int64) {
+	t.Helper()
+
+	err := s.state.Backend().Run(func(_ context.Context, tx *sqlx.Tx) error {
+		_, err := s.actionMgr.BeginAction(tx, id)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("beginning action: %v", err)
+	}
+}
+
+func TestCancelAction(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	rec := do(t, s, "DELETE", path, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputAction
+	decode(t, rec, &output)
+	if output.Status != string(model.ActionCancelled) || output.Completed == nil {
+		t.Fatalf("got action %+v, want cancelled", output)
+	}
+
+	// Cancelling again conflicts with the status of the action.
+	rec = do(t, s, "DELETE", path, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d cancelling again, body %q", rec.Code, rec.Body.String())
+	}
+	var body ErrorResponse
+	decode(t, rec, &body)
+	if body.Error.Code != codeConflict {
+		t.Fatalf("got error %+v, want conflict", body.Error)
+	}
+}
+
+func TestAbortAction(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10) + "/abort"
+
+	// A pending action is cancelled rather than aborted.
+	rec := do(t, s, "POST", path, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d aborting a pending action, body %q", rec.Code, rec.Body.String())
+	}
+
+	beginAction(t, s, added.ID)
+	rec = do(t, s, "POST", path, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputAction
+	decode(t, rec, &output)
+	if output.Status != string(model.ActionAborting) {
+		t.Fatalf("got action %+v, want aborting", output)
+	}
+
+	// A running action can't be cancelled.
+	rec = do(t, s, "DELETE", "/v1/actions/"+strconv.FormatInt(added.ID, 10), nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d cancelling an aborting action, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCancelMissingAction(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, req := range []struct{ method, path string }{
+		{"DELETE", "/v1/actions/42"},
+		{"POST", "/v1/actions/42/abort"},
+	} {
+		rec := do(t, s, req.method, req.path, nil)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got status %d, body %q", req.method, req.path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// finishAction completes the running action with the results.
+func finishAction(t *testing.T, s *Server, id int64, results map[string]interface{}) {
+	t.Helper()
+
+	err := s.state.Backend().Run(func(_ context.Context, tx *sqlx.Tx) error {
+		_, err := s.actionMgr.FinishAction(tx, id, model.ActionCompleted, "", results)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("finishing action: %v", err)
+	}
+}
+
+func TestActionResult(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	// There's no result until the action finishes.
+	rec := do(t, s, "GET", path+"/result", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d before finishing, body %q", rec.Code, rec.Body.String())
+	}
+	rec = do(t, s, "GET", path+"?include=result", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d including a missing result, body %q", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), `"results"`) {
+		t.Fatalf("got results before finishing: %s", rec.Body.String())
+	}
+
+	beginAction(t, s, added.ID)
+	finishAction(t, s, added.ID, map[string]interface{}{"size": "1GB"})
+
+	rec = do(t, s, "GET", path+"/result", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var results map[string]interface{}
+	decode(t, rec, &results)
+	if results["size"] != "1GB" || len(results) != 1 {
+		t.Fatalf("got results %v, want the stored results", results)
+	}
+
+	// The result is only included inline when asked for.
+	var output OutputAction
+	decode(t, do(t, s, "GET", path, nil), &output)
+	if output.Results != nil {
+		t.Fatalf("got results %v without asking for them", output.Results)
+	}
+	decode(t, do(t, s, "GET", path+"?include=result", nil), &output)
+	if output.Results["size"] != "1GB" {
+		t.Fatalf("got results %v, want them included", output.Results)
+	}
+}
+
+func TestActionSummary(t *testing.T) {
+	s := newTestServer(t)
+	for _, input := range []InputAction{
+		{Receiver: "unit-mysql-0", Name: "backup"},
+		{Receiver: "unit-mysql-0", Name: "restore"},
+		{Receiver: "unit-mysql-1", Name: "backup"},
+	} {
+		addAction(t, s, input)
+	}
+	cancelled := addAction(t, s, InputAction{Receiver: "unit-mysql-1", Name: "restore"})
+	if rec := do(t, s, "DELETE", "/v1/actions/"+strconv.FormatInt(cancelled.ID, 10), nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancelling action: got status %d, body %q", rec.Code, rec.Body.String())
+	}
+
+	rec := do(t, s, "GET", "/v1/actions/summary?by=status,receiver", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var got []ActionSummary
+	decode(t, rec, &got)
+	want := []ActionSummary{
+		{Key: map[string]string{"status": "cancelled", "receiver": "unit-mysql-1"}, Count: 1},
+		{Key: map[string]string{"status": "pending", "receiver": "unit-mysql-0"}, Count: 2},
+		{Key: map[string]string{"status": "pending", "receiver": "unit-mysql-1"}, Count: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got summary %+v, want %+v", got, want)
+	}
+
+	rec = do(t, s, "GET", "/v1/actions/summary?by=message", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d grouping by an unknown column, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAddActionParametersTooLarge(t *testing.T) {
+	s := newTestServer(t)
+
+	// The parameters are within the body limit, but over the limit of the
+	// action parameters.
+	rec := do(t, s, "POST", "/v1/actions", InputAction{
+		Receiver:   "unit-mysql-0",
+		Name:       "backup",
+		Parameters: map[string]interface{}{"data": strings.Repeat("x", 2<<20)},
+	})
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	var body ErrorResponse
+	decode(t, rec, &body)
+	if body.Error.Code != codeTooLarge || !strings.Contains(body.Error.Message, "(limit 1048576 bytes)") {
+		t.Fatalf("got error %+v, want the parameters too large", body.Error)
+	}
+}
+
+func TestAddActionRequestedBy(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{
+		Receiver:    "unit-mysql-0",
+		Name:        "backup",
+		RequestedBy: "user-admin",
+		Source:      "cli",
+	})
+	unknown := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	var output OutputAction
+	decode(t, do(t, s, "GET", "/v1/actions/"+strconv.FormatInt(added.ID, 10), nil), &output)
+	if output.RequestedBy != "user-admin" || output.Source != "cli" {
+		t.Fatalf("got action %+v, want it requested by the admin from the cli", output)
+	}
+
+	// Missing metadata is omitted, rather than sent as null.
+	rec := do(t, s, "GET", "/v1/actions/"+strconv.FormatInt(unknown.ID, 10), nil)
+	for _, field := range []string{`"requested-by"`, `"source"`} {
+		if strings.Contains(rec.Body.String(), field) {
+			t.Fatalf("got %s in %s, want it omitted", field, rec.Body.String())
+		}
+	}
+
+	for _, query := range []string{"requested-by=user-admin", "source=cli", "requested-by=user-admin&source=cli"} {
+		var list ActionList
+		decode(t, do(t, s, "GET", "/v1/actions?"+query, nil), &list)
+		if list.Total != 1 || list.Actions[0].ID != added.ID {
+			t.Errorf("%s: got actions %+v, want only %d", query, list.Actions, added.ID)
+		}
+	}
+	var list ActionList
+	decode(t, do(t, s, "GET", "/v1/actions?source=api", nil), &list)
+	if list.Total != 0 {
+		t.Errorf("got actions %+v from another source, want none", list.Actions)
+	}
+}
+
+// serveTest serves the API on a local port, returning its URL. The server is
+// shut down when the test finishes.
+func serveTest(t *testing.T, s *Server) (string, <-chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := s.serve(listener)
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+	return "http://" + listener.Addr().String(), errs
+}
+
+// waitForInFlight waits until the server is serving n requests.
+func waitForInFlight(t *testing.T, s *Server, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.metrics.mutex.Lock()
+		inFlight := s.metrics.inFlight
+		s.metrics.mutex.Unlock()
+		if inFlight == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d requests in flight, want %d", inFlight, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	s := newTestServer(t)
+	url, errs := serveTest(t, s)
+
+	// The request is in flight until the rest of its body is sent.
+	body, writer := io.Pipe()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(url+"/v1/actions", jsonContentType, body)
+		if err != nil {
+			t.Errorf("posting action: %v", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	if _, err := writer.Write([]byte(`{"receiver": "unit-mysql-0", `)); err != nil {
+		t.Fatal(err)
+	}
+	waitForInFlight(t, s, 1)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	// New connections are refused once shutting down, whilst the in-flight
+	// request is still being served.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(url + "/v1/healthz")
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("still accepting requests whilst shutting down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shut down with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := writer.Write([]byte(`"name": "backup"}`)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	resp, ok := <-responses
+	if !ok {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d for the drained request, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutting down: %v", err)
+	}
+	if err, ok := <-errs; ok {
+		t.Fatalf("got serve error %v, want none", err)
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	s := newTestServer(t)
+	url, _ := serveTest(t, s)
+
+	body, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		resp, err := http.Post(url+"/v1/actions", jsonContentType, body)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	if _, err := writer.Write([]byte(`{`)); err != nil {
+		t.Fatal(err)
+	}
+	waitForInFlight(t, s, 1)
+
+	// The request never completes, so the shutdown gives up on it.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want the deadline exceeded", err)
+	}
+}
+
+func TestShutdownReleasesWatches(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	url, _ := serveTest(t, s)
+
+	req, err := http.NewRequest("GET", url+"/v1/actions/"+strconv.FormatInt(added.ID, 10)+"/watch?timeout=5m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", actionETag(added))
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("watching action: %v", err)
+			close(responses)
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	waitForInFlight(t, s, 1)
+
+	// The parked watch returns straight away, rather than holding up the
+	// shutdown for its timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("shutting down: %v", err)
+	}
+	if status := <-responses; status != http.StatusNotModified {
+		t.Fatalf("got status %d, want %d", status, http.StatusNotModified)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.SetRequestTimeout(time.Nanosecond)
+
+	// The transaction is bound to the request context, so it gives up once
+	// the request has run out of time.
+	rec := do(t, s, "POST", "/v1/actions", InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeRetryLater || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("got error %+v, want to retry later", resp.Error)
+	}
+
+	s.SetRequestTimeout(defaultRequestTimeout)
+	if list := listActions(t, s, "/v1/actions"); list.Total != 0 {
+		t.Fatalf("got %d actions, want the timed out action rolled back", list.Total)
+	}
+}
+
+func TestAddBatch(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := do(t, s, "POST", "/v1/actions/batch", InputBatch{Actions: []InputAction{
+		{Receiver: "unit-mysql-0", Name: "backup"},
+		{Receiver: "unit-mysql-1", Name: "backup"},
+		{Receiver: "machine-0", Name: "upgrade"},
+	}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputOperation
+	decode(t, rec, &output)
+	if output.Summary != "batch of 3 actions" || output.ExpectedActions != 3 || len(output.Actions) != 3 {
+		t.Fatalf("got operation %+v, want a batch of 3 actions", output)
+	}
+	operation := strconv.FormatInt(output.ID, 10)
+	for i, action := range output.Actions {
+		if action.Operation != operation {
+			t.Errorf("got action %d under operation %q, want %q", i, action.Operation, operation)
+		}
+	}
+	list := listActions(t, s, "/v1/actions?sort=id")
+	if got, want := actionNames(list), []string{"backup", "backup", "upgrade"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got actions %v, want %v", got, want)
+	}
+}
+
+func TestAddBatchIsAtomic(t *testing.T) {
+	s := newTestServer(t)
+
+	// One invalid action rejects the whole batch, with the field errors
+	// indexed by the action they belong to.
+	rec := do(t, s, "POST", "/v1/actions/batch", InputBatch{Summary: "upgrade", Actions: []InputAction{
+		{Receiver: "unit-mysql-0", Name: "backup"},
+		{Receiver: "unit-mysql-1", Name: "Back Up", Operation: "7"},
+	}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	index := 1
+	want := []FieldError{
+		{Field: "actions[1].operation", Message: "not allowed, the batch is enqueued under a new operation", Index: &index},
+		{Field: "actions[1].name", Message: `"Back Up" is not a valid action name`, Index: &index},
+	}
+	if !reflect.DeepEqual(resp.Error.Fields, want) {
+		t.Fatalf("got fields %+v, want %+v", resp.Error.Fields, want)
+	}
+	if list := listActions(t, s, "/v1/actions"); list.Total != 0 {
+		t.Fatalf("got %d actions, want none", list.Total)
+	}
+
+	// Without any actions, the batch is rejected too.
+	rec = do(t, s, "POST", "/v1/actions/batch", InputBatch{Summary: "upgrade"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAddBatchTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	s.SetMaxBatchSize(2)
+
+	batch := InputBatch{Actions: []InputAction{
+		{Receiver: "unit-mysql-0", Name: "backup"},
+		{Receiver: "unit-mysql-1", Name: "backup"},
+		{Receiver: "unit-mysql-2", Name: "backup"},
+	}}
+	rec := do(t, s, "POST", "/v1/actions/batch", batch)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codeTooLarge {
+		t.Fatalf("got error %+v, want too large", resp.Error)
+	}
+
+	batch.Actions = batch.Actions[:2]
+	if rec := do(t, s, "POST", "/v1/actions/batch", batch); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+// doIfMatch serves the request with the If-Match header, if there is one.
+func doIfMatch(t *testing.T, s *Server, method, path, ifMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCancelActionIfMatch(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	rec := do(t, s, "GET", path, nil)
+	etag := rec.Header().Get("ETag")
+	if etag != actionETag(added) {
+		t.Fatalf("got ETag %q, want %q", etag, actionETag(added))
+	}
+
+	// Once the action has changed, the stale ETag no longer matches, and
+	// the action is left alone.
+	beginAction(t, s, added.ID)
+	rec = doIfMatch(t, s, "DELETE", path, etag)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error.Code != codePreconditionFailed {
+		t.Fatalf("got error %+v, want precondition failed", resp.Error)
+	}
+	var current OutputAction
+	decode(t, do(t, s, "GET", path, nil), &current)
+	if current.Status != string(model.ActionRunning) {
+		t.Fatalf("got status %q, want the action still running", current.Status)
+	}
+
+	// The current ETag matches, as a weak ETag too, and the response holds
+	// the ETag of the updated action.
+	rec = doIfMatch(t, s, "POST", path+"/abort", `"0", W/`+actionETag(current))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var aborted OutputAction
+	decode(t, rec, &aborted)
+	if got := rec.Header().Get("ETag"); got == actionETag(current) || got != actionETag(aborted) {
+		t.Fatalf("got ETag %q, want the new generation %q", got, actionETag(aborted))
+	}
+}
+
+func TestCancelActionIfMatchAny(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	rec := doIfMatch(t, s, "DELETE", "/v1/actions/"+strconv.FormatInt(added.ID, 10), "*")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if rec := doIfMatch(t, s, "DELETE", "/v1/actions/4242", "*"); rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestRequirePreconditions(t *testing.T) {
+	s := newTestServer(t)
+	s.SetRequirePreconditions(true)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10)
+
+	for _, req := range []struct{ method, path string }{{"DELETE", path}, {"POST", path + "/abort"}} {
+		rec := doIfMatch(t, s, req.method, req.path, "")
+		if rec.Code != http.StatusPreconditionRequired {
+			t.Fatalf("%s %s: got status %d, body %q", req.method, req.path, rec.Code, rec.Body.String())
+		}
+		var resp ErrorResponse
+		decode(t, rec, &resp)
+		if resp.Error.Code != codePreconditionRequired {
+			t.Fatalf("%s %s: got error %+v, want precondition required", req.method, req.path, resp.Error)
+		}
+	}
+
+	if rec := doIfMatch(t, s, "DELETE", path, actionETag(added)); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLogMessage(t *testing.T) {
+	s := newTestServer(t)
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	s.SetClock(testclock.NewClock(now))
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	path := "/v1/actions/" + strconv.FormatInt(added.ID, 10) + "/logs"
+
+	// Without a timestamp, the message is logged at the server's time.
+	for _, message := range []ActionMessage{
+		{Message: "starting"},
+		{Message: "copying", Timestamp: now.Add(time.Minute)},
+	} {
+		if rec := do(t, s, "POST", path, message); rec.Code >= http.StatusBadRequest {
+			t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := do(t, s, "GET", path, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var messages []ActionMessage
+	decode(t, rec, &messages)
+	want := []ActionMessage{
+		{Message: "starting", Timestamp: now},
+		{Message: "copying", Timestamp: now.Add(time.Minute)},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("got messages %+v, want %+v", messages, want)
+	}
+	for i, message := range messages {
+		if message.Message != want[i].Message || !message.Timestamp.Equal(want[i].Timestamp) {
+			t.Fatalf("got messages %+v, want %+v", messages, want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// testCert is a certificate along with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by the parent, or a self signed CA
+// certificate without a parent.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writeFiles writes the certificate and key as PEM files, returning their
+// paths.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", c.der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLSTest serves the server over TLS with the config, returning the
+// https URL of the server and a client trusting the CA.
+func serveTLSTest(t *testing.T, config *tls.Config, ca *testCert, clientCerts ...tls.Certificate) (string, *http.Client) {
+	t.Helper()
+
+	s := newTestServer(t)
+	s.SetTLSConfig(config)
+	url, _ := serveTest(t, s)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: clientCerts,
+		},
+	}}
+	return strings.Replace(url, "http://", "https://", 1), client
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "server", ca).writeFiles(t, dir, "server")
+
+	config, err := NewTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("creating TLS config: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.ClientAuth != tls.NoClientCert {
+		t.Fatalf("got TLS config %+v, want TLS 1.2 without client certificates", config)
+	}
+
+	url, client := serveTLSTest(t, config, ca)
+	resp, err := client.Get(url + "/v1/actions")
+	if err != nil {
+		t.Fatalf("getting actions: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Fatalf("got status %d over TLS %v, want %d", resp.StatusCode, resp.TLS != nil, http.StatusOK)
+	}
+
+	// Plain HTTP isn't served.
+	resp, err = http.Get(strings.Replace(url, "https://", "http://", 1) + "/v1/actions")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("got status %d over plain HTTP", resp.StatusCode)
+		}
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "server", ca).writeFiles(t, dir, "server")
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+
+	config, err := NewTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("creating TLS config: %v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("got client auth %v, want client certificates required", config.ClientAuth)
+	}
+
+	tests := []struct {
+		name   string
+		client *testCert
+		ok     bool
+	}{
+		{"signed by the CA", newTestCert(t, "client", ca), true},
+		{"without a certificate", nil, false},
+		{"signed by another CA", newTestCert(t, "client", newTestCert(t, "other", nil)), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var clientCerts []tls.Certificate
+			if test.client != nil {
+				clientCerts = append(clientCerts, test.client.tlsCertificate())
+			}
+			url, client := serveTLSTest(t, config, ca, clientCerts...)
+
+			resp, err := client.Get(url + "/v1/actions")
+			if !test.ok {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("got status %d, want the handshake refused", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getting actions: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "server", newTestCert(t, "ca", nil)).writeFiles(t, dir, "server")
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewTLSConfig(filepath.Join(dir, "missing.crt"), keyFile, ""); err == nil || !strings.Contains(err.Error(), "loading certificate") {
+		t.Errorf("got error %v, want the certificate not loaded", err)
+	}
+	if _, err := NewTLSConfig(certFile, keyFile, filepath.Join(dir, "missing.crt")); err == nil || !strings.Contains(err.Error(), "reading CA certificates") {
+		t.Errorf("got error %v, want the CA certificates not read", err)
+	}
+	if _, err := NewTLSConfig(certFile, keyFile, notPEM); !errors.IsNotValid(err) {
+		t.Errorf("got error %v, want the CA certificates not valid", err)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultWatchTimeout is the time a watch waits for the action to
+	// change, unless the timeout query parameter is given.
+	defaultWatchTimeout = 30 * time.Second
+
+	// maxWatchTimeout is the longest a watch can wait for the action to
+	// change.
+	maxWatchTimeout = 5 * time.Minute
+)
+
+// handleWatchAction long-polls for a change to the action. If the If-None-Match
+// header matches the current ETag of the action, the request is parked until
+// the action changes, returning the action along with its new ETag, or until
+// the timeout elapses, returning 304 Not Modified. Without the header, or if
+// the action has already changed, the action is returned immediately.
+func (s *Server) handleWatchAction(w http.ResponseWriter, r *http.Request, id int64) {
+	timeout := defaultWatchTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 || timeout > maxWatchTimeout {
+			badRequest(w, "timeout", "invalid timeout %q, expected a duration up to %v", value, maxWatchTimeout)
+			return
+		}
+	}
+
+	// The watch outlives the request timeout, but is still cancelled when
+	// the client goes away.
+	ctx := withoutRequestTimeout(r)
+
+	output, err := s.getActionByID(ctx, id, false)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	etag := actionETag(output)
+	if !matchesETag(r.Header.Get("If-None-Match"), etag) {
+		writeWatchedAction(w, output)
+		return
+	}
+
+	watcher, err := s.actionMgr.Watch(ctx, output.Receiver)
+	if err != nil {
+		s.handleError(w, r, err)
+		return
+	}
+	defer watcher.Stop()
+
+	timedOut := s.clock.After(timeout)
+
+	// The action is read again once watching, as it may have changed before
+	// the watcher subscribed.
+	changed := true
+	for {
+		if changed {
+			if output, err = s.getActionByID(ctx, id, false); err != nil {
+				s.handleError(w, r, err)
+				return
+			}
+			if actionETag(output) != etag {
+				writeWatchedAction(w, output)
+				return
+			}
+		}
+
+		select {
+		case ids, ok := <-watcher.Changes():
+			if !ok {
+				writeNotModified(w, etag)
+				return
+			}
+			changed = containsID(ids, id)
+		case <-timedOut:
+			writeNotModified(w, etag)
+			return
+		case <-s.shutdown:
+			writeNotModified(w, etag)
+			return
+		case <-ctx.Done():
+			// The client has gone away.
+			return
+		}
+	}
+}
+
+// actionETag returns the ETag of the action, which is its generation.
+func actionETag(action OutputAction) string {
+	return strconv.Quote(strconv.FormatInt(action.Generation, 10))
+}
+
+// matchesETag returns true if the If-Match or If-None-Match header matches
+// the ETag. The header is either "*" or a list of ETags, where weak ETags are
+// compared by value. An empty header matches nothing.
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeWatchedAction(w http.ResponseWriter, action OutputAction) {
+	w.Header().Set("ETag", actionETag(action))
+	w.Header().Set("Cache-Control", "no-store")
+	encodeJSON(w, action)
+}
+
+func writeNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// untimedKey is the context key of the context of a request, before the
+// request timeout was applied.
+type untimedKey struct{}
+
+// withoutRequestTimeout returns the context of the request without the
+// request timeout, for long running requests.
+func withoutRequestTimeout(r *http.Request) context.Context {
+	if ctx, ok := r.Context().Value(untimedKey{}).(context.Context); ok {
+		return ctx
+	}
+	return r.Context()
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/juju/clock/testclock"
+)
+
+// watchAction serves a watch of the action with the ETag, if there is one.
+func watchAction(t *testing.T, s *Server, id int64, etag, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/v1/actions/"+strconv.FormatInt(id, 10)+"/watch"+query, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// watchActionAsync serves the watch in the background, once the watch is
+// parked.
+func watchActionAsync(t *testing.T, s *Server, id int64, etag, query string) <-chan *httptest.ResponseRecorder {
+	t.Helper()
+
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		responses <- watchAction(t, s, id, etag, query)
+	}()
+	waitForInFlight(t, s, 1)
+	return responses
+}
+
+func TestWatchActionReturnsChanged(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	// Without an ETag, or with a stale one, the action is returned straight
+	// away.
+	for _, etag := range []string{"", `"0"`} {
+		rec := watchAction(t, s, added.ID, etag, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("If-None-Match %q: got status %d, body %q", etag, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("ETag"); got != actionETag(added) {
+			t.Fatalf("If-None-Match %q: got ETag %q, want %q", etag, got, actionETag(added))
+		}
+	}
+}
+
+func TestWatchActionWaitsForChange(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	responses := watchActionAsync(t, s, added.ID, actionETag(added), "?timeout=1m")
+
+	// Another action of the same receiver doesn't end the watch.
+	addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "restore"})
+	select {
+	case rec := <-responses:
+		t.Fatalf("got status %d before the action changed", rec.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	beginAction(t, s, added.ID)
+	var rec *httptest.ResponseRecorder
+	select {
+	case rec = <-responses:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("watch not woken by the change")
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	var output OutputAction
+	decode(t, rec, &output)
+	if output.Status != string(model.ActionRunning) {
+		t.Fatalf("got status %q, want %q", output.Status, model.ActionRunning)
+	}
+	if got := rec.Header().Get("ETag"); got == actionETag(added) || got != actionETag(output) {
+		t.Fatalf("got ETag %q, want the new generation %q", got, actionETag(output))
+	}
+}
+
+func TestWatchActionTimesOut(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	rec := watchAction(t, s, added.ID, actionETag(added), "?timeout=50ms")
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("ETag"); got != actionETag(added) {
+		t.Fatalf("got ETag %q, want %q", got, actionETag(added))
+	}
+}
+
+func TestWatchActionTimesOutOnTheClock(t *testing.T) {
+	s := newTestServer(t)
+	clock := testclock.NewClock(time.Now())
+	s.SetClock(clock)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	// A weak ETag, or a list holding the ETag, matches the action too.
+	for _, etag := range []string{"W/" + actionETag(added), `"0", ` + actionETag(added)} {
+		responses := watchActionAsync(t, s, added.ID, etag, "?timeout=1m")
+		if err := clock.WaitAdvance(time.Minute, time.Second, 1); err != nil {
+			t.Fatalf("If-None-Match %q: %v", etag, err)
+		}
+		select {
+		case rec := <-responses:
+			if rec.Code != http.StatusNotModified {
+				t.Fatalf("If-None-Match %q: got status %d, body %q", etag, rec.Code, rec.Body.String())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("If-None-Match %q: the watch didn't time out", etag)
+		}
+	}
+}
+
+func TestWatchActionOutlivesRequestTimeout(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+	s.SetRequestTimeout(10 * time.Millisecond)
+
+	rec := watchAction(t, s, added.ID, actionETag(added), "?timeout=100ms")
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("got status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWatchActionInvalid(t *testing.T) {
+	s := newTestServer(t)
+	added := addAction(t, s, InputAction{Receiver: "unit-mysql-0", Name: "backup"})
+
+	for _, timeout := range []string{"soon", "0s", "-1s", "6m"} {
+		rec := watchAction(t, s, added.ID, actionETag(added), "?timeout="+timeout)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("timeout %q: got status %d, want %d", timeout, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		var resp ErrorResponse
+		decode(t, rec, &resp)
+		if resp.Error.Field != "timeout" {
+			t.Errorf("timeout %q: got error %+v, want the timeout rejected", timeout, resp.Error)
+		}
+	}
+
+	if rec := watchAction(t, s, 4242, `"1"`, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{`"3"`, true},
+		{`W/"3"`, true},
+		{`"1", "3"`, true},
+		{` "1" ,W/"3" `, true},
+		{`*`, true},
+		{`"2"`, false},
+		{`3`, false},
+		{`"1", "2"`, false},
+		{``, false},
+	}
+	for _, test := range tests {
+		if got := matchesETag(test.header, `"3"`); got != test.match {
+			t.Errorf("If-Match %q: got match %v, want %v", test.header, got, test.match)
+		}
+	}
+}
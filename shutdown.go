@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// APIServer is the API server stopped on shutdown.
+type APIServer interface {
+	// Shutdown stops accepting requests and waits for the in-flight
+	// requests to complete, or the context to be done.
+	Shutdown(context.Context) error
+}
+
+// StateStopper is the state stopped on shutdown.
+type StateStopper interface {
+	// Stop stops the ensure loop and the managers.
+	Stop() error
+}
+
+// REPLWorker is the REPL stopped on shutdown.
+type REPLWorker interface {
+	// Kill closes the REPL sockets and ends the open sessions.
+	Kill()
+
+	// Wait blocks until every session has ended.
+	Wait() error
+}
+
+// DatabaseCloser is the database closed on shutdown.
+type DatabaseCloser interface {
+	Close() error
+}
+
+// ClusterNode is the dqlite node stopped on shutdown.
+type ClusterNode interface {
+	// Handover transfers leadership and the role of the node to other
+	// nodes, before the node goes offline.
+	Handover(context.Context) error
+	Close() error
+}
+
+// ShutdownDeps holds what is stopped on shutdown. Anything nil, because it
+// was never started, is skipped.
+type ShutdownDeps struct {
+	Server   APIServer
+	State    StateStopper
+	REPL     REPLWorker
+	Database DatabaseCloser
+	Node     ClusterNode
+}
+
+// RunUntilDone blocks until the context is done or the API fails to serve,
+// then shuts down within the timeout. The error serving the API, if any, is
+// returned in preference to any error shutting down.
+func RunUntilDone(ctx context.Context, serveErrs <-chan error, deps ShutdownDeps, timeout time.Duration) error {
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-serveErrs:
+		if serveErr != nil {
+			log.Printf("serving API: %v", serveErr)
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := Shutdown(shutdownCtx, deps)
+	if serveErr != nil {
+		return errors.Annotate(serveErr, "serving API")
+	}
+	return err
+}
+
+// Shutdown stops everything in order: stop accepting API requests and drain
+// the in-flight ones, stop the managers whilst the database is still
+// available, end the REPL sessions so that none of them hold a connection,
+// close the database, hand over leadership and the role of the node, then
+// close the node. Every step is attempted, even if an earlier one
+// fails, but no step outlasts the context.
+func Shutdown(ctx context.Context, deps ShutdownDeps) error {
+	var failed []string
+	step := func(name string, fn func() error) {
+		if err := runWithin(ctx, fn); err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if deps.Server != nil {
+		step("shutting down API", func() error { return deps.Server.Shutdown(ctx) })
+	}
+	if deps.State != nil {
+		step("stopping state", deps.State.Stop)
+	}
+	if deps.REPL != nil {
+		step("stopping REPL", func() error {
+			deps.REPL.Kill()
+			return deps.REPL.Wait()
+		})
+	}
+	if deps.Database != nil {
+		step("closing database", deps.Database.Close)
+	}
+	if deps.Node != nil {
+		step("handing over", func() error { return deps.Node.Handover(ctx) })
+		step("closing node", deps.Node.Close)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("shutdown failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// runWithin runs the function, giving up on it once the context is done.
+func runWithin(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Annotate(err, "shutdown timed out")
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "shutdown timed out")
+	}
+}
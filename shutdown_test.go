@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/repl"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// recorder records the shutdown steps in the order they're called. A step
+// fails with the error set for it, and blocks until the context is done if
+// it's set to block.
+type recorder struct {
+	mutex sync.Mutex
+	calls []string
+	errs  map[string]error
+	block map[string]bool
+}
+
+func (r *recorder) call(ctx context.Context, name string) error {
+	r.mutex.Lock()
+	r.calls = append(r.calls, name)
+	err, block := r.errs[name], r.block[name]
+	r.mutex.Unlock()
+
+	if block {
+		<-ctx.Done()
+	}
+	return err
+}
+
+func (r *recorder) recorded() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// deps returns every dependency, each recording its calls.
+func (r *recorder) deps(ctx context.Context) ShutdownDeps {
+	return ShutdownDeps{
+		Server:   fakeServer{r},
+		State:    fakeState{r, ctx},
+		REPL:     fakeREPL{r, ctx},
+		Database: fakeDatabase{r, ctx},
+		Node:     fakeNode{r, ctx},
+	}
+}
+
+type fakeServer struct{ r *recorder }
+
+func (s fakeServer) Shutdown(ctx context.Context) error { return s.r.call(ctx, "server") }
+
+type fakeState struct {
+	r   *recorder
+	ctx context.Context
+}
+
+func (s fakeState) Stop() error { return s.r.call(s.ctx, "state") }
+
+type fakeREPL struct {
+	r   *recorder
+	ctx context.Context
+}
+
+func (l fakeREPL) Kill()       { _ = l.r.call(l.ctx, "kill repl") }
+func (l fakeREPL) Wait() error { return l.r.call(l.ctx, "wait repl") }
+
+type fakeDatabase struct {
+	r   *recorder
+	ctx context.Context
+}
+
+func (d fakeDatabase) Close() error { return d.r.call(d.ctx, "database") }
+
+type fakeNode struct {
+	r   *recorder
+	ctx context.Context
+}
+
+func (n fakeNode) Handover(ctx context.Context) error { return n.r.call(ctx, "handover") }
+func (n fakeNode) Close() error                       { return n.r.call(n.ctx, "node") }
+
+var shutdownOrder = []string{"server", "state", "kill repl", "wait repl", "database", "handover", "node"}
+
+func TestShutdownOrder(t *testing.T) {
+	r := &recorder{}
+	ctx := context.Background()
+	if err := Shutdown(ctx, r.deps(ctx)); err != nil {
+		t.Fatalf("shutting down: %v", err)
+	}
+	if got := r.recorded(); !reflect.DeepEqual(got, shutdownOrder) {
+		t.Fatalf("got calls %v, want %v", got, shutdownOrder)
+	}
+}
+
+func TestShutdownSkipsMissingDeps(t *testing.T) {
+	r := &recorder{}
+	ctx := context.Background()
+	deps := r.deps(ctx)
+	deps.State = nil
+	deps.Node = nil
+	if err := Shutdown(ctx, deps); err != nil {
+		t.Fatalf("shutting down: %v", err)
+	}
+	if got, want := r.recorded(), []string{"server", "kill repl", "wait repl", "database"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestShutdownAttemptsEveryStep(t *testing.T) {
+	r := &recorder{
+		errs: map[string]error{
+			"server":   errors.New("listener gone"),
+			"handover": errors.New("no other voters"),
+		},
+	}
+	ctx := context.Background()
+	err := Shutdown(ctx, r.deps(ctx))
+	if err == nil {
+		t.Fatalf("expected shutdown to fail")
+	}
+	for _, want := range []string{"shutting down API: listener gone", "handing over: no other voters"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %q, want it to contain %q", err, want)
+		}
+	}
+	if got := r.recorded(); !reflect.DeepEqual(got, shutdownOrder) {
+		t.Fatalf("got calls %v, want every step %v", got, shutdownOrder)
+	}
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The server never finishes draining, so the steps after it are given
+	// up on once the context is done.
+	r := &recorder{block: map[string]bool{"server": true}}
+	err := Shutdown(ctx, r.deps(ctx))
+	if err == nil || !strings.Contains(err.Error(), "shutdown timed out") {
+		t.Fatalf("got error %v, want timed out", err)
+	}
+	if got, want := r.recorded(), []string{"server"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestShutdownBoundsREPLWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// A session never ends, so the database isn't closed from under it, and
+	// the steps after it are given up on once the context is done.
+	r := &recorder{block: map[string]bool{"wait repl": true}}
+	err := Shutdown(ctx, r.deps(ctx))
+	if err == nil || !strings.Contains(err.Error(), "stopping REPL: shutdown timed out") {
+		t.Fatalf("got error %v, want stopping the REPL timed out", err)
+	}
+	if got, want := r.recorded(), []string{"server", "state", "kill repl", "wait repl"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestShutdownClosesDatabasesOnceREPLStopped(t *testing.T) {
+	if !hasDriver("sqlite3") {
+		t.Skip("sqlite isn't available")
+	}
+	dir := t.TempDir()
+	open := func(_ context.Context, name string) (*sql.DB, error) {
+		return sql.Open("sqlite3", filepath.Join(dir, name+".db"))
+	}
+	databases := db.NewRegistry(open, db.WithAllowedNames("main"))
+	sqlDB, err := databases.GetDB(context.Background(), "main")
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	if _, err := sqlDB.Exec("CREATE TABLE actions (name TEXT); INSERT INTO actions VALUES ('backup')"); err != nil {
+		t.Fatalf("preparing database: %v", err)
+	}
+
+	sqlRepl, err := repl.New(filepath.Join(dir, "repl.sock"), databases, "main", nil, clock.WallClock)
+	if err != nil {
+		t.Fatalf("creating REPL: %v", err)
+	}
+
+	// A session is still using the database, with a transaction open, when
+	// the node shuts down.
+	conn, err := net.Dial("unix", filepath.Join(dir, "repl.sock"))
+	if err != nil {
+		t.Fatalf("connecting to REPL: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("BEGIN;\nDELETE FROM actions;\n")); err != nil {
+		t.Fatalf("writing statements: %v", err)
+	}
+	readUntil(t, conn, "Affected Rows: 1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx, ShutdownDeps{REPL: sqlRepl, Database: databases}); err != nil {
+		t.Fatalf("shutting down: %v", err)
+	}
+	readUntil(t, conn, "REPL system is shutting down")
+	if _, err := databases.GetDB(context.Background(), "main"); err == nil {
+		t.Fatalf("got the database from the closed registry")
+	}
+
+	// The session rolled back its transaction before the database was
+	// closed.
+	reopened, err := open(context.Background(), "main")
+	if err != nil {
+		t.Fatalf("reopening database: %v", err)
+	}
+	defer reopened.Close()
+	var n int
+	if err := reopened.QueryRow("SELECT COUNT(*) FROM actions").Scan(&n); err != nil {
+		t.Fatalf("counting actions: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("got %d actions, want the open transaction rolled back", n)
+	}
+}
+
+// hasDriver returns true if the SQL driver is registered.
+func hasDriver(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// readUntil reads from the connection until the output contains the string.
+func readUntil(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	var out []byte
+	buf := make([]byte, 4096)
+	for !strings.Contains(string(out), want) {
+		n, err := conn.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			t.Fatalf("reading %q: %v; got %q", want, err, out)
+		}
+	}
+}
+
+func TestRunUntilDone(t *testing.T) {
+	t.Run("context done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := &recorder{}
+		if err := RunUntilDone(ctx, make(chan error), r.deps(context.Background()), time.Second); err != nil {
+			t.Fatalf("running: %v", err)
+		}
+		if got := r.recorded(); !reflect.DeepEqual(got, shutdownOrder) {
+			t.Fatalf("got calls %v, want %v", got, shutdownOrder)
+		}
+	})
+
+	t.Run("serve error", func(t *testing.T) {
+		serveErrs := make(chan error, 1)
+		serveErrs <- errors.New("address in use")
+
+		// The serve error is returned in preference to the shutdown error.
+		r := &recorder{errs: map[string]error{"database": errors.New("busy")}}
+		err := RunUntilDone(context.Background(), serveErrs, r.deps(context.Background()), time.Second)
+		if err == nil || err.Error() != "serving API: address in use" {
+			t.Fatalf("got error %v, want the serve error", err)
+		}
+		if got := r.recorded(); !reflect.DeepEqual(got, shutdownOrder) {
+			t.Fatalf("got calls %v, want %v", got, shutdownOrder)
+		}
+	})
+
+	t.Run("shutdown error", func(t *testing.T) {
+		serveErrs := make(chan error, 1)
+		serveErrs <- nil
+
+		r := &recorder{errs: map[string]error{"database": errors.New("busy")}}
+		err := RunUntilDone(context.Background(), serveErrs, r.deps(context.Background()), time.Second)
+		if err == nil || !strings.Contains(err.Error(), "closing database: busy") {
+			t.Fatalf("got error %v, want the shutdown error", err)
+		}
+	})
+}
@@ -47,21 +47,42 @@ type Action struct {
 
 	// Message captures any error returned by the action.
 	Message sql.NullString `db:"message"`
+
+	// IdempotencyKey is the client supplied key the action was added with.
+	IdempotencyKey sql.NullString `db:"idempotency_key"`
+
+	// RequestedBy is the tag of the user or client that enqueued the action.
+	RequestedBy sql.NullString `db:"requested_by"`
+
+	// Source describes where the action was enqueued from.
+	Source sql.NullString `db:"source"`
+
+	// ExpiresAt is the time the action fails if it's still pending.
+	ExpiresAt sql.NullTime `db:"expires_at"`
+
+	// Generation is incremented every time the action changes.
+	Generation int64 `db:"generation"`
 }
 
 // Fields returns the list of fields directly from an Action type.
-func (a Action) Fields(tx *sqlx.Tx) string {
+func (a Action) Fields(tx *sqlx.Tx) (string, error) {
 	fields, err := db.FieldNames(tx, a)
 	if err != nil {
-		panic("programtic error: " + err.Error())
+		return "", errors.Trace(err)
 	}
-	return fields.Join()
+	return fields.Join(), nil
 }
 
 func (a Action) ToModel() (model.Action, error) {
+	// A NULL parameters column, or a JSON null, is treated as no parameters.
 	var parameters map[string]interface{}
-	if err := json.Unmarshal(a.Parameters, &parameters); err != nil {
-		return model.Action{}, errors.Trace(err)
+	if len(a.Parameters) > 0 {
+		if err := json.Unmarshal(a.Parameters, &parameters); err != nil {
+			return model.Action{}, errors.Trace(err)
+		}
+	}
+	if parameters == nil {
+		parameters = make(map[string]interface{})
 	}
 
 	tag, err := names.ParseActionTag(a.Tag)
@@ -74,32 +95,43 @@ func (a Action) ToModel() (model.Action, error) {
 		status = model.ActionStatus(a.Status.String)
 	}
 
-	enqueued := time.Time{}
-	if a.Enqueued.Valid {
-		enqueued = a.Enqueued.Time
-	}
-
-	started := time.Time{}
-	if a.Enqueued.Valid {
-		started = a.Started.Time
-	}
-
-	completed := time.Time{}
-	if a.Enqueued.Valid {
-		completed = a.Completed.Time
-	}
-
 	return model.Action{
 		ID:         a.ID,
 		Tag:        tag,
 		Receiver:   a.Receiver,
 		Name:       a.Name,
 		Parameters: parameters,
-		Enqueued:   enqueued,
-		Started:    started,
-		Completed:  completed,
+		Enqueued:   nullTime(a.Enqueued),
+		Started:    nullTime(a.Started),
+		Completed:  nullTime(a.Completed),
 		Operation:  a.Operation,
 		Status:     status,
 		Message:    a.Message.String,
+
+		IdempotencyKey: a.IdempotencyKey.String,
+		RequestedBy:    a.RequestedBy.String,
+		Source:         a.Source.String,
+		ExpiresAt:      nullTime(a.ExpiresAt),
+		Generation:     a.Generation,
 	}, nil
 }
+
+func nullTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// ActionMessage is a progress message logged by an action.
+type ActionMessage struct {
+	Message   string    `db:"output"`
+	Timestamp time.Time `db:"timestamp"`
+}
+
+func (m ActionMessage) ToModel() model.ActionMessage {
+	return model.ActionMessage{
+		Message:   m.Message,
+		Timestamp: m.Timestamp,
+	}
+}
@@ -0,0 +1,111 @@
+package actionstate_test
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/SimonRichardson/nu-juju-data/state/actionstate"
+)
+
+const testActionTag = "action-6ba7b810-9dad-41d1-80b4-00c04fd430c8"
+
+func TestActionToModelTimes(t *testing.T) {
+	enqueued := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	started := enqueued.Add(time.Minute)
+	completed := started.Add(time.Minute)
+
+	// Every combination of NULL and valid times is read from its own column.
+	for mask := 0; mask < 8; mask++ {
+		nullable := func(bit int, value time.Time) (sql.NullTime, time.Time) {
+			if mask&bit == 0 {
+				return sql.NullTime{}, time.Time{}
+			}
+			return sql.NullTime{Time: value, Valid: true}, value
+		}
+		enqueuedIn, enqueuedWant := nullable(1, enqueued)
+		startedIn, startedWant := nullable(2, started)
+		completedIn, completedWant := nullable(4, completed)
+
+		name := fmt.Sprintf("enqueued=%v,started=%v,completed=%v", enqueuedIn.Valid, startedIn.Valid, completedIn.Valid)
+		t.Run(name, func(t *testing.T) {
+			action := actionstate.Action{
+				Tag:       testActionTag,
+				Enqueued:  enqueuedIn,
+				Started:   startedIn,
+				Completed: completedIn,
+			}
+			result, err := action.ToModel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Enqueued.Equal(enqueuedWant) || !result.Started.Equal(startedWant) || !result.Completed.Equal(completedWant) {
+				t.Fatalf("got times %v, %v, %v, want %v, %v, %v",
+					result.Enqueued, result.Started, result.Completed,
+					enqueuedWant, startedWant, completedWant)
+			}
+		})
+	}
+}
+
+func TestActionToModelNullable(t *testing.T) {
+	tests := []struct {
+		name           string
+		action         actionstate.Action
+		wantParameters map[string]interface{}
+		wantStatus     model.ActionStatus
+		wantMessage    string
+		wantErr        bool
+	}{{
+		name:           "all null",
+		action:         actionstate.Action{},
+		wantParameters: map[string]interface{}{},
+		wantStatus:     model.ActionPending,
+	}, {
+		name:           "json null parameters",
+		action:         actionstate.Action{Parameters: []byte("null")},
+		wantParameters: map[string]interface{}{},
+		wantStatus:     model.ActionPending,
+	}, {
+		name: "all valid",
+		action: actionstate.Action{
+			Parameters: []byte(`{"mode":"full"}`),
+			Status:     sql.NullString{String: string(model.ActionFailed), Valid: true},
+			Message:    sql.NullString{String: "disk exhausted", Valid: true},
+		},
+		wantParameters: map[string]interface{}{"mode": "full"},
+		wantStatus:     model.ActionFailed,
+		wantMessage:    "disk exhausted",
+	}, {
+		name:    "invalid parameters",
+		action:  actionstate.Action{Parameters: []byte("{")},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.action.Tag = testActionTag
+			result, err := test.action.ToModel()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Parameters, test.wantParameters) {
+				t.Errorf("got parameters %v, want %v", result.Parameters, test.wantParameters)
+			}
+			if result.Status != test.wantStatus {
+				t.Errorf("got status %q, want %q", result.Status, test.wantStatus)
+			}
+			if result.Message != test.wantMessage {
+				t.Errorf("got message %q, want %q", result.Message, test.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package actionstate
+
+import "github.com/juju/utils"
+
+// PatchNewUUID replaces the generator of the action tag UUIDs, returning a
+// function restoring the original.
+func PatchNewUUID(fn func() (utils.UUID, error)) func() {
+	original := newUUID
+	newUUID = fn
+	return func() { newUUID = original }
+}
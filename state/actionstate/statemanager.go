@@ -4,9 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/SimonRichardson/nu-juju-data/db"
 	"github.com/SimonRichardson/nu-juju-data/model"
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
 	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
 	"github.com/juju/errors"
 	"github.com/juju/names"
 	"github.com/juju/utils"
@@ -16,34 +26,274 @@ type Backend interface {
 	// Run is a convince function for running one shot transactions, which
 	// correctly handles the rollback semantics and retries where available.
 	Run(func(context.Context, *sqlx.Tx) error) error
+
+	// RunContext runs one shot transactions, which are cancelled along with
+	// the context.
+	RunContext(context.Context, func(context.Context, *sqlx.Tx) error) error
+}
+
+// Publisher publishes events once the transactions that caused them have
+// committed.
+type Publisher interface {
+	Publish(event interface{})
+}
+
+const (
+	// defaultRetention is how long finished actions are kept for, before
+	// they're pruned.
+	defaultRetention = 7 * 24 * time.Hour
+
+	// pruneBatchSize is the maximum number of actions pruned within a single
+	// transaction.
+	pruneBatchSize = 100
+
+	// defaultParametersLimit is the default maximum size of the encoded
+	// parameters of an action.
+	defaultParametersLimit = 1 << 20
+
+	// defaultMessageLimit is the default maximum size of an action message.
+	defaultMessageLimit = 4 << 10
+
+	// expiredMessage is the message of the actions that expired whilst
+	// pending.
+	expiredMessage = "action expired before it was run"
+
+	// idsChunkSize is the maximum number of ids bound to a single statement,
+	// keeping well below the sqlite limit on the number of variables.
+	idsChunkSize = 500
+)
+
+// newUUID generates the UUIDs of the action tags.
+var newUUID = utils.NewUUID
+
+// Logger is the logging interface used by the manager.
+type Logger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warningf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
+// Subscriber subscribes to the events published once transactions have
+// committed.
+type Subscriber interface {
+	Subscribe(size int) *events.Subscription
+}
+
+// OperationRefresher derives the status of an operation from its actions.
+type OperationRefresher interface {
+	RefreshOperationStatus(tx *sqlx.Tx, id int64) (model.Operation, error)
 }
 
 type ActionManager struct {
-	backend Backend
+	backend    Backend
+	clock      clock.Clock
+	logger     Logger
+	publisher  Publisher
+	subscriber Subscriber
+	operations OperationRefresher
+
+	parametersLimit int
+	messageLimit    int
+
+	mutex         sync.Mutex
+	retention     time.Duration
+	receiverKinds []string
+	// fullText is set if the full text search index is available.
+	fullText bool
+}
+
+// Option configures an ActionManager.
+type Option func(*ActionManager)
+
+// WithSizeLimits sets the maximum size, in bytes, of the encoded parameters
+// and of the messages of an action.
+func WithSizeLimits(parameters, message int) Option {
+	return func(m *ActionManager) {
+		m.parametersLimit = parameters
+		m.messageLimit = message
+	}
 }
 
-// NewManager creates a new manager from a backend.
-func NewManager(backend Backend) *ActionManager {
-	return &ActionManager{
-		backend: backend,
+// NewManager creates a new manager from a backend. The status of the parent
+// operation is refreshed every time the status of an action changes.
+func NewManager(backend Backend, publisher Publisher, operations OperationRefresher, opts ...Option) *ActionManager {
+	m := &ActionManager{
+		backend:         backend,
+		clock:           clock.WallClock,
+		logger:          noopLogger{},
+		publisher:       publisher,
+		operations:      operations,
+		parametersLimit: defaultParametersLimit,
+		messageLimit:    defaultMessageLimit,
+		retention:       defaultRetention,
+		receiverKinds: []string{
+			names.UnitTagKind,
+			names.MachineTagKind,
+		},
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
+}
+
+// WithLogger sets the logger used by the manager.
+func WithLogger(logger Logger) Option {
+	return func(m *ActionManager) {
+		m.logger = logger
+	}
+}
+
+// WithClock sets the clock used to expire pending actions.
+func WithClock(clock clock.Clock) Option {
+	return func(m *ActionManager) {
+		m.clock = clock
+	}
+}
+
+// WithSubscriber sets the subscriber used to watch for action changes.
+func WithSubscriber(subscriber Subscriber) Option {
+	return func(m *ActionManager) {
+		m.subscriber = subscriber
+	}
+}
+
+// checkMessage checks the message is within the size limit.
+func (m *ActionManager) checkMessage(id int64, message string) error {
+	if len(message) > m.messageLimit {
+		return stateerrors.TooLargef("message for action %d of %d bytes (limit %d bytes)", id, len(message), m.messageLimit)
+	}
+	return nil
+}
+
+// SetReceiverKinds sets the kinds of tags that actions can be enqueued for.
+// By default, actions can be enqueued for units and machines.
+func (m *ActionManager) SetReceiverKinds(kinds ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.receiverKinds = kinds
+}
+
+// validateReceiver checks that actions can be enqueued for the receiver.
+func (m *ActionManager) validateReceiver(receiver names.Tag) error {
+	if receiver == nil {
+		return errors.BadRequestf("missing receiver")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, kind := range m.receiverKinds {
+		if receiver.Kind() == kind {
+			return nil
+		}
+	}
+	return errors.BadRequestf("receiver %q of kind %q, expected one of %s", receiver.String(), receiver.Kind(), strings.Join(m.receiverKinds, ", "))
+}
+
+// SetRetention sets how long finished actions are kept for, before they're
+// pruned by Ensure. A retention of zero disables pruning.
+func (m *ActionManager) SetRetention(retention time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.retention = retention
+}
+
+// publishOnCommit publishes the event once the transaction has committed.
+func (m *ActionManager) publishOnCommit(tx *sqlx.Tx, event interface{}) error {
+	return errors.Trace(db.OnCommit(tx, func() {
+		m.publisher.Publish(event)
+	}))
 }
 
 func (m *ActionManager) StartUp(ctx context.Context) error {
+	// The search index is only created by the schema if FTS5 was available
+	// at the time, so create it now if it's missing and FTS5 is available.
+	var fullText bool
+	err := m.backend.RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		fullText, err = schemastate.EnsureActionsFullText(ctx, tx)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	m.mutex.Lock()
+	m.fullText = fullText
+	m.mutex.Unlock()
+
+	if !fullText {
+		m.logger.Warningf("full text search is not available, searching actions will be slow")
+	}
+
 	// TODO (stickupkid): Prepare any queries within a transaction, to help
 	// with performance.
 	return nil
 }
 
-func (m *ActionManager) Stop() {}
+func (m *ActionManager) Stop(ctx context.Context) {}
+
+// Ensure fails the pending actions that have expired, then prunes the
+// finished actions that are older than the retention, in batches so that
+// each transaction stays small.
+func (m *ActionManager) Ensure(ctx context.Context) error {
+	err := m.backend.RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := m.ExpirePending(tx, m.clock.Now())
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Annotate(err, "expiring actions")
+	}
+
+	m.mutex.Lock()
+	retention := m.retention
+	m.mutex.Unlock()
+
+	if retention <= 0 {
+		return nil
+	}
+
+	for ctx.Err() == nil {
+		var pruned PruneResult
+		err := m.backend.RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			var err error
+			pruned, err = m.Prune(tx, retention, pruneBatchSize)
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return errors.Annotate(err, "pruning actions")
+		}
+		if pruned.Actions < pruneBatchSize {
+			break
+		}
+	}
+	return nil
+}
+
+// selectActions returns the statement for selecting all the fields of the
+// actions.
+func selectActions(tx *sqlx.Tx) (string, error) {
+	fields, err := Action{}.Fields(tx)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return "SELECT " + fields + " FROM actions", nil
+}
 
 // ActionByID returns one action by id.
 func (m *ActionManager) ActionByID(tx *sqlx.Tx, id int64) (model.Action, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
 	var action Action
-	err := tx.Get(&action, "SELECT "+action.Fields(tx)+" FROM actions WHERE id=$1", id)
+	err = tx.Get(&action, query+" WHERE id=$1", id)
 	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
-			return model.Action{}, errors.NotFoundf("action %v", id)
+			return model.Action{}, stateerrors.NotFoundf("action %v", id)
 		}
 		return model.Action{}, errors.Trace(err)
 	}
@@ -53,27 +303,332 @@ func (m *ActionManager) ActionByID(tx *sqlx.Tx, id int64) (model.Action, error)
 
 // ActionByTag returns one action by tag.
 func (m *ActionManager) ActionByTag(tx *sqlx.Tx, tag names.ActionTag) (model.Action, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
 	var action Action
-	err := tx.Get(&action, "SELECT "+action.Fields(tx)+" FROM actions WHERE tag=$1", tag.Id())
+	// Tags are stored in their full "action-<uuid>" form.
+	err = tx.Get(&action, query+" WHERE tag=$1", tag.String())
 	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
-			return model.Action{}, errors.NotFoundf("action %q", tag.Id())
+			return model.Action{}, stateerrors.NotFoundf("action %q", tag.Id())
 		}
 		return model.Action{}, errors.Trace(err)
 	}
 	return action.ToModel()
 }
 
+// ListFilter filters, sorts and pages the actions returned by ListActions.
+// Empty fields don't filter the actions.
+type ListFilter struct {
+	Statuses    []model.ActionStatus
+	Receiver    string
+	Name        string
+	Operation   string
+	RequestedBy string
+	Source      string
+
+	// Sort is the column the actions are sorted by, which is one of id,
+	// enqueued, name or status. Prefixing the column with "-" sorts in
+	// descending order. The actions are sorted by id by default.
+	Sort string
+
+	// Limit is the maximum number of actions returned. Zero returns all the
+	// actions.
+	Limit  int
+	Offset int
+}
+
+// sortColumns are the columns actions can be sorted by.
+var sortColumns = map[string]bool{
+	"id":       true,
+	"enqueued": true,
+	"name":     true,
+	"status":   true,
+}
+
+// ListActions returns the actions matching the filter, along with the total
+// number of matching actions, ignoring the limit and offset.
+func (m *ActionManager) ListActions(tx *sqlx.Tx, filter ListFilter) ([]model.Action, int, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			placeholders[i] = "?"
+			args = append(args, string(status))
+		}
+		conditions = append(conditions, "status IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	for _, column := range []struct {
+		name  string
+		value string
+	}{
+		{name: "receiver", value: filter.Receiver},
+		{name: "name", value: filter.Name},
+		{name: "operation", value: filter.Operation},
+		{name: "requested_by", value: filter.RequestedBy},
+		{name: "source", value: filter.Source},
+	} {
+		if column.value != "" {
+			conditions = append(conditions, column.name+" = ?")
+			args = append(args, column.value)
+		}
+	}
+	var where string
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	order := "id"
+	if filter.Sort != "" {
+		column, direction := strings.TrimPrefix(filter.Sort, "-"), "ASC"
+		if !sortColumns[column] {
+			return nil, 0, errors.BadRequestf("sorting actions by %q", column)
+		}
+		if strings.HasPrefix(filter.Sort, "-") {
+			direction = "DESC"
+		}
+		// Break ties by id, so that paging is stable.
+		order = column + " " + direction + ", id " + direction
+	}
+
+	var total int
+	if err := tx.Get(&total, "SELECT COUNT(*) FROM actions"+where, args...); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	query, err := selectActions(tx)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	query += where + " ORDER BY " + order
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	} else if filter.Offset > 0 {
+		query += " LIMIT -1 OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+
+	var actions []Action
+	if err := tx.Select(&actions, query, args...); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	results, err := toModels(actions)
+	return results, total, errors.Trace(err)
+}
+
+// ActionsByIDs returns the actions with the given ids, in the same order as
+// the ids. The ids that don't match an action are returned separately.
+func (m *ActionManager) ActionsByIDs(tx *sqlx.Tx, ids []int64) ([]model.Action, []int64, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	found := make(map[int64]Action, len(ids))
+	for start := 0; start < len(ids); start += idsChunkSize {
+		end := start + idsChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		chunkQuery, args, err := sqlx.In(query+" WHERE id IN (?)", ids[start:end])
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		var actions []Action
+		if err := tx.Select(&actions, tx.Rebind(chunkQuery), args...); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		for _, action := range actions {
+			found[action.ID] = action
+		}
+	}
+
+	var (
+		results []model.Action
+		missing []int64
+	)
+	for _, id := range ids {
+		action, ok := found[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		result, err := action.ToModel()
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		results = append(results, result)
+	}
+	return results, missing, nil
+}
+
 // ActionsByName returns a slice of actions that have the same name.
 func (m *ActionManager) ActionsByName(tx *sqlx.Tx, name string) ([]model.Action, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var actions []Action
+	err = tx.Select(&actions, query+" WHERE name=$1 ORDER BY tag", name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return toModels(actions)
+}
+
+// ActionsByReceiver returns the actions for the receiver, ordered by the time
+// they were enqueued. If any statuses are given, only the actions with one of
+// those statuses are returned.
+func (m *ActionManager) ActionsByReceiver(tx *sqlx.Tx, receiver names.Tag, statuses ...model.ActionStatus) ([]model.Action, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	query += " WHERE receiver = ?"
+	args := []interface{}{receiver.String()}
+	if len(statuses) > 0 {
+		placeholders := make([]string, len(statuses))
+		for i, status := range statuses {
+			placeholders[i] = "?"
+			args = append(args, string(status))
+		}
+		query += " AND status IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	var actions []Action
+	if err := tx.Select(&actions, query+" ORDER BY enqueued, id", args...); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return toModels(actions)
+}
+
+// ActionsByOperation returns the actions enqueued under the operation, ordered
+// by the time they were enqueued.
+func (m *ActionManager) ActionsByOperation(tx *sqlx.Tx, operationID string) ([]model.Action, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var actions []Action
+	err = tx.Select(&actions, query+" WHERE operation=$1 ORDER BY enqueued, id", operationID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return toModels(actions)
+}
+
+// summaryColumns are the columns actions can be grouped by in a summary.
+var summaryColumns = map[string]bool{
+	"status":   true,
+	"name":     true,
+	"receiver": true,
+}
+
+// Summary returns the number of actions grouped by the given columns, which
+// can be any of status, name and receiver. Without any columns, the total
+// number of actions is returned.
+func (m *ActionManager) Summary(tx *sqlx.Tx, groupBy ...string) ([]model.ActionSummary, error) {
+	for _, column := range groupBy {
+		if !summaryColumns[column] {
+			return nil, errors.BadRequestf("grouping actions by %q", column)
+		}
+	}
+
+	query := "SELECT COUNT(*) FROM actions"
+	if len(groupBy) > 0 {
+		columns := strings.Join(groupBy, ", ")
+		query = "SELECT " + columns + ", COUNT(*) FROM actions GROUP BY " + columns + " ORDER BY " + columns
+	}
+
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var results []model.ActionSummary
+	for rows.Next() {
+		values := make([]sql.NullString, len(groupBy))
+		dest := make([]interface{}, 0, len(groupBy)+1)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		var summary model.ActionSummary
+		if err := rows.Scan(append(dest, &summary.Count)...); err != nil {
+			return nil, errors.Trace(err)
+		}
+		summary.Key = make(map[string]string, len(groupBy))
+		for i, column := range groupBy {
+			summary.Key[column] = values[i].String
+		}
+		results = append(results, summary)
+	}
+	return results, errors.Trace(rows.Err())
+}
+
+// SearchActions returns up to limit actions whose name, message or parameters
+// match the query, ordered by relevance. If the full text search index isn't
+// available, the actions are matched using a substring search instead,
+// ordered by the most recent first.
+func (m *ActionManager) SearchActions(tx *sqlx.Tx, query string, limit int) ([]model.Action, error) {
+	m.mutex.Lock()
+	fullText := m.fullText
+	m.mutex.Unlock()
+
+	if !fullText {
+		return m.searchActionsLike(tx, query, limit)
+	}
+
+	var ids []int64
+	err := tx.Select(&ids, `
+	SELECT rowid FROM actions_fts WHERE actions_fts MATCH $1 ORDER BY rank LIMIT $2
+	`, query, limit)
+	if err != nil {
+		if strings.Contains(err.Error(), "fts5: syntax error") {
+			return nil, errors.BadRequestf("invalid search query %q", query)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	actions, _, err := m.ActionsByIDs(tx, ids)
+	return actions, errors.Trace(err)
+}
+
+func (m *ActionManager) searchActionsLike(tx *sqlx.Tx, query string, limit int) ([]model.Action, error) {
+	selectQuery, err := selectActions(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+
 	var actions []Action
-	err := tx.Select(&actions, "SELECT "+Action{}.Fields(tx)+" FROM actions WHERE name=$1 ORDER BY tag", name)
+	err = tx.Select(&actions, selectQuery+`
+	WHERE name LIKE $1 ESCAPE '\' OR message LIKE $1 ESCAPE '\' OR parameters_json LIKE $1 ESCAPE '\'
+	ORDER BY id DESC
+	LIMIT $2
+	`, pattern, limit)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	return toModels(actions)
+}
 
+func toModels(actions []Action) ([]model.Action, error) {
 	results := make([]model.Action, len(actions))
 	for k, action := range actions {
+		var err error
 		if results[k], err = action.ToModel(); err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -82,13 +637,161 @@ func (m *ActionManager) ActionsByName(tx *sqlx.Tx, name string) ([]model.Action,
 }
 
 // AddAction adds an action, returning the given action.
-func (m *ActionManager) AddAction(tx *sqlx.Tx, receiver names.Tag, operationID, actionName string, payload map[string]interface{}) (model.Action, error) {
+func (m *ActionManager) AddAction(tx *sqlx.Tx, receiver names.Tag, operationID, actionName string, payload map[string]interface{}, opts ...AddActionOption) (model.Action, error) {
+	var options addActionOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// If the action has already been added with the key, return the
+	// existing action rather than adding it again.
+	if options.idempotencyKey.Valid {
+		action, err := m.ActionByIdempotencyKey(tx, options.idempotencyKey.String)
+		if err == nil || !stateerrors.IsNotFound(err) {
+			return action, errors.Trace(err)
+		}
+	}
+
 	payloadData, err := json.Marshal(payload)
 	if err != nil {
 		return model.Action{}, errors.Trace(err)
 	}
+	return m.addAction(tx, receiver, operationID, actionName, payloadData, options)
+}
+
+// AddActionOption configures how an action is added.
+type AddActionOption func(*addActionOptions)
+
+type addActionOptions struct {
+	idempotencyKey sql.NullString
+	requestedBy    sql.NullString
+	source         sql.NullString
+	expiresAt      sql.NullTime
+}
+
+// IdempotencyKey adds the action with a client supplied key. Adding an action
+// with a key that has already been used returns the existing action.
+func IdempotencyKey(key string) AddActionOption {
+	return func(o *addActionOptions) {
+		o.idempotencyKey = sql.NullString{String: key, Valid: key != ""}
+	}
+}
+
+// RequestedBy records the tag of the user or client that enqueued the action.
+func RequestedBy(tag string) AddActionOption {
+	return func(o *addActionOptions) {
+		o.requestedBy = sql.NullString{String: tag, Valid: tag != ""}
+	}
+}
+
+// Source records where the action was enqueued from.
+func Source(source string) AddActionOption {
+	return func(o *addActionOptions) {
+		o.source = sql.NullString{String: source, Valid: source != ""}
+	}
+}
+
+// ExpiresAt fails the action if it's still pending at the given time.
+func ExpiresAt(t time.Time) AddActionOption {
+	return func(o *addActionOptions) {
+		o.expiresAt = sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+	}
+}
 
-	uuid, err := utils.NewUUID()
+// ActionByIdempotencyKey returns the action that was added with the key.
+func (m *ActionManager) ActionByIdempotencyKey(tx *sqlx.Tx, key string) (model.Action, error) {
+	query, err := selectActions(tx)
+	if err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	var action Action
+	err = tx.Get(&action, query+" WHERE idempotency_key=$1", key)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return model.Action{}, stateerrors.NotFoundf("action with idempotency key %q", key)
+		}
+		return model.Action{}, errors.Trace(err)
+	}
+	return action.ToModel()
+}
+
+// AddActions adds the same action for each of the receivers under one
+// operation, returning the actions in receiver order. If any of the actions
+// can't be added, the error is returned and the transaction should be rolled
+// back, so that none of the actions are enqueued. Idempotency keys aren't
+// supported for a batch of actions, and are ignored.
+func (m *ActionManager) AddActions(tx *sqlx.Tx, operationID string, receivers []names.Tag, actionName string, payload map[string]interface{}, opts ...AddActionOption) ([]model.Action, error) {
+	var options addActionOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	options.idempotencyKey = sql.NullString{}
+
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	actions := make([]model.Action, len(receivers))
+	for i, receiver := range receivers {
+		if receiver == nil {
+			return nil, errors.BadRequestf("missing receiver %d", i)
+		}
+		if actions[i], err = m.addAction(tx, receiver, operationID, actionName, payloadData, options); err != nil {
+			return nil, errors.Annotatef(err, "adding action for %q", receiver.String())
+		}
+	}
+	return actions, nil
+}
+
+// ActionSpec describes one of the actions of a batch.
+type ActionSpec struct {
+	Receiver   names.Tag
+	Name       string
+	Parameters map[string]interface{}
+	Options    []AddActionOption
+}
+
+// AddActionBatch adds the actions described by the specs under the
+// operation. Unlike AddActions, each action can have its own receiver, name
+// and parameters. Idempotency keys are ignored, as they identify a single
+// action. If any of the actions can't be added the whole batch fails, so the
+// transaction should be rolled back. The error is annotated with the index of
+// the action that failed.
+func (m *ActionManager) AddActionBatch(tx *sqlx.Tx, operationID string, specs []ActionSpec) ([]model.Action, error) {
+	actions := make([]model.Action, len(specs))
+	for i, spec := range specs {
+		if spec.Receiver == nil {
+			return nil, errors.BadRequestf("missing receiver for action %d", i)
+		}
+
+		var options addActionOptions
+		for _, opt := range spec.Options {
+			opt(&options)
+		}
+		options.idempotencyKey = sql.NullString{}
+
+		payloadData, err := json.Marshal(spec.Parameters)
+		if err != nil {
+			return nil, errors.Annotatef(err, "action %d", i)
+		}
+		if actions[i], err = m.addAction(tx, spec.Receiver, operationID, spec.Name, payloadData, options); err != nil {
+			return nil, errors.Annotatef(err, "action %d", i)
+		}
+	}
+	return actions, nil
+}
+
+func (m *ActionManager) addAction(tx *sqlx.Tx, receiver names.Tag, operationID, actionName string, payloadData []byte, options addActionOptions) (model.Action, error) {
+	if err := m.validateReceiver(receiver); err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+	if len(payloadData) > m.parametersLimit {
+		return model.Action{}, stateerrors.TooLargef("parameters for action %q of %d bytes (limit %d bytes)", actionName, len(payloadData), m.parametersLimit)
+	}
+
+	uuid, err := newUUID()
 	if err != nil {
 		return model.Action{}, errors.Trace(err)
 	}
@@ -100,13 +803,24 @@ func (m *ActionManager) AddAction(tx *sqlx.Tx, receiver names.Tag, operationID,
 		Name:       actionName,
 		Parameters: payloadData,
 		Operation:  operationID,
+
+		IdempotencyKey: options.idempotencyKey,
+		RequestedBy:    options.requestedBy,
+		Source:         options.source,
+		ExpiresAt:      options.expiresAt,
 	}
 
 	result, err := tx.NamedExec(`
-	INSERT INTO actions (tag, receiver, name, parameters_json, operation, enqueued, status)
-	VALUES (:tag, :receiver, :name, :parameters_json, :operation, DateTime('now'), 'pending')
+	INSERT INTO actions (tag, receiver, name, parameters_json, operation, enqueued, status, idempotency_key, requested_by, source, expires_at)
+	VALUES (:tag, :receiver, :name, :parameters_json, :operation, DateTime('now'), 'pending', :idempotency_key, :requested_by, :source, :expires_at)
 	`, action)
 	if err != nil {
+		if err = stateerrors.FromDB(err); stateerrors.IsAlreadyExists(err) {
+			if options.idempotencyKey.Valid {
+				return model.Action{}, stateerrors.AlreadyExistsf("action %q or idempotency key %q", action.Tag, options.idempotencyKey.String)
+			}
+			return model.Action{}, stateerrors.AlreadyExistsf("action %q", action.Tag)
+		}
 		return model.Action{}, errors.Trace(err)
 	}
 
@@ -124,5 +838,348 @@ func (m *ActionManager) AddAction(tx *sqlx.Tx, receiver names.Tag, operationID,
 		return model.Action{}, errors.Trace(err)
 	}
 
+	if err := m.publishOnCommit(tx, events.ActionStatusChanged{
+		ID:       id,
+		Receiver: action.Receiver,
+		To:       model.ActionPending,
+	}); err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	return m.ActionByID(tx, id)
+}
+
+// BeginAction moves a pending action to running, recording when it started.
+func (m *ActionManager) BeginAction(tx *sqlx.Tx, id int64) (model.Action, error) {
+	return m.transitionAction(tx, id, model.ActionRunning, func(from model.ActionStatus) (sql.Result, error) {
+		return tx.Exec(`
+	UPDATE actions SET status = $1, started = DateTime('now')
+	WHERE id = $2 AND status = $3
+	`, string(model.ActionRunning), id, string(from))
+	})
+}
+
+// ClaimNextAction moves the oldest pending action for the receiver to
+// running, returning the claimed action. Writes are serialised, so running
+// the claim within the caller's transaction prevents two runners claiming the
+// same action. NotFound is returned if there are no pending actions.
+func (m *ActionManager) ClaimNextAction(tx *sqlx.Tx, receiver names.Tag) (model.Action, error) {
+	var id int64
+	err := tx.Get(&id, `
+	SELECT id FROM actions WHERE receiver = $1 AND status = $2
+	ORDER BY enqueued, id
+	LIMIT 1
+	`, receiver.String(), string(model.ActionPending))
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return model.Action{}, stateerrors.NotFoundf("pending action for %q", receiver.String())
+		}
+		return model.Action{}, errors.Trace(err)
+	}
+	return m.BeginAction(tx, id)
+}
+
+// PendingCount returns the number of pending actions for the receiver.
+func (m *ActionManager) PendingCount(tx *sqlx.Tx, receiver names.Tag) (int, error) {
+	var count int
+	err := tx.Get(&count, "SELECT COUNT(*) FROM actions WHERE receiver = $1 AND status = $2",
+		receiver.String(), string(model.ActionPending))
+	return count, errors.Trace(err)
+}
+
+// FinishAction moves a running or aborting action to the given terminal
+// status, recording when it completed along with the message and results.
+func (m *ActionManager) FinishAction(tx *sqlx.Tx, id int64, status model.ActionStatus, message string, results map[string]interface{}) (model.Action, error) {
+	if !status.Finished() {
+		return model.Action{}, errors.BadRequestf("finishing action %d with non-terminal status %q", id, status)
+	}
+	if err := m.checkMessage(id, message); err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	action, err := m.transitionAction(tx, id, status, func(from model.ActionStatus) (sql.Result, error) {
+		if from != model.ActionRunning && from != model.ActionAborting {
+			return nil, stateerrors.InvalidTransitionf("action %d from %q to %q", id, from, status)
+		}
+		return tx.Exec(`
+	UPDATE actions SET status = $1, message = $2, completed = DateTime('now')
+	WHERE id = $3 AND status = $4
+	`, string(status), message, id, string(from))
+	})
+	if err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	if results != nil {
+		if err := setActionResult(tx, id, results); err != nil {
+			return model.Action{}, errors.Trace(err)
+		}
+	}
+	return action, nil
+}
+
+// CancelAction moves a pending action straight to cancelled, so that it is
+// never run.
+func (m *ActionManager) CancelAction(tx *sqlx.Tx, id int64) (model.Action, error) {
+	return m.transitionAction(tx, id, model.ActionCancelled, func(from model.ActionStatus) (sql.Result, error) {
+		if from != model.ActionPending {
+			return nil, stateerrors.InvalidTransitionf("action %d from %q to %q", id, from, model.ActionCancelled)
+		}
+		return tx.Exec(`
+	UPDATE actions SET status = $1, completed = DateTime('now')
+	WHERE id = $2 AND status = $3
+	`, string(model.ActionCancelled), id, string(from))
+	})
+}
+
+// AbortAction moves a running action to aborting. The runner is expected to
+// confirm the action has been aborted using FinishAction.
+func (m *ActionManager) AbortAction(tx *sqlx.Tx, id int64) (model.Action, error) {
+	return m.transitionAction(tx, id, model.ActionAborting, func(from model.ActionStatus) (sql.Result, error) {
+		return tx.Exec(`
+	UPDATE actions SET status = $1
+	WHERE id = $2 AND status = $3
+	`, string(model.ActionAborting), id, string(from))
+	})
+}
+
+// transitionAction moves the action to the given status using the update
+// function, which is passed the current status of the action. The update is
+// guarded by the current status, so a concurrent change results in a
+// conflict rather than an illegal transition. The generation of the action is
+// incremented with every transition.
+func (m *ActionManager) transitionAction(tx *sqlx.Tx, id int64, to model.ActionStatus, update func(from model.ActionStatus) (sql.Result, error)) (model.Action, error) {
+	action, err := m.ActionByID(tx, id)
+	if err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	from := action.Status
+	if !from.ValidTransition(to) {
+		return model.Action{}, stateerrors.InvalidTransitionf("action %d from %q to %q", id, from, to)
+	}
+
+	result, err := update(from)
+	if err != nil {
+		return model.Action{}, errors.Trace(stateerrors.FromDB(err))
+	}
+	modified, err := result.RowsAffected()
+	if err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+	if modified != 1 {
+		return model.Action{}, stateerrors.Conflictf("action %d status", id)
+	}
+	if _, err := tx.Exec("UPDATE actions SET generation = generation + 1 WHERE id = $1", id); err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	if err := m.publishOnCommit(tx, events.ActionStatusChanged{
+		ID:       id,
+		Receiver: action.Receiver,
+		From:     from,
+		To:       to,
+	}); err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
+	if err := m.refreshOperation(tx, action.Operation); err != nil {
+		return model.Action{}, errors.Trace(err)
+	}
+
 	return m.ActionByID(tx, id)
 }
+
+// refreshOperation refreshes the status of the parent operation. Actions that
+// weren't enqueued under an operation are ignored.
+func (m *ActionManager) refreshOperation(tx *sqlx.Tx, operation string) error {
+	if m.operations == nil || operation == "" {
+		return nil
+	}
+	id, err := strconv.ParseInt(operation, 10, 64)
+	if err != nil {
+		return nil
+	}
+	_, err = m.operations.RefreshOperationStatus(tx, id)
+	if stateerrors.IsNotFound(err) {
+		return nil
+	}
+	return errors.Annotatef(err, "refreshing operation %d", id)
+}
+
+// LogMessage records a progress message for the action.
+func (m *ActionManager) LogMessage(tx *sqlx.Tx, id int64, message string, timestamp time.Time) error {
+	if err := m.checkMessage(id, message); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := m.ActionByID(tx, id); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO actions_logs (action_id, output, timestamp) VALUES ($1, $2, $3)
+	`, id, message, timestamp.UTC())
+	return errors.Trace(stateerrors.FromDB(err))
+}
+
+// ActionLogs returns all the messages logged by the action, ordered by
+// timestamp.
+func (m *ActionManager) ActionLogs(tx *sqlx.Tx, id int64) ([]model.ActionMessage, error) {
+	return m.ActionLogsSince(tx, id, time.Time{})
+}
+
+// ActionLogsSince returns the messages logged by the action after the given
+// time, ordered by timestamp. It allows callers to poll for new messages.
+func (m *ActionManager) ActionLogsSince(tx *sqlx.Tx, id int64, since time.Time) ([]model.ActionMessage, error) {
+	if _, err := m.ActionByID(tx, id); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var messages []ActionMessage
+	err := tx.Select(&messages, `
+	SELECT output, timestamp FROM actions_logs
+	WHERE action_id = $1 AND timestamp > $2
+	ORDER BY timestamp, id
+	`, id, since.UTC())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	results := make([]model.ActionMessage, len(messages))
+	for k, message := range messages {
+		results[k] = message.ToModel()
+	}
+	return results, nil
+}
+
+// SetActionResult stores the results of the action, replacing any existing
+// results.
+func (m *ActionManager) SetActionResult(tx *sqlx.Tx, id int64, results map[string]interface{}) error {
+	if _, err := m.ActionByID(tx, id); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(setActionResult(tx, id, results))
+}
+
+// ActionResult returns the results of the action.
+func (m *ActionManager) ActionResult(tx *sqlx.Tx, id int64) (map[string]interface{}, error) {
+	var data string
+	err := tx.Get(&data, "SELECT result_json FROM actions_results WHERE action_id=$1", id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, stateerrors.NotFoundf("result for action %v", id)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	var results map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &results); err != nil {
+		return nil, errors.Annotatef(err, "malformed result for action %v", id)
+	}
+	return results, nil
+}
+
+// ExpirePending fails the pending actions that expired before now, returning
+// the failed actions. Actions that have been claimed are never expired.
+func (m *ActionManager) ExpirePending(tx *sqlx.Tx, now time.Time) ([]model.Action, error) {
+	var ids []int64
+	err := tx.Select(&ids, `
+	SELECT id FROM actions
+	WHERE status = $1 AND expires_at IS NOT NULL AND expires_at <= $2
+	ORDER BY expires_at, id
+	`, string(model.ActionPending), now.UTC())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	expired := make([]model.Action, 0, len(ids))
+	for _, id := range ids {
+		action, err := m.transitionAction(tx, id, model.ActionFailed, func(from model.ActionStatus) (sql.Result, error) {
+			return tx.Exec(`
+	UPDATE actions SET status = $1, message = $2, completed = DateTime('now')
+	WHERE id = $3 AND status = $4
+	`, string(model.ActionFailed), expiredMessage, id, string(model.ActionPending))
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "expiring action %d", id)
+		}
+		expired = append(expired, action)
+	}
+	return expired, nil
+}
+
+// PruneResult holds the number of rows deleted by a prune.
+type PruneResult struct {
+	Actions int64
+	Logs    int64
+	Results int64
+}
+
+// Prune deletes up to maxBatch finished actions that completed more than
+// olderThan ago, along with their logs and results. Actions that haven't
+// finished are never pruned.
+func (m *ActionManager) Prune(tx *sqlx.Tx, olderThan time.Duration, maxBatch int) (PruneResult, error) {
+	var ids []int64
+	err := tx.Select(&ids, `
+	SELECT id FROM actions
+	WHERE status IN ($1, $2, $3, $4, $5) AND completed IS NOT NULL AND completed < DateTime('now', $6)
+	ORDER BY completed, id
+	LIMIT $7
+	`, string(model.ActionCompleted), string(model.ActionFailed), string(model.ActionError),
+		string(model.ActionCancelled), string(model.ActionAborted),
+		fmt.Sprintf("-%d seconds", int64(olderThan/time.Second)), maxBatch)
+	if err != nil {
+		return PruneResult{}, errors.Trace(err)
+	}
+	if len(ids) == 0 {
+		return PruneResult{}, nil
+	}
+
+	// The foreign keys don't cascade, so the logs and results are deleted
+	// before the actions.
+	var result PruneResult
+	for _, stmt := range []struct {
+		query string
+		count *int64
+	}{
+		{query: "DELETE FROM actions_logs WHERE action_id IN (?)", count: &result.Logs},
+		{query: "DELETE FROM actions_results WHERE action_id IN (?)", count: &result.Results},
+		{query: "DELETE FROM actions WHERE id IN (?)", count: &result.Actions},
+	} {
+		query, args, err := sqlx.In(stmt.query, ids)
+		if err != nil {
+			return PruneResult{}, errors.Trace(err)
+		}
+		res, err := tx.Exec(tx.Rebind(query), args...)
+		if err != nil {
+			return PruneResult{}, errors.Trace(stateerrors.FromDB(err))
+		}
+		if *stmt.count, err = res.RowsAffected(); err != nil {
+			return PruneResult{}, errors.Trace(err)
+		}
+	}
+	return result, nil
+}
+
+// setActionResult stores the results of an action, replacing any existing
+// results.
+func setActionResult(tx *sqlx.Tx, id int64, results map[string]interface{}) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO actions_results (action_id, result_json) VALUES ($1, $2)
+	ON CONFLICT (action_id) DO UPDATE SET result_json = excluded.result_json
+	`, id, string(data))
+	return errors.Trace(err)
+}
+
+// noopLogger discards all log messages.
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...interface{})   {}
+func (noopLogger) Infof(string, ...interface{})    {}
+func (noopLogger) Warningf(string, ...interface{}) {}
+func (noopLogger) Errorf(string, ...interface{})   {}
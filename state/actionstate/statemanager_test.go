@@ -0,0 +1,1412 @@
+package actionstate_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/SimonRichardson/nu-juju-data/state/actionstate"
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+	"github.com/juju/names"
+	"github.com/juju/utils"
+)
+
+// newTestState returns a started state over an in-memory database, which is
+// stopped when the test finishes.
+func newTestState(t *testing.T) *state.State {
+	t.Helper()
+
+	return newTestStateWithClock(t, clock.WallClock)
+}
+
+// newTestStateWithClock returns a started state using the clock.
+func newTestStateWithClock(t *testing.T, clock clock.Clock) *state.State {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	st := state.NewState(backend, nopLogger{}, clock, nil)
+	if err := st.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting state: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = st.Stop()
+		_ = backend.Close()
+	})
+	return st
+}
+
+// run runs the function in a transaction, failing the test on error.
+func run(t *testing.T, st *state.State, fn func(*sqlx.Tx) error) {
+	t.Helper()
+
+	err := st.Backend().Run(func(_ context.Context, tx *sqlx.Tx) error {
+		return fn(tx)
+	})
+	if err != nil {
+		t.Fatalf("running transaction: %v", err)
+	}
+}
+
+// search returns the ids of the actions matching the query.
+func search(t *testing.T, st *state.State, query string) []int64 {
+	t.Helper()
+
+	var actions []model.Action
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		actions, err = st.ActionManager().SearchActions(tx, query, 10)
+		return err
+	})
+	ids := make([]int64, len(actions))
+	for i, action := range actions {
+		ids[i] = action.ID
+	}
+	return ids
+}
+
+func TestSearchActionsFollowsChanges(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+
+	var backup, restore model.Action
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		if backup, err = mgr.AddAction(tx, names.NewUnitTag("mysql/0"), "", "backup", map[string]interface{}{"target": "archive"}); err != nil {
+			return err
+		}
+		restore, err = mgr.AddAction(tx, names.NewUnitTag("mysql/0"), "", "restore", nil)
+		return err
+	})
+
+	if ids := search(t, st, "backup"); len(ids) != 1 || ids[0] != backup.ID {
+		t.Fatalf("searching by name: got %v, want [%d]", ids, backup.ID)
+	}
+	if ids := search(t, st, "archive"); len(ids) != 1 || ids[0] != backup.ID {
+		t.Fatalf("searching by parameters: got %v, want [%d]", ids, backup.ID)
+	}
+
+	// Updating the message of an action is picked up by the search.
+	run(t, st, func(tx *sqlx.Tx) error {
+		if _, err := mgr.BeginAction(tx, restore.ID); err != nil {
+			return err
+		}
+		_, err := mgr.FinishAction(tx, restore.ID, model.ActionFailed, "disk exhausted", nil)
+		return err
+	})
+	if ids := search(t, st, "exhausted"); len(ids) != 1 || ids[0] != restore.ID {
+		t.Fatalf("searching by message: got %v, want [%d]", ids, restore.ID)
+	}
+
+	// Deleted actions are no longer found.
+	run(t, st, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("DELETE FROM actions WHERE id = $1", backup.ID)
+		return err
+	})
+	if ids := search(t, st, "backup"); len(ids) != 0 {
+		t.Fatalf("searching for a deleted action: got %v, want none", ids)
+	}
+	if ids := search(t, st, "exhausted"); len(ids) != 1 || ids[0] != restore.ID {
+		t.Fatalf("searching after a delete: got %v, want [%d]", ids, restore.ID)
+	}
+}
+
+func TestSearchActionsWithoutMatches(t *testing.T) {
+	st := newTestState(t)
+
+	if ids := search(t, st, "anything"); len(ids) != 0 {
+		t.Fatalf("got %v, want none", ids)
+	}
+}
+
+// inTx runs the function in a transaction, returning its error.
+func inTx(st *state.State, fn func(*sqlx.Tx) error) error {
+	return st.Backend().Run(func(_ context.Context, tx *sqlx.Tx) error {
+		return fn(tx)
+	})
+}
+
+// change runs the change of an action in a transaction.
+func change(st *state.State, fn func(*actionstate.ActionManager, *sqlx.Tx) (model.Action, error)) (model.Action, error) {
+	var action model.Action
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		var err error
+		action, err = fn(st.ActionManager(), tx)
+		return err
+	})
+	return action, err
+}
+
+// addAction adds an action with the name for the unit.
+func addAction(t *testing.T, st *state.State, unit, name string, opts ...actionstate.AddActionOption) model.Action {
+	t.Helper()
+
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.AddAction(tx, names.NewUnitTag(unit), "", name, nil, opts...)
+	})
+	if err != nil {
+		t.Fatalf("adding action: %v", err)
+	}
+	return action
+}
+
+// actionWithStatus adds an action, then moves it to the status through the
+// transitions a runner would make.
+func actionWithStatus(t *testing.T, st *state.State, status model.ActionStatus) model.Action {
+	t.Helper()
+
+	action := addAction(t, st, "mysql/0", "backup")
+	var steps []func(*actionstate.ActionManager, *sqlx.Tx) (model.Action, error)
+	begin := func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.BeginAction(tx, action.ID)
+	}
+	switch status {
+	case model.ActionPending:
+	case model.ActionCancelled:
+		steps = append(steps, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.CancelAction(tx, action.ID)
+		})
+	case model.ActionRunning:
+		steps = append(steps, begin)
+	case model.ActionAborting:
+		steps = append(steps, begin, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.AbortAction(tx, action.ID)
+		})
+	default:
+		steps = append(steps, begin, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.FinishAction(tx, action.ID, status, "", nil)
+		})
+	}
+	for _, step := range steps {
+		var err error
+		if action, err = change(st, step); err != nil {
+			t.Fatalf("moving action to %q: %v", status, err)
+		}
+	}
+	if action.Status != status {
+		t.Fatalf("got status %q, want %q", action.Status, status)
+	}
+	return action
+}
+
+func TestBeginAction(t *testing.T) {
+	st := newTestState(t)
+	added := addAction(t, st, "mysql/0", "backup")
+	if added.Status != model.ActionPending || !added.Started.IsZero() {
+		t.Fatalf("got added action %+v, want pending and not started", added)
+	}
+
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.BeginAction(tx, added.ID)
+	})
+	if err != nil {
+		t.Fatalf("beginning action: %v", err)
+	}
+	if action.Status != model.ActionRunning {
+		t.Errorf("got status %q, want running", action.Status)
+	}
+	if action.Started.IsZero() || !action.Completed.IsZero() {
+		t.Errorf("got started %v and completed %v, want only started", action.Started, action.Completed)
+	}
+	if action.Generation != added.Generation+1 {
+		t.Errorf("got generation %d, want %d", action.Generation, added.Generation+1)
+	}
+}
+
+func TestFinishAction(t *testing.T) {
+	tests := []struct {
+		from model.ActionStatus
+		to   model.ActionStatus
+	}{
+		{model.ActionRunning, model.ActionCompleted},
+		{model.ActionRunning, model.ActionFailed},
+		{model.ActionRunning, model.ActionError},
+		{model.ActionRunning, model.ActionCancelled},
+		{model.ActionRunning, model.ActionAborted},
+		{model.ActionAborting, model.ActionCompleted},
+		{model.ActionAborting, model.ActionAborted},
+	}
+	for _, test := range tests {
+		t.Run(string(test.from)+" to "+string(test.to), func(t *testing.T) {
+			st := newTestState(t)
+			from := actionWithStatus(t, st, test.from)
+
+			action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+				return mgr.FinishAction(tx, from.ID, test.to, "done", map[string]interface{}{"size": "10G"})
+			})
+			if err != nil {
+				t.Fatalf("finishing action: %v", err)
+			}
+			if action.Status != test.to || action.Message != "done" || action.Completed.IsZero() {
+				t.Fatalf("got action %+v, want %q with the message and completed", action, test.to)
+			}
+			if action.Generation != from.Generation+1 {
+				t.Errorf("got generation %d, want %d", action.Generation, from.Generation+1)
+			}
+		})
+	}
+}
+
+func TestIllegalTransitions(t *testing.T) {
+	begin := func(id int64) func(*actionstate.ActionManager, *sqlx.Tx) (model.Action, error) {
+		return func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.BeginAction(tx, id)
+		}
+	}
+	finish := func(id int64) func(*actionstate.ActionManager, *sqlx.Tx) (model.Action, error) {
+		return func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.FinishAction(tx, id, model.ActionCompleted, "", nil)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		from   model.ActionStatus
+		change func(id int64) func(*actionstate.ActionManager, *sqlx.Tx) (model.Action, error)
+	}{
+		{"begin running", model.ActionRunning, begin},
+		{"begin aborting", model.ActionAborting, begin},
+		{"begin completed", model.ActionCompleted, begin},
+		{"begin cancelled", model.ActionCancelled, begin},
+		{"finish pending", model.ActionPending, finish},
+		{"finish completed", model.ActionCompleted, finish},
+		{"finish failed", model.ActionFailed, finish},
+		{"finish cancelled", model.ActionCancelled, finish},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := newTestState(t)
+			from := actionWithStatus(t, st, test.from)
+
+			_, err := change(st, test.change(from.ID))
+			if !stateerrors.IsInvalidTransition(err) {
+				t.Fatalf("got error %v, want invalid transition", err)
+			}
+
+			// The action is left as it was.
+			action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+				return mgr.ActionByID(tx, from.ID)
+			})
+			if err != nil {
+				t.Fatalf("reading action: %v", err)
+			}
+			if action.Status != from.Status || action.Generation != from.Generation {
+				t.Fatalf("got action %+v, want it unchanged from %+v", action, from)
+			}
+		})
+	}
+}
+
+func TestFinishActionWithoutTerminalStatus(t *testing.T) {
+	st := newTestState(t)
+	running := actionWithStatus(t, st, model.ActionRunning)
+
+	for _, status := range []model.ActionStatus{model.ActionPending, model.ActionRunning, model.ActionAborting, "unknown"} {
+		_, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.FinishAction(tx, running.ID, status, "", nil)
+		})
+		if !stateerrors.IsBadRequest(err) {
+			t.Errorf("got error %v finishing with %q, want bad request", err, status)
+		}
+	}
+}
+
+func TestTransitionMissingAction(t *testing.T) {
+	st := newTestState(t)
+
+	_, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.BeginAction(tx, 42)
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+}
+
+func TestCancelAction(t *testing.T) {
+	st := newTestState(t)
+	pending := actionWithStatus(t, st, model.ActionPending)
+
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.CancelAction(tx, pending.ID)
+	})
+	if err != nil {
+		t.Fatalf("cancelling action: %v", err)
+	}
+	if action.Status != model.ActionCancelled || action.Completed.IsZero() || !action.Started.IsZero() {
+		t.Fatalf("got action %+v, want cancelled without starting", action)
+	}
+
+	// Only pending actions can be cancelled; running ones are aborted.
+	for _, status := range []model.ActionStatus{model.ActionRunning, model.ActionAborting, model.ActionCompleted, model.ActionCancelled} {
+		from := actionWithStatus(t, st, status)
+		_, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.CancelAction(tx, from.ID)
+		})
+		if !stateerrors.IsInvalidTransition(err) {
+			t.Errorf("got error %v cancelling a %s action, want invalid transition", err, status)
+		}
+	}
+}
+
+func TestAbortAction(t *testing.T) {
+	st := newTestState(t)
+	running := actionWithStatus(t, st, model.ActionRunning)
+
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.AbortAction(tx, running.ID)
+	})
+	if err != nil {
+		t.Fatalf("aborting action: %v", err)
+	}
+	if action.Status != model.ActionAborting || !action.Completed.IsZero() {
+		t.Fatalf("got action %+v, want aborting and not completed", action)
+	}
+
+	// The runner confirms the abort.
+	action, err = change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.FinishAction(tx, running.ID, model.ActionAborted, "aborted by the operator", nil)
+	})
+	if err != nil {
+		t.Fatalf("confirming abort: %v", err)
+	}
+	if action.Status != model.ActionAborted || action.Completed.IsZero() {
+		t.Fatalf("got action %+v, want aborted and completed", action)
+	}
+
+	for _, status := range []model.ActionStatus{model.ActionPending, model.ActionAborting, model.ActionCompleted, model.ActionAborted} {
+		from := actionWithStatus(t, st, status)
+		_, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.AbortAction(tx, from.ID)
+		})
+		if !stateerrors.IsInvalidTransition(err) {
+			t.Errorf("got error %v aborting a %s action, want invalid transition", err, status)
+		}
+	}
+}
+
+// actionResult returns the stored results of the action.
+func actionResult(st *state.State, id int64) (map[string]interface{}, error) {
+	var results map[string]interface{}
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		var err error
+		results, err = st.ActionManager().ActionResult(tx, id)
+		return err
+	})
+	return results, err
+}
+
+func TestActionResult(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+	action := actionWithStatus(t, st, model.ActionRunning)
+
+	if _, err := actionResult(st, action.ID); !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v before any result, want not found", err)
+	}
+
+	// Finishing the action stores its results.
+	_, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.FinishAction(tx, action.ID, model.ActionCompleted, "", map[string]interface{}{"size": "1GB", "files": 3})
+	})
+	if err != nil {
+		t.Fatalf("finishing action: %v", err)
+	}
+	results, err := actionResult(st, action.ID)
+	if err != nil {
+		t.Fatalf("getting result: %v", err)
+	}
+	if want := map[string]interface{}{"size": "1GB", "files": float64(3)}; !reflect.DeepEqual(results, want) {
+		t.Fatalf("got results %v, want %v", results, want)
+	}
+
+	// Setting the results again replaces them rather than merging.
+	run(t, st, func(tx *sqlx.Tx) error {
+		return mgr.SetActionResult(tx, action.ID, map[string]interface{}{"size": "2GB"})
+	})
+	results, err = actionResult(st, action.ID)
+	if err != nil {
+		t.Fatalf("getting result: %v", err)
+	}
+	if want := map[string]interface{}{"size": "2GB"}; !reflect.DeepEqual(results, want) {
+		t.Fatalf("got results %v, want them replaced with %v", results, want)
+	}
+}
+
+func TestSetActionResultMissingAction(t *testing.T) {
+	st := newTestState(t)
+
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		return st.ActionManager().SetActionResult(tx, 42, map[string]interface{}{"size": "1GB"})
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+}
+
+func TestActionResultMalformed(t *testing.T) {
+	st := newTestState(t)
+	action := addAction(t, st, "mysql/0", "backup")
+
+	run(t, st, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("INSERT INTO actions_results (action_id, result_json) VALUES ($1, $2)", action.ID, "{not json")
+		return err
+	})
+	_, err := actionResult(st, action.ID)
+	if err == nil || !strings.Contains(err.Error(), "malformed result") {
+		t.Fatalf("got error %v, want malformed result", err)
+	}
+	if stateerrors.IsNotFound(err) {
+		t.Fatalf("got not found for a malformed result")
+	}
+}
+
+// age moves the completed time of the actions back by a day.
+func age(t *testing.T, st *state.State, actions ...model.Action) {
+	t.Helper()
+
+	run(t, st, func(tx *sqlx.Tx) error {
+		for _, action := range actions {
+			_, err := tx.Exec("UPDATE actions SET completed = DateTime('now', '-1 day') WHERE id = $1", action.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// actionIDs returns the ids of every action that remains.
+func actionIDs(t *testing.T, st *state.State) []int64 {
+	t.Helper()
+
+	var ids []int64
+	run(t, st, func(tx *sqlx.Tx) error {
+		return tx.Select(&ids, "SELECT id FROM actions ORDER BY id")
+	})
+	return ids
+}
+
+func prune(t *testing.T, st *state.State, olderThan time.Duration, maxBatch int) actionstate.PruneResult {
+	t.Helper()
+
+	var result actionstate.PruneResult
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		result, err = st.ActionManager().Prune(tx, olderThan, maxBatch)
+		return err
+	})
+	return result
+}
+
+func TestPruneInBatches(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+
+	var finished []model.Action
+	for _, status := range []model.ActionStatus{model.ActionCompleted, model.ActionFailed, model.ActionCancelled, model.ActionAborted} {
+		action := actionWithStatus(t, st, status)
+		run(t, st, func(tx *sqlx.Tx) error {
+			if err := mgr.LogMessage(tx, action.ID, "done", time.Now()); err != nil {
+				return err
+			}
+			return mgr.SetActionResult(tx, action.ID, map[string]interface{}{"ok": true})
+		})
+		finished = append(finished, action)
+	}
+	age(t, st, finished...)
+	// A recently finished action is kept.
+	recent := actionWithStatus(t, st, model.ActionCompleted)
+
+	if got, want := prune(t, st, time.Hour, 3), (actionstate.PruneResult{Actions: 3, Logs: 3, Results: 3}); got != want {
+		t.Fatalf("got first batch %+v, want %+v", got, want)
+	}
+	if got, want := prune(t, st, time.Hour, 3), (actionstate.PruneResult{Actions: 1, Logs: 1, Results: 1}); got != want {
+		t.Fatalf("got second batch %+v, want %+v", got, want)
+	}
+	if got := prune(t, st, time.Hour, 3); got != (actionstate.PruneResult{}) {
+		t.Fatalf("got %+v once pruned, want nothing", got)
+	}
+	if got, want := actionIDs(t, st), []int64{recent.ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got actions %v, want %v", got, want)
+	}
+}
+
+func TestPruneKeepsUnfinishedActions(t *testing.T) {
+	st := newTestState(t)
+
+	var unfinished []model.Action
+	var ids []int64
+	for _, status := range []model.ActionStatus{model.ActionPending, model.ActionRunning, model.ActionAborting} {
+		action := actionWithStatus(t, st, status)
+		unfinished = append(unfinished, action)
+		ids = append(ids, action.ID)
+	}
+	// Even with a completed time, unfinished actions are never pruned.
+	age(t, st, unfinished...)
+
+	if got := prune(t, st, 0, 100); got != (actionstate.PruneResult{}) {
+		t.Fatalf("got %+v, want nothing pruned", got)
+	}
+	if got := actionIDs(t, st); !reflect.DeepEqual(got, ids) {
+		t.Fatalf("got actions %v, want %v", got, ids)
+	}
+}
+
+func TestEnsurePrunesWithRetention(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+
+	old := actionWithStatus(t, st, model.ActionCompleted)
+	age(t, st, old)
+	pending := actionWithStatus(t, st, model.ActionPending)
+
+	// Pruning is disabled without a retention.
+	if err := mgr.Ensure(context.Background()); err != nil {
+		t.Fatalf("ensuring: %v", err)
+	}
+	if got, want := actionIDs(t, st), []int64{old.ID, pending.ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got actions %v without a retention, want %v", got, want)
+	}
+
+	mgr.SetRetention(time.Hour)
+	if err := mgr.Ensure(context.Background()); err != nil {
+		t.Fatalf("ensuring: %v", err)
+	}
+	if got, want := actionIDs(t, st), []int64{pending.ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got actions %v, want %v", got, want)
+	}
+}
+
+func TestAddActions(t *testing.T) {
+	st := newTestState(t)
+
+	receivers := []names.Tag{names.NewUnitTag("mysql/2"), names.NewUnitTag("mysql/0"), names.NewUnitTag("mysql/1")}
+	var actions []model.Action
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		actions, err = st.ActionManager().AddActions(tx, "1", receivers, "backup", map[string]interface{}{"target": "archive"})
+		return err
+	})
+	if len(actions) != len(receivers) {
+		t.Fatalf("got %d actions, want %d", len(actions), len(receivers))
+	}
+	for i, action := range actions {
+		if action.Receiver != receivers[i].String() || action.Operation != "1" || action.Name != "backup" || action.Status != model.ActionPending {
+			t.Errorf("got action %d %+v, want a pending backup for %q", i, action, receivers[i])
+		}
+	}
+}
+
+func TestAddActionsRollsBack(t *testing.T) {
+	st := newTestState(t)
+	st.ActionManager().SetReceiverKinds(names.UnitTagKind)
+
+	// The machine isn't a valid receiver, so none of the actions are added.
+	receivers := []names.Tag{names.NewUnitTag("mysql/0"), names.NewMachineTag("0"), names.NewUnitTag("mysql/1")}
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		_, err := st.ActionManager().AddActions(tx, "1", receivers, "backup", nil)
+		return err
+	})
+	if !errors.IsBadRequest(err) || !strings.Contains(err.Error(), `"machine-0"`) {
+		t.Fatalf("got error %v, want the invalid receiver", err)
+	}
+	if ids := actionIDs(t, st); len(ids) != 0 {
+		t.Fatalf("got actions %v, want none added", ids)
+	}
+
+	err = inTx(st, func(tx *sqlx.Tx) error {
+		_, err := st.ActionManager().AddActions(tx, "1", []names.Tag{names.NewUnitTag("mysql/0"), nil}, "backup", nil)
+		return err
+	})
+	if !errors.IsBadRequest(err) {
+		t.Fatalf("got error %v, want the missing receiver", err)
+	}
+	if ids := actionIDs(t, st); len(ids) != 0 {
+		t.Fatalf("got actions %v, want none added", ids)
+	}
+}
+
+// claimNext claims the next pending action for the receiver.
+func claimNext(st *state.State, receiver names.Tag) (model.Action, error) {
+	return change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ClaimNextAction(tx, receiver)
+	})
+}
+
+func TestClaimNextAction(t *testing.T) {
+	st := newTestState(t)
+	receiver := names.NewUnitTag("mysql/0")
+
+	first := addAction(t, st, "mysql/0", "backup")
+	second := addAction(t, st, "mysql/0", "restore")
+	addAction(t, st, "mysql/1", "backup")
+
+	var count int
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		count, err = st.ActionManager().PendingCount(tx, receiver)
+		return err
+	})
+	if count != 2 {
+		t.Fatalf("got %d pending actions, want 2", count)
+	}
+
+	// The oldest action is claimed first, and only for the receiver.
+	for _, want := range []model.Action{first, second} {
+		claimed, err := claimNext(st, receiver)
+		if err != nil {
+			t.Fatalf("claiming action: %v", err)
+		}
+		if claimed.ID != want.ID || claimed.Status != model.ActionRunning || claimed.Started.IsZero() {
+			t.Fatalf("got claimed action %+v, want %d running", claimed, want.ID)
+		}
+	}
+	if _, err := claimNext(st, receiver); !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v from an empty queue, want not found", err)
+	}
+}
+
+func TestClaimNextActionConcurrently(t *testing.T) {
+	st := newTestState(t)
+	receiver := names.NewUnitTag("mysql/0")
+
+	var pending []int64
+	for _, name := range []string{"backup", "restore", "upgrade"} {
+		pending = append(pending, addAction(t, st, "mysql/0", name).ID)
+	}
+
+	// Two runners claim actions until the queue is empty.
+	var (
+		mutex   sync.Mutex
+		claimed []int64
+		wg      sync.WaitGroup
+	)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				action, err := claimNext(st, receiver)
+				if stateerrors.IsNotFound(err) {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				mutex.Lock()
+				claimed = append(claimed, action.ID)
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("claiming action: %v", err)
+	}
+
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i] < claimed[j] })
+	if !reflect.DeepEqual(claimed, pending) {
+		t.Fatalf("got claimed %v, want each of %v claimed once", claimed, pending)
+	}
+}
+
+// ids returns the ids of the actions.
+func ids(actions []model.Action) []int64 {
+	result := make([]int64, len(actions))
+	for i, action := range actions {
+		result[i] = action.ID
+	}
+	return result
+}
+
+func TestActionsByReceiver(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+
+	pending := addAction(t, st, "mysql/0", "backup")
+	running := actionWithStatus(t, st, model.ActionRunning)
+	completed := actionWithStatus(t, st, model.ActionCompleted)
+	addAction(t, st, "mysql/1", "backup")
+
+	tests := []struct {
+		name     string
+		statuses []model.ActionStatus
+		want     []int64
+	}{
+		{"every status", nil, []int64{pending.ID, running.ID, completed.ID}},
+		{"one status", []model.ActionStatus{model.ActionRunning}, []int64{running.ID}},
+		{"many statuses", []model.ActionStatus{model.ActionCompleted, model.ActionPending}, []int64{pending.ID, completed.ID}},
+		{"no matches", []model.ActionStatus{model.ActionFailed}, []int64{}},
+	}
+	for _, test := range tests {
+		var actions []model.Action
+		run(t, st, func(tx *sqlx.Tx) error {
+			var err error
+			actions, err = mgr.ActionsByReceiver(tx, names.NewUnitTag("mysql/0"), test.statuses...)
+			return err
+		})
+		if got := ids(actions); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got actions %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestActionsByOperation(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+
+	var added []model.Action
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		added, err = mgr.AddActions(tx, "1", []names.Tag{names.NewUnitTag("mysql/1"), names.NewUnitTag("mysql/0")}, "backup", nil)
+		return err
+	})
+	addAction(t, st, "mysql/0", "restore")
+
+	for _, test := range []struct {
+		operation string
+		want      []int64
+	}{
+		{"1", ids(added)},
+		{"2", []int64{}},
+	} {
+		var actions []model.Action
+		run(t, st, func(tx *sqlx.Tx) error {
+			var err error
+			actions, err = mgr.ActionsByOperation(tx, test.operation)
+			return err
+		})
+		if got := ids(actions); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("operation %s: got actions %v, want %v", test.operation, got, test.want)
+		}
+	}
+}
+
+func TestActionByTag(t *testing.T) {
+	st := newTestState(t)
+	added := addAction(t, st, "mysql/0", "backup")
+	addAction(t, st, "mysql/0", "restore")
+
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByTag(tx, added.Tag)
+	})
+	if err != nil {
+		t.Fatalf("getting action: %v", err)
+	}
+	if action.ID != added.ID {
+		t.Fatalf("got action %d, want %d", action.ID, added.ID)
+	}
+
+	_, err = change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByTag(tx, names.NewActionTag("f47ac10b-58cc-4372-a567-0e02b2c3d479"))
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v for an unknown tag, want not found", err)
+	}
+}
+
+func TestActionFieldsSelectEveryColumn(t *testing.T) {
+	st := newTestState(t)
+
+	var fields, columns []string
+	run(t, st, func(tx *sqlx.Tx) error {
+		selected, err := actionstate.Action{}.Fields(tx)
+		if err != nil {
+			return err
+		}
+		fields = strings.Split(selected, ", ")
+		return tx.Select(&columns, "SELECT name FROM pragma_table_info('actions') ORDER BY name")
+	})
+	if !reflect.DeepEqual(fields, columns) {
+		t.Fatalf("got fields %v, want the columns %v", fields, columns)
+	}
+}
+
+func TestActionByIDReadsBackTheAddedAction(t *testing.T) {
+	st := newTestState(t)
+
+	added, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.AddAction(tx, names.NewUnitTag("mysql/0"), "", "backup", map[string]interface{}{"target": "archive", "full": true})
+	})
+	if err != nil {
+		t.Fatalf("adding action: %v", err)
+	}
+	read, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByID(tx, added.ID)
+	})
+	if err != nil {
+		t.Fatalf("getting action: %v", err)
+	}
+
+	// The action read back through the selected fields encodes the same as
+	// the action that was added.
+	want, err := json.Marshal(added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("got action %s, want %s", got, want)
+	}
+
+	_, err = change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByID(tx, added.ID+1)
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v for an unknown id, want not found", err)
+	}
+}
+
+func TestAddActionDuplicateTag(t *testing.T) {
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := actionstate.PatchNewUUID(func() (utils.UUID, error) { return uuid, nil })
+	defer restore()
+
+	st := newTestState(t)
+	addAction(t, st, "mysql/0", "backup")
+
+	_, err = change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.AddAction(tx, names.NewUnitTag("mysql/1"), "", "backup", nil)
+	})
+	if !stateerrors.IsAlreadyExists(err) {
+		t.Fatalf("got error %v adding a duplicate tag, want already exists", err)
+	}
+	if !strings.Contains(err.Error(), uuid.String()) {
+		t.Fatalf("got error %q, want it to name the tag", err)
+	}
+	if got := actionIDs(t, st); len(got) != 1 {
+		t.Fatalf("got actions %v, want only the first added", got)
+	}
+}
+
+func TestAddActionIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   []string
+		unique int
+	}{
+		{"same key", []string{"retry-1", "retry-1"}, 1},
+		{"different keys", []string{"retry-1", "retry-2"}, 2},
+		{"no key", []string{"", ""}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := newTestState(t)
+
+			var added []model.Action
+			for _, key := range test.keys {
+				added = append(added, addAction(t, st, "mysql/0", "backup", actionstate.IdempotencyKey(key)))
+			}
+			if got := actionIDs(t, st); len(got) != test.unique {
+				t.Fatalf("got actions %v, want %d", got, test.unique)
+			}
+			if sameAction := added[0].ID == added[1].ID; sameAction != (test.unique == 1) {
+				t.Fatalf("got actions %d and %d, want the same action %v", added[0].ID, added[1].ID, test.unique == 1)
+			}
+		})
+	}
+}
+
+func TestActionByIdempotencyKey(t *testing.T) {
+	st := newTestState(t)
+	added := addAction(t, st, "mysql/0", "backup", actionstate.IdempotencyKey("retry-1"))
+
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByIdempotencyKey(tx, "retry-1")
+	})
+	if err != nil {
+		t.Fatalf("getting action: %v", err)
+	}
+	if action.ID != added.ID {
+		t.Fatalf("got action %d, want %d", action.ID, added.ID)
+	}
+
+	_, err = change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByIdempotencyKey(tx, "retry-2")
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v for an unknown key, want not found", err)
+	}
+}
+
+func TestOperationStatusFollowsActions(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []model.ActionStatus
+		want     model.ActionStatus
+	}{
+		{"all completed", []model.ActionStatus{model.ActionCompleted, model.ActionCompleted}, model.ActionCompleted},
+		{"one failed", []model.ActionStatus{model.ActionCompleted, model.ActionFailed}, model.ActionFailed},
+		{"one errored", []model.ActionStatus{model.ActionFailed, model.ActionError}, model.ActionError},
+		{"one aborted", []model.ActionStatus{model.ActionAborted, model.ActionCompleted}, model.ActionFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st := newTestState(t)
+			mgr := st.ActionManager()
+
+			var (
+				operation model.Operation
+				actions   []model.Action
+			)
+			operationStatus := func() model.Operation {
+				t.Helper()
+				run(t, st, func(tx *sqlx.Tx) error {
+					var err error
+					operation, err = st.OperationManager().OperationByID(tx, operation.ID)
+					return err
+				})
+				return operation
+			}
+			run(t, st, func(tx *sqlx.Tx) error {
+				var err error
+				if operation, err = st.OperationManager().AddOperation(tx, "backup"); err != nil {
+					return err
+				}
+				receivers := []names.Tag{names.NewUnitTag("mysql/0"), names.NewUnitTag("mysql/1")}
+				actions, err = mgr.AddActions(tx, strconv.FormatInt(operation.ID, 10), receivers, "backup", nil)
+				return err
+			})
+
+			// The operation runs whilst any of its actions are running.
+			for _, action := range actions {
+				if _, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+					return mgr.BeginAction(tx, action.ID)
+				}); err != nil {
+					t.Fatalf("beginning action: %v", err)
+				}
+			}
+			if got := operationStatus(); got.Status != model.ActionRunning || got.Started.IsZero() || !got.Completed.IsZero() {
+				t.Fatalf("got operation %+v, want running", got)
+			}
+
+			for i, action := range actions {
+				if test.outcomes[i] == model.ActionAborted {
+					if _, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+						return mgr.AbortAction(tx, action.ID)
+					}); err != nil {
+						t.Fatalf("aborting action: %v", err)
+					}
+				}
+				if _, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+					return mgr.FinishAction(tx, action.ID, test.outcomes[i], "", nil)
+				}); err != nil {
+					t.Fatalf("finishing action: %v", err)
+				}
+
+				// The operation only completes with its last action.
+				got := operationStatus()
+				if last := i == len(actions)-1; last != !got.Completed.IsZero() {
+					t.Fatalf("after action %d got operation %+v, want completed %v", i, got, last)
+				}
+			}
+
+			got := operationStatus()
+			if got.Status != test.want {
+				t.Fatalf("got status %q, want %q", got.Status, test.want)
+			}
+			counts := map[model.ActionStatus]int{}
+			for _, outcome := range test.outcomes {
+				counts[outcome]++
+			}
+			if !reflect.DeepEqual(got.ActionCounts, counts) {
+				t.Fatalf("got action counts %v, want %v", got.ActionCounts, counts)
+			}
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	st := newTestState(t)
+	for _, status := range []model.ActionStatus{model.ActionPending, model.ActionRunning, model.ActionCompleted, model.ActionCompleted} {
+		actionWithStatus(t, st, status)
+	}
+	addAction(t, st, "mysql/1", "restore")
+
+	summary := func(k ...string) map[string]string {
+		key := make(map[string]string)
+		for i := 0; i < len(k); i += 2 {
+			key[k[i]] = k[i+1]
+		}
+		return key
+	}
+	tests := []struct {
+		name    string
+		groupBy []string
+		want    []model.ActionSummary
+	}{
+		{"total", nil, []model.ActionSummary{{Key: summary(), Count: 5}}},
+		{"by status", []string{"status"}, []model.ActionSummary{
+			{Key: summary("status", "completed"), Count: 2},
+			{Key: summary("status", "pending"), Count: 2},
+			{Key: summary("status", "running"), Count: 1},
+		}},
+		{"by status and receiver", []string{"status", "receiver"}, []model.ActionSummary{
+			{Key: summary("status", "completed", "receiver", "unit-mysql-0"), Count: 2},
+			{Key: summary("status", "pending", "receiver", "unit-mysql-0"), Count: 1},
+			{Key: summary("status", "pending", "receiver", "unit-mysql-1"), Count: 1},
+			{Key: summary("status", "running", "receiver", "unit-mysql-0"), Count: 1},
+		}},
+		{"by name", []string{"name"}, []model.ActionSummary{
+			{Key: summary("name", "backup"), Count: 4},
+			{Key: summary("name", "restore"), Count: 1},
+		}},
+	}
+	for _, test := range tests {
+		var got []model.ActionSummary
+		run(t, st, func(tx *sqlx.Tx) error {
+			var err error
+			got, err = st.ActionManager().Summary(tx, test.groupBy...)
+			return err
+		})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSummaryInvalidColumn(t *testing.T) {
+	st := newTestState(t)
+
+	// Only known columns can be grouped by, as they're part of the query.
+	for _, column := range []string{"message", "status; DROP TABLE actions"} {
+		err := inTx(st, func(tx *sqlx.Tx) error {
+			_, err := st.ActionManager().Summary(tx, "status", column)
+			return err
+		})
+		if !errors.IsBadRequest(err) {
+			t.Errorf("got error %v grouping by %q, want bad request", err, column)
+		}
+	}
+}
+
+// actionsByIDs returns the actions with the ids, and the missing ids.
+func actionsByIDs(t *testing.T, st *state.State, want []int64) ([]int64, []int64) {
+	t.Helper()
+
+	var (
+		found   []model.Action
+		missing []int64
+	)
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		found, missing, err = st.ActionManager().ActionsByIDs(tx, want)
+		return err
+	})
+	return ids(found), missing
+}
+
+func TestActionsByIDs(t *testing.T) {
+	st := newTestState(t)
+	first := addAction(t, st, "mysql/0", "backup")
+	second := addAction(t, st, "mysql/0", "restore")
+	third := addAction(t, st, "mysql/1", "backup")
+
+	tests := []struct {
+		name    string
+		ids     []int64
+		found   []int64
+		missing []int64
+	}{
+		{"none", nil, []int64{}, nil},
+		{"input order", []int64{third.ID, first.ID, second.ID}, []int64{third.ID, first.ID, second.ID}, nil},
+		{"missing", []int64{42, second.ID, 43}, []int64{second.ID}, []int64{42, 43}},
+		{"all missing", []int64{42}, []int64{}, []int64{42}},
+	}
+	for _, test := range tests {
+		found, missing := actionsByIDs(t, st, test.ids)
+		if !reflect.DeepEqual(found, test.found) || !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("%s: got %v missing %v, want %v missing %v", test.name, found, missing, test.found, test.missing)
+		}
+	}
+}
+
+func TestActionsByIDsAcrossChunks(t *testing.T) {
+	st := newTestState(t)
+
+	// More actions than are bound to a single statement.
+	receivers := make([]names.Tag, 1200)
+	for i := range receivers {
+		receivers[i] = names.NewUnitTag("mysql/" + strconv.Itoa(i))
+	}
+	var added []model.Action
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		added, err = st.ActionManager().AddActions(tx, "", receivers, "backup", nil)
+		return err
+	})
+
+	// Ask for every action in reverse, with missing ids at either end of
+	// the chunks.
+	var want, request []int64
+	for i := len(added) - 1; i >= 0; i-- {
+		want = append(want, added[i].ID)
+	}
+	request = append(request, -1)
+	request = append(request, want...)
+	request = append(request, -2)
+
+	found, missing := actionsByIDs(t, st, request)
+	if !reflect.DeepEqual(found, want) {
+		t.Fatalf("got %d actions out of order, want %d in reverse", len(found), len(want))
+	}
+	if !reflect.DeepEqual(missing, []int64{-1, -2}) {
+		t.Fatalf("got missing %v, want [-1 -2]", missing)
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	st := newTestState(t)
+	// A manager with tiny limits over the same database.
+	mgr := actionstate.NewManager(st.Backend(), st.Events(), nil, actionstate.WithSizeLimits(32, 8))
+
+	var action model.Action
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		_, err := mgr.AddAction(tx, names.NewUnitTag("mysql/0"), "", "backup", map[string]interface{}{"target": "a very long archive name"})
+		return err
+	})
+	if !stateerrors.IsTooLarge(err) || !stateerrors.IsBadRequest(err) {
+		t.Fatalf("got error %v adding large parameters, want too large", err)
+	}
+	if want := `parameters for action "backup" of 37 bytes (limit 32 bytes) is too large`; err.Error() != want {
+		t.Fatalf("got error %q, want %q", err, want)
+	}
+	if ids := actionIDs(t, st); len(ids) != 0 {
+		t.Fatalf("got actions %v, want none added", ids)
+	}
+
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		if action, err = mgr.AddAction(tx, names.NewUnitTag("mysql/0"), "", "backup", map[string]interface{}{"a": 1}); err != nil {
+			return err
+		}
+		_, err = mgr.BeginAction(tx, action.ID)
+		return err
+	})
+
+	// Messages are limited when logged and when finishing the action.
+	err = inTx(st, func(tx *sqlx.Tx) error {
+		return mgr.LogMessage(tx, action.ID, "downloading", time.Now())
+	})
+	if !stateerrors.IsTooLarge(err) || !strings.Contains(err.Error(), "of 11 bytes (limit 8 bytes)") {
+		t.Fatalf("got error %v logging a large message, want too large", err)
+	}
+	err = inTx(st, func(tx *sqlx.Tx) error {
+		_, err := mgr.FinishAction(tx, action.ID, model.ActionFailed, "disk exhausted", nil)
+		return err
+	})
+	if !stateerrors.IsTooLarge(err) || !strings.Contains(err.Error(), "of 14 bytes (limit 8 bytes)") {
+		t.Fatalf("got error %v finishing with a large message, want too large", err)
+	}
+
+	// Input within the limits is accepted.
+	_, err = change(st, func(_ *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.FinishAction(tx, action.ID, model.ActionFailed, "no disk", nil)
+	})
+	if err != nil {
+		t.Fatalf("finishing action: %v", err)
+	}
+}
+
+func TestAddActionRequestedBy(t *testing.T) {
+	st := newTestState(t)
+	requested := addAction(t, st, "mysql/0", "backup", actionstate.RequestedBy("user-admin"), actionstate.Source("cli"))
+	unknown := addAction(t, st, "mysql/0", "backup")
+
+	if requested.RequestedBy != "user-admin" || requested.Source != "cli" {
+		t.Fatalf("got action %+v, want it requested by the admin from the cli", requested)
+	}
+
+	// Actions without the metadata are stored as NULL, and read as empty.
+	var nulls int
+	run(t, st, func(tx *sqlx.Tx) error {
+		return tx.Get(&nulls, "SELECT COUNT(*) FROM actions WHERE id = $1 AND requested_by IS NULL AND source IS NULL", unknown.ID)
+	})
+	if nulls != 1 {
+		t.Fatalf("got the metadata stored for action %d, want NULL", unknown.ID)
+	}
+	action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+		return mgr.ActionByID(tx, unknown.ID)
+	})
+	if err != nil {
+		t.Fatalf("getting action: %v", err)
+	}
+	if action.RequestedBy != "" || action.Source != "" {
+		t.Fatalf("got action %+v, want no metadata", action)
+	}
+}
+
+func TestEnsureExpiresPendingActions(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := testclock.NewClock(now)
+	st := newTestStateWithClock(t, clock)
+	mgr := st.ActionManager()
+
+	expiring := addAction(t, st, "mysql/0", "backup", actionstate.ExpiresAt(now.Add(time.Hour)))
+	later := addAction(t, st, "mysql/0", "backup", actionstate.ExpiresAt(now.Add(2*time.Hour)))
+	forever := addAction(t, st, "mysql/0", "backup")
+	// A claimed action is never expired, even once it's past its expiry.
+	claimed := addAction(t, st, "mysql/1", "backup", actionstate.ExpiresAt(now.Add(time.Hour)))
+	if _, err := claimNext(st, names.NewUnitTag("mysql/1")); err != nil {
+		t.Fatalf("claiming action: %v", err)
+	}
+
+	status := func(id int64) model.Action {
+		t.Helper()
+		action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+			return mgr.ActionByID(tx, id)
+		})
+		if err != nil {
+			t.Fatalf("getting action: %v", err)
+		}
+		return action
+	}
+
+	steps := []struct {
+		advance time.Duration
+		want    map[int64]model.ActionStatus
+	}{
+		// Just before the expiry, nothing has expired.
+		{time.Hour - time.Second, map[int64]model.ActionStatus{
+			expiring.ID: model.ActionPending, later.ID: model.ActionPending,
+			forever.ID: model.ActionPending, claimed.ID: model.ActionRunning,
+		}},
+		// Crossing the expiry fails the action.
+		{time.Second, map[int64]model.ActionStatus{
+			expiring.ID: model.ActionFailed, later.ID: model.ActionPending,
+			forever.ID: model.ActionPending, claimed.ID: model.ActionRunning,
+		}},
+		{24 * time.Hour, map[int64]model.ActionStatus{
+			expiring.ID: model.ActionFailed, later.ID: model.ActionFailed,
+			forever.ID: model.ActionPending, claimed.ID: model.ActionRunning,
+		}},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if err := mgr.Ensure(context.Background()); err != nil {
+			t.Fatalf("step %d: ensuring: %v", i, err)
+		}
+		for id, want := range step.want {
+			if got := status(id); got.Status != want {
+				t.Errorf("step %d: got action %d %q, want %q", i, id, got.Status, want)
+			}
+		}
+	}
+
+	if action := status(expiring.ID); action.Message != "action expired before it was run" || action.Completed.IsZero() || !action.Started.IsZero() {
+		t.Fatalf("got expired action %+v, want it failed without running", action)
+	}
+}
+
+func TestExpirePendingReturnsExpired(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	st := newTestStateWithClock(t, testclock.NewClock(now))
+
+	first := addAction(t, st, "mysql/0", "backup", actionstate.ExpiresAt(now.Add(time.Minute)))
+	second := addAction(t, st, "mysql/0", "backup", actionstate.ExpiresAt(now))
+	addAction(t, st, "mysql/0", "backup", actionstate.ExpiresAt(now.Add(time.Hour)))
+
+	var expired []model.Action
+	run(t, st, func(tx *sqlx.Tx) error {
+		var err error
+		expired, err = st.ActionManager().ExpirePending(tx, now.Add(time.Minute))
+		return err
+	})
+	// The actions are expired in the order of their expiry.
+	if got, want := ids(expired), []int64{second.ID, first.ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got expired %v, want %v", got, want)
+	}
+	for _, action := range expired {
+		if action.Status != model.ActionFailed {
+			t.Fatalf("got expired action %+v, want failed", action)
+		}
+	}
+}
+
+// nopLogger discards all log messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{})   {}
+func (nopLogger) Infof(string, ...interface{})    {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+func (nopLogger) Errorf(string, ...interface{})   {}
+
+func TestActionLogs(t *testing.T) {
+	st := newTestState(t)
+	action := addAction(t, st, "mysql/0", "backup")
+
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		for _, message := range []model.ActionMessage{
+			{Message: "starting", Timestamp: start},
+			{Message: "finishing", Timestamp: start.Add(2 * time.Minute)},
+			{Message: "copying", Timestamp: start.Add(time.Minute)},
+		} {
+			if err := st.ActionManager().LogMessage(tx, action.ID, message.Message, message.Timestamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("logging messages: %v", err)
+	}
+
+	// logs returns the messages logged since the time.
+	logs := func(since time.Time) []string {
+		var messages []model.ActionMessage
+		err := inTx(st, func(tx *sqlx.Tx) error {
+			var err error
+			messages, err = st.ActionManager().ActionLogsSince(tx, action.ID, since)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("getting messages: %v", err)
+		}
+		var names []string
+		for _, message := range messages {
+			names = append(names, message.Message)
+		}
+		return names
+	}
+	if got, want := logs(time.Time{}), []string{"starting", "copying", "finishing"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got messages %v, want %v", got, want)
+	}
+	if got, want := logs(start.Add(time.Minute)), []string{"finishing"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got messages since %v, want %v", got, want)
+	}
+
+	err = inTx(st, func(tx *sqlx.Tx) error {
+		return st.ActionManager().LogMessage(tx, action.ID+1, "lost", start)
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v logging for a missing action, want not found", err)
+	}
+}
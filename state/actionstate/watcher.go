@@ -0,0 +1,170 @@
+package actionstate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// watcherBufferSize is the number of events buffered for each watcher, before
+// the events are dropped.
+const watcherBufferSize = 64
+
+// watcherRetryDelay is the time before the pending actions are read again,
+// after failing to recover from dropped events.
+const watcherRetryDelay = time.Second
+
+// ActionWatcher notifies of the actions for a receiver that have been added
+// or have changed status.
+type ActionWatcher struct {
+	receiver string
+	clock    clock.Clock
+	sub      *events.Subscription
+	changes  chan []int64
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// pending reads the ids of the pending actions of the receiver.
+	pending func() ([]int64, error)
+	// dropped is the number of events the subscription has dropped, that
+	// have been recovered from.
+	dropped int
+}
+
+// Watch returns a watcher for the actions of the receiver. The first change
+// holds the ids of the pending actions, and every subsequent change holds the
+// ids of the actions that have been added or changed status since the last
+// change was received. Ids are coalesced whilst the consumer is busy, so a
+// slow watcher never blocks the writers. If the watcher falls so far behind
+// that events are dropped, the pending actions are read again once it has
+// caught up, so that none are missed. The watcher must be stopped once it's no longer needed.
+func (m *ActionManager) Watch(ctx context.Context, receiver string) (*ActionWatcher, error) {
+	if m.subscriber == nil {
+		return nil, errors.NotSupportedf("watching actions without a subscriber")
+	}
+
+	// Subscribe before reading the pending actions, so that no changes are
+	// missed in between.
+	sub := m.subscriber.Subscribe(watcherBufferSize)
+
+	pendingIDs := func(ctx context.Context) ([]int64, error) {
+		var ids []int64
+		err := m.backend.RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+			return errors.Trace(tx.SelectContext(ctx, &ids, `
+	SELECT id FROM actions WHERE receiver = $1 AND status = $2 ORDER BY enqueued, id
+	`, receiver, string(model.ActionPending)))
+		})
+		return ids, errors.Trace(err)
+	}
+	pending, err := pendingIDs(ctx)
+	if err != nil {
+		sub.Unsubscribe()
+		return nil, errors.Trace(err)
+	}
+
+	w := &ActionWatcher{
+		receiver: receiver,
+		clock:    m.clock,
+		sub:      sub,
+		changes:  make(chan []int64),
+		done:     make(chan struct{}),
+		pending: func() ([]int64, error) {
+			return pendingIDs(context.Background())
+		},
+	}
+	go w.loop(pending)
+	return w, nil
+}
+
+// Changes returns the channel the changes are delivered on. The channel is
+// closed once the watcher is stopped.
+func (w *ActionWatcher) Changes() <-chan []int64 {
+	return w.changes
+}
+
+// Stop stops the watcher. It is safe to call more than once.
+func (w *ActionWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.sub.Unsubscribe()
+	})
+}
+
+func (w *ActionWatcher) loop(pending []int64) {
+	defer close(w.changes)
+
+	// The initial change is always sent, even if there are no pending
+	// actions.
+	initial := true
+	// retry fires once it's time to recover from dropped events again,
+	// after failing to.
+	var retry <-chan time.Time
+	for {
+		var out chan []int64
+		if initial || len(pending) > 0 {
+			out = w.changes
+		}
+
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.sub.Events():
+			if !ok {
+				return
+			}
+			changed, ok := event.(events.ActionStatusChanged)
+			if ok && changed.Receiver == w.receiver {
+				pending = appendUnique(pending, changed.ID)
+			}
+			// Recover once the buffered events have been drained, rather
+			// than on a later event, as there may not be one.
+			if len(w.sub.Events()) == 0 {
+				pending, retry = w.recoverDropped(pending, retry)
+			}
+		case <-retry:
+			pending, retry = w.recoverDropped(pending, nil)
+		case out <- pending:
+			initial = false
+			pending = nil
+		}
+	}
+}
+
+// recoverDropped adds the ids of the pending actions to the change if the
+// subscription has dropped events since it last recovered, as the dropped
+// events may have been for new actions. If the pending actions can't be read,
+// it returns when to try again.
+func (w *ActionWatcher) recoverDropped(ids []int64, retry <-chan time.Time) ([]int64, <-chan time.Time) {
+	dropped := w.sub.Dropped()
+	if dropped == w.dropped {
+		return ids, retry
+	}
+
+	pending, err := w.pending()
+	if err != nil {
+		if retry == nil {
+			retry = w.clock.After(watcherRetryDelay)
+		}
+		return ids, retry
+	}
+	w.dropped = dropped
+	for _, id := range pending {
+		ids = appendUnique(ids, id)
+	}
+	return ids, nil
+}
+
+func appendUnique(ids []int64, id int64) []int64 {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
@@ -0,0 +1,281 @@
+package actionstate_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/SimonRichardson/nu-juju-data/state"
+	"github.com/SimonRichardson/nu-juju-data/state/actionstate"
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+	"github.com/juju/names"
+)
+
+// watch returns a watcher for the receiver, which is stopped when the test
+// finishes.
+func watch(t *testing.T, st *state.State, receiver string) *actionstate.ActionWatcher {
+	t.Helper()
+
+	w, err := st.ActionManager().Watch(context.Background(), receiver)
+	if err != nil {
+		t.Fatalf("watching actions: %v", err)
+	}
+	t.Cleanup(w.Stop)
+	return w
+}
+
+// nextChange returns the next change of the watcher.
+func nextChange(t *testing.T, w *actionstate.ActionWatcher) []int64 {
+	t.Helper()
+
+	select {
+	case ids, ok := <-w.Changes():
+		if !ok {
+			t.Fatalf("watcher stopped")
+		}
+		return ids
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for a change")
+	}
+	return nil
+}
+
+// waitForIDs reads the changes of the watcher until every id has been seen,
+// as the ids can be split across changes.
+func waitForIDs(t *testing.T, w *actionstate.ActionWatcher, want ...int64) {
+	t.Helper()
+
+	seen := make(map[int64]bool)
+	for len(seen) < len(want) {
+		for _, id := range nextChange(t, w) {
+			seen[id] = true
+		}
+	}
+	var got []int64
+	for id := range seen {
+		got = append(got, id)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got changes for %v, want %v", got, want)
+	}
+}
+
+// assertNoChange checks the watcher has no pending change.
+func assertNoChange(t *testing.T, w *actionstate.ActionWatcher) {
+	t.Helper()
+
+	select {
+	case ids := <-w.Changes():
+		t.Fatalf("got unexpected change %v", ids)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchSendsPendingFirst(t *testing.T) {
+	st := newTestState(t)
+	first := addAction(t, st, "mysql/0", "backup")
+	second := addAction(t, st, "mysql/0", "restore")
+	actionWithStatus(t, st, model.ActionRunning)
+	addAction(t, st, "mysql/1", "backup")
+
+	w := watch(t, st, "unit-mysql-0")
+	if got, want := nextChange(t, w), []int64{first.ID, second.ID}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got initial change %v, want the pending actions %v", got, want)
+	}
+	assertNoChange(t, w)
+
+	// The initial change is sent even without any pending actions.
+	if got := nextChange(t, watch(t, st, "unit-mysql-2")); len(got) != 0 {
+		t.Fatalf("got initial change %v, want it empty", got)
+	}
+}
+
+func TestWatchMultipleReceivers(t *testing.T) {
+	st := newTestState(t)
+	mgr := st.ActionManager()
+	pending := addAction(t, st, "mysql/0", "backup")
+
+	w0 := watch(t, st, "unit-mysql-0")
+	w1 := watch(t, st, "unit-mysql-1")
+	w0Again := watch(t, st, "unit-mysql-0")
+	for _, w := range []*actionstate.ActionWatcher{w0, w1, w0Again} {
+		nextChange(t, w)
+	}
+
+	// Writes for both receivers are interleaved, each watcher only sees the
+	// changes for its own receiver.
+	other := addAction(t, st, "mysql/1", "backup")
+	added := addAction(t, st, "mysql/0", "restore")
+	run(t, st, func(tx *sqlx.Tx) error {
+		_, err := mgr.BeginAction(tx, pending.ID)
+		return err
+	})
+
+	waitForIDs(t, w0, added.ID, pending.ID)
+	waitForIDs(t, w0Again, added.ID, pending.ID)
+	waitForIDs(t, w1, other.ID)
+	for _, w := range []*actionstate.ActionWatcher{w0, w1, w0Again} {
+		assertNoChange(t, w)
+	}
+}
+
+func TestWatchIgnoresRolledBackChanges(t *testing.T) {
+	st := newTestState(t)
+	w := watch(t, st, "unit-mysql-0")
+	nextChange(t, w)
+
+	err := inTx(st, func(tx *sqlx.Tx) error {
+		if _, err := st.ActionManager().AddAction(tx, names.NewUnitTag("mysql/0"), "", "backup", nil); err != nil {
+			return err
+		}
+		return errors.New("rolled back")
+	})
+	if err == nil || err.Error() != "rolled back" {
+		t.Fatalf("got error %v, want the transaction rolled back", err)
+	}
+	assertNoChange(t, w)
+}
+
+func TestWatchSlowWatcherDoesntBlockWrites(t *testing.T) {
+	st := newTestState(t)
+	w := watch(t, st, "unit-mysql-0")
+
+	// The watcher isn't read whilst many more actions are added than are
+	// buffered for it.
+	type result struct {
+		added []int64
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var added []int64
+		for i := 0; i < 200; i++ {
+			action, err := change(st, func(mgr *actionstate.ActionManager, tx *sqlx.Tx) (model.Action, error) {
+				return mgr.AddAction(tx, names.NewUnitTag("mysql/0"), "", "backup", nil)
+			})
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			added = append(added, action.ID)
+		}
+		done <- result{added: added}
+	}()
+
+	var added []int64
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("adding action: %v", res.err)
+		}
+		added = res.added
+	case <-time.After(10 * time.Second):
+		t.Fatalf("writes blocked by a slow watcher")
+	}
+
+	// The changes are coalesced, and any dropped whilst the watcher was
+	// behind are read again, so every action is still seen.
+	waitForIDs(t, w, added...)
+}
+
+// overflowingSubscriber subscribes to the bus, then publishes more events
+// than are buffered, so the subscription has dropped events before the
+// watcher has read any.
+type overflowingSubscriber struct {
+	bus *events.Bus
+}
+
+func (s overflowingSubscriber) Subscribe(size int) *events.Subscription {
+	sub := s.bus.Subscribe(size)
+	for i := 0; i <= size; i++ {
+		s.bus.Publish(struct{}{})
+	}
+	return sub
+}
+
+// flakyBackend fails the call to the backend with the index, signalling
+// failed once it has.
+type flakyBackend struct {
+	actionstate.Backend
+	fail   int
+	failed chan struct{}
+
+	mutex sync.Mutex
+	calls int
+}
+
+func (b *flakyBackend) RunContext(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) error {
+	b.mutex.Lock()
+	call := b.calls
+	b.calls++
+	b.mutex.Unlock()
+
+	if call == b.fail {
+		close(b.failed)
+		return errors.New("boom")
+	}
+	return b.Backend.RunContext(ctx, fn)
+}
+
+func TestWatchRecoversWithoutLaterEvents(t *testing.T) {
+	clock := testclock.NewClock(time.Now())
+	st := newTestStateWithClock(t, clock)
+
+	// The first recovery from the dropped events fails, and no events follow
+	// it.
+	backend := &flakyBackend{Backend: st.Backend(), fail: 1, failed: make(chan struct{})}
+	bus := events.NewBus()
+	mgr := actionstate.NewManager(backend, bus, nil,
+		actionstate.WithClock(clock),
+		actionstate.WithSubscriber(overflowingSubscriber{bus: bus}),
+	)
+	w, err := mgr.Watch(context.Background(), "unit-mysql-0")
+	if err != nil {
+		t.Fatalf("watching actions: %v", err)
+	}
+	t.Cleanup(w.Stop)
+	if got := nextChange(t, w); len(got) != 0 {
+		t.Fatalf("got initial change %v, want it empty", got)
+	}
+	select {
+	case <-backend.failed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the recovery")
+	}
+
+	// The action is only found by trying to recover again.
+	added := addAction(t, st, "mysql/0", "backup")
+	if err := clock.WaitAdvance(time.Minute, 10*time.Second, 1); err != nil {
+		t.Fatalf("waiting for the retry: %v", err)
+	}
+	waitForIDs(t, w, added.ID)
+}
+
+func TestWatchStop(t *testing.T) {
+	st := newTestState(t)
+	w := watch(t, st, "unit-mysql-0")
+	nextChange(t, w)
+
+	w.Stop()
+	w.Stop()
+	select {
+	case _, ok := <-w.Changes():
+		if ok {
+			t.Fatalf("got a change after stopping")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("changes not closed after stopping")
+	}
+
+	// Writing after the watcher has stopped is unaffected.
+	addAction(t, st, "mysql/0", "backup")
+}
@@ -0,0 +1,138 @@
+// Package errors provides the vocabulary of errors returned by the state
+// managers, so that callers such as the server can classify them without
+// inspecting raw database errors.
+package errors
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// NotFoundf returns an error which satisfies IsNotFound.
+func NotFoundf(format string, args ...interface{}) error {
+	return errors.NewNotFound(nil, fmt.Sprintf(format+" not found", args...))
+}
+
+// IsNotFound reports whether the error was created with NotFoundf, or is a
+// juju/errors NotFound error.
+func IsNotFound(err error) bool {
+	return errors.IsNotFound(err)
+}
+
+// AlreadyExistsf returns an error which satisfies IsAlreadyExists.
+func AlreadyExistsf(format string, args ...interface{}) error {
+	return errors.NewAlreadyExists(nil, fmt.Sprintf(format+" already exists", args...))
+}
+
+// IsAlreadyExists reports whether the error was created with AlreadyExistsf,
+// or is a juju/errors AlreadyExists error.
+func IsAlreadyExists(err error) bool {
+	return errors.IsAlreadyExists(err)
+}
+
+// invalidTransition represents a state change that isn't allowed.
+type invalidTransition struct {
+	errors.Err
+}
+
+// InvalidTransitionf returns an error which satisfies IsInvalidTransition.
+func InvalidTransitionf(format string, args ...interface{}) error {
+	err := &invalidTransition{errors.NewErr(format+" is an invalid transition", args...)}
+	err.SetLocation(1)
+	return err
+}
+
+// IsInvalidTransition reports whether the error was created with
+// InvalidTransitionf.
+func IsInvalidTransition(err error) bool {
+	_, ok := errors.Cause(err).(*invalidTransition)
+	return ok
+}
+
+// conflict represents a change that conflicts with a concurrent change.
+type conflict struct {
+	errors.Err
+}
+
+// Conflictf returns an error which satisfies IsConflict.
+func Conflictf(format string, args ...interface{}) error {
+	err := &conflict{errors.NewErr(format+" conflict", args...)}
+	err.SetLocation(1)
+	return err
+}
+
+// IsConflict reports whether the error was created with Conflictf.
+func IsConflict(err error) bool {
+	_, ok := errors.Cause(err).(*conflict)
+	return ok
+}
+
+// retryLater represents a transient failure, where the same request is
+// expected to succeed later.
+type retryLater struct {
+	errors.Err
+}
+
+// RetryLaterf returns an error which satisfies IsRetryLater.
+func RetryLaterf(format string, args ...interface{}) error {
+	err := &retryLater{errors.NewErr(format+", retry later", args...)}
+	err.SetLocation(1)
+	return err
+}
+
+// NewRetryLater returns an error which wraps err and satisfies IsRetryLater.
+func NewRetryLater(err error, msg string) error {
+	return errors.Wrap(err, &retryLater{errors.NewErr(msg)})
+}
+
+// IsRetryLater reports whether the error was created with RetryLaterf or
+// NewRetryLater.
+func IsRetryLater(err error) bool {
+	_, ok := errors.Cause(err).(*retryLater)
+	return ok
+}
+
+// tooLarge represents input that exceeds a size limit.
+type tooLarge struct {
+	errors.Err
+}
+
+// TooLargef returns an error which satisfies IsTooLarge and IsBadRequest.
+func TooLargef(format string, args ...interface{}) error {
+	err := &tooLarge{errors.NewErr(format+" is too large", args...)}
+	err.SetLocation(1)
+	return err
+}
+
+// IsTooLarge reports whether the error was created with TooLargef.
+func IsTooLarge(err error) bool {
+	_, ok := errors.Cause(err).(*tooLarge)
+	return ok
+}
+
+// IsBadRequest reports whether the error is a juju/errors BadRequest error,
+// or input that is too large.
+func IsBadRequest(err error) bool {
+	return errors.IsBadRequest(err) || IsTooLarge(err)
+}
+
+// FromDB classifies a raw database error into the state error vocabulary. A
+// unique constraint violation becomes AlreadyExists and a busy or locked
+// database becomes RetryLater. Any other error is returned unchanged.
+func FromDB(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	message := errors.Cause(err).Error()
+	switch {
+	case strings.Contains(message, "UNIQUE constraint failed"):
+		return errors.NewAlreadyExists(err, message)
+	case strings.Contains(message, "database is locked"),
+		strings.Contains(message, "database is busy"):
+		return NewRetryLater(err, message)
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package errors_test
+
+import (
+	"testing"
+
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/juju/errors"
+)
+
+func TestClassification(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		check func(error) bool
+	}{{
+		name:  "not found",
+		err:   stateerrors.NotFoundf("action %d", 1),
+		check: stateerrors.IsNotFound,
+	}, {
+		name:  "already exists",
+		err:   stateerrors.AlreadyExistsf("action %d", 1),
+		check: stateerrors.IsAlreadyExists,
+	}, {
+		name:  "invalid transition",
+		err:   stateerrors.InvalidTransitionf("pending to completed"),
+		check: stateerrors.IsInvalidTransition,
+	}, {
+		name:  "conflict",
+		err:   stateerrors.Conflictf("schema version %d", 2),
+		check: stateerrors.IsConflict,
+	}, {
+		name:  "retry later",
+		err:   stateerrors.RetryLaterf("database busy"),
+		check: stateerrors.IsRetryLater,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The classification survives annotation.
+			err := errors.Annotate(test.err, "doing something")
+			if !test.check(err) {
+				t.Fatalf("got %v unclassified", err)
+			}
+			for _, other := range tests {
+				if other.name != test.name && other.check(err) {
+					t.Fatalf("got %v classified as %s", err, other.name)
+				}
+			}
+		})
+	}
+}
+
+func TestTooLargeIsBadRequest(t *testing.T) {
+	err := errors.Annotate(stateerrors.TooLargef("parameters"), "adding action")
+	if !stateerrors.IsTooLarge(err) || !stateerrors.IsBadRequest(err) {
+		t.Fatalf("got %v, want too large and bad request", err)
+	}
+	if err := errors.BadRequestf("name"); stateerrors.IsTooLarge(err) || !stateerrors.IsBadRequest(err) {
+		t.Fatalf("got %v, want only bad request", err)
+	}
+}
+
+func TestFromDB(t *testing.T) {
+	if err := stateerrors.FromDB(nil); err != nil {
+		t.Fatalf("got %v from nil, want nil", err)
+	}
+
+	unique := stateerrors.FromDB(errors.New("UNIQUE constraint failed: actions.tag"))
+	if !stateerrors.IsAlreadyExists(unique) {
+		t.Fatalf("got %v, want already exists", unique)
+	}
+	for _, message := range []string{"database is locked", "database is busy"} {
+		if err := stateerrors.FromDB(errors.New(message)); !stateerrors.IsRetryLater(err) {
+			t.Fatalf("got %v, want retry later", err)
+		}
+	}
+
+	other := errors.New("no such table: actions")
+	if err := stateerrors.FromDB(other); err != other {
+		t.Fatalf("got %v, want the error unchanged", err)
+	}
+}
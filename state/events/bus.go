@@ -0,0 +1,100 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/SimonRichardson/nu-juju-data/model"
+)
+
+// ActionStatusChanged is published once the status of an action has changed.
+// A newly added action has an empty From status.
+type ActionStatusChanged struct {
+	ID       int64
+	Receiver string
+	From     model.ActionStatus
+	To       model.ActionStatus
+}
+
+// OperationCompleted is published once all the actions of an operation have
+// finished.
+type OperationCompleted struct {
+	ID int64
+}
+
+// Bus is a lightweight in-process event bus. Delivery is best-effort: events
+// are buffered per subscriber, and a subscriber that falls behind misses
+// events rather than blocking the publisher.
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBus creates a new event bus.
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends the event to every subscriber, without blocking. Events from a
+// single publisher are received in the order they were published.
+func (b *Bus) Publish(event interface{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Subscribe returns a subscription that receives all subsequently published
+// events, buffering up to size events.
+func (b *Bus) Subscribe(size int) *Subscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	sub := &Subscription{
+		bus:    b,
+		events: make(chan interface{}, size),
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Subscription receives the events published on a bus.
+type Subscription struct {
+	bus     *Bus
+	events  chan interface{}
+	dropped int
+}
+
+// Events returns the channel the events are delivered on. The channel is
+// closed once the subscription is unsubscribed.
+func (s *Subscription) Events() <-chan interface{} {
+	return s.events
+}
+
+// Dropped returns the number of events the subscription missed because its
+// buffer was full.
+func (s *Subscription) Dropped() int {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+	return s.dropped
+}
+
+// Unsubscribe stops the delivery of events and closes the events channel. It
+// is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; !ok {
+		return
+	}
+	delete(s.bus.subscribers, s)
+	close(s.events)
+}
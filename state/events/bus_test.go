@@ -0,0 +1,89 @@
+package events_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+)
+
+func TestEventsFromAPublisherAreOrdered(t *testing.T) {
+	bus := events.NewBus()
+	first := bus.Subscribe(10)
+	second := bus.Subscribe(10)
+
+	for id := int64(1); id <= 5; id++ {
+		bus.Publish(events.OperationCompleted{ID: id})
+	}
+
+	for _, sub := range []*events.Subscription{first, second} {
+		for want := int64(1); want <= 5; want++ {
+			select {
+			case event := <-sub.Events():
+				if got := event.(events.OperationCompleted).ID; got != want {
+					t.Fatalf("got event %d, want %d", got, want)
+				}
+			default:
+				t.Fatalf("missing event %d", want)
+			}
+		}
+		if dropped := sub.Dropped(); dropped != 0 {
+			t.Fatalf("got %d dropped events, want none", dropped)
+		}
+	}
+}
+
+func TestFullSubscriberDoesNotBlockPublish(t *testing.T) {
+	bus := events.NewBus()
+	full := bus.Subscribe(2)
+	other := bus.Subscribe(5)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := int64(1); id <= 5; id++ {
+			bus.Publish(events.OperationCompleted{ID: id})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publishing blocked on a full subscriber")
+	}
+
+	if dropped := full.Dropped(); dropped != 3 {
+		t.Fatalf("got %d dropped events, want 3", dropped)
+	}
+	// The buffered events are the oldest ones.
+	for want := int64(1); want <= 2; want++ {
+		if got := (<-full.Events()).(events.OperationCompleted).ID; got != want {
+			t.Fatalf("got event %d, want %d", got, want)
+		}
+	}
+
+	// Other subscribers are unaffected.
+	if dropped := other.Dropped(); dropped != 0 {
+		t.Fatalf("got %d dropped events for the other subscriber, want none", dropped)
+	}
+	if n := len(other.Events()); n != 5 {
+		t.Fatalf("got %d events for the other subscriber, want 5", n)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	bus := events.NewBus()
+	sub := bus.Subscribe(1)
+
+	sub.Unsubscribe()
+	// Unsubscribing again is a noop, rather than closing the channel twice.
+	sub.Unsubscribe()
+
+	// Events published afterwards are neither delivered nor dropped.
+	bus.Publish(events.OperationCompleted{ID: 1})
+	if _, ok := <-sub.Events(); ok {
+		t.Fatalf("got an event after unsubscribing")
+	}
+	if dropped := sub.Dropped(); dropped != 0 {
+		t.Fatalf("got %d dropped events after unsubscribing, want none", dropped)
+	}
+}
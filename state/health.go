@@ -0,0 +1,103 @@
+package state
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// HealthChecker is implemented by managers that can report on their own
+// health.
+type HealthChecker interface {
+	// Health returns an error if the manager is unhealthy.
+	Health(context.Context) error
+}
+
+// HealthCheck is the result of a single health check.
+type HealthCheck struct {
+	Name string
+	Err  error
+}
+
+// Health is the result of checking the health of the state.
+type Health struct {
+	Checks []HealthCheck
+}
+
+// Healthy returns true if every check passed.
+func (h Health) Healthy() bool {
+	for _, check := range h.Checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping checks the backend can run a transaction. Unlike the transactions run
+// through Backend, it doesn't require the state to be ready.
+func (s *State) Ping(ctx context.Context) error {
+	err := s.stateEng.Backend().RunReadOnly(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		var one int
+		return errors.Trace(tx.GetContext(ctx, &one, "SELECT 1"))
+	})
+	return errors.Annotate(err, "pinging backend")
+}
+
+// Health checks the backend is reachable, the schema is up to date and that
+// the managers are healthy.
+func (s *State) Health(ctx context.Context) Health {
+	health := Health{
+		Checks: []HealthCheck{{
+			Name: "backend",
+			Err:  s.Ping(ctx),
+		}, {
+			Name: "schema",
+			Err:  s.schemaHealth(),
+		}},
+	}
+	if !s.Ready() {
+		health.Checks = append(health.Checks, HealthCheck{
+			Name: "managers",
+			Err:  errors.NotProvisionedf("state"),
+		})
+		return health
+	}
+	health.Checks = append(health.Checks, s.stateEng.Health(ctx)...)
+	return health
+}
+
+func (s *State) schemaHealth() error {
+	status, err := s.schemaMgr.Status()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !status.UpToDate() {
+		return errors.Errorf("schema is not up to date: %s", status)
+	}
+	return nil
+}
+
+// Health returns a check for every started manager that implements
+// HealthChecker, or that is backing off after failing to Ensure.
+func (se *StateEngine) Health(ctx context.Context) []HealthCheck {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	var checks []HealthCheck
+	for _, entry := range se.order {
+		var err error
+		if checker, ok := entry.manager.(HealthChecker); ok {
+			err = checker.Health(ctx)
+		}
+		if backoff, ok := se.backoff[entry.name]; err == nil && ok {
+			err = errors.Errorf("ensure failed %d times, retrying at %s", backoff.failures, backoff.next.Format("15:04:05"))
+		}
+		checks = append(checks, HealthCheck{
+			Name: "manager " + entry.name,
+			Err:  err,
+		})
+	}
+	return checks
+}
@@ -0,0 +1,71 @@
+package operationstate
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/model"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+type Operation struct {
+	ID int64 `db:"id"`
+
+	// Summary describes the operation.
+	Summary sql.NullString `db:"summary"`
+
+	// Enqueued is the time the operation was added.
+	Enqueued sql.NullTime `db:"enqueued"`
+
+	// Started reflects the time the operation began running.
+	Started sql.NullTime `db:"started"`
+
+	// Completed reflects the time that the operation was finished.
+	Completed sql.NullTime `db:"completed"`
+
+	// Status represents the state of the operation.
+	Status sql.NullString `db:"status"`
+
+	// Fail captures why the operation failed, from the operations results.
+	Fail sql.NullString `db:"fail"`
+
+	// ExpectedActions is the number of actions enqueued under the operation.
+	ExpectedActions int `db:"expected_actions"`
+}
+
+// Fields returns the list of fields directly from an Operation type.
+func (o Operation) Fields(tx *sqlx.Tx) (string, error) {
+	fields, err := db.FieldNames(tx, o)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fields.Join(), nil
+}
+
+func (o Operation) ToModel() model.Operation {
+	status := model.ActionPending
+	if o.Status.Valid {
+		status = model.ActionStatus(o.Status.String)
+	}
+
+	return model.Operation{
+		ID:        o.ID,
+		Summary:   o.Summary.String,
+		Enqueued:  nullTime(o.Enqueued),
+		Started:   nullTime(o.Started),
+		Completed: nullTime(o.Completed),
+		Status:    status,
+		Fail:      o.Fail.String,
+
+		ExpectedActions: o.ExpectedActions,
+	}
+}
+
+func nullTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time
+}
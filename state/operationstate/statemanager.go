@@ -0,0 +1,293 @@
+package operationstate
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/model"
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+type Backend interface {
+	// Run is a convince function for running one shot transactions, which
+	// correctly handles the rollback semantics and retries where available.
+	Run(func(context.Context, *sqlx.Tx) error) error
+}
+
+// Publisher publishes events once the transactions that caused them have
+// committed.
+type Publisher interface {
+	Publish(event interface{})
+}
+
+type OperationManager struct {
+	backend   Backend
+	publisher Publisher
+}
+
+// NewManager creates a new manager from a backend.
+func NewManager(backend Backend, publisher Publisher) *OperationManager {
+	return &OperationManager{
+		backend:   backend,
+		publisher: publisher,
+	}
+}
+
+func (m *OperationManager) StartUp(ctx context.Context) error {
+	return nil
+}
+
+func (m *OperationManager) Stop(ctx context.Context) {}
+
+// selectOperations selects the operations along with their results.
+func selectOperations(tx *sqlx.Tx) (string, error) {
+	fields, err := Operation{}.Fields(tx)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return "SELECT " + fields + " FROM operations LEFT JOIN operations_results ON operations_results.operation_id = operations.id", nil
+}
+
+// OperationByID returns one operation by id.
+func (m *OperationManager) OperationByID(tx *sqlx.Tx, id int64) (model.Operation, error) {
+	query, err := selectOperations(tx)
+	if err != nil {
+		return model.Operation{}, errors.Trace(err)
+	}
+
+	var operation Operation
+	err = tx.Get(&operation, query+" WHERE id=$1", id)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return model.Operation{}, stateerrors.NotFoundf("operation %v", id)
+		}
+		return model.Operation{}, errors.Trace(err)
+	}
+
+	result := operation.ToModel()
+	if result.ActionCounts, err = actionCounts(tx, id); err != nil {
+		return model.Operation{}, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// actionCounts returns the number of actions enqueued under the operation for
+// each status.
+func actionCounts(tx *sqlx.Tx, id int64) (map[model.ActionStatus]int, error) {
+	var rows []struct {
+		Status sql.NullString `db:"status"`
+		Count  int            `db:"count"`
+	}
+	err := tx.Select(&rows, `
+	SELECT status, COUNT(*) AS count FROM actions WHERE operation = $1 GROUP BY status
+	`, strconv.FormatInt(id, 10))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	counts := make(map[model.ActionStatus]int, len(rows))
+	for _, row := range rows {
+		status := model.ActionPending
+		if row.Status.Valid {
+			status = model.ActionStatus(row.Status.String)
+		}
+		counts[status] += row.Count
+	}
+	return counts, nil
+}
+
+// RefreshOperationStatus derives the status of the operation from the actions
+// enqueued under it, updating the operation if the status has changed. The
+// status is derived explicitly, rather than by a trigger, so that the
+// completion of an operation is published once the transaction commits.
+func (m *OperationManager) RefreshOperationStatus(tx *sqlx.Tx, id int64) (model.Operation, error) {
+	operation, err := m.OperationByID(tx, id)
+	if err != nil {
+		return model.Operation{}, errors.Trace(err)
+	}
+
+	status, ok := deriveStatus(operation.ActionCounts)
+	if !ok || status == operation.Status {
+		return operation, nil
+	}
+	return m.UpdateOperationStatus(tx, id, status)
+}
+
+// deriveStatus returns the status of an operation from the number of actions
+// for each status. False is returned if the operation has no actions.
+func deriveStatus(counts map[model.ActionStatus]int) (model.ActionStatus, bool) {
+	var total, finished int
+	for status, count := range counts {
+		total += count
+		if status.Finished() {
+			finished += count
+		}
+	}
+	switch {
+	case total == 0:
+		return "", false
+	case counts[model.ActionRunning] > 0 || counts[model.ActionAborting] > 0:
+		return model.ActionRunning, true
+	case finished < total && finished > 0:
+		// Some of the actions have run, others are still pending.
+		return model.ActionRunning, true
+	case finished < total:
+		return model.ActionPending, true
+	case counts[model.ActionError] > 0:
+		return model.ActionError, true
+	case counts[model.ActionFailed] > 0 || counts[model.ActionAborted] > 0:
+		return model.ActionFailed, true
+	case counts[model.ActionCancelled] == total:
+		return model.ActionCancelled, true
+	}
+	return model.ActionCompleted, true
+}
+
+// ListFilter filters the operations returned by ListOperations.
+type ListFilter struct {
+	// Statuses restricts the operations to those with one of the statuses.
+	Statuses []model.ActionStatus
+
+	// Limit is the maximum number of operations returned. Zero returns all
+	// the operations.
+	Limit  int
+	Offset int
+}
+
+// ListOperations returns the operations matching the filter ordered by id,
+// along with the total number of matching operations, ignoring the limit and
+// offset.
+func (m *OperationManager) ListOperations(tx *sqlx.Tx, filter ListFilter) ([]model.Operation, int, error) {
+	var (
+		where string
+		args  []interface{}
+	)
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			placeholders[i] = "?"
+			args = append(args, string(status))
+		}
+		where = " WHERE status IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	var total int
+	if err := tx.Get(&total, "SELECT COUNT(*) FROM operations"+where, args...); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	query, err := selectOperations(tx)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	query += where + " ORDER BY id"
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	} else if filter.Offset > 0 {
+		query += " LIMIT -1 OFFSET ?"
+		args = append(args, filter.Offset)
+	}
+
+	var operations []Operation
+	if err := tx.Select(&operations, query, args...); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	results := make([]model.Operation, len(operations))
+	for i, operation := range operations {
+		results[i] = operation.ToModel()
+	}
+	return results, total, nil
+}
+
+// AddOperation adds an operation, returning the given operation.
+func (m *OperationManager) AddOperation(tx *sqlx.Tx, summary string) (model.Operation, error) {
+	result, err := tx.Exec(`
+	INSERT INTO operations (summary, enqueued, status)
+	VALUES ($1, DateTime('now'), 'pending')
+	`, summary)
+	if err != nil {
+		return model.Operation{}, errors.Trace(stateerrors.FromDB(err))
+	}
+
+	// Get the ID, so we can return the operation.
+	id, err := result.LastInsertId()
+	if err != nil {
+		return model.Operation{}, errors.Trace(err)
+	}
+
+	return m.OperationByID(tx, id)
+}
+
+// UpdateOperationStatus updates the status of an operation, returning the
+// updated operation. The started time is set once the operation is running
+// and the completed time is set once it has finished.
+func (m *OperationManager) UpdateOperationStatus(tx *sqlx.Tx, id int64, status model.ActionStatus) (model.Operation, error) {
+	result, err := tx.Exec(`
+	UPDATE operations SET
+		status = $1,
+		started = CASE WHEN started IS NULL AND $1 != 'pending' THEN DateTime('now') ELSE started END,
+		completed = CASE WHEN $2 THEN DateTime('now') ELSE completed END
+	WHERE id = $3
+	`, string(status), status.Finished(), id)
+	if err != nil {
+		return model.Operation{}, errors.Trace(err)
+	}
+
+	modified, err := result.RowsAffected()
+	if err != nil {
+		return model.Operation{}, errors.Trace(err)
+	}
+	if modified != 1 {
+		return model.Operation{}, stateerrors.NotFoundf("operation %v", id)
+	}
+
+	if status.Finished() {
+		if err := db.OnCommit(tx, func() {
+			m.publisher.Publish(events.OperationCompleted{ID: id})
+		}); err != nil {
+			return model.Operation{}, errors.Trace(err)
+		}
+	}
+
+	return m.OperationByID(tx, id)
+}
+
+// SetExpectedActions records the number of actions enqueued under the
+// operation.
+func (m *OperationManager) SetExpectedActions(tx *sqlx.Tx, id int64, count int) error {
+	result, err := tx.Exec("UPDATE operations SET expected_actions = $1 WHERE id = $2", count, id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	modified, err := result.RowsAffected()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if modified != 1 {
+		return stateerrors.NotFoundf("operation %v", id)
+	}
+	return nil
+}
+
+// SetOperationResult records why an operation failed, replacing any previous
+// result.
+func (m *OperationManager) SetOperationResult(tx *sqlx.Tx, id int64, fail string) error {
+	if _, err := m.OperationByID(tx, id); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO operations_results (operation_id, fail) VALUES ($1, $2)
+	ON CONFLICT (operation_id) DO UPDATE SET fail = excluded.fail
+	`, id, fail)
+	return errors.Trace(err)
+}
@@ -0,0 +1,326 @@
+package operationstate_test
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/model"
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+	"github.com/SimonRichardson/nu-juju-data/state/operationstate"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// newTestManager returns an operation manager over an in-memory database with
+// the schema applied, publishing to the returned bus.
+func newTestManager(t *testing.T) (*operationstate.OperationManager, *db.SQLDatabase, *events.Bus) {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	if err := schemastate.NewManager(backend, "", nopLogger{}).StartUp(context.Background()); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	bus := events.NewBus()
+	return operationstate.NewManager(backend, bus), backend, bus
+}
+
+// run runs the function in a transaction, failing the test on error.
+func run(t *testing.T, backend *db.SQLDatabase, fn func(*sqlx.Tx) error) {
+	t.Helper()
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return fn(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addOperation adds an operation, returning it.
+func addOperation(t *testing.T, m *operationstate.OperationManager, backend *db.SQLDatabase, summary string) model.Operation {
+	t.Helper()
+
+	var operation model.Operation
+	run(t, backend, func(tx *sqlx.Tx) error {
+		var err error
+		operation, err = m.AddOperation(tx, summary)
+		return err
+	})
+	return operation
+}
+
+func TestOperationByID(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		added, err := m.AddOperation(tx, "backup")
+		if err != nil {
+			return err
+		}
+		if added.Summary != "backup" || added.Status != model.ActionPending {
+			t.Errorf("got operation %+v, want a pending backup", added)
+		}
+
+		got, err := m.OperationByID(tx, added.ID)
+		if err != nil {
+			return err
+		}
+		if got.ID != added.ID || got.Summary != added.Summary {
+			t.Errorf("got operation %+v, want %+v", got, added)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOperationByIDNotFound(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := m.OperationByID(tx, 42)
+		return err
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+}
+
+func TestListOperations(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		for _, summary := range []string{"a", "b", "c"} {
+			if _, err := m.AddOperation(tx, summary); err != nil {
+				return err
+			}
+		}
+
+		operations, total, err := m.ListOperations(tx, operationstate.ListFilter{Limit: 2, Offset: 1})
+		if err != nil {
+			return err
+		}
+		if total != 3 {
+			t.Errorf("got total %d, want 3", total)
+		}
+		if len(operations) != 2 || operations[0].Summary != "b" || operations[1].Summary != "c" {
+			t.Errorf("got operations %+v, want b and c", operations)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateOperationStatus(t *testing.T) {
+	m, backend, bus := newTestManager(t)
+	sub := bus.Subscribe(10)
+	added := addOperation(t, m, backend, "backup")
+	if !added.Started.IsZero() || !added.Completed.IsZero() {
+		t.Fatalf("got new operation %+v, want it neither started nor completed", added)
+	}
+
+	var running model.Operation
+	run(t, backend, func(tx *sqlx.Tx) error {
+		var err error
+		running, err = m.UpdateOperationStatus(tx, added.ID, model.ActionRunning)
+		return err
+	})
+	if running.Status != model.ActionRunning || running.Started.IsZero() || !running.Completed.IsZero() {
+		t.Fatalf("got operation %+v, want it running and started", running)
+	}
+
+	var completed model.Operation
+	run(t, backend, func(tx *sqlx.Tx) error {
+		var err error
+		completed, err = m.UpdateOperationStatus(tx, added.ID, model.ActionCompleted)
+		return err
+	})
+	if completed.Status != model.ActionCompleted || !completed.Started.Equal(running.Started) || completed.Completed.IsZero() {
+		t.Fatalf("got operation %+v, want it completed", completed)
+	}
+
+	// The completion is published once the transaction has committed.
+	select {
+	case event := <-sub.Events():
+		if event != (events.OperationCompleted{ID: added.ID}) {
+			t.Fatalf("got event %#v, want the operation completed", event)
+		}
+	default:
+		t.Fatalf("got no event for the completed operation")
+	}
+}
+
+func TestUpdateOperationStatusNotFound(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := m.UpdateOperationStatus(tx, 42, model.ActionRunning)
+		return err
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+}
+
+func TestSetOperationResult(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+	added := addOperation(t, m, backend, "backup")
+
+	for _, fail := range []string{"disk exhausted", "timed out"} {
+		var got model.Operation
+		run(t, backend, func(tx *sqlx.Tx) error {
+			if err := m.SetOperationResult(tx, added.ID, fail); err != nil {
+				return err
+			}
+			var err error
+			got, err = m.OperationByID(tx, added.ID)
+			return err
+		})
+		if got.Fail != fail {
+			t.Fatalf("got fail %q, want the result replaced with %q", got.Fail, fail)
+		}
+	}
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return m.SetOperationResult(tx, 42, "disk exhausted")
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+}
+
+func TestSetExpectedActions(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+	added := addOperation(t, m, backend, "backup")
+
+	var got model.Operation
+	run(t, backend, func(tx *sqlx.Tx) error {
+		if err := m.SetExpectedActions(tx, added.ID, 3); err != nil {
+			return err
+		}
+		var err error
+		got, err = m.OperationByID(tx, added.ID)
+		return err
+	})
+	if got.ExpectedActions != 3 {
+		t.Fatalf("got %d expected actions, want 3", got.ExpectedActions)
+	}
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return m.SetExpectedActions(tx, 42, 3)
+	})
+	if !stateerrors.IsNotFound(err) {
+		t.Fatalf("got error %v, want not found", err)
+	}
+}
+
+func TestListOperationsByStatus(t *testing.T) {
+	m, backend, _ := newTestManager(t)
+	pending := addOperation(t, m, backend, "pending")
+	running := addOperation(t, m, backend, "running")
+	failed := addOperation(t, m, backend, "failed")
+	run(t, backend, func(tx *sqlx.Tx) error {
+		if _, err := m.UpdateOperationStatus(tx, running.ID, model.ActionRunning); err != nil {
+			return err
+		}
+		_, err := m.UpdateOperationStatus(tx, failed.ID, model.ActionFailed)
+		return err
+	})
+
+	tests := []struct {
+		name     string
+		statuses []model.ActionStatus
+		want     []int64
+	}{
+		{"all", nil, []int64{pending.ID, running.ID, failed.ID}},
+		{"pending", []model.ActionStatus{model.ActionPending}, []int64{pending.ID}},
+		{"running or failed", []model.ActionStatus{model.ActionRunning, model.ActionFailed}, []int64{running.ID, failed.ID}},
+		{"none", []model.ActionStatus{model.ActionCompleted}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				operations []model.Operation
+				total      int
+			)
+			run(t, backend, func(tx *sqlx.Tx) error {
+				var err error
+				operations, total, err = m.ListOperations(tx, operationstate.ListFilter{Statuses: test.statuses})
+				return err
+			})
+			var got []int64
+			for _, operation := range operations {
+				got = append(got, operation.ID)
+			}
+			if !reflect.DeepEqual(got, test.want) || total != len(test.want) {
+				t.Fatalf("got operations %v of %d, want %v", got, total, test.want)
+			}
+		})
+	}
+}
+
+// nopLogger discards all log messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{})   {}
+func (nopLogger) Infof(string, ...interface{})    {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+func (nopLogger) Errorf(string, ...interface{})   {}
+
+func TestRefreshOperationStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     model.ActionStatus
+	}{
+		{"no actions", nil, model.ActionPending},
+		{"all pending", []string{"pending", "pending"}, model.ActionPending},
+		{"some running", []string{"running", "pending"}, model.ActionRunning},
+		{"some finished", []string{"completed", "pending"}, model.ActionRunning},
+		{"all completed", []string{"completed", "completed"}, model.ActionCompleted},
+		{"one failed", []string{"completed", "failed"}, model.ActionFailed},
+		{"one errored", []string{"failed", "error"}, model.ActionError},
+		{"all cancelled", []string{"cancelled", "cancelled"}, model.ActionCancelled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, backend, _ := newTestManager(t)
+			added := addOperation(t, m, backend, "backup")
+
+			var got model.Operation
+			run(t, backend, func(tx *sqlx.Tx) error {
+				for i, status := range test.statuses {
+					_, err := tx.Exec(`
+					INSERT INTO actions (tag, receiver, name, operation, status)
+					VALUES ($1, 'unit-mysql-0', 'backup', $2, $3)
+					`, "action-"+strconv.Itoa(i), strconv.FormatInt(added.ID, 10), status)
+					if err != nil {
+						return err
+					}
+				}
+				var err error
+				got, err = m.RefreshOperationStatus(tx, added.ID)
+				return err
+			})
+			if got.Status != test.want {
+				t.Fatalf("got status %q, want %q", got.Status, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package rolestate
+
+import (
+	"sort"
+)
+
+// Role is the role of a node in the database cluster.
+type Role string
+
+const (
+	// Voter nodes replicate the data and take part in the quorum.
+	Voter Role = "voter"
+	// StandBy nodes replicate the data, but don't take part in the quorum.
+	StandBy Role = "stand-by"
+	// Spare nodes neither replicate the data nor take part in the quorum.
+	Spare Role = "spare"
+)
+
+// Node describes a node of the cluster, as seen by the leader.
+type Node struct {
+	ID      uint64
+	Address string
+	Role    Role
+	// Online is true if the node could be reached.
+	Online bool
+}
+
+// Change is a change of the role of a node.
+type Change struct {
+	// Node is the node, with the role it had before the change.
+	Node Node
+	// Role is the role the node is changed to.
+	Role Role
+}
+
+// Plan returns the changes of roles that keep the target number of voters
+// online. Whilst too few voters are online, online stand-bys are promoted to
+// voters. Offline voters are left alone, so that a node that is briefly
+// unreachable keeps its place in the quorum, and spares are never promoted,
+// so that nodes can be kept out of the quorum deliberately.
+func Plan(nodes []Node, voters int) []Change {
+	sorted := make([]Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	var (
+		online   int
+		standBys []Node
+	)
+	for _, node := range sorted {
+		switch {
+		case node.Role == Voter && node.Online:
+			online++
+		case node.Role == StandBy && node.Online:
+			standBys = append(standBys, node)
+		}
+	}
+
+	var changes []Change
+	for _, node := range standBys {
+		if online >= voters {
+			break
+		}
+		changes = append(changes, Change{Node: node, Role: Voter})
+		online++
+	}
+	return changes
+}
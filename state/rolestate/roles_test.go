@@ -0,0 +1,60 @@
+package rolestate_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/state/rolestate"
+)
+
+func TestPlan(t *testing.T) {
+	var (
+		voter          = func(id uint64) rolestate.Node { return rolestate.Node{ID: id, Role: rolestate.Voter, Online: true} }
+		offlineVoter   = func(id uint64) rolestate.Node { return rolestate.Node{ID: id, Role: rolestate.Voter} }
+		standBy        = func(id uint64) rolestate.Node { return rolestate.Node{ID: id, Role: rolestate.StandBy, Online: true} }
+		offlineStandBy = func(id uint64) rolestate.Node { return rolestate.Node{ID: id, Role: rolestate.StandBy} }
+		spare          = func(id uint64) rolestate.Node { return rolestate.Node{ID: id, Role: rolestate.Spare, Online: true} }
+		to             = func(node rolestate.Node, role rolestate.Role) rolestate.Change {
+			return rolestate.Change{Node: node, Role: role}
+		}
+	)
+
+	tests := []struct {
+		name  string
+		nodes []rolestate.Node
+		want  []rolestate.Change
+	}{{
+		name:  "enough voters",
+		nodes: []rolestate.Node{voter(1), voter(2), voter(3), standBy(4)},
+	}, {
+		name:  "promotes online stand-bys",
+		nodes: []rolestate.Node{voter(1), offlineVoter(2), offlineVoter(3), standBy(4), offlineStandBy(5), standBy(6)},
+		want: []rolestate.Change{
+			to(standBy(4), rolestate.Voter),
+			to(standBy(6), rolestate.Voter),
+		},
+	}, {
+		name:  "promotes in order of id",
+		nodes: []rolestate.Node{standBy(6), voter(1), standBy(5), voter(2), standBy(4)},
+		want:  []rolestate.Change{to(standBy(4), rolestate.Voter)},
+	}, {
+		name:  "keeps offline voters without enough stand-bys",
+		nodes: []rolestate.Node{voter(1), offlineVoter(2), offlineVoter(3), standBy(4)},
+		want:  []rolestate.Change{to(standBy(4), rolestate.Voter)},
+	}, {
+		name:  "never demotes offline voters",
+		nodes: []rolestate.Node{voter(1), voter(2), voter(3), offlineVoter(4)},
+	}, {
+		name:  "never promotes spares",
+		nodes: []rolestate.Node{voter(1), spare(2), spare(3)},
+	}, {
+		name: "no nodes",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rolestate.Plan(test.nodes, 3); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got changes %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package rolestate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// historySize is the number of recent changes of roles kept.
+const historySize = 10
+
+// Cluster reports and changes the roles of the nodes of the cluster.
+type Cluster interface {
+	// Nodes returns the nodes of the cluster, along with whether they could
+	// be reached.
+	Nodes(context.Context) ([]Node, error)
+
+	// Assign changes the role of the node.
+	Assign(ctx context.Context, id uint64, role Role) error
+}
+
+// Logger is the logging interface used by the manager.
+type Logger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warningf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
+// Status describes the roles managed by the manager.
+type Status struct {
+	// Voters is the target number of online voters.
+	Voters int
+	// Checked is the time the roles were last checked, zero if they haven't
+	// been checked by the local node.
+	Checked time.Time
+	// Changes holds the most recent changes of roles, oldest first.
+	Changes []AppliedChange
+}
+
+// AppliedChange records a change of role made by the manager.
+type AppliedChange struct {
+	Change
+	Time time.Time
+}
+
+// RoleManager promotes stand-bys to voters whilst too few voters are online.
+// The roles are checked on every pass of the ensure loop, which only runs
+// whilst the local node holds leadership.
+type RoleManager struct {
+	cluster Cluster
+	voters  int
+	clock   clock.Clock
+	logger  Logger
+
+	mutex   sync.Mutex
+	checked time.Time
+	history []AppliedChange
+}
+
+// Option configures a RoleManager.
+type Option func(*RoleManager)
+
+// WithLogger sets the logger used to report every change of role.
+func WithLogger(logger Logger) Option {
+	return func(m *RoleManager) {
+		m.logger = logger
+	}
+}
+
+// WithClock sets the clock used to record when the roles are checked and
+// changed.
+func WithClock(clock clock.Clock) Option {
+	return func(m *RoleManager) {
+		m.clock = clock
+	}
+}
+
+// NewManager creates a new manager keeping the number of online voters of
+// the cluster at the target.
+func NewManager(cluster Cluster, voters int, opts ...Option) *RoleManager {
+	m := &RoleManager{
+		cluster: cluster,
+		voters:  voters,
+		clock:   clock.WallClock,
+		logger:  noopLogger{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// StartUp is part of the StateManager interface.
+func (m *RoleManager) StartUp(ctx context.Context) error {
+	return nil
+}
+
+// Stop is part of the StateManager interface.
+func (m *RoleManager) Stop(ctx context.Context) {}
+
+// Ensure is part of the Ensurer interface. The roles are adjusted on every
+// pass of the ensure loop.
+func (m *RoleManager) Ensure(ctx context.Context) error {
+	return errors.Trace(m.Adjust(ctx))
+}
+
+// Adjust checks the roles of the nodes once, making the changes planned to
+// keep the target number of voters online. Every change is logged.
+func (m *RoleManager) Adjust(ctx context.Context) error {
+	nodes, err := m.cluster.Nodes(ctx)
+	if err != nil {
+		return errors.Annotate(err, "listing cluster nodes")
+	}
+
+	m.mutex.Lock()
+	m.checked = m.clock.Now()
+	m.mutex.Unlock()
+
+	changes := Plan(nodes, m.voters)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	online := countOnlineVoters(nodes)
+	for _, change := range changes {
+		if err := m.cluster.Assign(ctx, change.Node.ID, change.Role); err != nil {
+			return errors.Annotatef(err, "changing node %d (%s) from %s to %s", change.Node.ID, change.Node.Address, change.Node.Role, change.Role)
+		}
+		m.logger.Infof("changed node %d (%s) from %s to %s, with %d of %d voters online", change.Node.ID, change.Node.Address, change.Node.Role, change.Role, online, m.voters)
+		if change.Role == Voter {
+			online++
+		}
+		m.record(change)
+	}
+	return nil
+}
+
+func (m *RoleManager) record(change Change) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.history = append(m.history, AppliedChange{
+		Change: change,
+		Time:   m.clock.Now(),
+	})
+	if len(m.history) > historySize {
+		m.history = m.history[len(m.history)-historySize:]
+	}
+}
+
+// Status returns the target number of voters and the most recent changes of
+// roles made by the manager.
+func (m *RoleManager) Status() Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	changes := make([]AppliedChange, len(m.history))
+	copy(changes, m.history)
+	return Status{
+		Voters:  m.voters,
+		Checked: m.checked,
+		Changes: changes,
+	}
+}
+
+func countOnlineVoters(nodes []Node) int {
+	var online int
+	for _, node := range nodes {
+		if node.Role == Voter && node.Online {
+			online++
+		}
+	}
+	return online
+}
+
+// noopLogger discards all log messages.
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...interface{})   {}
+func (noopLogger) Infof(string, ...interface{})    {}
+func (noopLogger) Warningf(string, ...interface{}) {}
+func (noopLogger) Errorf(string, ...interface{})   {}
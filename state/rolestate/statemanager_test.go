@@ -0,0 +1,211 @@
+package rolestate_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/state/rolestate"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// fakeCluster is a cluster whose nodes take the roles assigned to them.
+type fakeCluster struct {
+	mutex     sync.Mutex
+	nodes     []rolestate.Node
+	nodesErr  error
+	assignErr map[uint64]error
+	calls     int
+	assigned  []rolestate.Change
+}
+
+func (c *fakeCluster) Nodes(context.Context) ([]rolestate.Node, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.calls++
+	if c.nodesErr != nil {
+		return nil, c.nodesErr
+	}
+	return append([]rolestate.Node(nil), c.nodes...), nil
+}
+
+func (c *fakeCluster) Assign(_ context.Context, id uint64, role rolestate.Role) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.assignErr[id]; err != nil {
+		return err
+	}
+	for i, node := range c.nodes {
+		if node.ID == id {
+			c.assigned = append(c.assigned, rolestate.Change{Node: node, Role: role})
+			c.nodes[i].Role = role
+			return nil
+		}
+	}
+	return errors.NotFoundf("node %d", id)
+}
+
+// setOnline changes whether the node can be reached.
+func (c *fakeCluster) setOnline(id uint64, online bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range c.nodes {
+		if c.nodes[i].ID == id {
+			c.nodes[i].Online = online
+		}
+	}
+}
+
+func (c *fakeCluster) nodesCalls() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.calls
+}
+
+// newCluster returns a cluster with three voters and two stand-bys, with the
+// first voter offline.
+func newCluster() *fakeCluster {
+	return &fakeCluster{
+		nodes: []rolestate.Node{
+			{ID: 1, Address: "10.0.0.1:9000", Role: rolestate.Voter},
+			{ID: 2, Address: "10.0.0.2:9000", Role: rolestate.Voter, Online: true},
+			{ID: 3, Address: "10.0.0.3:9000", Role: rolestate.Voter, Online: true},
+			{ID: 4, Address: "10.0.0.4:9000", Role: rolestate.StandBy, Online: true},
+			{ID: 5, Address: "10.0.0.5:9000", Role: rolestate.StandBy, Online: true},
+		},
+	}
+}
+
+func TestAdjustPromotes(t *testing.T) {
+	cluster := newCluster()
+	clock := testclock.NewClock(time.Now())
+	m := rolestate.NewManager(cluster, 3, rolestate.WithClock(clock))
+
+	if err := m.Adjust(context.Background()); err != nil {
+		t.Fatalf("adjusting: %v", err)
+	}
+
+	want := []rolestate.Change{
+		{Node: rolestate.Node{ID: 4, Address: "10.0.0.4:9000", Role: rolestate.StandBy, Online: true}, Role: rolestate.Voter},
+	}
+	if !reflect.DeepEqual(cluster.assigned, want) {
+		t.Fatalf("got changes %+v, want %+v", cluster.assigned, want)
+	}
+
+	status := m.Status()
+	if status.Voters != 3 || !status.Checked.Equal(clock.Now()) {
+		t.Errorf("got status %+v, want 3 voters checked now", status)
+	}
+	if len(status.Changes) != len(want) {
+		t.Fatalf("got recorded changes %+v, want %d", status.Changes, len(want))
+	}
+	for i, change := range status.Changes {
+		if !reflect.DeepEqual(change.Change, want[i]) || !change.Time.Equal(clock.Now()) {
+			t.Errorf("got recorded change %+v, want %+v now", change, want[i])
+		}
+	}
+
+	// Once the roles are settled there is nothing more to change.
+	if err := m.Adjust(context.Background()); err != nil {
+		t.Fatalf("adjusting again: %v", err)
+	}
+	if len(cluster.assigned) != len(want) {
+		t.Fatalf("got changes %+v, want none once settled", cluster.assigned[len(want):])
+	}
+}
+
+func TestAdjustFailures(t *testing.T) {
+	t.Run("listing nodes", func(t *testing.T) {
+		cluster := newCluster()
+		cluster.nodesErr = errors.New("boom")
+		m := rolestate.NewManager(cluster, 3)
+
+		if err := m.Adjust(context.Background()); err == nil {
+			t.Fatalf("expected adjusting to fail")
+		}
+		if status := m.Status(); !status.Checked.IsZero() {
+			t.Fatalf("got checked %v, want the roles not to have been checked", status.Checked)
+		}
+	})
+
+	t.Run("assigning", func(t *testing.T) {
+		cluster := newCluster()
+		cluster.setOnline(2, false)
+		cluster.assignErr = map[uint64]error{5: errors.New("boom")}
+		m := rolestate.NewManager(cluster, 3)
+
+		if err := m.Adjust(context.Background()); err == nil {
+			t.Fatalf("expected adjusting to fail")
+		}
+		// The promotion preceding the failed promotion is still recorded.
+		changes := m.Status().Changes
+		if len(changes) != 1 || changes[0].Node.ID != 4 {
+			t.Fatalf("got recorded changes %+v, want only the first promotion", changes)
+		}
+	})
+}
+
+func TestChangesAreCapped(t *testing.T) {
+	cluster := &fakeCluster{}
+	for id := uint64(1); id <= 12; id++ {
+		cluster.nodes = append(cluster.nodes, rolestate.Node{ID: id, Role: rolestate.StandBy, Online: true})
+	}
+	m := rolestate.NewManager(cluster, 13)
+
+	if err := m.Adjust(context.Background()); err != nil {
+		t.Fatalf("adjusting: %v", err)
+	}
+	changes := m.Status().Changes
+	if len(changes) != 10 {
+		t.Fatalf("got %d recorded changes, want the 10 most recent", len(changes))
+	}
+	if first, last := changes[0].Node.ID, changes[len(changes)-1].Node.ID; first != 3 || last != 12 {
+		t.Fatalf("got changes of nodes %d to %d, want 3 to 12", first, last)
+	}
+}
+
+func TestEnsureAdjustsRoles(t *testing.T) {
+	cluster := newCluster()
+	m := rolestate.NewManager(cluster, 3)
+	ctx := context.Background()
+
+	if err := m.StartUp(ctx); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if n := cluster.nodesCalls(); n != 0 {
+		t.Fatalf("got %d checks on starting, want none before the first ensure pass", n)
+	}
+
+	if err := m.Ensure(ctx); err != nil {
+		t.Fatalf("ensuring: %v", err)
+	}
+	if changes := m.Status().Changes; len(changes) != 1 || changes[0].Node.ID != 4 {
+		t.Fatalf("got recorded changes %+v, want the promotion of node 4", changes)
+	}
+
+	// The offline voter is kept, whilst another stand-by is promoted as
+	// soon as a second voter goes away.
+	cluster.setOnline(2, false)
+	if err := m.Ensure(ctx); err != nil {
+		t.Fatalf("ensuring again: %v", err)
+	}
+	if changes := m.Status().Changes; len(changes) != 2 || changes[1].Node.ID != 5 {
+		t.Fatalf("got recorded changes %+v, want the promotion of node 5", changes)
+	}
+	for _, change := range cluster.assigned {
+		if change.Role != rolestate.Voter {
+			t.Fatalf("got change %+v, want only promotions", change)
+		}
+	}
+
+	cluster.nodesErr = errors.New("boom")
+	if err := m.Ensure(ctx); err == nil {
+		t.Fatalf("expected ensuring to fail when the nodes can't be listed")
+	}
+}
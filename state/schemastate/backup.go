@@ -0,0 +1,117 @@
+package schemastate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// BackupFunc is called by Ensure before any pending updates are applied. It
+// must call write with the writer that the backup should be written to, and
+// return any error from it.
+type BackupFunc func(write func(io.Writer) error) error
+
+// Backup instructs the schema to dump the database before applying any
+// pending updates. If the backup fails, Ensure is aborted before any update
+// is applied. Any previously installed backup function will be replaced.
+func (s *Schema) Backup(backup BackupFunc) {
+	s.backup = backup
+}
+
+// ensureBackup dumps the database using the backup function, if there are any
+// pending updates to apply to an existing database.
+func (s *Schema) ensureBackup(ctx context.Context, backend Backend) error {
+	if s.backup == nil {
+		return nil
+	}
+
+	var pending bool
+	err := backend.RunContext(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		exists, err := doesSchemaTableExist(ctx, tx, s.table())
+		if err != nil || !exists {
+			pending = false
+			return errors.Trace(err)
+		}
+		current, err := queryCurrentVersion(ctx, tx, s.table(), s.patches)
+		pending = current < len(s.patches)
+		return errors.Trace(err)
+	})
+	if err != nil || !pending {
+		return errors.Trace(err)
+	}
+
+	// The database is part way through being upgraded, so dump the tables
+	// that currently exist, rather than the ones expected by the updates.
+	return errors.Trace(s.backup(func(w io.Writer) error {
+		return dumpTo(w, backend, s, DumpOptions{}, func(ctx context.Context, tx *sqlx.Tx) ([]string, error) {
+			return selectTablesSQL(ctx, tx, s.namespace)
+		})
+	}))
+}
+
+// BackupTo instructs the manager to write a timestamped backup file to the
+// directory before any pending patches are applied during StartUp. Only the
+// most recent keep backups are retained.
+func (m *SchemaManager) BackupTo(dir string, keep int) {
+	prefix := m.schema.table() + "-"
+	m.schema.Backup(func(write func(io.Writer) error) error {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return errors.Trace(err)
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%s%s.sql", prefix, time.Now().UTC().Format("20060102T150405.000000000Z")))
+		if err := writeBackup(path, write); err != nil {
+			_ = os.Remove(path)
+			return errors.Annotatef(err, "writing backup %q", path)
+		}
+		m.logger.Infof("schema backup written to %s", path)
+
+		if err := pruneBackups(dir, prefix, keep); err != nil {
+			m.logger.Warningf("unable to prune schema backups: %v", err)
+		}
+		return nil
+	})
+}
+
+func writeBackup(path string, write func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return errors.Trace(err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+// pruneBackups removes all but the most recent keep backups in the directory.
+// The timestamps within the names sort in the order they were written.
+func pruneBackups(dir, prefix string, keep int) error {
+	paths, err := filepath.Glob(filepath.Join(dir, prefix+"*.sql"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(paths) <= keep {
+		return nil
+	}
+
+	sort.Strings(paths)
+	for _, path := range paths[:len(paths)-keep] {
+		if err := os.Remove(path); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package schemastate_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/juju/errors"
+)
+
+// rewindLastPatch removes the record of the last patch of the default schema,
+// so that the next StartUp applies it again. Unless the column added by the
+// patch is dropped as well, applying it again fails.
+func rewindLastPatch(t *testing.T, backend *db.SQLDatabase, dropColumn bool) {
+	t.Helper()
+
+	statements := []string{"DELETE FROM schema WHERE version = (SELECT MAX(version) FROM schema)"}
+	if dropColumn {
+		statements = append(statements, "ALTER TABLE actions DROP COLUMN generation")
+	}
+	exec(t, backend, statements...)
+}
+
+// backups returns the backups in the directory, oldest first.
+func backups(t *testing.T, dir string) []string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+// hasColumn returns true if the table of the database has the column.
+func hasColumn(t *testing.T, backend *db.SQLDatabase, table, column string) bool {
+	t.Helper()
+
+	for _, row := range rows(t, backend, "SELECT name FROM pragma_table_info('"+table+"')") {
+		if name, _ := row[0].(string); name == column {
+			return true
+		}
+	}
+	return false
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBackupIsSkippedWithoutPendingPatches(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	var calls int
+	schema := namespaced("things", createTable("CREATE TABLE things_items (id INTEGER PRIMARY KEY)"))
+	schema.Backup(func(write func(io.Writer) error) error {
+		calls++
+		return write(ioutil.Discard)
+	})
+
+	// Neither a new database nor an up to date one needs a backup.
+	for i := 0; i < 2; i++ {
+		if _, err := schema.Ensure(context.Background(), backend); err != nil {
+			t.Fatalf("applying schema: %v", err)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("got %d backups, want none", calls)
+	}
+}
+
+func TestBackupIsWrittenBeforePatches(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	v1 := createTable("CREATE TABLE things_items (id INTEGER PRIMARY KEY, name TEXT)")
+	v2 := createTable("CREATE TABLE things_more (id INTEGER PRIMARY KEY)")
+	if _, err := namespaced("things", v1).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	exec(t, backend, "INSERT INTO things_items (name) VALUES ('kept')")
+
+	var backup bytes.Buffer
+	schema := namespaced("things", v1, v2)
+	schema.Backup(func(write func(io.Writer) error) error {
+		return write(&backup)
+	})
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("upgrading schema: %v", err)
+	}
+
+	out := backup.String()
+	if !strings.Contains(out, "things_items") || !strings.Contains(out, "'kept'") {
+		t.Errorf("backup is missing the existing table and rows:\n%s", out)
+	}
+	if strings.Contains(out, "things_more") {
+		t.Errorf("backup has the table of the pending patch:\n%s", out)
+	}
+}
+
+func TestBackupFailureAbortsUpgrade(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	v1 := createTable("CREATE TABLE things_items (id INTEGER PRIMARY KEY)")
+	v2 := createTable("CREATE TABLE things_more (id INTEGER PRIMARY KEY)")
+	if _, err := namespaced("things", v1).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+
+	schema := namespaced("things", v1, v2)
+	schema.Backup(func(func(io.Writer) error) error {
+		return errors.New("disk full")
+	})
+	if _, err := schema.Ensure(context.Background(), backend); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("got error %v, want the backup failure", err)
+	}
+	if hasTable(t, backend, "things_more") {
+		t.Fatalf("pending patch applied despite the failed backup")
+	}
+}
+
+func TestBackupToBeforeUpgrade(t *testing.T) {
+	backend := newTestDatabase(t)
+	newTestManager(t, backend, "")
+	exec(t, backend, "INSERT INTO actions (tag, receiver, name) VALUES ('action-1', 'unit-mysql-0', 'backup')")
+	rewindLastPatch(t, backend, true)
+
+	dir := t.TempDir()
+	m := schemastate.NewManager(backend, "", nopLogger{})
+	m.BackupTo(dir, 3)
+	if err := m.StartUp(context.Background()); err != nil {
+		t.Fatalf("upgrading schema: %v", err)
+	}
+	if !hasColumn(t, backend, "actions", "generation") {
+		t.Fatalf("pending patch wasn't applied")
+	}
+
+	paths := backups(t, dir)
+	if len(paths) != 1 {
+		t.Fatalf("got backups %v, want one", paths)
+	}
+	if base := filepath.Base(paths[0]); !strings.HasPrefix(base, "schema-") {
+		t.Errorf("got backup %q, want it named after the schema table", base)
+	}
+	out := readFile(t, paths[0])
+	if !strings.Contains(out, "'action-1'") {
+		t.Errorf("backup is missing the existing action:\n%s", out)
+	}
+	if strings.Contains(out, "generation") {
+		t.Errorf("backup was written after the pending patch:\n%s", out)
+	}
+
+	// An up to date schema isn't backed up again.
+	if err := m.StartUp(context.Background()); err != nil {
+		t.Fatalf("ensuring schema: %v", err)
+	}
+	if paths := backups(t, dir); len(paths) != 1 {
+		t.Fatalf("got backups %v, want one", paths)
+	}
+}
+
+func TestBackupToKeepsMostRecent(t *testing.T) {
+	backend := newTestDatabase(t)
+	newTestManager(t, backend, "")
+
+	const keep = 2
+	dir := t.TempDir()
+	m := schemastate.NewManager(backend, "", nopLogger{})
+	m.BackupTo(dir, keep)
+
+	var written []string
+	for i := 0; i < 4; i++ {
+		rewindLastPatch(t, backend, true)
+		if err := m.StartUp(context.Background()); err != nil {
+			t.Fatalf("upgrading schema: %v", err)
+		}
+		paths := backups(t, dir)
+		written = append(written, paths[len(paths)-1])
+	}
+
+	if got, want := backups(t, dir), written[len(written)-keep:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got backups %v, want the most recent %v", got, want)
+	}
+}
+
+func TestBackupToIsLoadableAfterFailedUpgrade(t *testing.T) {
+	backend := newTestDatabase(t)
+	newTestManager(t, backend, "")
+	exec(t, backend, "INSERT INTO actions (tag, receiver, name) VALUES ('action-1', 'unit-mysql-0', 'backup')")
+	// Leaving the column in place makes the pending patch fail.
+	rewindLastPatch(t, backend, false)
+
+	dir := t.TempDir()
+	m := schemastate.NewManager(backend, "", nopLogger{})
+	m.BackupTo(dir, 3)
+	if err := m.StartUp(context.Background()); err == nil {
+		t.Fatalf("expected the upgrade to fail")
+	}
+
+	paths := backups(t, dir)
+	if len(paths) != 1 {
+		t.Fatalf("got backups %v, want one", paths)
+	}
+	restored := restore(t, readFile(t, paths[0]))
+	got := rows(t, restored, "SELECT tag, receiver, name FROM actions")
+	want := [][]interface{}{{"action-1", "unit-mysql-0", "backup"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got restored actions %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+package schemastate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// SchemaDiff describes the differences between the schema of a live database
+// and the schema expected by applying all the patches.
+type SchemaDiff struct {
+	// OnlyLive holds the objects that are only in the live database.
+	OnlyLive []string
+
+	// OnlyExpected holds the objects that are only in the expected schema.
+	OnlyExpected []string
+
+	// Changed holds the objects that are in both, but are defined
+	// differently.
+	Changed []ObjectDiff
+}
+
+// ObjectDiff describes an object that is defined differently in the live
+// database and the expected schema.
+type ObjectDiff struct {
+	Name     string
+	Live     string
+	Expected string
+}
+
+// Empty returns true if there are no differences.
+func (d SchemaDiff) Empty() bool {
+	return len(d.OnlyLive) == 0 && len(d.OnlyExpected) == 0 && len(d.Changed) == 0
+}
+
+func (d SchemaDiff) String() string {
+	if d.Empty() {
+		return "no differences"
+	}
+
+	var b strings.Builder
+	for _, name := range d.OnlyLive {
+		fmt.Fprintf(&b, "only in live: %s\n", name)
+	}
+	for _, name := range d.OnlyExpected {
+		fmt.Fprintf(&b, "only in expected: %s\n", name)
+	}
+	for _, changed := range d.Changed {
+		fmt.Fprintf(&b, "changed: %s\n  live:     %s\n  expected: %s\n", changed.Name, changed.Live, changed.Expected)
+	}
+	return b.String()
+}
+
+// Diff compares the schema of the live database with the schema created by
+// applying all the patches of the expected schema to a scratch in-memory
+// database. The statements are compared with normalised whitespace.
+//
+// The full text search index is optional, as it's only created where the
+// sqlite library includes FTS5, so its objects are left out of the
+// comparison. Otherwise a live database with the index would always drift from
+// a scratch database without it, or the other way around.
+func Diff(backend Backend, expected *Schema) (SchemaDiff, error) {
+	live, err := schemaObjects(backend, expected.namespace)
+	if err != nil {
+		return SchemaDiff{}, errors.Annotatef(err, "reading live schema")
+	}
+
+	scratch, err := db.NewInMemorySQLDatabase()
+	if err != nil {
+		return SchemaDiff{}, errors.Annotatef(err, "creating scratch database")
+	}
+	defer scratch.Close()
+
+	// Only the patches are required, so don't fire any of the hooks of the
+	// expected schema.
+	schema := &Schema{
+		namespace: expected.namespace,
+		patches:   expected.patches,
+		hook:      omitHook,
+		postHook:  omitHook,
+		progress:  omitProgress,
+	}
+	if _, err := schema.Ensure(context.Background(), scratch); err != nil {
+		return SchemaDiff{}, errors.Annotatef(err, "applying expected schema")
+	}
+	wanted, err := schemaObjects(scratch, expected.namespace)
+	if err != nil {
+		return SchemaDiff{}, errors.Annotatef(err, "reading expected schema")
+	}
+
+	var diff SchemaDiff
+	for name, statement := range live {
+		other, ok := wanted[name]
+		if !ok {
+			diff.OnlyLive = append(diff.OnlyLive, name)
+			continue
+		}
+		if statement != other {
+			diff.Changed = append(diff.Changed, ObjectDiff{
+				Name:     name,
+				Live:     statement,
+				Expected: other,
+			})
+		}
+	}
+	for name := range wanted {
+		if _, ok := live[name]; !ok {
+			diff.OnlyExpected = append(diff.OnlyExpected, name)
+		}
+	}
+
+	sort.Strings(diff.OnlyLive)
+	sort.Strings(diff.OnlyExpected)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Name < diff.Changed[j].Name
+	})
+	return diff, nil
+}
+
+// schemaObjects returns the normalised statements for every object of the
+// namespace in the database, keyed by the object type and name.
+func schemaObjects(backend Backend, namespace string) (map[string]string, error) {
+	statements := make(map[string]string)
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		objects, err := selectObjects(ctx, tx, namespace, "table", "index", "view", "trigger")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, object := range objects {
+			if isFullTextObject(object.Name) {
+				continue
+			}
+			name := fmt.Sprintf("%s %s", object.Type, object.Name)
+			statements[name] = strings.Join(strings.Fields(object.SQL), " ")
+		}
+		return nil
+	})
+	return statements, errors.Trace(err)
+}
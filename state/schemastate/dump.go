@@ -1,8 +1,11 @@
 package schemastate
 
 import (
+	"bufio"
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"sort"
 	"strconv"
 	"strings"
@@ -12,81 +15,311 @@ import (
 	"github.com/juju/errors"
 )
 
+// DumpOptions controls which parts of the database are written by DumpTo.
+type DumpOptions struct {
+	// Tables restricts the dump to the named tables. If no tables are
+	// supplied, then every table is dumped.
+	Tables []string
+
+	// SkipData omits the table rows, producing a schema only dump.
+	SkipData bool
+
+	// SkipSchema omits the table definitions and the related indexes, views
+	// and triggers, producing a data only dump.
+	SkipSchema bool
+}
+
+func (o DumpOptions) includes(table string) bool {
+	if len(o.Tables) == 0 {
+		return true
+	}
+	for _, name := range o.Tables {
+		if name == table {
+			return true
+		}
+	}
+	return false
+}
+
 // Dump returns a SQL text dump of all rows across all tables.
 func Dump(backend Backend, schema *Schema) (string, error) {
-	var statements []string
+	var builder strings.Builder
+	if err := DumpTo(&builder, backend, schema, DumpOptions{}); err != nil {
+		return "", errors.Trace(err)
+	}
+	return builder.String(), nil
+}
+
+// DumpTo streams a SQL text dump to the writer. The statements are written
+// row by row and the output is flushed after every table, so the whole dump is
+// never held in memory.
+//
+// If an error is returned, the writer may contain a partial dump.
+func DumpTo(w io.Writer, backend Backend, schema *Schema, opts DumpOptions) error {
+	return dumpTo(w, backend, schema, opts, schema.applied)
+}
+
+// dumpTo streams a SQL text dump to the writer, using the statements function
+// to get the currently applied schema.
+func dumpTo(w io.Writer, backend Backend, schema *Schema, opts DumpOptions, statements func(context.Context, *sqlx.Tx) ([]string, error)) error {
+	if opts.SkipSchema && opts.SkipData {
+		return errors.NotValidf("dump skipping both schema and data")
+	}
+
+	out := &countingWriter{w: w}
+	d := &dumper{
+		out:       bufio.NewWriter(out),
+		opts:      opts,
+		namespace: schema.namespace,
+	}
 	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		// The transaction can be retried, but once something has been
+		// written we can't take it back.
+		if out.n > 0 {
+			return errors.Errorf("dump can not be retried once output has been written")
+		}
+		d.out.Reset(out)
+
+		if err := d.write("BEGIN TRANSACTION"); err != nil {
+			return errors.Trace(err)
+		}
+
 		// Firstly, parse the schema table, checking for the currently applied
 		// schema version.
-		stmts, err := parseTableStatements(tx, "schema", strings.Trim(schemaTable, "\n"))
-		if err != nil {
-			return errors.Annotatef(err, "failed to dump table schema")
+		if table := schema.table(); opts.includes(table) {
+			if err := d.table(tx, table, strings.Trim(fmt.Sprintf(schemaTable, table), "\n")); err != nil {
+				return errors.Annotatef(err, "failed to dump table %s", table)
+			}
 		}
-		statements = append(statements, stmts...)
 
 		// Secondly, get the currently applied schema.
-		schemas, err := schema.applied(ctx, tx)
+		schemas, err := statements(ctx, tx)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
 		// Thirdly, parse only the tables out of the applied schema, so that
-		// we can correctly inspect every table.
-		for _, table := range parseTables(schemas) {
-			stmts, err := parseTableStatements(tx, table.name, table.statements)
+		// we can correctly inspect every table. The contents of virtual
+		// tables are rebuilt once everything else has been restored.
+		tables := parseTables(schemas)
+		for _, table := range tables {
+			if !opts.includes(table.name) {
+				continue
+			}
+			if table.module != "" {
+				err = d.virtualTable(table.statements)
+			} else {
+				err = d.table(tx, table.name, table.statements)
+			}
 			if err != nil {
-				return errors.Annotatef(err, "failed to dump table %s", table)
+				return errors.Annotatef(err, "failed to dump table %s", table.name)
 			}
-			statements = append(statements, stmts...)
 		}
 
 		// Fourthly, it's advised to remove the sqlite_sequence if we want to
 		// replay the schema from the dump, so no sequence items are
 		// correctly started.
-		stmts, err = parseTableStatements(tx, "sqlite_sequence", "DELETE FROM sqlite_sequence")
-		if err != nil {
+		if err := d.sequences(tx); err != nil {
 			return errors.Annotatef(err, "failed to dump table sqlite_sequence")
 		}
-		statements = append(statements, stmts...)
 
-		return nil
+		// Fifthly, add the indexes, views and triggers once all the data has
+		// been inserted. This prevents triggers from firing and indexes from
+		// being updated whilst the dump is being replayed.
+		if err := d.objects(ctx, tx); err != nil {
+			return errors.Annotatef(err, "failed to dump objects")
+		}
+
+		// Finally, rebuild the full text search indexes from the restored
+		// rows, as their contents aren't dumped.
+		if err := d.rebuild(tables); err != nil {
+			return errors.Annotatef(err, "failed to dump virtual tables")
+		}
+
+		if err := d.write("COMMIT"); err != nil {
+			return errors.Trace(err)
+		}
+		return d.out.Flush()
 	})
+	return errors.Trace(err)
+}
+
+// countingWriter records the number of bytes written to the underlying
+// writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// dumper writes statements to the buffered output, according to the dump
+// options.
+type dumper struct {
+	out  *bufio.Writer
+	opts DumpOptions
+	// namespace is the namespace of the schema being dumped.
+	namespace string
+}
+
+func (d *dumper) write(statement string) error {
+	_, err := fmt.Fprintf(d.out, "%s;\n", statement)
+	return errors.Trace(err)
+}
+
+// table writes the schema and rows of a single table, flushing the output
+// once the table has been written.
+func (d *dumper) table(tx *sqlx.Tx, table, schema string) error {
+	if !d.opts.SkipSchema {
+		if err := d.write(schema); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !d.opts.SkipData {
+		query := fmt.Sprintf("SELECT * FROM %s ORDER BY rowid", quoteIdentifier(table))
+		if err := d.rows(tx, table, query); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(d.out.Flush())
+}
+
+// virtualTable writes the schema of a virtual table. The rows aren't written,
+// as they're either held in the shadow tables of the virtual table, which
+// aren't writable, or in another table altogether.
+func (d *dumper) virtualTable(schema string) error {
+	if d.opts.SkipSchema {
+		return nil
+	}
+	return errors.Trace(d.write(schema))
+}
+
+// rebuild writes the statements rebuilding the full text search indexes
+// included in the dump, from the restored rows.
+func (d *dumper) rebuild(tables []tableSchema) error {
+	if d.opts.SkipData {
+		return nil
+	}
+	for _, table := range tables {
+		if !d.opts.includes(table.name) || !rebuildModules[strings.ToLower(table.module)] {
+			continue
+		}
+		name := quoteIdentifier(table.name)
+		if err := d.write(fmt.Sprintf("INSERT INTO %s(%s) VALUES('rebuild')", name, name)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(d.out.Flush())
+}
+
+// rebuildModules are the virtual table modules that rebuild their index with
+// the 'rebuild' command.
+var rebuildModules = map[string]bool{
+	"fts4": true,
+	"fts5": true,
+}
+
+// sequences writes the rows of the sqlite_sequence table, restricted to the
+// tables included in the dump.
+func (d *dumper) sequences(tx *sqlx.Tx) error {
+	if d.opts.SkipData {
+		return nil
+	}
+
+	var where string
+	if len(d.opts.Tables) > 0 {
+		names := make([]string, len(d.opts.Tables))
+		for i, table := range d.opts.Tables {
+			names[i] = quoteString(table)
+		}
+		where = fmt.Sprintf(" WHERE name IN (%s)", strings.Join(names, ", "))
+	}
+
+	if err := d.write("DELETE FROM sqlite_sequence" + where); err != nil {
+		return errors.Trace(err)
+	}
+	query := fmt.Sprintf("SELECT * FROM sqlite_sequence%s ORDER BY rowid", where)
+	if err := d.rows(tx, "sqlite_sequence", query); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(d.out.Flush())
+}
+
+// objects writes the indexes, views and triggers that belong to the tables
+// included in the dump.
+func (d *dumper) objects(ctx context.Context, tx *sqlx.Tx) error {
+	if d.opts.SkipSchema {
+		return nil
+	}
+
+	objects, err := selectObjects(ctx, tx, d.namespace, "index", "view", "trigger")
 	if err != nil {
-		return "", errors.Trace(err)
+		return errors.Trace(err)
 	}
 
-	var sql string
-	sql += "BEGIN TRANSACTION;\n"
-	sql += strings.Join(statements, ";\n") + ";\n"
-	sql += "COMMIT;\n"
+	var indexes, views, triggers []string
+	for _, object := range objects {
+		if !d.opts.includes(object.Table) {
+			continue
+		}
+		statement := strings.Trim(object.SQL, " \n") + ";"
+		switch object.Type {
+		case "index":
+			indexes = append(indexes, statement)
+		case "view":
+			views = append(views, statement)
+		case "trigger":
+			triggers = append(triggers, statement)
+		}
+	}
 
-	return sql, nil
+	for _, group := range [][]string{indexes, views, triggers} {
+		for _, statement := range group {
+			if err := d.write(statement); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return errors.Trace(d.out.Flush())
 }
 
 type tableSchema struct {
 	name       string
 	statements string
+	// module is the module implementing a virtual table, or empty for an
+	// ordinary table.
+	module string
 }
 
 // parseTables return a sorted slice of table names to their schema
-// definition, taking a full schema generated with Schema.Applied().
+// definition, taking a full schema generated with Schema.Applied(). The
+// shadow tables holding the contents of virtual tables, which are named after
+// the virtual table, are left out as they're created by the virtual table.
 func parseTables(schemas []string) []tableSchema {
-	tables := make(map[string]string)
+	tables := make(map[string]tableSchema)
 	for _, statement := range schemas {
 		statement = strings.Trim(statement, " \n") + ";"
-		if !strings.HasPrefix(statement, "CREATE TABLE") {
+		table, module, ok := parseTableName(statement)
+		if !ok {
 			continue
 		}
-		table := strings.Split(statement, " ")[2]
-		tables[table] = statement
+		tables[table] = tableSchema{
+			name:       table,
+			statements: statement,
+			module:     module,
+		}
 	}
 
 	sorted := make([]tableSchema, 0, len(tables))
-	for table, statements := range tables {
-		sorted = append(sorted, tableSchema{
-			name:       table,
-			statements: statements,
-		})
+	for _, table := range tables {
+		if table.module == "" && isShadowTable(table.name, tables) {
+			continue
+		}
+		sorted = append(sorted, table)
 	}
 	sort.Slice(sorted, func(i int, j int) bool {
 		return sorted[i].name < sorted[j].name
@@ -94,22 +327,149 @@ func parseTables(schemas []string) []tableSchema {
 	return sorted
 }
 
-// parseTableStatements dumps a single table, returning the SQL statements
-// containing statements for its schema and data.
-func parseTableStatements(tx *sqlx.Tx, table, schema string) ([]string, error) {
-	statements := []string{schema}
+// isShadowTable returns true if the table is named after one of the virtual
+// tables.
+func isShadowTable(name string, tables map[string]tableSchema) bool {
+	for _, table := range tables {
+		if table.module != "" && strings.HasPrefix(name, table.name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTableName returns the name of the table created by a CREATE TABLE or
+// CREATE VIRTUAL TABLE statement, with any quoting removed from the
+// identifier, along with the module implementing a virtual table. The name is
+// not returned if the statement is not a CREATE TABLE statement.
+func parseTableName(statement string) (string, string, bool) {
+	rest, ok := consumeKeyword(statement, "CREATE")
+	if !ok {
+		return "", "", false
+	}
+	var virtual bool
+	if r, ok := consumeKeyword(rest, "TEMPORARY"); ok {
+		rest = r
+	} else if r, ok := consumeKeyword(rest, "TEMP"); ok {
+		rest = r
+	} else if r, ok := consumeKeyword(rest, "VIRTUAL"); ok {
+		rest, virtual = r, true
+	}
+	if rest, ok = consumeKeyword(rest, "TABLE"); !ok {
+		return "", "", false
+	}
+	if r, ok := consumeKeyword(rest, "IF"); ok {
+		if r, ok = consumeKeyword(r, "NOT"); ok {
+			if r, ok = consumeKeyword(r, "EXISTS"); ok {
+				rest = r
+			}
+		}
+	}
+
+	name, rest, ok := consumeIdentifier(rest)
+	if !ok {
+		return "", "", false
+	}
+	// The table name may be qualified with the schema name.
+	if rest = strings.TrimLeft(rest, whitespace); strings.HasPrefix(rest, ".") {
+		if name, rest, ok = consumeIdentifier(rest[1:]); !ok {
+			return "", "", false
+		}
+	}
+	if !virtual {
+		return name, "", true
+	}
+
+	rest, ok = consumeKeyword(rest, "USING")
+	if !ok {
+		return "", "", false
+	}
+	module, _, ok := consumeIdentifier(rest)
+	return name, module, ok
+}
+
+const whitespace = " \t\r\n"
+
+// consumeKeyword removes the case insensitive keyword from the start of the
+// input, returning the remaining input.
+func consumeKeyword(input, keyword string) (string, bool) {
+	input = strings.TrimLeft(input, whitespace)
+	if len(input) < len(keyword) || !strings.EqualFold(input[:len(keyword)], keyword) {
+		return input, false
+	}
+	rest := input[len(keyword):]
+	if rest != "" && isIdentifierChar(rest[0]) {
+		return input, false
+	}
+	return rest, true
+}
+
+// consumeIdentifier removes an identifier from the start of the input,
+// returning the unquoted identifier and the remaining input. Identifiers
+// can be quoted using double quotes, backticks, square brackets or single
+// quotes.
+func consumeIdentifier(input string) (string, string, bool) {
+	input = strings.TrimLeft(input, whitespace)
+	if input == "" {
+		return "", input, false
+	}
+
+	var closing byte
+	switch input[0] {
+	case '"', '`', '\'':
+		closing = input[0]
+	case '[':
+		closing = ']'
+	default:
+		i := 0
+		for i < len(input) && isIdentifierChar(input[i]) {
+			i++
+		}
+		if i == 0 {
+			return "", input, false
+		}
+		return input[:i], input[i:], true
+	}
+
+	var name strings.Builder
+	for i := 1; i < len(input); i++ {
+		if input[i] != closing {
+			name.WriteByte(input[i])
+			continue
+		}
+		// A doubled quote character is an escaped quote, square brackets
+		// have no such escaping.
+		if closing != ']' && i+1 < len(input) && input[i+1] == closing {
+			name.WriteByte(closing)
+			i++
+			continue
+		}
+		return name.String(), input[i+1:], true
+	}
+	return "", input, false
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
 
-	// Query all rows.
-	rows, err := tx.Query(fmt.Sprintf("SELECT * FROM %s ORDER BY rowid", table))
+// rows writes an INSERT statement for every row returned by the query.
+func (d *dumper) rows(tx *sqlx.Tx, table, query string) error {
+	rows, err := tx.Query(query)
 	if err != nil {
-		return nil, errors.Annotatef(err, "failed to fetch rows")
+		return errors.Annotatef(err, "failed to fetch rows")
 	}
 	defer rows.Close()
 
 	// Figure column names
 	columns, err := rows.Columns()
 	if err != nil {
-		return nil, errors.Annotatef(err, "failed to get columns")
+		return errors.Annotatef(err, "failed to get columns")
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
 	}
 
 	// Generate an INSERT statement for each row.
@@ -121,31 +481,62 @@ func parseTableStatements(tx *sqlx.Tx, table, schema string) ([]string, error) {
 		}
 		err := rows.Scan(row...)
 		if err != nil {
-			return nil, errors.Annotatef(err, "failed to scan row %d", i)
+			return errors.Annotatef(err, "failed to scan row %d", i)
 		}
 
 		values := make([]string, len(columns))
 		for j, v := range raw {
-			switch v := v.(type) {
-			case int64:
-				values[j] = strconv.FormatInt(v, 10)
-			case string:
-				values[j] = fmt.Sprintf("'%s'", v)
-			case []byte:
-				values[j] = fmt.Sprintf("'%s'", string(v))
-			case time.Time:
-				values[j] = strconv.FormatInt(v.Unix(), 10)
-			case nil:
-				values[j] = "NULL"
-			default:
-				return nil, errors.Errorf("unexpected column type %q for row %d", columns[j], i)
+			if values[j], err = formatValue(v); err != nil {
+				return errors.Annotatef(err, "column %q for row %d", columns[j], i)
 			}
 		}
-		statement := fmt.Sprintf("INSERT INTO %s VALUES(%s)", table, strings.Join(values, ","))
-		statements = append(statements, statement)
+		statement := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", quoteIdentifier(table), strings.Join(quoted, ","), strings.Join(values, ","))
+		if err := d.write(statement); err != nil {
+			return errors.Trace(err)
+		}
 	}
-	if err := rows.Err(); err != nil {
-		return nil, errors.Trace(err)
+	return errors.Trace(rows.Err())
+}
+
+// timestampFormat matches the format of timestamps written using the
+// nowTimestamp SQL expression, but keeps the full precision of the time so
+// that restored timestamps compare and order exactly as the dumped ones.
+const timestampFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// formatValue returns the SQL literal for a scanned column value.
+func formatValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case string:
+		return quoteString(v), nil
+	case []byte:
+		return fmt.Sprintf("X'%s'", hex.EncodeToString(v)), nil
+	case time.Time:
+		// Render times as ISO-8601 UTC timestamps, which is how they're
+		// stored by the schema and understood by the drivers.
+		return quoteString(v.UTC().Format(timestampFormat)), nil
+	case nil:
+		return "NULL", nil
+	default:
+		return "", errors.Errorf("unexpected column type %T", v)
 	}
-	return statements, nil
+}
+
+// quoteIdentifier quotes a table or column name, so that it can be safely used
+// within a statement.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteString quotes a string value, escaping any embedded single quotes.
+func quoteString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
 }
@@ -0,0 +1,445 @@
+package schemastate_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDatabase returns an in-memory database, which is closed when the
+// test finishes.
+func newTestDatabase(t *testing.T) *db.SQLDatabase {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	return backend
+}
+
+// newTestManager returns a schema manager for the namespace, with the schema
+// applied to the database.
+func newTestManager(t *testing.T, backend *db.SQLDatabase, namespace string) *schemastate.SchemaManager {
+	t.Helper()
+
+	m := schemastate.NewManager(backend, namespace, nopLogger{})
+	if err := m.StartUp(context.Background()); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	return m
+}
+
+// exec runs the statements in a transaction, failing the test on error.
+func exec(t *testing.T, backend *db.SQLDatabase, statements ...string) {
+	t.Helper()
+
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return errors.Annotatef(err, "running %q", statement)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dump returns the dump of the database, failing the test on error.
+func dump(t *testing.T, backend *db.SQLDatabase, m *schemastate.SchemaManager) string {
+	t.Helper()
+
+	out, err := schemastate.Dump(backend, m.Schema())
+	if err != nil {
+		t.Fatalf("dumping database: %v", err)
+	}
+	return out
+}
+
+// restore restores the dump into a new database, returning it.
+func restore(t *testing.T, dump string) *db.SQLDatabase {
+	t.Helper()
+
+	backend := newTestDatabase(t)
+	if err := schemastate.Restore(strings.NewReader(dump), backend); err != nil {
+		t.Fatalf("restoring dump: %v", err)
+	}
+	return backend
+}
+
+// hasTable returns true if the database has the table.
+func hasTable(t *testing.T, backend *db.SQLDatabase, table string) bool {
+	t.Helper()
+
+	var count int
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1", table)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+// rows returns every row of the query, as scanned by the driver.
+func rows(t *testing.T, backend *db.SQLDatabase, query string) [][]interface{} {
+	t.Helper()
+
+	var results [][]interface{}
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		results = nil
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			row := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range row {
+				dest[i] = &row[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			results = append(results, row)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatalf("querying %q: %v", query, err)
+	}
+	return results
+}
+
+func TestDumpRoundTripsHostileData(t *testing.T) {
+	backend := newTestDatabase(t)
+	m := newTestManager(t, backend, "")
+	exec(t, backend,
+		`INSERT INTO actions (tag, receiver, name, parameters_json, message, enqueued) VALUES
+			('action-1', 'unit-mysql-0', 'it''s', '{"quote":"\"''"}', 'line one
+line two; DROP TABLE actions; --', '2021-01-02 03:04:05.123456789+00:00'),
+			('action-2', 'unit-mysql-0', 'ünïcødé', NULL, '', '2021-01-02 03:04:05.123456788+00:00'),
+			('action-3', 'unit-mysql-0', '"double"', '{}', NULL, '2021-01-02 03:04:05.123456789+00:00')`,
+		`INSERT INTO actions_results (action_id, result_json) VALUES (1, X'00ff27223b0a')`,
+		`INSERT INTO actions_logs (action_id, output, timestamp) VALUES (2, 'it''s ''quoted''', '2021-01-02 03:04:06+00:00')`,
+	)
+
+	out := dump(t, backend, m)
+	restored := restore(t, out)
+
+	queries := []string{
+		"SELECT id, tag, receiver, name, parameters_json, message, CAST(enqueued AS TEXT) FROM actions ORDER BY id",
+		"SELECT action_id, result_json FROM actions_results ORDER BY action_id",
+		"SELECT id, action_id, output, CAST(timestamp AS TEXT) FROM actions_logs ORDER BY id",
+		// Timestamps a nanosecond apart still order and compare the same once
+		// restored.
+		"SELECT tag FROM actions ORDER BY enqueued, id",
+		"SELECT a.tag, b.tag FROM actions a JOIN actions b ON a.enqueued = b.enqueued AND a.id < b.id",
+	}
+	for _, query := range queries {
+		if got, want := rows(t, restored, query), rows(t, backend, query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", query, got, want)
+		}
+	}
+
+	if again := dump(t, restored, m); again != out {
+		t.Fatalf("dump of the restored database differs:\n%s\nwant:\n%s", again, out)
+	}
+}
+
+func TestDumpRestoresFullTextSearch(t *testing.T) {
+	backend := newTestDatabase(t)
+	m := newTestManager(t, backend, "")
+	if !hasTable(t, backend, schemastate.ActionsFullTextTable) {
+		t.Skip("sqlite built without FTS5")
+	}
+	exec(t, backend,
+		"INSERT INTO actions (tag, receiver, name, message) VALUES ('action-1', 'unit-mysql-0', 'backup', 'disk exhausted')",
+	)
+
+	out := dump(t, backend, m)
+	if strings.Contains(out, schemastate.ActionsFullTextTable+"_data") {
+		t.Fatalf("dump contains the shadow tables of the search index:\n%s", out)
+	}
+	restored := restore(t, out)
+
+	// The index is rebuilt from the restored actions.
+	var ids []int64
+	err := restored.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &ids, "SELECT rowid FROM actions_fts WHERE actions_fts MATCH 'exhausted'")
+	})
+	if err != nil {
+		t.Fatalf("searching restored database: %v", err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("got %v from the restored search index, want one action", ids)
+	}
+
+	// The triggers keeping the index in sync work against the restored
+	// index.
+	exec(t, restored,
+		"INSERT INTO actions (tag, receiver, name) VALUES ('action-2', 'unit-mysql-0', 'restore')",
+		"UPDATE actions SET message = 'done' WHERE tag = 'action-1'",
+		"DELETE FROM actions WHERE tag = 'action-2'",
+	)
+
+	if again := dump(t, restored, m); again != dump(t, restore(t, again), m) {
+		t.Fatalf("dump of a restored database doesn't round trip:\n%s", again)
+	}
+}
+
+func TestEnsureActionsFullTextIsIdempotent(t *testing.T) {
+	backend := newTestDatabase(t)
+	newTestManager(t, backend, "")
+	before := hasTable(t, backend, schemastate.ActionsFullTextTable)
+
+	var after bool
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		after, err = schemastate.EnsureActionsFullText(ctx, tx)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ensuring search index: %v", err)
+	}
+	if before != after {
+		t.Fatalf("got search index %v, want %v", after, before)
+	}
+}
+
+// dumpedThings returns a database with the things schema applied and a few
+// rows inserted into its tables.
+func dumpedThings(t *testing.T) (*db.SQLDatabase, *schemastate.Schema) {
+	t.Helper()
+
+	backend := newTestDatabase(t)
+	schema := namespaced("things",
+		createTable("CREATE TABLE things_items (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT)"),
+		createTable("CREATE TABLE things_tags (item_id INTEGER, tag TEXT)"),
+		createTable("CREATE INDEX idx_things_tags ON things_tags (tag)"),
+	)
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	exec(t, backend,
+		"INSERT INTO things_items (name) VALUES ('a'), ('b')",
+		"INSERT INTO things_tags (item_id, tag) VALUES (1, 'x')",
+	)
+	return backend, schema
+}
+
+func TestDumpToOptions(t *testing.T) {
+	backend, schema := dumpedThings(t)
+
+	tests := []struct {
+		name string
+		opts schemastate.DumpOptions
+		want string
+	}{{
+		name: "tables",
+		opts: schemastate.DumpOptions{Tables: []string{"things_items"}},
+		want: `BEGIN TRANSACTION;
+CREATE TABLE things_items (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT);;
+INSERT INTO "things_items"("id","name") VALUES(1,'a');
+INSERT INTO "things_items"("id","name") VALUES(2,'b');
+DELETE FROM sqlite_sequence WHERE name IN ('things_items');
+INSERT INTO "sqlite_sequence"("name","seq") VALUES('things_items',2);
+COMMIT;
+`,
+	}, {
+		name: "skip data",
+		opts: schemastate.DumpOptions{Tables: []string{"things_items", "things_tags"}, SkipData: true},
+		want: `BEGIN TRANSACTION;
+CREATE TABLE things_items (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT);;
+CREATE TABLE things_tags (item_id INTEGER, tag TEXT);;
+CREATE INDEX idx_things_tags ON things_tags (tag);;
+COMMIT;
+`,
+	}, {
+		name: "skip schema",
+		opts: schemastate.DumpOptions{Tables: []string{"things_tags"}, SkipSchema: true},
+		want: `BEGIN TRANSACTION;
+INSERT INTO "things_tags"("item_id","tag") VALUES(1,'x');
+DELETE FROM sqlite_sequence WHERE name IN ('things_tags');
+COMMIT;
+`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := schemastate.DumpTo(&out, backend, schema, test.opts); err != nil {
+				t.Fatalf("dumping database: %v", err)
+			}
+			if got := out.String(); got != test.want {
+				t.Fatalf("got dump:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDumpMatchesDumpTo(t *testing.T) {
+	backend, schema := dumpedThings(t)
+
+	var out strings.Builder
+	if err := schemastate.DumpTo(&out, backend, schema, schemastate.DumpOptions{}); err != nil {
+		t.Fatalf("dumping database: %v", err)
+	}
+	dumped, err := schemastate.Dump(backend, schema)
+	if err != nil {
+		t.Fatalf("dumping database: %v", err)
+	}
+	if dumped != out.String() {
+		t.Fatalf("got dump:\n%s\nwant:\n%s", dumped, out.String())
+	}
+	// Every table is included, along with the schema table.
+	for _, want := range []string{"CREATE TABLE schema_things", `INSERT INTO "things_items"`, `INSERT INTO "things_tags"`} {
+		if !strings.Contains(dumped, want) {
+			t.Fatalf("got dump without %q:\n%s", want, dumped)
+		}
+	}
+}
+
+func TestDumpToSkippingEverything(t *testing.T) {
+	backend, schema := dumpedThings(t)
+
+	var out strings.Builder
+	err := schemastate.DumpTo(&out, backend, schema, schemastate.DumpOptions{SkipData: true, SkipSchema: true})
+	if !errors.IsNotValid(err) {
+		t.Fatalf("got error %v, want not valid", err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("got output %q, want nothing written", out.String())
+	}
+}
+
+func TestParseTableName(t *testing.T) {
+	tests := []struct {
+		statement string
+		name      string
+		module    string
+		ok        bool
+	}{
+		{statement: "CREATE TABLE actions (id INTEGER)", name: "actions", ok: true},
+		{statement: "CREATE TABLE IF NOT EXISTS actions (id INTEGER)", name: "actions", ok: true},
+		{statement: "create table if not exists Actions(id INTEGER)", name: "Actions", ok: true},
+		{statement: "CREATE TEMP TABLE scratch (id INTEGER)", name: "scratch", ok: true},
+		{statement: `CREATE TABLE "my table" (id INTEGER)`, name: "my table", ok: true},
+		{statement: `CREATE TABLE "say ""hi""" (id INTEGER)`, name: `say "hi"`, ok: true},
+		{statement: "CREATE TABLE `my table` (id INTEGER)", name: "my table", ok: true},
+		{statement: "CREATE TABLE [my table] (id INTEGER)", name: "my table", ok: true},
+		{statement: "CREATE TABLE main.actions (id INTEGER)", name: "actions", ok: true},
+		{statement: `CREATE TABLE "main"."my table" (id INTEGER)`, name: "my table", ok: true},
+		{statement: "CREATE\n\tTABLE\n\tIF NOT EXISTS\n\tactions (id INTEGER)", name: "actions", ok: true},
+		{statement: "CREATE VIRTUAL TABLE actions_fts USING fts5(name)", name: "actions_fts", module: "fts5", ok: true},
+		{statement: "CREATE TABLE IF_NOT_EXISTS (id INTEGER)", name: "IF_NOT_EXISTS", ok: true},
+		{statement: "CREATE TABLES actions (id INTEGER)"},
+		{statement: "CREATE INDEX idx_actions ON actions (id)"},
+		{statement: `CREATE TABLE "unterminated (id INTEGER)`},
+	}
+	for _, test := range tests {
+		name, module, ok := schemastate.ParseTableName(test.statement)
+		if name != test.name || module != test.module || ok != test.ok {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q, %v", test.statement, name, module, ok, test.name, test.module, test.ok)
+		}
+	}
+}
+
+func TestConsumeIdentifier(t *testing.T) {
+	tests := []struct {
+		input string
+		name  string
+		rest  string
+		ok    bool
+	}{
+		{input: "actions (id)", name: "actions", rest: " (id)", ok: true},
+		{input: "  MixedCase(id)", name: "MixedCase", rest: "(id)", ok: true},
+		{input: `"quoted name" (id)`, name: "quoted name", rest: " (id)", ok: true},
+		{input: "`back tick`.rest", name: "back tick", rest: ".rest", ok: true},
+		{input: "[brackets]]", name: "brackets", rest: "]", ok: true},
+		{input: "'single''quote'", name: "single'quote", rest: "", ok: true},
+		{input: "(id)", rest: "(id)"},
+		{input: "", rest: ""},
+	}
+	for _, test := range tests {
+		name, rest, ok := schemastate.ConsumeIdentifier(test.input)
+		if name != test.name || rest != test.rest || ok != test.ok {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q, %v", test.input, name, rest, ok, test.name, test.rest, test.ok)
+		}
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	schemas := []string{
+		"CREATE TABLE IF NOT EXISTS zebras (id INTEGER)",
+		`CREATE TABLE "Actions" (id INTEGER)`,
+		"CREATE INDEX idx_zebras ON zebras (id)",
+		"CREATE VIRTUAL TABLE actions_fts USING fts5(name)",
+		// The shadow tables of the virtual table are left out.
+		"CREATE TABLE 'actions_fts_data'(id INTEGER PRIMARY KEY, block BLOB)",
+		"CREATE TABLE [my table] (id INTEGER)",
+	}
+	want := []string{"Actions", "actions_fts", "my table", "zebras"}
+	if got := schemastate.TableNames(schemas); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got tables %q, want %q", got, want)
+	}
+}
+
+// nopLogger discards all log messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{})   {}
+func (nopLogger) Infof(string, ...interface{})    {}
+func (nopLogger) Warningf(string, ...interface{}) {}
+func (nopLogger) Errorf(string, ...interface{})   {}
+
+func TestDumpEscapesValues(t *testing.T) {
+	backend := newTestDatabase(t)
+	schema := schemastate.New([]schemastate.Patch{
+		createTable(`CREATE TABLE things_items (id INTEGER PRIMARY KEY, "na""me" TEXT, weight REAL, data BLOB)`),
+		createTable("CREATE INDEX idx_things_items ON things_items (weight)"),
+		createTable("CREATE VIEW things_heavy AS SELECT id FROM things_items WHERE weight > 1"),
+		createTable("CREATE TRIGGER things_items_delete AFTER DELETE ON things_items BEGIN SELECT 1; END"),
+	})
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	exec(t, backend, `INSERT INTO things_items VALUES (1, 'it''s; DROP TABLE things_items', 1.5, X'00ff27')`)
+
+	dumped, err := schemastate.Dump(backend, schema)
+	if err != nil {
+		t.Fatalf("dumping database: %v", err)
+	}
+	want := `INSERT INTO "things_items"("id","na""me","weight","data") VALUES(1,'it''s; DROP TABLE things_items',1.5,X'00ff27');`
+	if !strings.Contains(dumped, want) {
+		t.Fatalf("got dump without %q:\n%s", want, dumped)
+	}
+
+	// The index, view and trigger follow the data, in that order.
+	last := strings.Index(dumped, want)
+	for _, object := range []string{"CREATE INDEX idx_things_items", "CREATE VIEW things_heavy", "CREATE TRIGGER things_items_delete"} {
+		i := strings.Index(dumped, object)
+		if i < last {
+			t.Fatalf("got %q out of order in dump:\n%s", object, dumped)
+		}
+		last = i
+	}
+}
@@ -0,0 +1,21 @@
+package schemastate
+
+// Patches are the patches of the default schema, so that the tests can create
+// a database as it was before a patch.
+var Patches = patches
+
+// ParseTableName exposes the parsing of CREATE TABLE statements.
+var ParseTableName = parseTableName
+
+// ConsumeIdentifier exposes the parsing of identifiers.
+var ConsumeIdentifier = consumeIdentifier
+
+// TableNames returns the names of the tables parsed from the schema, in the
+// order they're dumped.
+func TableNames(schemas []string) []string {
+	var names []string
+	for _, table := range parseTables(schemas) {
+		names = append(names, table.name)
+	}
+	return names
+}
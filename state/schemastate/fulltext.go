@@ -0,0 +1,78 @@
+package schemastate
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// ActionsFullTextTable is the FTS5 table indexing the actions for searching.
+const ActionsFullTextTable = "actions_fts"
+
+// isFullTextObject returns true if the object is part of the optional full
+// text search index: the virtual table, its shadow tables or the triggers
+// keeping it in sync.
+func isFullTextObject(name string) bool {
+	return name == ActionsFullTextTable || strings.HasPrefix(name, ActionsFullTextTable+"_")
+}
+
+// EnsureActionsFullText creates the full text search index of the actions,
+// along with the triggers keeping it in sync, if it doesn't exist yet and the
+// sqlite library includes FTS5. It returns true if the index exists.
+//
+// Not every build of sqlite includes FTS5, so the index is optional. It's
+// created by a schema patch where possible, but the patch is a no-op without
+// FTS5. The index is therefore also ensured at start up, so that it's created
+// once the database is used by a build that includes FTS5.
+func EnsureActionsFullText(ctx context.Context, tx *sqlx.Tx) (bool, error) {
+	var count int
+	err := tx.GetContext(ctx, &count, "SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = $1", ActionsFullTextTable)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	var available bool
+	if err := tx.GetContext(ctx, &available, "SELECT sqlite_compileoption_used('ENABLE_FTS5')"); err != nil {
+		return false, errors.Annotate(err, "checking for FTS5")
+	}
+	if !available {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+CREATE VIRTUAL TABLE actions_fts USING fts5(
+	name,
+	message,
+	parameters_json,
+	content='actions',
+	content_rowid='id'
+);
+-- Keep the search index in sync with the actions.
+CREATE TRIGGER IF NOT EXISTS actions_fts_insert AFTER INSERT ON actions BEGIN
+	INSERT INTO actions_fts (rowid, name, message, parameters_json)
+	VALUES (new.id, new.name, new.message, new.parameters_json);
+END;
+CREATE TRIGGER IF NOT EXISTS actions_fts_delete AFTER DELETE ON actions BEGIN
+	INSERT INTO actions_fts (actions_fts, rowid, name, message, parameters_json)
+	VALUES ('delete', old.id, old.name, old.message, old.parameters_json);
+END;
+CREATE TRIGGER IF NOT EXISTS actions_fts_update AFTER UPDATE ON actions BEGIN
+	INSERT INTO actions_fts (actions_fts, rowid, name, message, parameters_json)
+	VALUES ('delete', old.id, old.name, old.message, old.parameters_json);
+	INSERT INTO actions_fts (rowid, name, message, parameters_json)
+	VALUES (new.id, new.name, new.message, new.parameters_json);
+END;
+-- Index the existing actions.
+INSERT INTO actions_fts (actions_fts) VALUES ('rebuild');
+		`,
+	)
+	if err != nil {
+		return false, errors.Annotate(err, "creating the actions search index")
+	}
+	return true, nil
+}
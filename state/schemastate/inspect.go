@@ -0,0 +1,75 @@
+package schemastate
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// Tables returns the names of the user tables in the database, ordered by
+// name. The tables recording the schema are excluded.
+func Tables(backend Backend) ([]string, error) {
+	var tables []string
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		objects, err := selectObjects(ctx, tx, allNamespaces, "table")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		tables = make([]string, len(objects))
+		for i, object := range objects {
+			tables[i] = object.Name
+		}
+		return nil
+	})
+	return tables, errors.Trace(err)
+}
+
+// TablesSQL returns the statements that create the tables in the database,
+// along with their indexes, views and triggers. If any tables are supplied,
+// then only the statements for those tables are returned.
+func TablesSQL(backend Backend, tables ...string) ([]string, error) {
+	var statements []string
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		if len(tables) == 0 {
+			var err error
+			statements, err = selectTablesSQL(ctx, tx, allNamespaces)
+			return errors.Trace(err)
+		}
+
+		objects, err := selectObjects(ctx, tx, allNamespaces, "table", "index", "view", "trigger")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		opts := DumpOptions{Tables: tables}
+		for _, object := range objects {
+			if opts.includes(object.Table) {
+				statements = append(statements, object.SQL)
+			}
+		}
+		return nil
+	})
+	return statements, errors.Trace(err)
+}
+
+// CurrentVersion returns the highest version recorded in the schema table of
+// the database. Zero means that no patches have been applied yet.
+func CurrentVersion(backend Backend) (int, error) {
+	var current int
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		table := Empty().table()
+		exists, err := doesSchemaTableExist(ctx, tx, table)
+		if err != nil || !exists {
+			return errors.Trace(err)
+		}
+		versions, err := selectSchemaVersions(ctx, tx, table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(versions) > 0 {
+			current = versions[len(versions)-1]
+		}
+		return nil
+	})
+	return current, errors.Trace(err)
+}
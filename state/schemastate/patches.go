@@ -2,6 +2,7 @@ package schemastate
 
 import (
 	"context"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/juju/errors"
@@ -10,10 +11,18 @@ import (
 var patches = []Patch{
 	patchV0,
 	patchV1,
+	patchV2,
+	patchV3,
+	patchV4,
+	patchV5,
+	patchV6,
+	patchV7,
+	patchV8,
+	patchV9,
 }
 
 func patchV0(ctx context.Context, tx *sqlx.Tx) error {
-	_, err := tx.ExecContext(context.TODO(), `
+	_, err := tx.ExecContext(ctx, `
 CREATE TABLE IF NOT EXISTS actions (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	tag TEXT,
@@ -48,7 +57,7 @@ CREATE TABLE IF NOT EXISTS actions_results (
 }
 
 func patchV1(ctx context.Context, tx *sqlx.Tx) error {
-	_, err := tx.ExecContext(context.TODO(), `
+	_, err := tx.ExecContext(ctx, `
 CREATE TABLE IF NOT EXISTS operations (
 	id INTEGER PRIMARY KEY AUTOINCREMENT, 
 	summary TEXT,
@@ -66,3 +75,91 @@ CREATE TABLE IF NOT EXISTS operations_results (
 	)
 	return errors.Trace(err)
 }
+
+func patchV2(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+-- The number of actions enqueued under the operation.
+ALTER TABLE operations ADD COLUMN expected_actions INTEGER NOT NULL DEFAULT 0;
+		`,
+	)
+	return errors.Trace(err)
+}
+
+func patchV3(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+CREATE INDEX IF NOT EXISTS idx_actions_receiver ON actions (receiver);
+CREATE INDEX IF NOT EXISTS idx_actions_operation ON actions (operation);
+CREATE INDEX IF NOT EXISTS idx_actions_status ON actions (status);
+		`,
+	)
+	return errors.Trace(err)
+}
+
+func patchV4(ctx context.Context, tx *sqlx.Tx) error {
+	// Check for duplicate tags first, so that the patch fails with a clear
+	// message rather than a raw constraint error.
+	var duplicates []string
+	if err := tx.SelectContext(ctx, &duplicates, `
+SELECT tag FROM actions GROUP BY tag HAVING COUNT(*) > 1 ORDER BY tag
+		`); err != nil {
+		return errors.Trace(err)
+	}
+	if len(duplicates) > 0 {
+		return errors.Errorf("actions share the same tags: %s; remove the duplicate actions before upgrading", strings.Join(duplicates, ", "))
+	}
+
+	_, err := tx.ExecContext(ctx, `
+CREATE UNIQUE INDEX IF NOT EXISTS idx_actions_tag ON actions (tag);
+		`,
+	)
+	return errors.Trace(err)
+}
+
+func patchV5(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+-- The idempotency key is supplied by clients, so that retrying the same
+-- request doesn't enqueue the action twice. Actions without a key are NULL,
+-- which the unique index allows any number of.
+ALTER TABLE actions ADD COLUMN idempotency_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_actions_idempotency_key ON actions (idempotency_key);
+		`,
+	)
+	return errors.Trace(err)
+}
+
+func patchV6(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+-- Who asked for the action and from where, for auditing.
+ALTER TABLE actions ADD COLUMN requested_by TEXT;
+ALTER TABLE actions ADD COLUMN source TEXT;
+		`,
+	)
+	return errors.Trace(err)
+}
+
+func patchV7(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+-- Pending actions that haven't been claimed by expires_at are failed.
+ALTER TABLE actions ADD COLUMN expires_at DATETIME;
+		`,
+	)
+	return errors.Trace(err)
+}
+
+// patchV8 adds the full text search index of the actions. The patch is a
+// no-op if the sqlite library doesn't include FTS5, in which case the index is
+// created at start up by the first build that does, see EnsureActionsFullText.
+func patchV8(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := EnsureActionsFullText(ctx, tx)
+	return errors.Trace(err)
+}
+
+func patchV9(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+-- The generation is incremented every time the action changes, so that
+-- clients can detect concurrent changes.
+ALTER TABLE actions ADD COLUMN generation INTEGER NOT NULL DEFAULT 1;
+		`,
+	)
+	return errors.Trace(err)
+}
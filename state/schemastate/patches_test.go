@@ -0,0 +1,135 @@
+package schemastate_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+)
+
+// applyPatches applies the first n patches of the default schema.
+func applyPatches(t *testing.T, backend *db.SQLDatabase, n int) error {
+	t.Helper()
+
+	_, err := schemastate.New(schemastate.Patches[:n]).Ensure(context.Background(), backend)
+	return err
+}
+
+// indexes returns the names of the indexes on the table, excluding those
+// created by SQLite itself.
+func indexes(t *testing.T, backend *db.SQLDatabase, table string) []string {
+	t.Helper()
+
+	var names []string
+	for _, row := range rows(t, backend, "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = '"+table+"' AND name LIKE 'idx_%' ORDER BY name") {
+		name, _ := row[0].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestActionIndexesPatchOverOldDatabase(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	// The database is created before the indexes were added, and already has
+	// actions in it.
+	if err := applyPatches(t, backend, 3); err != nil {
+		t.Fatalf("applying old patches: %v", err)
+	}
+	exec(t, backend,
+		"INSERT INTO actions (tag, receiver, operation, status) VALUES ('action-1', 'unit-mysql-0', '1', 'pending')",
+		"INSERT INTO actions (tag, receiver, operation, status) VALUES ('action-2', 'unit-mysql-1', '1', 'running')",
+	)
+	if got := indexes(t, backend, "actions"); len(got) != 0 {
+		t.Fatalf("got indexes %v before the patch, want none", got)
+	}
+
+	if err := applyPatches(t, backend, 4); err != nil {
+		t.Fatalf("applying index patch: %v", err)
+	}
+	want := []string{"idx_actions_operation", "idx_actions_receiver", "idx_actions_status"}
+	if got := indexes(t, backend, "actions"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got indexes %v, want %v", got, want)
+	}
+	if got := rows(t, backend, "SELECT COUNT(*) FROM actions WHERE receiver = 'unit-mysql-0'"); got[0][0] != int64(1) {
+		t.Fatalf("got %v actions for the receiver, want the existing action kept", got[0][0])
+	}
+
+	// The rest of the patches apply on top.
+	if err := applyPatches(t, backend, len(schemastate.Patches)); err != nil {
+		t.Fatalf("applying remaining patches: %v", err)
+	}
+}
+
+func TestUniqueTagPatchOverDuplicateTags(t *testing.T) {
+	backend := newTestDatabase(t)
+	if err := applyPatches(t, backend, 4); err != nil {
+		t.Fatalf("applying old patches: %v", err)
+	}
+	exec(t, backend,
+		"INSERT INTO actions (tag, receiver, status) VALUES ('action-1', 'unit-mysql-0', 'pending')",
+		"INSERT INTO actions (tag, receiver, status) VALUES ('action-1', 'unit-mysql-1', 'pending')",
+		"INSERT INTO actions (tag, receiver, status) VALUES ('action-2', 'unit-mysql-0', 'pending')",
+	)
+
+	// The patch fails with the duplicates, rather than a constraint error.
+	err := applyPatches(t, backend, 5)
+	if err == nil || !strings.Contains(err.Error(), "actions share the same tags: action-1; remove the duplicate actions before upgrading") {
+		t.Fatalf("got error %v, want the duplicate tags", err)
+	}
+	if strings.Contains(err.Error(), "UNIQUE constraint") {
+		t.Fatalf("got raw constraint error %q", err)
+	}
+	if got := indexes(t, backend, "actions"); len(got) != 3 {
+		t.Fatalf("got indexes %v, want the unique index rolled back", got)
+	}
+
+	// Once the duplicate is removed, the patch applies.
+	exec(t, backend, "DELETE FROM actions WHERE receiver = 'unit-mysql-1'")
+	if err := applyPatches(t, backend, 5); err != nil {
+		t.Fatalf("applying unique tag patch: %v", err)
+	}
+	exec(t, backend, "INSERT INTO actions (tag) VALUES ('action-3')")
+	err = backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO actions (tag) VALUES ('action-2')")
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		t.Fatalf("got error %v inserting a duplicate tag, want it rejected", err)
+	}
+}
+
+func TestRequestedByPatchOverPopulatedTable(t *testing.T) {
+	backend := newTestDatabase(t)
+	if err := applyPatches(t, backend, 6); err != nil {
+		t.Fatalf("applying old patches: %v", err)
+	}
+	exec(t, backend,
+		"INSERT INTO actions (tag, receiver, name, status) VALUES ('action-1', 'unit-mysql-0', 'backup', 'completed')",
+		"INSERT INTO actions (tag, receiver, name, status) VALUES ('action-2', 'unit-mysql-1', 'restore', 'pending')",
+	)
+
+	if err := applyPatches(t, backend, 7); err != nil {
+		t.Fatalf("applying requested by patch: %v", err)
+	}
+	for _, column := range []string{"requested_by", "source"} {
+		if !hasColumn(t, backend, "actions", column) {
+			t.Fatalf("got no %s column", column)
+		}
+	}
+
+	// The existing actions are kept, without anyone recorded as asking for
+	// them.
+	got := rows(t, backend, "SELECT tag, name, requested_by, source FROM actions ORDER BY id")
+	want := [][]interface{}{
+		{"action-1", "backup", nil, nil},
+		{"action-2", "restore", nil, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got rows %v, want %v", got, want)
+	}
+}
@@ -2,21 +2,28 @@ package schemastate
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
 
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
 	"github.com/jmoiron/sqlx"
 	"github.com/juju/errors"
 )
 
 // doesSchemaTableExist return whether the schema table is present in the
 // database.
-func doesSchemaTableExist(ctx context.Context, tx *sqlx.Tx) (bool, error) {
+func doesSchemaTableExist(ctx context.Context, tx *sqlx.Tx, table string) (bool, error) {
 	var count int
-	err := tx.GetContext(ctx, &count, "SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = 'schema'")
+	err := tx.GetContext(ctx, &count, "SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = ?", table)
 	return count == 1, errors.Trace(err)
 }
 
+// schemaTable is the statement for creating a schema table, formatted with
+// the name of the table.
 const schemaTable = `
-CREATE TABLE schema (
+CREATE TABLE %s (
     id         INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
     version    INTEGER NOT NULL,
     updated_at DATETIME NOT NULL,
@@ -25,22 +32,47 @@ CREATE TABLE schema (
 `
 
 // Create the schema table.
-func createSchemaTable(ctx context.Context, tx *sqlx.Tx) error {
-	_, err := tx.ExecContext(ctx, schemaTable)
+func createSchemaTable(ctx context.Context, tx *sqlx.Tx, table string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(schemaTable, table))
+	return errors.Trace(err)
+}
+
+// nowTimestamp is the SQL expression for the current time as an ISO-8601 UTC
+// timestamp. The format is understood by both the sqlite and dqlite drivers,
+// so the value can be read back as a time.Time.
+const nowTimestamp = `strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')`
+
+// Convert any updated_at values that were stored as unix seconds into ISO-8601
+// UTC timestamps. Older versions stored the unix seconds in the DATETIME
+// column, which can't be consistently read back as a time.
+func migrateSchemaTimestamps(ctx context.Context, tx *sqlx.Tx, table string) error {
+	_, err := tx.ExecContext(ctx, `
+UPDATE `+table+` SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at, 'unixepoch')
+WHERE typeof(updated_at) = 'integer'
+`)
+	return errors.Trace(err)
+}
+
+// Take the write lock for the transaction. Sqlite only takes the write lock
+// when the first write statement is executed, so a no-op update against the
+// schema table is enough to prevent other transactions from applying patches
+// until this transaction has finished.
+func lockSchemaTable(ctx context.Context, tx *sqlx.Tx, table string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE "+table+" SET version = version WHERE version < 0")
 	return errors.Trace(err)
 }
 
 // Return the highest patch version currently applied. Zero means that no
 // patches have been applied yet.
-func queryCurrentVersion(ctx context.Context, tx *sqlx.Tx) (int, error) {
-	versions, err := selectSchemaVersions(ctx, tx)
+func queryCurrentVersion(ctx context.Context, tx *sqlx.Tx, table string, patches []schemaPatch) (int, error) {
+	versions, err := selectSchemaVersions(ctx, tx, table)
 	if err != nil {
 		return -1, errors.Errorf("failed to fetch patch versions: %v", err)
 	}
 
 	var current int
 	if len(versions) > 0 {
-		err = checkSchemaVersionsHaveNoHoles(versions)
+		err = checkSchemaVersionsHaveNoHoles(versions, patches)
 		if err != nil {
 			return -1, errors.Trace(err)
 		}
@@ -52,27 +84,33 @@ func queryCurrentVersion(ctx context.Context, tx *sqlx.Tx) (int, error) {
 }
 
 // Return all versions in the schema table, in increasing order.
-func selectSchemaVersions(ctx context.Context, tx *sqlx.Tx) ([]int, error) {
+func selectSchemaVersions(ctx context.Context, tx *sqlx.Tx, table string) ([]int, error) {
 	var values []int
-	err := tx.SelectContext(ctx, &values, "SELECT version FROM schema ORDER BY version")
+	err := tx.SelectContext(ctx, &values, "SELECT version FROM "+table+" ORDER BY version")
 	return values, errors.Trace(err)
 }
 
 // Check that the given list of update version numbers doesn't have "holes",
 // that is each version equal the preceding version plus 1.
-func checkSchemaVersionsHaveNoHoles(versions []int) error {
+func checkSchemaVersionsHaveNoHoles(versions []int, patches []schemaPatch) error {
 	// Ensure that there are no "holes" in the recorded versions.
 	for i := range versions[:len(versions)-1] {
 		if versions[i+1] != versions[i]+1 {
-			return errors.Errorf("missing patches: %d to %d", versions[i], versions[i+1])
+			var missing []PatchStatus
+			for version := versions[i] + 1; version < versions[i+1]; version++ {
+				missing = append(missing, patchStatus(version, patches))
+			}
+			return errors.Errorf(
+				"missing patches between versions %d and %d: %s; the schema table is inconsistent and the database should be restored from a backup",
+				versions[i], versions[i+1], formatPatches(missing))
 		}
 	}
 	return nil
 }
 
 // Check that all the given patches are applied.
-func checkAllPatchesAreApplied(ctx context.Context, tx *sqlx.Tx, patches []Patch) error {
-	versions, err := selectSchemaVersions(ctx, tx)
+func checkAllPatchesAreApplied(ctx context.Context, tx *sqlx.Tx, table string, patches []schemaPatch) error {
+	versions, err := selectSchemaVersions(ctx, tx, table)
 	if err != nil {
 		return errors.Errorf("failed to fetch patch versions: %v", err)
 	}
@@ -81,89 +119,289 @@ func checkAllPatchesAreApplied(ctx context.Context, tx *sqlx.Tx, patches []Patch
 		return errors.Errorf("expected schema table to contain at least one row")
 	}
 
-	err = checkSchemaVersionsHaveNoHoles(versions)
+	err = checkSchemaVersionsHaveNoHoles(versions, patches)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
 	current := versions[len(versions)-1]
-	if current != len(patches) {
-		return errors.Errorf("patch level is %d, expected %d", current, len(patches))
+	if current < len(patches) {
+		var missing []PatchStatus
+		for version := current + 1; version <= len(patches); version++ {
+			missing = append(missing, patchStatus(version, patches))
+		}
+		return errors.Errorf("patch level is %d, expected %d: missing patches %s; run Ensure to apply them",
+			current, len(patches), formatPatches(missing))
+	} else if current > len(patches) {
+		return errors.Errorf("patch level is %d, expected %d: the database is more recent than the known patches",
+			current, len(patches))
 	}
 	return nil
 }
 
 // Ensure that the schema exists.
-func ensureSchemaTableExists(ctx context.Context, tx *sqlx.Tx) error {
-	exists, err := doesSchemaTableExist(ctx, tx)
+func ensureSchemaTableExists(ctx context.Context, tx *sqlx.Tx, table string) error {
+	exists, err := doesSchemaTableExist(ctx, tx, table)
 	if err != nil {
 		return errors.Errorf("failed to check if schema table is there: %v", err)
 	}
 	if !exists {
-		if err := createSchemaTable(ctx, tx); err != nil {
+		if err := createSchemaTable(ctx, tx, table); err != nil {
 			return errors.Errorf("failed to create schema table: %v", err)
 		}
 	}
 	return nil
 }
 
-// Apply any pending patch that was not yet applied.
-func ensurePatchsAreApplied(ctx context.Context, tx *sqlx.Tx, current int, patches []Patch, hook Hook) error {
+// Apply any pending patch that was not yet applied, up until the next
+// standalone patch. The patches applied before any error are returned along
+// with the error.
+func ensurePatchsAreApplied(ctx context.Context, tx *sqlx.Tx, current int, schema *Schema, postHook Hook) ([]AppliedPatch, error) {
+	patches := schema.patches
 	if current > len(patches) {
-		return errors.Errorf(
+		return nil, errors.Errorf(
 			"schema version '%d' is more recent than expected '%d'",
 			current, len(patches))
 	}
 
 	// If there are no patches, there's nothing to do.
 	if len(patches) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	// Apply missing patches.
+	var applied []AppliedPatch
 	for _, patch := range patches[current:] {
+		// Standalone patches can't be applied within the transaction.
+		if patch.standalone != nil {
+			break
+		}
+
 		// If the context has any underlying errors, close out immediately.
 		if err := ctx.Err(); err != nil {
-			return errors.Trace(err)
+			return applied, errors.Trace(err)
 		}
 
-		if err := hook(ctx, tx, current); err != nil {
-			return errors.Annotatef(err, "failed to execute hook (version %d)", current)
+		start := time.Now()
+		if err := schema.hook(ctx, tx, current); err != nil {
+			return applied, errors.Annotatef(err, "failed to execute hook (version %d)", current)
 		}
 
-		if err := patch(ctx, tx); err != nil {
-			return errors.Errorf("failed to apply patch %d: %v", current, err)
+		err := schema.runPatch(ctx, current, func(ctx context.Context) error {
+			return patch.transactional(ctx, tx)
+		})
+		if err != nil {
+			return applied, errors.Trace(err)
 		}
 		current++
 
-		if err := insertSchemaVersion(ctx, tx, current); err != nil {
-			return errors.Errorf("failed to insert version %d", current)
+		if err := insertSchemaVersion(ctx, tx, schema.table(), current); err != nil {
+			return applied, errors.Annotatef(err, "failed to insert version %d", current)
 		}
+
+		if err := postHook(ctx, tx, current); err != nil {
+			return applied, errors.Annotatef(err, "failed to execute post hook (version %d)", current)
+		}
+
+		applied = append(applied, AppliedPatch{
+			Version:  current,
+			Duration: time.Since(start),
+		})
 	}
 
-	return nil
+	return applied, nil
 }
 
 // Insert a new version into the schema table.
-func insertSchemaVersion(ctx context.Context, tx *sqlx.Tx, new int) error {
+func insertSchemaVersion(ctx context.Context, tx *sqlx.Tx, table string, new int) error {
 	statement := `
-INSERT INTO schema (version, updated_at) VALUES (?, strftime("%s"))
+INSERT INTO ` + table + ` (version, updated_at) VALUES (?, ` + nowTimestamp + `)
 `
 	_, err := tx.ExecContext(ctx, statement, new)
-	return err
+	if err = stateerrors.FromDB(err); stateerrors.IsAlreadyExists(err) {
+		// Another transaction has already inserted the version.
+		return stateerrors.Conflictf("schema version %d", new)
+	}
+	return errors.Trace(err)
 }
 
-// Return a list of SQL statements that can be used to create all tables in the
-// database.
-func selectTablesSQL(ctx context.Context, tx *sqlx.Tx) ([]string, error) {
+// allNamespaces selects the objects of every namespace, rather than those of
+// a single namespace.
+const allNamespaces = "*"
+
+// Return a list of SQL statements that can be used to create all tables of
+// the namespace in the database. The tables recording the schema are
+// excluded.
+func selectTablesSQL(ctx context.Context, tx *sqlx.Tx, namespace string) ([]string, error) {
+	condition, err := namespaceCondition(ctx, tx, namespace)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	statement := `
 SELECT sql FROM sqlite_master WHERE
   type IN ('table', 'index', 'view', 'trigger') AND
-  name != 'schema' AND
-  name NOT LIKE 'sqlite_%'
+  name != 'schema' AND name NOT LIKE 'schema\_%' ESCAPE '\' AND
+  name NOT LIKE 'sqlite_%'` + condition + `
 ORDER BY name
 `
 	var tables []string
-	err := tx.SelectContext(ctx, &tables, statement)
+	err = tx.SelectContext(ctx, &tables, statement)
 	return tables, errors.Trace(err)
 }
+
+// namespaceCondition returns the condition restricting the objects of
+// sqlite_master to those of the namespace. The objects of a namespace are
+// those whose table is prefixed with the namespace, and the default namespace
+// has the objects that aren't in any other namespace of the database.
+func namespaceCondition(ctx context.Context, tx *sqlx.Tx, namespace string) (string, error) {
+	switch namespace {
+	case allNamespaces:
+		return "", nil
+	case "":
+	default:
+		return " AND tbl_name LIKE " + namespacePattern(namespace) + ` ESCAPE '\'`, nil
+	}
+
+	others, err := selectNamespaces(ctx, tx)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	var condition strings.Builder
+	for _, other := range others {
+		condition.WriteString(" AND tbl_name NOT LIKE " + namespacePattern(other) + ` ESCAPE '\'`)
+	}
+	return condition.String(), nil
+}
+
+// namespacePattern returns the LIKE pattern matching the tables of the
+// namespace.
+func namespacePattern(namespace string) string {
+	return quoteString(namespace + `\_%`)
+}
+
+// selectNamespaces returns the namespaces, other than the default namespace,
+// that have a schema table in the database.
+func selectNamespaces(ctx context.Context, tx *sqlx.Tx) ([]string, error) {
+	var tables []string
+	err := tx.SelectContext(ctx, &tables, `
+SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'schema\_%' ESCAPE '\'
+ORDER BY name
+`)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var namespaces []string
+	for _, table := range tables {
+		// Namespaces can't contain underscores, so anything else is a seeds
+		// table.
+		namespace := strings.TrimPrefix(table, "schema_")
+		if namespace == "seeds" || strings.Contains(namespace, "_") {
+			continue
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces, nil
+}
+
+// checkNamespaceIsFree checks that none of the tables in the database would
+// be taken to be in the namespace, before the namespace is first used.
+func checkNamespaceIsFree(ctx context.Context, tx *sqlx.Tx, namespace string) error {
+	var tables []string
+	err := tx.SelectContext(ctx, &tables, `
+SELECT name FROM sqlite_master WHERE type = 'table' AND tbl_name LIKE `+namespacePattern(namespace)+` ESCAPE '\'
+ORDER BY name
+`)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tables) > 0 {
+		return errors.NotValidf("schema namespace %q clashing with existing tables %s", namespace, strings.Join(tables, ", "))
+	}
+	return nil
+}
+
+// schemaObject represents an index, view or trigger within the database.
+type schemaObject struct {
+	Type  string `db:"type"`
+	Name  string `db:"name"`
+	Table string `db:"tbl_name"`
+	SQL   string `db:"sql"`
+}
+
+// Return all the objects of the given types of the namespace in the database,
+// ordered by name.
+func selectObjects(ctx context.Context, tx *sqlx.Tx, namespace string, types ...string) ([]schemaObject, error) {
+	condition, err := namespaceCondition(ctx, tx, namespace)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	quoted := make([]string, len(types))
+	for i, t := range types {
+		quoted[i] = quoteString(t)
+	}
+	statement := `
+SELECT type, name, tbl_name, sql FROM sqlite_master WHERE
+  type IN (` + strings.Join(quoted, ", ") + `) AND
+  tbl_name != 'schema' AND tbl_name NOT LIKE 'schema\_%' ESCAPE '\' AND
+  sql IS NOT NULL AND
+  name NOT LIKE 'sqlite_%'` + condition + `
+ORDER BY name
+`
+	var objects []schemaObject
+	err = tx.SelectContext(ctx, &objects, statement)
+	return objects, errors.Trace(err)
+}
+
+// Check that there are no foreign key violations within the database.
+func checkForeignKeys(ctx context.Context, tx *sqlx.Tx) error {
+	rows, err := tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+
+	var violations []string
+	for rows.Next() {
+		var (
+			table, parent string
+			rowID         sql.NullInt64
+			foreignKeyID  int
+		)
+		if err := rows.Scan(&table, &rowID, &parent, &foreignKeyID); err != nil {
+			return errors.Trace(err)
+		}
+		violations = append(violations, fmt.Sprintf("%s (row %d) references missing %s", table, rowID.Int64, parent))
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if len(violations) > 0 {
+		return errors.Errorf("foreign key violations: %s", strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// Check that foreign key constraints are enforced for the connection.
+func checkForeignKeysEnabled(ctx context.Context, tx *sqlx.Tx) error {
+	var enabled bool
+	if err := tx.GetContext(ctx, &enabled, "PRAGMA foreign_keys"); err != nil {
+		return errors.Trace(err)
+	}
+	if !enabled {
+		return errors.Errorf("foreign key constraints are not enforced: enable foreign_keys for the database connection")
+	}
+	return nil
+}
+
+// Check the integrity of the database.
+func checkIntegrity(ctx context.Context, tx *sqlx.Tx) error {
+	var results []string
+	if err := tx.SelectContext(ctx, &results, "PRAGMA integrity_check"); err != nil {
+		return errors.Trace(err)
+	}
+	if len(results) == 1 && results[0] == "ok" {
+		return nil
+	}
+	return errors.Errorf("integrity check failed: %s", strings.Join(results, ", "))
+}
@@ -0,0 +1,72 @@
+package schemastate
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// Restore replays a dump written by DumpTo into the database. The dump is
+// applied within a single transaction, so a failed restore leaves the
+// database unchanged; the transaction statements of the dump itself are
+// skipped.
+//
+// The dump is streamed, so the restore can't be retried once the dump has
+// started to be read.
+func Restore(r io.Reader, backend Backend) error {
+	var started bool
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		if started {
+			return errors.Errorf("restore can not be retried once the dump has been read")
+		}
+		started = true
+
+		var splitter StatementSplitter
+		buf := make([]byte, restoreBufferSize)
+		for {
+			n, readErr := r.Read(buf)
+			for _, statement := range splitter.Write(string(buf[:n])) {
+				if err := restoreStatement(ctx, tx, statement); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			if readErr == io.EOF {
+				break
+			} else if readErr != nil {
+				return errors.Annotate(readErr, "reading dump")
+			}
+		}
+		if rest := strings.TrimSpace(splitter.Remainder()); rest != "" {
+			return errors.Errorf("reading dump: unterminated statement %q", truncate(rest, 80))
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+// restoreBufferSize is the size of the chunks the dump is read in.
+const restoreBufferSize = 32 * 1024
+
+// restoreStatement runs a statement of the dump, skipping the transaction
+// statements.
+func restoreStatement(ctx context.Context, tx *sqlx.Tx, statement string) error {
+	switch strings.ToUpper(strings.TrimSpace(strings.TrimSuffix(statement, ";"))) {
+	case "BEGIN TRANSACTION", "BEGIN", "COMMIT", "END TRANSACTION":
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, statement); err != nil {
+		return errors.Annotatef(err, "restoring %q", truncate(statement, 80))
+	}
+	return nil
+}
+
+// truncate shortens the text for error messages.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	return text[:max] + "..."
+}
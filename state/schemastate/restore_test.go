@@ -0,0 +1,72 @@
+package schemastate_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestRestoreTriggerWithManyStatements(t *testing.T) {
+	restored := restore(t, `BEGIN TRANSACTION;
+CREATE TABLE things (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE audit (thing_id INTEGER, note TEXT);
+CREATE TRIGGER things_audit AFTER INSERT ON things BEGIN
+	INSERT INTO audit (thing_id, note) VALUES (new.id, 'added; first');
+	INSERT INTO audit (thing_id, note) VALUES (new.id, 'added; second');
+END;
+COMMIT;
+`)
+	exec(t, restored, "INSERT INTO things (name) VALUES ('widget')")
+
+	var count int
+	err := restored.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM audit")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("got %d audit rows, want 2", count)
+	}
+}
+
+func TestRestoreReadOneByteAtATime(t *testing.T) {
+	dump := `BEGIN TRANSACTION;
+-- The trigger notes; whether the thing is named.
+CREATE TABLE things (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE audit (thing_id INTEGER, note TEXT);
+CREATE TRIGGER things_audit AFTER INSERT ON things BEGIN
+	/* end; */
+	INSERT INTO audit (thing_id, note) VALUES (new.id, CASE WHEN new.name IS NULL THEN 'unnamed;' ELSE 'named' END);
+END;
+INSERT INTO things (name) VALUES ('it''s; here');
+COMMIT;
+`
+	restored := newTestDatabase(t)
+	if err := schemastate.Restore(iotest.OneByteReader(strings.NewReader(dump)), restored); err != nil {
+		t.Fatalf("restoring dump: %v", err)
+	}
+	exec(t, restored, "INSERT INTO things (name) VALUES (NULL)")
+
+	var notes []string
+	err := restored.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &notes, "SELECT note FROM audit ORDER BY thing_id")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || notes[0] != "named" || notes[1] != "unnamed;" {
+		t.Fatalf("got audit notes %q, want the trigger restored", notes)
+	}
+}
+
+func TestRestoreUnterminatedStatement(t *testing.T) {
+	err := schemastate.Restore(strings.NewReader("CREATE TABLE things (id INTEGER);\nINSERT INTO things VALUES (1)\n"), newTestDatabase(t))
+	if err == nil || !strings.Contains(err.Error(), `unterminated statement "INSERT INTO things VALUES (1)"`) {
+		t.Fatalf("got error %v, want the unterminated statement reported", err)
+	}
+}
@@ -3,32 +3,68 @@ package schemastate
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 
+	stateerrors "github.com/SimonRichardson/nu-juju-data/state/errors"
 	"github.com/jmoiron/sqlx"
 	"github.com/juju/errors"
 )
 
+// maxEnsureAttempts is the number of times Ensure will be attempted when
+// another Ensure has concurrently applied the same patches.
+const maxEnsureAttempts = 3
+
 // Schema captures the schema of a database in terms of a series of ordered
 // updates.
 type Schema struct {
-	patches []Patch
-	hook    Hook
+	namespace        string
+	patches          []schemaPatch
+	seeds            []Patch
+	hook             Hook
+	postHook         Hook
+	checkForeignKeys bool
+	patchTimeout     time.Duration
+	progress         ProgressFunc
+	backup           BackupFunc
 }
 
 // Patch applies a specific schema change to a database, and returns an error
 // if anything goes wrong.
 type Patch func(context.Context, *sqlx.Tx) error
 
+// StandalonePatch applies a specific schema change to a database outside of a
+// transaction, and returns an error if anything goes wrong. This is required
+// for statements that can not be run within a transaction (VACUUM, certain
+// PRAGMA changes) or data changes that need to be split up into batches.
+//
+// A standalone patch that fails part way through will be run again on the
+// next Ensure, so it must be safe to re-run.
+type StandalonePatch func(context.Context, *sqlx.Conn) error
+
 // Hook is a callback that gets fired when a update gets applied.
 type Hook func(context.Context, *sqlx.Tx, int) error
 
+// schemaPatch holds a single update, which is either applied within the
+// Ensure transaction or standalone on its own connection.
+type schemaPatch struct {
+	name          string
+	transactional Patch
+	standalone    StandalonePatch
+}
+
 // New creates a new schema Schema with the given patches.
 func New(patches []Patch) *Schema {
-	return &Schema{
-		patches: patches,
-		hook:    omitHook,
+	s := &Schema{
+		hook:     omitHook,
+		postHook: omitHook,
+		progress: omitProgress,
 	}
+	for _, patch := range patches {
+		s.Add(patch)
+	}
+	return s
 }
 
 // Empty creates a new schema with no patches.
@@ -39,7 +75,49 @@ func Empty() *Schema {
 // Add a new update to the schema. It will be appended at the end of the
 // existing series.
 func (s *Schema) Add(update Patch) {
-	s.patches = append(s.patches, update)
+	s.patches = append(s.patches, schemaPatch{
+		name:          funcName(update),
+		transactional: update,
+	})
+}
+
+// AddStandalone adds a new standalone update to the schema. It will be
+// appended at the end of the existing series.
+//
+// When Ensure reaches a standalone update, the updates applied so far are
+// committed, the standalone update is run on its own connection and then its
+// version is recorded, before the remaining updates are applied. The backend
+// must implement StandaloneBackend for the update to be applied.
+func (s *Schema) AddStandalone(update StandalonePatch) {
+	s.patches = append(s.patches, schemaPatch{
+		name:       funcName(update),
+		standalone: update,
+	})
+}
+
+// Seed adds a function that populates reference data on a fresh install. Seeds
+// are run in their own transaction, in the order they were added, once all
+// the updates have been applied. They're only run when the database had no
+// updates applied at the start of Ensure, so upgraded databases never run
+// them.
+func (s *Schema) Seed(seed Patch) {
+	s.seeds = append(s.seeds, seed)
+}
+
+// Namespace sets the namespace of the schema, so that multiple schemas can
+// manage disjoint sets of tables within the same database. Each namespace
+// records its updates in its own schema table, named after the namespace. The
+// namespace must be lower case alphanumeric; the empty namespace is the
+// default. Tables named "schema" or prefixed with "schema_" are reserved for
+// recording updates.
+//
+// The tables and views of a namespace must be prefixed with the namespace and
+// an underscore, such as "model_units" for the "model" namespace, and indexes
+// and triggers belong to the namespace of their table. The default namespace
+// has every other table. A namespace can't be used for the first time if any
+// tables already have its prefix.
+func (s *Schema) Namespace(namespace string) {
+	s.namespace = namespace
 }
 
 // Hook instructs the schema to invoke the given function whenever a update is
@@ -51,6 +129,86 @@ func (s *Schema) Hook(hook Hook) {
 	s.hook = hook
 }
 
+// PostHook instructs the schema to invoke the given function whenever a update
+// has been applied. The function gets passed the version number that has been
+// recorded for the update and the running transaction, and if it returns an
+// error it will cause the schema transaction to be rolled back. Any previously
+// installed post hook will be replaced.
+func (s *Schema) PostHook(hook Hook) {
+	s.postHook = hook
+}
+
+// CheckForeignKeys instructs the schema to run a foreign key check after every
+// update has been applied. Any violation will cause the schema transaction to
+// be rolled back.
+func (s *Schema) CheckForeignKeys(check bool) {
+	s.checkForeignKeys = check
+}
+
+// PatchTimeout bounds the time each update is allowed to take. If an update
+// takes longer than the timeout, the context passed to the update is
+// cancelled and the schema transaction is rolled back. A zero timeout means
+// updates are unbounded.
+func (s *Schema) PatchTimeout(timeout time.Duration) {
+	s.patchTimeout = timeout
+}
+
+// Progress instructs the schema to invoke the given function whenever an
+// update reports progress using ReportProgress. Any previously installed
+// progress function will be replaced.
+func (s *Schema) Progress(progress ProgressFunc) {
+	s.progress = progress
+}
+
+// table returns the name of the table recording the applied updates.
+func (s *Schema) table() string {
+	if s.namespace == "" {
+		return "schema"
+	}
+	return "schema_" + s.namespace
+}
+
+// seedsTable returns the name of the table recording the applied seeds.
+func (s *Schema) seedsTable() string {
+	return s.table() + "_seeds"
+}
+
+// validate checks that the namespace can't be confused with the tables of
+// another namespace.
+func (s *Schema) validate() error {
+	if s.namespace == "seeds" || !validNamespace.MatchString(s.namespace) {
+		return errors.NotValidf("schema namespace %q", s.namespace)
+	}
+	return nil
+}
+
+var validNamespace = regexp.MustCompile(`^([a-z][a-z0-9]*)?$`)
+
+// runPatch runs the update for the given version, bounding it by the patch
+// timeout and allowing it to report progress.
+func (s *Schema) runPatch(ctx context.Context, version int, fn func(context.Context) error) error {
+	name := s.patches[version].name
+	patchCtx := ctx
+	if s.patchTimeout > 0 {
+		var cancel context.CancelFunc
+		patchCtx, cancel = context.WithTimeout(ctx, s.patchTimeout)
+		defer cancel()
+	}
+	patchCtx = context.WithValue(patchCtx, progressKey{}, func(message string) {
+		s.progress(version, name, message)
+	})
+
+	if err := fn(patchCtx); err != nil {
+		// Only report a timeout if it was the patch timeout that expired,
+		// rather than the context of the Ensure.
+		if ctx.Err() == nil && patchCtx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("patch %d (%s) timed out after %v", version, name, s.patchTimeout)
+		}
+		return errors.Errorf("failed to apply patch %d (%s): %v", version, name, err)
+	}
+	return nil
+}
+
 // Len returns the number of total patches in the schema.
 func (s *Schema) Len() int {
 	return len(s.patches)
@@ -59,6 +217,22 @@ func (s *Schema) Len() int {
 // ChangeSet returns the schema changes for the schema when they're applied.
 type ChangeSet struct {
 	Current, Applied int
+
+	// Patches holds the patches that were applied, in the order that they
+	// were applied.
+	Patches []AppliedPatch
+
+	// Seeded is true if the seeds were run.
+	Seeded bool
+}
+
+// AppliedPatch records a patch that was applied during an Ensure.
+type AppliedPatch struct {
+	// Version is the schema version recorded once the patch was applied.
+	Version int
+
+	// Duration is how long it took to apply the patch, including any hooks.
+	Duration time.Duration
 }
 
 // Ensure makes sure that the actual schema in the given database matches the
@@ -66,45 +240,257 @@ type ChangeSet struct {
 //
 // All updates are applied transactionally. In case any error occurs the
 // transaction will be rolled back and the database will remain unchanged.
+// Standalone updates split the updates into separate transactions; in that
+// case the schema table reflects exactly the updates that have completed.
 //
 // A update will be applied only if it hasn't been before (currently applied
 // updates are tracked in the a 'schema' table, which gets automatically
 // created).
 //
+// Concurrent calls to Ensure against the same database are serialized by
+// taking the write lock on the schema table before the current version is
+// read. If another Ensure still manages to apply the same patch first, the
+// transaction is retried and observes the patches as already applied.
+//
+// If the context is cancelled, the running transaction is rolled back and the
+// error reports the last version that was applied before the cancellation.
+//
 // If no error occurs, the integer returned by this method is the
 // initial version that the schema has been upgraded from.
-func (s *Schema) Ensure(backend Backend) (ChangeSet, error) {
+func (s *Schema) Ensure(ctx context.Context, backend Backend) (ChangeSet, error) {
+	if err := s.validate(); err != nil {
+		return ChangeSet{}, errors.Trace(err)
+	}
+	if err := s.ensureBackup(ctx, backend); err != nil {
+		return ChangeSet{}, errors.Annotatef(err, "backing up before applying patches")
+	}
+
 	var (
-		current = -1
-		applied = -1
+		changeSet ChangeSet
+		err       error
 	)
-	err := backend.Run(func(ctx context.Context, t *sqlx.Tx) error {
-		err := ensureSchemaTableExists(ctx, t)
-		if err != nil {
-			return errors.Trace(err)
+	for attempt := 0; attempt < maxEnsureAttempts; attempt++ {
+		changeSet, err = s.ensure(ctx, backend)
+		if !stateerrors.IsConflict(err) {
+			break
 		}
+	}
+	return changeSet, errors.Trace(err)
+}
 
-		current, err = queryCurrentVersion(ctx, t)
-		if err != nil {
-			return errors.Trace(err)
+func (s *Schema) ensure(ctx context.Context, backend Backend) (ChangeSet, error) {
+	changeSet := ChangeSet{
+		Current: -1,
+		Applied: -1,
+	}
+
+	postHook := s.postHook
+	if s.checkForeignKeys {
+		postHook = func(ctx context.Context, tx *sqlx.Tx, version int) error {
+			if err := checkForeignKeys(ctx, tx); err != nil {
+				return errors.Trace(err)
+			}
+			return s.postHook(ctx, tx, version)
+		}
+	}
+
+	for {
+		var (
+			current, applied int
+			patches          []AppliedPatch
+		)
+		err := backend.RunContext(ctx, func(ctx context.Context, t *sqlx.Tx) error {
+			current, patches = 0, nil
+
+			if err := s.ensureNamespaceIsFree(ctx, t); err != nil {
+				return errors.Trace(err)
+			}
+			err := ensureSchemaTableExists(ctx, t, s.table())
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Take the write lock before reading the current version, so
+			// that any other Ensure has to wait for this one to complete.
+			if err := lockSchemaTable(ctx, t, s.table()); err != nil {
+				return errors.Trace(err)
+			}
+			if err := migrateSchemaTimestamps(ctx, t, s.table()); err != nil {
+				return errors.Annotatef(err, "failed to migrate schema timestamps")
+			}
+
+			current, err = queryCurrentVersion(ctx, t, s.table(), s.patches)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// A fresh install creates the seeds table along side the first
+			// patches, which marks the database as requiring seeding.
+			if current == 0 && len(s.seeds) > 0 {
+				if err := createSeedsTable(ctx, t, s.seedsTable()); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			patches, err = ensurePatchsAreApplied(ctx, t, current, s, postHook)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			applied, err = queryCurrentVersion(ctx, t, s.table(), s.patches)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// If the next patch is a standalone patch, run the hook whilst
+			// we're still in the transaction.
+			if applied < len(s.patches) {
+				if err := s.hook(ctx, t, applied); err != nil {
+					return errors.Annotatef(err, "failed to execute hook (version %d)", applied)
+				}
+			}
+			return nil
+		})
+		if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+			last := current
+			if len(patches) > 0 {
+				last = patches[len(patches)-1].Version
+			}
+			return changeSet, errors.Annotatef(ctxErr,
+				"schema upgrade cancelled after applying version %d, rolled back to version %d", last, current)
+		} else if err != nil {
+			return changeSet, errors.Trace(err)
 		}
 
-		err = ensurePatchsAreApplied(ctx, t, current, s.patches, s.hook)
+		if changeSet.Current == -1 {
+			changeSet.Current = current
+		}
+		changeSet.Applied = applied
+		changeSet.Patches = append(changeSet.Patches, patches...)
+
+		if applied >= len(s.patches) {
+			changeSet.Seeded, err = s.ensureSeedsAreApplied(ctx, backend)
+			return changeSet, errors.Trace(err)
+		}
+
+		patch, err := s.ensureStandalonePatchIsApplied(ctx, backend, applied, postHook)
 		if err != nil {
+			return changeSet, errors.Trace(err)
+		}
+		changeSet.Applied = patch.Version
+		changeSet.Patches = append(changeSet.Patches, patch)
+	}
+}
+
+// ensureNamespaceIsFree checks that a namespace that hasn't been used yet
+// won't take over the tables of another namespace.
+func (s *Schema) ensureNamespaceIsFree(ctx context.Context, tx *sqlx.Tx) error {
+	if s.namespace == "" {
+		return nil
+	}
+	exists, err := doesSchemaTableExist(ctx, tx, s.table())
+	if err != nil || exists {
+		return errors.Trace(err)
+	}
+	return errors.Trace(checkNamespaceIsFree(ctx, tx, s.namespace))
+}
+
+// ensureSeedsAreApplied runs the seeds in their own transaction, if the
+// database was marked as requiring seeding during a fresh install. Returns
+// true if the seeds were run.
+func (s *Schema) ensureSeedsAreApplied(ctx context.Context, backend Backend) (bool, error) {
+	if len(s.seeds) == 0 {
+		return false, nil
+	}
+
+	var seeded bool
+	err := backend.RunContext(ctx, func(ctx context.Context, t *sqlx.Tx) error {
+		seeded = false
+
+		required, err := requiresSeeding(ctx, t, s.seedsTable())
+		if err != nil || !required {
 			return errors.Trace(err)
 		}
 
-		applied, err = queryCurrentVersion(ctx, t)
+		for i, seed := range s.seeds {
+			if err := seed(ctx, t); err != nil {
+				return errors.Annotatef(err, "failed to apply seed %d", i)
+			}
+			if err := insertSeed(ctx, t, s.seedsTable(), i, funcName(seed)); err != nil {
+				return errors.Annotatef(err, "failed to record seed %d", i)
+			}
+		}
+		seeded = true
+		return nil
+	})
+	return seeded, errors.Trace(err)
+}
+
+// ensureStandalonePatchIsApplied runs the standalone patch for the current
+// version outside of a transaction, then records the new version.
+func (s *Schema) ensureStandalonePatchIsApplied(ctx context.Context, backend Backend, current int, postHook Hook) (AppliedPatch, error) {
+	standalone, ok := backend.(StandaloneBackend)
+	if !ok {
+		return AppliedPatch{}, errors.NotSupportedf("standalone patch %d with backend %T", current, backend)
+	}
+
+	start := time.Now()
+	err := standalone.RunStandalone(ctx, func(ctx context.Context, conn *sqlx.Conn) error {
+		return s.runPatch(ctx, current, func(ctx context.Context) error {
+			return s.patches[current].standalone(ctx, conn)
+		})
+	})
+	if err != nil {
+		return AppliedPatch{}, errors.Trace(err)
+	}
+
+	version := current + 1
+	err = backend.RunContext(ctx, func(ctx context.Context, t *sqlx.Tx) error {
+		// The standalone patch runs without the lock on the schema table, so
+		// another Ensure may have applied it concurrently. Re-read the
+		// version under the lock, so that the race is reported as a
+		// conflict and Ensure is retried.
+		if err := lockSchemaTable(ctx, t, s.table()); err != nil {
+			return errors.Trace(err)
+		}
+		latest, err := queryCurrentVersion(ctx, t, s.table(), s.patches)
 		if err != nil {
 			return errors.Trace(err)
 		}
-
+		if latest != current {
+			return stateerrors.Conflictf("schema version %d", version)
+		}
+		if err := insertSchemaVersion(ctx, t, s.table(), version); err != nil {
+			return errors.Annotatef(err, "failed to insert version %d", version)
+		}
+		if err := postHook(ctx, t, version); err != nil {
+			return errors.Annotatef(err, "failed to execute post hook (version %d)", version)
+		}
 		return nil
 	})
-	return ChangeSet{
-		Current: current,
-		Applied: applied,
-	}, errors.Trace(err)
+	if err != nil {
+		return AppliedPatch{}, errors.Trace(err)
+	}
+	return AppliedPatch{
+		Version:  version,
+		Duration: time.Since(start),
+	}, nil
+}
+
+// Verify checks that the database enforces the constraints expected by the
+// schema. It checks that foreign keys are enforced, that there are no
+// foreign key violations and that the integrity of the database is intact.
+func (s *Schema) Verify(backend Backend) error {
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		if err := checkForeignKeysEnabled(ctx, tx); err != nil {
+			return errors.Trace(err)
+		}
+		if err := checkForeignKeys(ctx, tx); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(checkIntegrity(ctx, tx))
+	})
+	return errors.Annotatef(err, "schema verification")
 }
 
 // Applied returns the SQL commands that has been applied to the database. The
@@ -124,10 +510,10 @@ func (s *Schema) Applied(backend Backend) (string, error) {
 }
 
 func (s *Schema) applied(ctx context.Context, tx *sqlx.Tx) ([]string, error) {
-	if err := checkAllPatchesAreApplied(ctx, tx, s.patches); err != nil {
+	if err := checkAllPatchesAreApplied(ctx, tx, s.table(), s.patches); err != nil {
 		return nil, errors.Trace(err)
 	}
-	statements, err := selectTablesSQL(ctx, tx)
+	statements, err := selectTablesSQL(ctx, tx, s.namespace)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -136,11 +522,64 @@ func (s *Schema) applied(ctx context.Context, tx *sqlx.Tx) ([]string, error) {
 	statements = append(
 		statements,
 		fmt.Sprintf(`
-INSERT INTO schema (version, updated_at) VALUES (%d, strftime("%%s"))
-`, len(s.patches)))
+INSERT INTO %s (version, updated_at) VALUES (%d, %s)
+`, s.table(), len(s.patches), nowTimestamp))
 
 	return statements, nil
 }
 
+// CurrentSQL returns the SQL commands that describe the live schema of the
+// database, followed by the current version row. Unlike Applied, it doesn't
+// require all the patches to be applied, so it can be used to inspect a
+// database that is part way through an upgrade.
+func (s *Schema) CurrentSQL(backend Backend) (string, error) {
+	var statements []string
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		statements, err = selectTablesSQL(ctx, tx, s.namespace)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		exists, err := doesSchemaTableExist(ctx, tx, s.table())
+		if err != nil || !exists {
+			return errors.Trace(err)
+		}
+		versions, err := selectSchemaVersions(ctx, tx, s.table())
+		if err != nil || len(versions) == 0 {
+			return errors.Trace(err)
+		}
+
+		// Add a statement for inserting the current schema version row.
+		statements = append(
+			statements,
+			fmt.Sprintf(`
+INSERT INTO %s (version, updated_at) VALUES (%d, %s)
+`, s.table(), versions[len(versions)-1], nowTimestamp))
+		return nil
+	})
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return strings.Join(statements, ";\n"), nil
+}
+
+// ProgressFunc is called with the version and name of an update whenever it
+// reports progress.
+type ProgressFunc func(version int, name string, message string)
+
+type progressKey struct{}
+
+// ReportProgress reports the progress of a long running update. It should be
+// called with the context passed to the update.
+func ReportProgress(ctx context.Context, format string, args ...interface{}) {
+	if report, ok := ctx.Value(progressKey{}).(func(string)); ok {
+		report(fmt.Sprintf(format, args...))
+	}
+}
+
+// omitProgress ignores any progress that is reported.
+func omitProgress(int, string, string) {}
+
 // omitHook always returns a nil, omitting the error.
 func omitHook(context.Context, *sqlx.Tx, int) error { return nil }
@@ -0,0 +1,802 @@
+package schemastate_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// createTable returns a patch creating the table.
+func createTable(statement string) schemastate.Patch {
+	return func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, statement)
+		return err
+	}
+}
+
+// namespaced returns a schema in the namespace with the patches.
+func namespaced(namespace string, patches ...schemastate.Patch) *schemastate.Schema {
+	schema := schemastate.New(patches)
+	schema.Namespace(namespace)
+	return schema
+}
+
+func TestNamespacesAreIndependent(t *testing.T) {
+	backend := newTestDatabase(t)
+	defaults := newTestManager(t, backend, "")
+
+	alphaV1 := createTable("CREATE TABLE alpha_things (id INTEGER PRIMARY KEY, name TEXT)")
+	betaV1 := createTable("CREATE TABLE beta_items (id INTEGER PRIMARY KEY)")
+	betaV2 := createTable("CREATE INDEX idx_beta_items ON beta_items (id)")
+
+	alpha := namespaced("alpha", alphaV1)
+	if _, err := alpha.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying alpha: %v", err)
+	}
+	if _, err := namespaced("beta", betaV1).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying beta: %v", err)
+	}
+
+	// Upgrading one namespace leaves the others alone.
+	beta := namespaced("beta", betaV1, betaV2)
+	changes, err := beta.Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("upgrading beta: %v", err)
+	}
+	if changes.Current != 1 || changes.Applied != 2 {
+		t.Errorf("upgrading beta: got versions %d to %d, want 1 to 2", changes.Current, changes.Applied)
+	}
+	changes, err = alpha.Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("ensuring alpha: %v", err)
+	}
+	if changes.Current != 1 || changes.Applied != 1 || len(changes.Patches) != 0 {
+		t.Errorf("ensuring alpha: got %+v, want no changes at version 1", changes)
+	}
+
+	tests := []struct {
+		name    string
+		schema  *schemastate.Schema
+		want    []string
+		notWant []string
+	}{{
+		name:    "default",
+		schema:  defaults.Schema(),
+		want:    []string{"actions"},
+		notWant: []string{"alpha_things", "beta_items"},
+	}, {
+		name:    "alpha",
+		schema:  alpha,
+		want:    []string{"alpha_things"},
+		notWant: []string{"actions", "beta_items"},
+	}, {
+		name:    "beta",
+		schema:  beta,
+		want:    []string{"beta_items", "idx_beta_items"},
+		notWant: []string{"actions", "alpha_things"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			applied, err := test.schema.Applied(backend)
+			if err != nil {
+				t.Fatalf("reading applied schema: %v", err)
+			}
+			current, err := test.schema.CurrentSQL(backend)
+			if err != nil {
+				t.Fatalf("reading current schema: %v", err)
+			}
+			out, err := schemastate.Dump(backend, test.schema)
+			if err != nil {
+				t.Fatalf("dumping: %v", err)
+			}
+			for kind, text := range map[string]string{"applied": applied, "current": current, "dump": out} {
+				for _, name := range test.want {
+					if !strings.Contains(text, name) {
+						t.Errorf("%s schema missing %s:\n%s", kind, name, text)
+					}
+				}
+				for _, name := range test.notWant {
+					if strings.Contains(text, "CREATE TABLE "+name+" ") || strings.Contains(text, "CREATE TABLE IF NOT EXISTS "+name+" ") {
+						t.Errorf("%s schema has %s of another namespace:\n%s", kind, name, text)
+					}
+				}
+			}
+
+			if err := test.schema.Verify(backend); err != nil {
+				t.Errorf("verifying: %v", err)
+			}
+			diff, err := schemastate.Diff(backend, test.schema)
+			if err != nil {
+				t.Fatalf("diffing: %v", err)
+			}
+			if len(diff.OnlyLive) > 0 || len(diff.OnlyExpected) > 0 || len(diff.Changed) > 0 {
+				t.Errorf("got drift %+v, want none", diff)
+			}
+		})
+	}
+}
+
+func TestNamespaceClashingWithExistingTables(t *testing.T) {
+	backend := newTestDatabase(t)
+	newTestManager(t, backend, "")
+
+	// The default namespace already has the actions_logs table.
+	schema := namespaced("actions", createTable("CREATE TABLE actions_more (id INTEGER PRIMARY KEY)"))
+	_, err := schema.Ensure(context.Background(), backend)
+	if !errors.IsNotValid(err) {
+		t.Fatalf("got error %v, want not valid", err)
+	}
+}
+
+func TestConcurrentEnsure(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	var calls int32
+	counted := func(statement string) schemastate.Patch {
+		patch := createTable(statement)
+		return func(ctx context.Context, tx *sqlx.Tx) error {
+			atomic.AddInt32(&calls, 1)
+			return patch(ctx, tx)
+		}
+	}
+	patches := []schemastate.Patch{
+		counted("CREATE TABLE racing_things (id INTEGER PRIMARY KEY)"),
+		counted("CREATE INDEX idx_racing_things ON racing_things (id)"),
+	}
+
+	const ensurers = 4
+	var (
+		wg      sync.WaitGroup
+		changes = make([]schemastate.ChangeSet, ensurers)
+		errs    = make([]error, ensurers)
+	)
+	for i := 0; i < ensurers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			changes[i], errs[i] = namespaced("racing", patches...).Ensure(context.Background(), backend)
+		}(i)
+	}
+	wg.Wait()
+
+	var upgraded int
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("ensure %d: %v", i, err)
+		}
+		if changes[i].Applied != len(patches) {
+			t.Errorf("ensure %d: got version %d, want %d", i, changes[i].Applied, len(patches))
+		}
+		if len(changes[i].Patches) > 0 {
+			upgraded++
+		}
+	}
+	if upgraded != 1 {
+		t.Errorf("got %d ensures applying patches, want 1", upgraded)
+	}
+	if calls != int32(len(patches)) {
+		t.Errorf("got %d patches run, want each patch run once", calls)
+	}
+}
+
+func TestDiffIgnoresFullTextSearch(t *testing.T) {
+	backend := newTestDatabase(t)
+	m := newTestManager(t, backend, "")
+
+	// Stand-ins for the objects of the search index, which only exist where
+	// the sqlite library includes FTS5, along with an object that merely
+	// shares the prefix.
+	exec(t, backend,
+		"CREATE TABLE IF NOT EXISTS "+schemastate.ActionsFullTextTable+"_data (id INTEGER PRIMARY KEY, block BLOB)",
+		"CREATE TRIGGER IF NOT EXISTS "+schemastate.ActionsFullTextTable+"_insert AFTER INSERT ON actions BEGIN SELECT 1; END",
+		"CREATE TABLE actions_ftsish (id INTEGER PRIMARY KEY)",
+	)
+
+	diff, err := m.Diff()
+	if err != nil {
+		t.Fatalf("diffing: %v", err)
+	}
+	want := []string{"table actions_ftsish"}
+	if len(diff.OnlyLive) != 1 || diff.OnlyLive[0] != want[0] || len(diff.OnlyExpected) > 0 || len(diff.Changed) > 0 {
+		t.Fatalf("got drift %+v, want only %v", diff, want)
+	}
+}
+
+// schemaVersion returns the highest version recorded in the schema table.
+func schemaVersion(t *testing.T, backend schemastate.Backend, table string) int {
+	t.Helper()
+
+	var version int
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &version, "SELECT IFNULL(MAX(version), 0) FROM "+table)
+	})
+	if err != nil {
+		t.Fatalf("reading the schema version: %v", err)
+	}
+	return version
+}
+
+func TestStandalonePatchResumesAfterFailure(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	var created, backfills, indexed int32
+	schema := namespaced("resumed")
+	schema.Add(func(ctx context.Context, tx *sqlx.Tx) error {
+		atomic.AddInt32(&created, 1)
+		_, err := tx.ExecContext(ctx, "CREATE TABLE resumed_things (id INTEGER PRIMARY KEY)")
+		return err
+	})
+	schema.AddStandalone(func(ctx context.Context, conn *sqlx.Conn) error {
+		// Backfill in batches, failing part way through the first time.
+		for id := 1; id <= 4; id++ {
+			if _, err := conn.ExecContext(ctx, "INSERT OR IGNORE INTO resumed_things (id) VALUES (?)", id); err != nil {
+				return err
+			}
+			if id == 2 && atomic.AddInt32(&backfills, 1) == 1 {
+				return errors.New("boom")
+			}
+		}
+		return nil
+	})
+	schema.Add(func(ctx context.Context, tx *sqlx.Tx) error {
+		atomic.AddInt32(&indexed, 1)
+		_, err := tx.ExecContext(ctx, "CREATE INDEX idx_resumed_things ON resumed_things (id)")
+		return err
+	})
+
+	if _, err := schema.Ensure(context.Background(), backend); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got error %v, want the standalone patch to fail", err)
+	}
+	// The patch preceding the standalone patch was committed, whilst
+	// neither the standalone patch nor the following patch were recorded.
+	if version := schemaVersion(t, backend, "schema_resumed"); version != 1 {
+		t.Fatalf("got version %d after the failure, want 1", version)
+	}
+	if indexed != 0 {
+		t.Fatalf("got the patch after the standalone patch applied, want it skipped")
+	}
+
+	changeSet, err := schema.Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	if changeSet.Current != 1 || changeSet.Applied != 3 {
+		t.Fatalf("got versions %d to %d, want 1 to 3", changeSet.Current, changeSet.Applied)
+	}
+	if created != 1 || backfills != 2 || indexed != 1 {
+		t.Fatalf("got %d, %d and %d runs of the patches, want 1, 2 and 1", created, backfills, indexed)
+	}
+
+	var count int
+	err = backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM resumed_things")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("got %d rows, want the backfill completed", count)
+	}
+}
+
+// racingBackend runs another Ensure as soon as a standalone patch has been
+// run, before the version of the patch has been recorded.
+type racingBackend struct {
+	*db.SQLDatabase
+	race func()
+}
+
+func (b *racingBackend) RunStandalone(ctx context.Context, fn func(context.Context, *sqlx.Conn) error) error {
+	if err := b.SQLDatabase.RunStandalone(ctx, fn); err != nil {
+		return err
+	}
+	if race := b.race; race != nil {
+		b.race = nil
+		race()
+	}
+	return nil
+}
+
+func TestStandalonePatchRacingEnsure(t *testing.T) {
+	database := newTestDatabase(t)
+
+	var runs int32
+	newSchema := func() *schemastate.Schema {
+		schema := namespaced("racing", createTable("CREATE TABLE racing_things (id INTEGER PRIMARY KEY)"))
+		schema.AddStandalone(func(ctx context.Context, conn *sqlx.Conn) error {
+			atomic.AddInt32(&runs, 1)
+			_, err := conn.ExecContext(ctx, "INSERT OR IGNORE INTO racing_things (id) VALUES (1)")
+			return err
+		})
+		return schema
+	}
+
+	backend := &racingBackend{SQLDatabase: database}
+	var raceErr error
+	backend.race = func() {
+		_, raceErr = newSchema().Ensure(context.Background(), database)
+	}
+
+	changeSet, err := newSchema().Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("got error %v, want the lost race to be retried", err)
+	}
+	if raceErr != nil {
+		t.Fatalf("racing ensure: %v", raceErr)
+	}
+	if changeSet.Applied != 2 {
+		t.Fatalf("got version %d, want 2", changeSet.Applied)
+	}
+	if version := schemaVersion(t, database, "schema_racing"); version != 2 {
+		t.Fatalf("got version %d recorded, want 2", version)
+	}
+	if runs != 2 {
+		t.Fatalf("got %d runs of the standalone patch, want one for each ensure", runs)
+	}
+}
+
+// updatedAt returns the time each version was recorded in the schema table,
+// read back as a time.
+func updatedAt(t *testing.T, backend schemastate.Backend, table string) []time.Time {
+	t.Helper()
+
+	var times []time.Time
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &times, "SELECT updated_at FROM "+table+" ORDER BY version")
+	})
+	if err != nil {
+		t.Fatalf("reading the schema timestamps: %v", err)
+	}
+	return times
+}
+
+func TestUpdatedAtReadsAsTime(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	before := time.Now().UTC().Truncate(time.Millisecond)
+	create := createTable("CREATE TABLE stamped_things (id INTEGER PRIMARY KEY)")
+	if _, err := namespaced("stamped", create).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	after := time.Now().UTC()
+
+	times := updatedAt(t, backend, "schema_stamped")
+	if len(times) != 1 {
+		t.Fatalf("got %d versions, want 1", len(times))
+	}
+	if got := times[0]; got.Location() != time.UTC || got.Before(before) || got.After(after) {
+		t.Fatalf("got updated at %v, want a UTC time between %v and %v", got, before, after)
+	}
+}
+
+func TestUpdatedAtMigratesUnixSeconds(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	create := createTable("CREATE TABLE stamped_things (id INTEGER PRIMARY KEY)")
+	if _, err := namespaced("stamped", create).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	// Versions used to be recorded as unix seconds.
+	exec(t, backend, "UPDATE schema_stamped SET updated_at = strftime('%s', '2021-06-01 12:00:00')")
+
+	index := createTable("CREATE INDEX idx_stamped_things ON stamped_things (id)")
+	if _, err := namespaced("stamped", create, index).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("upgrading schema: %v", err)
+	}
+
+	times := updatedAt(t, backend, "schema_stamped")
+	if len(times) != 2 {
+		t.Fatalf("got %d versions, want 2", len(times))
+	}
+	if want := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC); !times[0].Equal(want) {
+		t.Fatalf("got updated at %v for the migrated version, want %v", times[0], want)
+	}
+	if times[1].Before(times[0]) {
+		t.Fatalf("got updated at %v for the new version, want it after %v", times[1], times[0])
+	}
+
+	// The migrated version is stored as a timestamp, rather than relying on
+	// the driver to convert unix seconds.
+	var types []string
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.SelectContext(ctx, &types, "SELECT DISTINCT typeof(updated_at) FROM schema_stamped")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 1 || types[0] != "text" {
+		t.Fatalf("got updated at stored as %v, want text", types)
+	}
+}
+
+// tableExists returns whether the table exists in the database.
+func tableExists(t *testing.T, backend schemastate.Backend, table string) bool {
+	t.Helper()
+
+	var count int
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	})
+	if err != nil {
+		t.Fatalf("reading the tables: %v", err)
+	}
+	return count > 0
+}
+
+// slowPatch waits for its context to be done, reporting its progress.
+func slowPatch(ctx context.Context, tx *sqlx.Tx) error {
+	schemastate.ReportProgress(ctx, "waiting")
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		return errors.New("the patch was never cancelled")
+	}
+}
+
+func TestPatchTimeout(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	schema := namespaced("slow", createTable("CREATE TABLE slow_things (id INTEGER PRIMARY KEY)"), slowPatch)
+	schema.PatchTimeout(20 * time.Millisecond)
+
+	_, err := schema.Ensure(context.Background(), backend)
+	if err == nil || !strings.Contains(err.Error(), "patch 1 (") || !strings.Contains(err.Error(), "slowPatch) timed out after 20ms") {
+		t.Fatalf("got error %v, want the slow patch to time out", err)
+	}
+	// The whole Ensure is rolled back, including the patch before.
+	if tableExists(t, backend, "slow_things") || tableExists(t, backend, "schema_slow") {
+		t.Fatalf("got the patches before the timeout committed, want them rolled back")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	var reported []string
+	schema := namespaced("progress", createTable("CREATE TABLE progress_things (id INTEGER PRIMARY KEY)"))
+	schema.Add(func(ctx context.Context, tx *sqlx.Tx) error {
+		for i := 1; i <= 2; i++ {
+			schemastate.ReportProgress(ctx, "backfilled %d of 2", i)
+		}
+		return nil
+	})
+	schema.Progress(func(version int, name string, message string) {
+		reported = append(reported, fmt.Sprintf("%d %s", version, message))
+		if name == "" {
+			t.Errorf("got progress without the name of the patch")
+		}
+	})
+
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	want := []string{"1 backfilled 1 of 2", "1 backfilled 2 of 2"}
+	if len(reported) != len(want) || reported[0] != want[0] || reported[1] != want[1] {
+		t.Fatalf("got progress %v, want %v", reported, want)
+	}
+}
+
+func TestCancelledEnsureRollsBack(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs [3]int
+	patch := func(i int, statement string) schemastate.Patch {
+		return func(ctx context.Context, tx *sqlx.Tx) error {
+			runs[i]++
+			_, err := tx.ExecContext(ctx, statement)
+			return err
+		}
+	}
+	schema := namespaced("cancelled",
+		patch(0, "CREATE TABLE cancelled_a (id INTEGER PRIMARY KEY)"),
+		patch(1, "CREATE TABLE cancelled_b (id INTEGER PRIMARY KEY)"),
+		patch(2, "CREATE TABLE cancelled_c (id INTEGER PRIMARY KEY)"),
+	)
+	// Cancel once the first patch has been applied.
+	schema.PostHook(func(_ context.Context, _ *sqlx.Tx, version int) error {
+		if version == 1 {
+			cancel()
+		}
+		return nil
+	})
+
+	_, err := schema.Ensure(ctx, backend)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("got error %v, want the Ensure cancelled", err)
+	}
+	if !strings.Contains(err.Error(), "cancelled after applying version 1, rolled back to version 0") {
+		t.Fatalf("got error %v, want the versions applied and rolled back to", err)
+	}
+	if runs != [3]int{1, 0, 0} {
+		t.Fatalf("got runs %v of the patches, want only the first", runs)
+	}
+	// The version table is untouched, along with the first patch.
+	if tableExists(t, backend, "schema_cancelled") || tableExists(t, backend, "cancelled_a") {
+		t.Fatalf("got the first patch committed, want it rolled back")
+	}
+
+	schema.PostHook(func(context.Context, *sqlx.Tx, int) error { return nil })
+	changeSet, err := schema.Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("rerunning: %v", err)
+	}
+	if changeSet.Current != 0 || changeSet.Applied != 3 || len(changeSet.Patches) != 3 {
+		t.Fatalf("got versions %d to %d with %d patches, want all 3 applied", changeSet.Current, changeSet.Applied, len(changeSet.Patches))
+	}
+	if runs != [3]int{2, 1, 1} {
+		t.Fatalf("got runs %v of the patches, want all of them run again", runs)
+	}
+}
+
+func TestInvalidNamespace(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	for _, namespace := range []string{"Upper", "with_underscore", "1st", "seeds"} {
+		_, err := namespaced(namespace).Ensure(context.Background(), backend)
+		if !errors.IsNotValid(err) {
+			t.Errorf("namespace %q: got error %v, want not valid", namespace, err)
+		}
+	}
+}
+
+func TestEnsurePostHook(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	schema := schemastate.New([]schemastate.Patch{
+		createTable("CREATE TABLE hooked_things (id INTEGER PRIMARY KEY)"),
+		createTable("CREATE INDEX idx_hooked_things ON hooked_things (id)"),
+	})
+	var versions []int
+	schema.PostHook(func(ctx context.Context, tx *sqlx.Tx, version int) error {
+		versions = append(versions, version)
+		return nil
+	})
+	changeSet, err := schema.Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("got post hook versions %v, want %v", versions, want)
+	}
+	if len(changeSet.Patches) != 2 {
+		t.Fatalf("got applied patches %v, want 2", changeSet.Patches)
+	}
+	for i, patch := range changeSet.Patches {
+		if patch.Version != i+1 {
+			t.Errorf("got patch %d version %d, want %d", i, patch.Version, i+1)
+		}
+	}
+}
+
+func TestEnsurePostHookErrorRollsBack(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	schema := schemastate.New([]schemastate.Patch{
+		createTable("CREATE TABLE hooked_things (id INTEGER PRIMARY KEY)"),
+		createTable("CREATE INDEX idx_hooked_things ON hooked_things (id)"),
+	})
+	schema.PostHook(func(ctx context.Context, tx *sqlx.Tx, version int) error {
+		if version == 2 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	if _, err := schema.Ensure(context.Background(), backend); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got error %v, want the post hook error", err)
+	}
+
+	changeSet, err := schemastate.New(nil).Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("ensuring empty schema: %v", err)
+	}
+	if changeSet.Current != 0 {
+		t.Fatalf("got version %d, want the failed patches rolled back", changeSet.Current)
+	}
+}
+
+func TestEnsureCheckForeignKeys(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	schema := schemastate.New([]schemastate.Patch{
+		createTable("CREATE TABLE checked_parents (id INTEGER PRIMARY KEY)"),
+		createTable("CREATE TABLE checked_children (id INTEGER PRIMARY KEY, parent_id INTEGER REFERENCES checked_parents (id))"),
+		createTable("PRAGMA defer_foreign_keys = ON"),
+		createTable("INSERT INTO checked_children (parent_id) VALUES (42)"),
+	})
+	schema.CheckForeignKeys(true)
+	_, err := schema.Ensure(context.Background(), backend)
+	if err == nil || !strings.Contains(err.Error(), "checked_children (row 1) references missing checked_parents") {
+		t.Fatalf("got error %v, want a foreign key violation", err)
+	}
+}
+
+func createStatusItems(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE TABLE status_items (id INTEGER PRIMARY KEY)")
+	return err
+}
+
+func createStatusTags(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "CREATE TABLE status_tags (item_id INTEGER, tag TEXT)")
+	return err
+}
+
+func TestStatus(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	if _, err := schemastate.New([]schemastate.Patch{createStatusItems}).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+
+	schema := schemastate.New([]schemastate.Patch{createStatusItems, createStatusTags})
+	status, err := schema.Status(backend)
+	if err != nil {
+		t.Fatalf("getting status: %v", err)
+	}
+	want := schemastate.Status{
+		Current:  1,
+		Expected: 2,
+		Missing:  []schemastate.PatchStatus{{Version: 2, Name: "createStatusTags"}},
+	}
+	if !reflect.DeepEqual(status, want) {
+		t.Fatalf("got status %+v, want %+v", status, want)
+	}
+	if status.UpToDate() {
+		t.Fatalf("got status up to date, want missing patches")
+	}
+	if got, want := status.String(), "version 1, expected 2; missing patches 2 (createStatusTags)"; got != want {
+		t.Fatalf("got status %q, want %q", got, want)
+	}
+
+	// The missing patch is named when the applied schema is requested.
+	if _, err := schema.Applied(backend); err == nil || !strings.Contains(err.Error(), "missing patches 2 (createStatusTags)") {
+		t.Fatalf("got error %v, want the missing patch named", err)
+	}
+
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	if status, err = schema.Status(backend); err != nil {
+		t.Fatalf("getting status: %v", err)
+	} else if !status.UpToDate() {
+		t.Fatalf("got status %v, want up to date", status)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	schema := schemastate.New([]schemastate.Patch{createStatusItems, createStatusTags})
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	history, err := schema.History(backend)
+	if err != nil {
+		t.Fatalf("getting history: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("got history %v, want 2 entries", history)
+	}
+	for i, name := range []string{"createStatusItems", "createStatusTags"} {
+		if entry := history[i]; entry.Version != i+1 || entry.Name != name || entry.UpdatedAt.IsZero() {
+			t.Errorf("got entry %d %+v, want version %d named %q", i, entry, i+1, name)
+		}
+	}
+}
+
+func TestManagerChangeSet(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	m := schemastate.NewManager(backend, "", nopLogger{})
+	if err := m.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting manager: %v", err)
+	}
+	changeSet := m.ChangeSet()
+	if changeSet.Current != 0 || changeSet.Applied != m.Schema().Len() {
+		t.Fatalf("got versions %d to %d, want 0 to %d", changeSet.Current, changeSet.Applied, m.Schema().Len())
+	}
+	history, err := m.History()
+	if err != nil {
+		t.Fatalf("getting history: %v", err)
+	}
+	if len(history) != changeSet.Applied {
+		t.Fatalf("got %d history entries, want %d", len(history), changeSet.Applied)
+	}
+
+	// Starting up again applies nothing.
+	if err := m.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting manager: %v", err)
+	}
+	if changeSet := m.ChangeSet(); changeSet.Current != changeSet.Applied || len(changeSet.Patches) != 0 {
+		t.Fatalf("got change set %+v, want nothing applied", changeSet)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	schema := schemastate.New([]schemastate.Patch{
+		createTable("CREATE TABLE verified_parents (id INTEGER PRIMARY KEY)"),
+		createTable("CREATE TABLE verified_children (id INTEGER PRIMARY KEY, parent_id INTEGER REFERENCES verified_parents (id))"),
+	})
+	if _, err := schema.Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+	if err := schema.Verify(backend); err != nil {
+		t.Fatalf("verifying schema: %v", err)
+	}
+
+	// Sneak a violation in with the constraints turned off.
+	err := backend.RunStandalone(context.Background(), func(ctx context.Context, conn *sqlx.Conn) error {
+		for _, statement := range []string{
+			"PRAGMA foreign_keys = OFF",
+			"INSERT INTO verified_children (parent_id) VALUES (42)",
+			"PRAGMA foreign_keys = ON",
+		} {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = schema.Verify(backend)
+	if err == nil || !strings.Contains(err.Error(), "verified_children (row 1) references missing verified_parents") {
+		t.Fatalf("got error %v, want a foreign key violation", err)
+	}
+}
+
+func TestVerifyForeignKeysDisabled(t *testing.T) {
+	sqlDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	err = schemastate.Empty().Verify(db.NewSQLDatabase(sqlDB, "sqlite3"))
+	if err == nil || !strings.Contains(err.Error(), "foreign key constraints are not enforced") {
+		t.Fatalf("got error %v, want foreign keys reported as not enforced", err)
+	}
+}
+
+func TestCurrentSQLPartiallyUpgraded(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	if _, err := schemastate.New([]schemastate.Patch{createStatusItems}).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("applying schema: %v", err)
+	}
+
+	schema := schemastate.New([]schemastate.Patch{createStatusItems, createStatusTags})
+	if _, err := schema.Applied(backend); err == nil {
+		t.Fatalf("got no error from Applied, want the missing patch reported")
+	}
+	current, err := schema.CurrentSQL(backend)
+	if err != nil {
+		t.Fatalf("getting current SQL: %v", err)
+	}
+	for _, want := range []string{"CREATE TABLE status_items", "INSERT INTO schema (version, updated_at) VALUES (1,"} {
+		if !strings.Contains(current, want) {
+			t.Errorf("got current SQL without %q:\n%s", want, current)
+		}
+	}
+	if strings.Contains(current, "status_tags") {
+		t.Errorf("got current SQL with the missing patch:\n%s", current)
+	}
+}
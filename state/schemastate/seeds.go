@@ -0,0 +1,49 @@
+package schemastate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// seedsTable records the seeds that have been run. The table is only created
+// on a fresh install, so its presence marks a database that requires seeding.
+// The statement is formatted with the name of the table.
+const seedsTable = `
+CREATE TABLE IF NOT EXISTS %s (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    seed       INTEGER NOT NULL,
+    name       TEXT NOT NULL,
+    applied_at DATETIME NOT NULL,
+    UNIQUE (seed)
+)
+`
+
+// Create the seeds table.
+func createSeedsTable(ctx context.Context, tx *sqlx.Tx, table string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(seedsTable, table))
+	return errors.Trace(err)
+}
+
+// Return whether the seeds table exists and no seeds have been recorded.
+func requiresSeeding(ctx context.Context, tx *sqlx.Tx, table string) (bool, error) {
+	var count int
+	err := tx.GetContext(ctx, &count, "SELECT COUNT(name) FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	if err != nil || count == 0 {
+		return false, errors.Trace(err)
+	}
+
+	err = tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM "+table)
+	return count == 0, errors.Trace(err)
+}
+
+// Insert a seed into the seeds table.
+func insertSeed(ctx context.Context, tx *sqlx.Tx, table string, seed int, name string) error {
+	statement := `
+INSERT INTO ` + table + ` (seed, name, applied_at) VALUES (?, ?, ` + nowTimestamp + `)
+`
+	_, err := tx.ExecContext(ctx, statement, seed, name)
+	return errors.Trace(err)
+}
@@ -0,0 +1,97 @@
+package schemastate_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// seededSchema returns a schema in the namespace with the patches, which
+// seeds a row into the first table, counting the times it's seeded.
+func seededSchema(seeds *int, patches ...schemastate.Patch) *schemastate.Schema {
+	schema := namespaced("seeded", patches...)
+	schema.Seed(func(ctx context.Context, tx *sqlx.Tx) error {
+		*seeds++
+		_, err := tx.ExecContext(ctx, "INSERT INTO seeded_kinds (name) VALUES ('default')")
+		return err
+	})
+	return schema
+}
+
+func TestSeedsRunOnceOnFreshInstall(t *testing.T) {
+	backend := newTestDatabase(t)
+	create := createTable("CREATE TABLE seeded_kinds (name TEXT NOT NULL)")
+
+	var seeds int
+	changeSet, err := seededSchema(&seeds, create).Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("installing: %v", err)
+	}
+	if !changeSet.Seeded || seeds != 1 {
+		t.Fatalf("got seeded %v with %d runs, want the seeds run once", changeSet.Seeded, seeds)
+	}
+
+	// Ensuring again, or upgrading, doesn't run the seeds again.
+	upgrade := createTable("CREATE INDEX idx_seeded_kinds ON seeded_kinds (name)")
+	for _, schema := range []*schemastate.Schema{
+		seededSchema(&seeds, create),
+		seededSchema(&seeds, create, upgrade),
+	} {
+		changeSet, err := schema.Ensure(context.Background(), backend)
+		if err != nil {
+			t.Fatalf("ensuring again: %v", err)
+		}
+		if changeSet.Seeded || seeds != 1 {
+			t.Fatalf("got seeded %v with %d runs, want the seeds not run again", changeSet.Seeded, seeds)
+		}
+	}
+
+	var count int
+	err = backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM seeded_kinds")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d seeded rows, want 1", count)
+	}
+}
+
+func TestSeedsNeverRunOnUpgrade(t *testing.T) {
+	backend := newTestDatabase(t)
+	create := createTable("CREATE TABLE seeded_kinds (name TEXT NOT NULL)")
+
+	// The database was installed before the schema had any seeds.
+	if _, err := namespaced("seeded", create).Ensure(context.Background(), backend); err != nil {
+		t.Fatalf("installing: %v", err)
+	}
+
+	var seeds int
+	upgrade := createTable("CREATE INDEX idx_seeded_kinds ON seeded_kinds (name)")
+	changeSet, err := seededSchema(&seeds, create, upgrade).Ensure(context.Background(), backend)
+	if err != nil {
+		t.Fatalf("upgrading: %v", err)
+	}
+	if changeSet.Seeded || seeds != 0 {
+		t.Fatalf("got seeded %v with %d runs, want the seeds never run", changeSet.Seeded, seeds)
+	}
+}
+
+func TestSeedFailureKeepsCause(t *testing.T) {
+	backend := newTestDatabase(t)
+
+	cause := errors.New("boom")
+	schema := namespaced("seeded", createTable("CREATE TABLE seeded_kinds (name TEXT NOT NULL)"))
+	schema.Seed(func(context.Context, *sqlx.Tx) error {
+		return cause
+	})
+
+	_, err := schema.Ensure(context.Background(), backend)
+	if errors.Cause(err) != cause {
+		t.Fatalf("got error %v, want the cause of the failed seed", err)
+	}
+}
@@ -2,7 +2,7 @@ package schemastate
 
 import (
 	"context"
-	"fmt"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/juju/errors"
@@ -12,36 +12,116 @@ type Backend interface {
 	// Run is a convince function for running one shot transactions, which
 	// correctly handles the rollback semantics and retries where available.
 	Run(func(context.Context, *sqlx.Tx) error) error
+
+	// RunContext is like Run, but the transaction is bound to the given
+	// context.
+	RunContext(context.Context, func(context.Context, *sqlx.Tx) error) error
+}
+
+// StandaloneBackend is implemented by backends that can run functions outside
+// of a transaction, which is required for applying standalone patches.
+type StandaloneBackend interface {
+	Backend
+
+	// RunStandalone runs the function on a dedicated connection, outside of
+	// any transaction.
+	RunStandalone(context.Context, func(context.Context, *sqlx.Conn) error) error
+}
+
+// Logger is the logging interface used by the schema manager.
+type Logger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warningf(string, ...interface{})
+	Errorf(string, ...interface{})
 }
 
 type SchemaManager struct {
 	backend Backend
 	schema  *Schema
+	logger  Logger
+
+	mutex     sync.Mutex
+	changeSet ChangeSet
 }
 
-// NewManager creates a new manager from a backend.
-func NewManager(backend Backend) *SchemaManager {
+// NewManager creates a new manager from a backend. The namespace identifies
+// the schema within the database; the empty namespace is the default.
+func NewManager(backend Backend, namespace string, logger Logger) *SchemaManager {
+	schema := New(patches)
+	schema.Namespace(namespace)
+	schema.Progress(func(version int, name string, message string) {
+		logger.Infof("schema patch %d (%s): %s", version, name, message)
+	})
 	return &SchemaManager{
 		backend: backend,
-		schema:  New(patches),
+		schema:  schema,
+		logger:  logger,
 	}
 }
 
 func (m *SchemaManager) StartUp(ctx context.Context) error {
-	m.schema.Hook(func(ctx context.Context, tx *sqlx.Tx, current int) error {
-		fmt.Println("Applying:", current)
+	changeSet, err := m.schema.Ensure(ctx, m.backend)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	m.mutex.Lock()
+	m.changeSet = changeSet
+	m.mutex.Unlock()
+
+	if err := m.schema.Verify(m.backend); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(changeSet.Patches) == 0 {
+		m.logger.Infof("schema is up to date at version %d", changeSet.Applied)
 		return nil
-	})
-	// Ignore the change set from ensure for now.
-	_, err := m.schema.Ensure(m.backend)
-	return errors.Trace(err)
+	}
+	for _, patch := range changeSet.Patches {
+		m.logger.Debugf("applied schema patch version %d in %v", patch.Version, patch.Duration)
+	}
+	m.logger.Infof("schema upgraded from version %d to %d", changeSet.Current, changeSet.Applied)
+	return nil
 }
 
-func (m *SchemaManager) Stop() {}
+func (m *SchemaManager) Stop(ctx context.Context) {}
 
-// Applied returns the applied schema.
+// Applied returns the schema currently applied to the database, even if not
+// all the patches have been applied yet.
 func (m *SchemaManager) Applied() (string, error) {
-	return m.schema.Applied(m.backend)
+	return m.schema.CurrentSQL(m.backend)
+}
+
+// Verify checks the live database enforces the constraints expected by the
+// schema.
+func (m *SchemaManager) Verify() error {
+	return m.schema.Verify(m.backend)
+}
+
+// Diff compares the live database schema against the schema expected from
+// applying all the patches.
+func (m *SchemaManager) Diff() (SchemaDiff, error) {
+	return Diff(m.backend, m.schema)
+}
+
+// Status compares the patches recorded in the database against the patches
+// of the schema.
+func (m *SchemaManager) Status() (Status, error) {
+	return m.schema.Status(m.backend)
+}
+
+// ChangeSet returns the changes applied to the schema during StartUp.
+func (m *SchemaManager) ChangeSet() ChangeSet {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.changeSet
+}
+
+// History returns the patches that have been applied to the database, in the
+// order they were applied.
+func (m *SchemaManager) History() ([]HistoryEntry, error) {
+	return m.schema.History(m.backend)
 }
 
 // Schema returns the underlying schema that is being managed.
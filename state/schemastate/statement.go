@@ -0,0 +1,161 @@
+package schemastate
+
+import "strings"
+
+// StatementSplitter splits SQL text into the statements terminated by a
+// semicolon, so that the text can be split as it's read. Semicolons within
+// string literals, quoted identifiers, comments and the body of a trigger
+// don't terminate a statement.
+type StatementSplitter struct {
+	input []byte
+	// start is the offset of the current statement and pos is the offset of
+	// the next byte to be scanned.
+	start, pos int
+
+	quote   byte
+	comment string
+
+	// prefix holds the first keywords of the current statement, which tell
+	// whether it creates a trigger.
+	prefix  []string
+	trigger bool
+	// depth is the number of BEGIN and CASE keywords of a trigger that
+	// haven't been closed by END yet.
+	depth int
+}
+
+// Write adds the text to the input, returning the statements that it
+// completes, including their terminating semicolons.
+func (s *StatementSplitter) Write(text string) []string {
+	s.input = append(s.input, text...)
+
+	var statements []string
+	for s.pos < len(s.input) {
+		c := s.input[s.pos]
+		switch {
+		case s.comment == "--":
+			if c == '\n' {
+				s.comment = ""
+			}
+		case s.comment == "/*":
+			if c != '*' {
+				break
+			}
+			next, ok := s.peek()
+			if !ok {
+				return s.compact(statements)
+			}
+			if next == '/' {
+				s.comment = ""
+				s.pos++
+			}
+		case s.quote != 0:
+			// A doubled quote is an escaped quote, which is handled by
+			// leaving and immediately re-entering the literal.
+			if c == s.quote {
+				s.quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			s.quote = c
+		case c == '[':
+			s.quote = ']'
+		case c == '-' || c == '/':
+			next, ok := s.peek()
+			if !ok {
+				return s.compact(statements)
+			}
+			if (c == '-' && next == '-') || (c == '/' && next == '*') {
+				s.comment = string(s.input[s.pos : s.pos+2])
+				s.pos++
+			}
+		case isIdentifierChar(c):
+			end := s.pos
+			for end < len(s.input) && isIdentifierChar(s.input[end]) {
+				end++
+			}
+			// The word may continue in the next write.
+			if end == len(s.input) {
+				return s.compact(statements)
+			}
+			s.keyword(s.input[s.pos:end])
+			s.pos = end
+			continue
+		case c == ';' && s.depth == 0:
+			if statement := strings.TrimSpace(string(s.input[s.start : s.pos+1])); statement != ";" {
+				statements = append(statements, statement)
+			}
+			s.start = s.pos + 1
+			s.prefix, s.trigger = s.prefix[:0], false
+		}
+		s.pos++
+	}
+	return s.compact(statements)
+}
+
+// peek returns the byte following the one being scanned, or false if it
+// hasn't been written yet, as comments start and end with a pair of bytes
+// which may be split across writes.
+func (s *StatementSplitter) peek() (byte, bool) {
+	if s.pos+1 == len(s.input) {
+		return 0, false
+	}
+	return s.input[s.pos+1], true
+}
+
+// Remainder returns the input following the last terminated statement.
+func (s *StatementSplitter) Remainder() string {
+	return string(s.input[s.start:])
+}
+
+// keyword tracks the words of the statement that create a trigger and open
+// or close the blocks within its body.
+func (s *StatementSplitter) keyword(word []byte) {
+	if len(s.prefix) < 3 {
+		s.prefix = append(s.prefix, strings.ToUpper(string(word)))
+		s.trigger = isCreateTrigger(s.prefix)
+		return
+	}
+	if !s.trigger {
+		return
+	}
+	switch strings.ToUpper(string(word)) {
+	case "BEGIN", "CASE":
+		s.depth++
+	case "END":
+		if s.depth > 0 {
+			s.depth--
+		}
+	}
+}
+
+// compact drops the input of the statements that have been returned, so that
+// the input doesn't grow whilst a long text is split.
+func (s *StatementSplitter) compact(statements []string) []string {
+	if s.start > 0 {
+		s.input = append(s.input[:0], s.input[s.start:]...)
+		s.pos -= s.start
+		s.start = 0
+	}
+	return statements
+}
+
+// isCreateTrigger returns true if the first keywords of a statement are those
+// of a CREATE TRIGGER statement.
+func isCreateTrigger(prefix []string) bool {
+	if len(prefix) < 2 || prefix[0] != "CREATE" {
+		return false
+	}
+	if prefix[1] == "TEMP" || prefix[1] == "TEMPORARY" {
+		return len(prefix) > 2 && prefix[2] == "TRIGGER"
+	}
+	return prefix[1] == "TRIGGER"
+}
+
+// SplitStatements splits the input into the statements terminated by a
+// semicolon, as split by a StatementSplitter. Any input following the last
+// terminator is returned as the remainder.
+func SplitStatements(input string) ([]string, string) {
+	var splitter StatementSplitter
+	statements := splitter.Write(input)
+	return statements, splitter.Remainder()
+}
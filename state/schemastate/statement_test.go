@@ -0,0 +1,108 @@
+package schemastate_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		statements []string
+		remainder  string
+	}{{
+		name:       "single",
+		input:      "SELECT 1;",
+		statements: []string{"SELECT 1;"},
+	}, {
+		name:       "many on a line",
+		input:      "SELECT 1; SELECT 2;",
+		statements: []string{"SELECT 1;", "SELECT 2;"},
+	}, {
+		name:       "over many lines",
+		input:      "SELECT\n  name\nFROM actions\n;",
+		statements: []string{"SELECT\n  name\nFROM actions\n;"},
+	}, {
+		name:      "unterminated",
+		input:     "SELECT name\nFROM actions\n",
+		remainder: "SELECT name\nFROM actions\n",
+	}, {
+		name:       "remainder",
+		input:      "SELECT 1; SELECT",
+		statements: []string{"SELECT 1;"},
+		remainder:  " SELECT",
+	}, {
+		name:       "empty statements",
+		input:      ";; SELECT 1;",
+		statements: []string{"SELECT 1;"},
+	}, {
+		name:       "string literal",
+		input:      "SELECT 'a;b', 'it''s;';",
+		statements: []string{"SELECT 'a;b', 'it''s;';"},
+	}, {
+		name:       "quoted identifiers",
+		input:      "SELECT \"a;\", `b;`, [c;] FROM t;",
+		statements: []string{"SELECT \"a;\", `b;`, [c;] FROM t;"},
+	}, {
+		name:       "line comment",
+		input:      "SELECT 1 -- not the end;\n;",
+		statements: []string{"SELECT 1 -- not the end;\n;"},
+	}, {
+		name:       "block comment",
+		input:      "SELECT /* not; the end */ 1;",
+		statements: []string{"SELECT /* not; the end */ 1;"},
+	}, {
+		name:      "unterminated literal",
+		input:     "SELECT 'a;",
+		remainder: "SELECT 'a;",
+	}, {
+		name:       "trigger body",
+		input:      "CREATE TRIGGER t AFTER INSERT ON a BEGIN\n\tINSERT INTO b VALUES (1);\n\tDELETE FROM c;\nEND; SELECT 1;",
+		statements: []string{"CREATE TRIGGER t AFTER INSERT ON a BEGIN\n\tINSERT INTO b VALUES (1);\n\tDELETE FROM c;\nEND;", "SELECT 1;"},
+	}, {
+		name:       "temporary trigger with a case",
+		input:      "create temp trigger t after update on a begin update b set x = case when new.y then 1 else 0 end; end;",
+		statements: []string{"create temp trigger t after update on a begin update b set x = case when new.y then 1 else 0 end; end;"},
+	}, {
+		name:      "unterminated trigger body",
+		input:     "CREATE TRIGGER t AFTER INSERT ON a BEGIN DELETE FROM c;",
+		remainder: "CREATE TRIGGER t AFTER INSERT ON a BEGIN DELETE FROM c;",
+	}, {
+		name:       "comment in a trigger body",
+		input:      "CREATE TRIGGER t AFTER INSERT ON a BEGIN -- end;\nDELETE FROM c; /* end; */ END;",
+		statements: []string{"CREATE TRIGGER t AFTER INSERT ON a BEGIN -- end;\nDELETE FROM c; /* end; */ END;"},
+	}, {
+		name:       "begin transaction",
+		input:      "BEGIN TRANSACTION; CREATE TABLE t (id INTEGER); COMMIT;",
+		statements: []string{"BEGIN TRANSACTION;", "CREATE TABLE t (id INTEGER);", "COMMIT;"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, remainder := schemastate.SplitStatements(test.input)
+			if !reflect.DeepEqual(statements, test.statements) {
+				t.Errorf("got statements %q, want %q", statements, test.statements)
+			}
+			if remainder != test.remainder {
+				t.Errorf("got remainder %q, want %q", remainder, test.remainder)
+			}
+
+			// Writing the input a byte at a time splits it the same.
+			var (
+				splitter schemastate.StatementSplitter
+				written  []string
+			)
+			for i := range test.input {
+				written = append(written, splitter.Write(test.input[i:i+1])...)
+			}
+			if !reflect.DeepEqual(written, test.statements) {
+				t.Errorf("got statements %q written a byte at a time, want %q", written, test.statements)
+			}
+			if got := splitter.Remainder(); got != test.remainder {
+				t.Errorf("got remainder %q written a byte at a time, want %q", got, test.remainder)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package schemastate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/errors"
+)
+
+// Status describes how the schema recorded in a database compares to the
+// patches of a Schema.
+type Status struct {
+	// Current is the highest version recorded in the schema table.
+	Current int
+
+	// Expected is the version the database will be at once all the patches
+	// have been applied.
+	Expected int
+
+	// Missing holds the patches that have not been recorded as applied.
+	Missing []PatchStatus
+
+	// Unknown holds the versions recorded in the schema table that don't
+	// match any known patch.
+	Unknown []int
+}
+
+// PatchStatus identifies a single patch by version and name.
+type PatchStatus struct {
+	Version int
+	Name    string
+}
+
+// UpToDate returns true if all the patches have been applied and there are
+// no unknown versions.
+func (s Status) UpToDate() bool {
+	return len(s.Missing) == 0 && len(s.Unknown) == 0
+}
+
+func (s Status) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "version %d, expected %d", s.Current, s.Expected)
+	if len(s.Missing) > 0 {
+		fmt.Fprintf(&b, "; missing patches %s", formatPatches(s.Missing))
+	}
+	if len(s.Unknown) > 0 {
+		versions := make([]string, len(s.Unknown))
+		for i, version := range s.Unknown {
+			versions[i] = fmt.Sprintf("%d", version)
+		}
+		fmt.Fprintf(&b, "; unknown versions %s", strings.Join(versions, ", "))
+	}
+	return b.String()
+}
+
+// HistoryEntry records when a patch was applied to the database.
+type HistoryEntry struct {
+	Version   int
+	Name      string
+	UpdatedAt time.Time
+}
+
+// History returns the patches recorded in the schema table, in version
+// order.
+func (s *Schema) History(backend Backend) ([]HistoryEntry, error) {
+	var history []HistoryEntry
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		exists, err := doesSchemaTableExist(ctx, tx, s.table())
+		if err != nil || !exists {
+			return errors.Trace(err)
+		}
+
+		var rows []struct {
+			Version   int       `db:"version"`
+			UpdatedAt time.Time `db:"updated_at"`
+		}
+		if err := tx.SelectContext(ctx, &rows, "SELECT version, updated_at FROM "+s.table()+" ORDER BY version"); err != nil {
+			return errors.Trace(err)
+		}
+
+		history = make([]HistoryEntry, len(rows))
+		for i, row := range rows {
+			history[i] = HistoryEntry{
+				Version:   row.Version,
+				Name:      patchStatus(row.Version, s.patches).Name,
+				UpdatedAt: row.UpdatedAt,
+			}
+		}
+		return nil
+	})
+	return history, errors.Trace(err)
+}
+
+// Status returns a report of the patches applied to the database, compared to
+// the patches of the schema.
+func (s *Schema) Status(backend Backend) (Status, error) {
+	var status Status
+	err := backend.Run(func(ctx context.Context, tx *sqlx.Tx) error {
+		var err error
+		status, err = s.status(ctx, tx)
+		return errors.Trace(err)
+	})
+	return status, errors.Trace(err)
+}
+
+func (s *Schema) status(ctx context.Context, tx *sqlx.Tx) (Status, error) {
+	status := Status{
+		Expected: len(s.patches),
+	}
+
+	exists, err := doesSchemaTableExist(ctx, tx, s.table())
+	if err != nil {
+		return Status{}, errors.Trace(err)
+	}
+	var versions []int
+	if exists {
+		if versions, err = selectSchemaVersions(ctx, tx, s.table()); err != nil {
+			return Status{}, errors.Trace(err)
+		}
+	}
+
+	recorded := make(map[int]bool, len(versions))
+	for _, version := range versions {
+		recorded[version] = true
+		if version > status.Current {
+			status.Current = version
+		}
+		if version < 1 || version > len(s.patches) {
+			status.Unknown = append(status.Unknown, version)
+		}
+	}
+	for version := 1; version <= len(s.patches); version++ {
+		if !recorded[version] {
+			status.Missing = append(status.Missing, patchStatus(version, s.patches))
+		}
+	}
+	return status, nil
+}
+
+// patchStatus returns the status for the patch that records the given
+// version.
+func patchStatus(version int, patches []schemaPatch) PatchStatus {
+	status := PatchStatus{
+		Version: version,
+	}
+	if version >= 1 && version <= len(patches) {
+		status.Name = patches[version-1].name
+	}
+	return status
+}
+
+// formatPatches returns a human readable list of patches.
+func formatPatches(patches []PatchStatus) string {
+	names := make([]string, len(patches))
+	for i, patch := range patches {
+		names[i] = fmt.Sprintf("%d", patch.Version)
+		if patch.Name != "" {
+			names[i] += fmt.Sprintf(" (%s)", patch.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// funcName returns the name of the function without the package path, which
+// is used to name a patch.
+func funcName(fn interface{}) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return ""
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
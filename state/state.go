@@ -3,38 +3,87 @@ package state
 import (
 	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/SimonRichardson/nu-juju-data/state/actionstate"
+	"github.com/SimonRichardson/nu-juju-data/state/events"
+	"github.com/SimonRichardson/nu-juju-data/state/operationstate"
 	"github.com/SimonRichardson/nu-juju-data/state/schemastate"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
+	"github.com/juju/errors"
 	"gopkg.in/tomb.v2"
 )
 
+// defaultStopTimeout is the time the managers are given to stop, before Stop
+// gives up on them.
+const defaultStopTimeout = 30 * time.Second
+
+// defaultEnsureInterval is the time between passes of the ensure loop.
+const defaultEnsureInterval = 5 * time.Minute
+
 // State is the central manager of the system, keeping track
 // of all available state managers and related helpers.
 type State struct {
 	stateEng *StateEngine
 	tomb     *tomb.Tomb
+	clock    clock.Clock
+	logger   Logger
+	bus      *events.Bus
+	// ready is set once StartUp has succeeded.
+	ready int32
+	// leader is set whilst the local node holds leadership.
+	leader     int32
+	leadership LeadershipWatcher
 	// managers
-	mutex   sync.Mutex
-	started bool
+	mutex          sync.Mutex
+	started        bool
+	running        bool
+	stopTimeout    time.Duration
+	ensureInterval time.Duration
+	ensureNow      chan struct{}
+
+	stopOnce sync.Once
+	stopErr  error
 
-	schemaMgr *schemastate.SchemaManager
-	actionMgr *actionstate.ActionManager
+	schemaMgr    *schemastate.SchemaManager
+	operationMgr *operationstate.OperationManager
+	actionMgr    *actionstate.ActionManager
 }
 
 // NewState state creates a managed system state encapsulating a backend.
-func NewState(backend Backend) *State {
+// The leadership watcher gates the activities that should only run on the
+// leader; if it is nil, the local node is always considered the leader.
+func NewState(backend Backend, logger Logger, clock clock.Clock, leadership LeadershipWatcher) *State {
 	s := &State{
-		tomb:     new(tomb.Tomb),
-		stateEng: NewStateEngine(backend),
+		tomb:           new(tomb.Tomb),
+		stateEng:       NewStateEngine(backend, clock),
+		clock:          clock,
+		logger:         logger,
+		bus:            events.NewBus(),
+		stopTimeout:    defaultStopTimeout,
+		ensureInterval: defaultEnsureInterval,
+		ensureNow:      make(chan struct{}, 1),
+		leadership:     leadership,
 	}
+	if leadership == nil {
+		s.leader = 1
+	}
+	s.stateEng.SetLogger(logger)
+
+	s.schemaMgr = schemastate.NewManager(backend, "", logger)
+	s.stateEng.AddManager("schema", s.schemaMgr)
 
-	// Ensure we register the new schema manager first.
-	s.schemaMgr = schemastate.NewManager(backend)
-	s.stateEng.AddManager(s.schemaMgr)
+	s.operationMgr = operationstate.NewManager(backend, s.bus)
+	s.stateEng.AddManager("operations", s.operationMgr, DependsOn("schema"))
 
-	s.actionMgr = actionstate.NewManager(backend)
-	s.stateEng.AddManager(s.actionMgr)
+	s.actionMgr = actionstate.NewManager(backend, s.bus, s.operationMgr,
+		actionstate.WithClock(clock),
+		actionstate.WithLogger(logger),
+		actionstate.WithSubscriber(s.bus),
+	)
+	s.stateEng.AddManager("actions", s.actionMgr, DependsOn("schema", "operations"))
 
 	return s
 }
@@ -50,22 +99,211 @@ func (s *State) StartUp(ctx context.Context) error {
 	if s.started {
 		return nil
 	}
+	if err := s.stateEng.StartUp(ctx); err != nil {
+		return errors.Trace(err)
+	}
 	s.started = true
+	atomic.StoreInt32(&s.ready, 1)
+	return nil
+}
+
+// StartupReport returns the result of starting each manager, in the order they
+// were started.
+func (s *State) StartupReport() []ManagerStartup {
+	return s.stateEng.StartupReport()
+}
+
+// Ready returns true once StartUp has succeeded, at which point the schema
+// has been applied and the managers can be used.
+func (s *State) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// Run starts the ensure loop, which periodically asks the managers to
+// reconcile the state whilst the local node holds leadership. The loop runs
+// until the context is done or the state is stopped. It is a noop if the loop
+// is already running.
+func (s *State) Run(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.running {
+		return nil
+	}
+	if !s.tomb.Alive() {
+		return errors.Errorf("state has been stopped")
+	}
+	s.running = true
+
+	interval := s.ensureInterval
+	s.tomb.Go(func() error {
+		return s.ensureLoop(s.tomb.Context(ctx), interval)
+	})
+	if s.leadership != nil {
+		s.tomb.Go(func() error {
+			return s.leadershipLoop(s.tomb.Context(ctx))
+		})
+	}
+	return nil
+}
+
+// IsLeader returns true whilst the local node holds leadership.
+func (s *State) IsLeader() bool {
+	return atomic.LoadInt32(&s.leader) == 1
+}
+
+func (s *State) leadershipLoop(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case leader, ok := <-s.leadership.Changes():
+			if !ok {
+				return nil
+			}
 
-	return s.stateEng.StartUp(ctx)
+			var value int32
+			if leader {
+				value = 1
+			}
+			if atomic.SwapInt32(&s.leader, value) == value {
+				continue
+			}
+
+			s.logger.Infof("leadership changed, leader: %v", leader)
+			s.stateEng.LeadershipChanged(ctx, leader)
+			if leader {
+				s.EnsureNow()
+			}
+		}
+	}
+}
+
+// EnsureNow triggers an immediate pass of the ensure loop.
+func (s *State) EnsureNow() {
+	select {
+	case s.ensureNow <- struct{}{}:
+	default:
+		// A pass is already pending.
+	}
 }
 
-// Stop stops the ensure loop and the managers under the StateEngine.
+func (s *State) ensureLoop(ctx context.Context, interval time.Duration) error {
+	for {
+		if s.IsLeader() {
+			if err := s.stateEng.Ensure(ctx); err != nil {
+				s.logger.Warningf("%v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.clock.After(interval):
+		case <-s.ensureNow:
+		}
+	}
+}
+
+// SetEnsureInterval sets the time between passes of the ensure loop. It must
+// be called before Run.
+func (s *State) SetEnsureInterval(interval time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ensureInterval = interval
+}
+
+// SetStopTimeout sets the time the managers are given to stop, when the
+// state is stopped.
+func (s *State) SetStopTimeout(timeout time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopTimeout = timeout
+}
+
+// Stop stops the ensure loop and the managers under the StateEngine. It is
+// safe to call Stop more than once; subsequent calls return the result of the
+// first.
 func (s *State) Stop() error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.stop()
+	})
+	return s.stopErr
+}
+
+func (s *State) stop() error {
+	// The tomb is killed under the mutex, so that Run can't start the loops
+	// once the state is stopping.
+	s.mutex.Lock()
+	timeout := s.stopTimeout
+	running := s.running
 	s.tomb.Kill(nil)
-	err := s.tomb.Wait()
-	s.stateEng.Stop()
+	s.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The tomb only dies once its goroutines have exited, so it's only
+	// waited on if Run started the loops. A manager wedged in Ensure keeps
+	// the ensure loop from exiting, so the wait is bounded too.
+	var err error
+	if running {
+		select {
+		case <-s.tomb.Dead():
+			err = s.tomb.Err()
+		case <-ctx.Done():
+			err = errors.Errorf("ensure loop failed to stop in time")
+		}
+	}
+
+	if stopErr := s.stateEng.Stop(ctx); err == nil {
+		err = stopErr
+	}
 	return err
 }
 
-// Backend returns the system backend managed by the state.
+// Backend returns the system backend managed by the state. Until the state is
+// ready, the backend fails fast with a NotProvisioned error, rather than
+// running transactions against a database without the schema.
 func (s *State) Backend() Backend {
-	return s.stateEng.Backend()
+	return readyBackend{
+		Backend: s.stateEng.Backend(),
+		state:   s,
+	}
+}
+
+// readyBackend is a Backend that only runs transactions once the state is
+// ready.
+type readyBackend struct {
+	Backend
+	state *State
+}
+
+func (b readyBackend) Run(fn func(context.Context, *sqlx.Tx) error) error {
+	if !b.state.Ready() {
+		return errors.NotProvisionedf("state")
+	}
+	return b.Backend.Run(fn)
+}
+
+func (b readyBackend) RunReadOnly(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) error {
+	if !b.state.Ready() {
+		return errors.NotProvisionedf("state")
+	}
+	return b.Backend.RunReadOnly(ctx, fn)
+}
+
+func (b readyBackend) RunContext(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) error {
+	if !b.state.Ready() {
+		return errors.NotProvisionedf("state")
+	}
+	return b.Backend.RunContext(ctx, fn)
+}
+
+// View runs the function within a read-only transaction, avoiding contention
+// with writers. It should be used by managers and callers that only read.
+func (s *State) View(ctx context.Context, fn func(context.Context, *sqlx.Tx) error) error {
+	return s.Backend().RunReadOnly(ctx, fn)
 }
 
 // StateEngine returns the state engine used by state.
@@ -78,6 +316,39 @@ func (s *State) SchemaManager() *schemastate.SchemaManager {
 	return s.schemaMgr
 }
 
+// SchemaChangeSet returns the schema changes applied during StartUp.
+func (s *State) SchemaChangeSet() schemastate.ChangeSet {
+	return s.schemaMgr.ChangeSet()
+}
+
+// SchemaHistory returns the schema patches that have been applied to the
+// database.
+func (s *State) SchemaHistory() ([]schemastate.HistoryEntry, error) {
+	return s.schemaMgr.History()
+}
+
+// Events returns the event bus, which the managers publish their changes on
+// once they have been committed.
+func (s *State) Events() *events.Bus {
+	return s.bus
+}
+
+// RegisterManager registers an additional manager with the state engine. It
+// must be called before StartUp.
+func (s *State) RegisterManager(name string, m StateManager, opts ...ManagerOption) error {
+	return errors.Trace(s.stateEng.RegisterManager(name, m, opts...))
+}
+
+// Manager returns the manager registered under the given name.
+func (s *State) Manager(name string) (StateManager, error) {
+	return s.stateEng.Manager(name)
+}
+
+// OperationManager returns the operation manager from the state.
+func (s *State) OperationManager() *operationstate.OperationManager {
+	return s.operationMgr
+}
+
 // ActionManager returns the action manager from the state.
 func (s *State) ActionManager() *actionstate.ActionManager {
 	return s.actionMgr
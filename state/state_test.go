@@ -0,0 +1,348 @@
+package state
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/SimonRichardson/nu-juju-data/db"
+	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// newTestState returns a state over an in-memory database, which is closed
+// when the test finishes.
+func newTestState(t *testing.T) *State {
+	t.Helper()
+	return newTestStateWith(t, clock.WallClock, nil)
+}
+
+// newTestStateWith returns a state like newTestState, with the clock and the
+// leadership watcher.
+func newTestStateWith(t *testing.T, clock clock.Clock, leadership LeadershipWatcher) *State {
+	t.Helper()
+
+	backend, err := db.NewInMemorySQLDatabase()
+	if errors.IsNotSupported(err) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("creating database: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+
+	return NewState(backend, noopLogger{}, clock, leadership)
+}
+
+func TestStopWithoutRun(t *testing.T) {
+	s := newTestState(t)
+	s.SetStopTimeout(time.Second)
+	if err := s.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	start := time.Now()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("stopping took %v, want it not to wait for the ensure loop", elapsed)
+	}
+}
+
+func TestStopAfterRun(t *testing.T) {
+	s := newTestState(t)
+	s.SetStopTimeout(time.Second)
+	if err := s.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("running: %v", err)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+}
+
+// ensureCounter returns a manager that signals every call to Ensure.
+func ensureCounter(calls *callLog) (*stubManager, <-chan struct{}) {
+	ensured := make(chan struct{}, 10)
+	return &stubManager{
+		name:  "counter",
+		calls: calls,
+		ensure: func(context.Context) error {
+			ensured <- struct{}{}
+			return nil
+		},
+	}, ensured
+}
+
+// waitEnsured waits for the next call to Ensure.
+func waitEnsured(t *testing.T, ensured <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ensured:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// assertNotEnsured checks that Ensure isn't called.
+func assertNotEnsured(t *testing.T, ensured <-chan struct{}, what string) {
+	t.Helper()
+
+	select {
+	case <-ensured:
+		t.Fatalf("unexpected ensure %s", what)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEnsureLoop(t *testing.T) {
+	const interval = time.Minute
+	clock := testclock.NewClock(time.Now())
+	s := newTestStateWith(t, clock, nil)
+	s.SetEnsureInterval(interval)
+
+	calls := new(callLog)
+	counter, ensured := ensureCounter(calls)
+	if err := s.RegisterManager("counter", counter); err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if err := s.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("running: %v", err)
+	}
+	defer func() { _ = s.Stop() }()
+
+	// A pass runs as soon as the loop starts, then every interval.
+	waitEnsured(t, ensured, "the first pass")
+	if err := clock.WaitAdvance(interval-time.Second, time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	assertNotEnsured(t, ensured, "before the interval")
+	clock.Advance(time.Second)
+	waitEnsured(t, ensured, "the pass after the interval")
+
+	// EnsureNow triggers a pass without waiting for the interval.
+	s.EnsureNow()
+	waitEnsured(t, ensured, "the triggered pass")
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	s.EnsureNow()
+	clock.Advance(interval)
+	assertNotEnsured(t, ensured, "after stopping")
+}
+
+// fakeLeadership is a leadership watcher whose changes are sent by the test.
+type fakeLeadership struct {
+	changes chan bool
+}
+
+func (l *fakeLeadership) Changes() <-chan bool {
+	return l.changes
+}
+
+func TestLeadershipGatesManagersAndEnsure(t *testing.T) {
+	const interval = time.Minute
+	clock := testclock.NewClock(time.Now())
+	leadership := &fakeLeadership{changes: make(chan bool)}
+	s := newTestStateWith(t, clock, leadership)
+	s.SetEnsureInterval(interval)
+
+	calls := new(callLog)
+	counter, ensured := ensureCounter(calls)
+	if err := s.RegisterManager("counter", counter); err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if err := s.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("running: %v", err)
+	}
+	defer func() { _ = s.Stop() }()
+
+	// Without leadership, the ensure loop skips its passes.
+	if s.IsLeader() {
+		t.Fatalf("expected not to be the leader before gaining leadership")
+	}
+	if err := clock.WaitAdvance(interval, time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	assertNotEnsured(t, ensured, "without leadership")
+
+	// Gaining leadership activates the manager and triggers a pass.
+	leadership.changes <- true
+	waitEnsured(t, ensured, "the pass on gaining leadership")
+	if !s.IsLeader() {
+		t.Fatalf("expected to be the leader")
+	}
+	if got := calls.count("counter.LeadershipChanged(true)"); got != 1 {
+		t.Fatalf("got calls %v, want the manager activated once", calls.get())
+	}
+
+	// Repeating the same leadership isn't a change, whilst losing
+	// leadership deactivates the manager and gates the loop again. The
+	// changes are unbuffered, so each send waits for the previous change to
+	// have been handled.
+	leadership.changes <- true
+	leadership.changes <- false
+	leadership.changes <- false
+	if s.IsLeader() {
+		t.Fatalf("expected not to be the leader after losing leadership")
+	}
+	want := []string{"counter.StartUp", "counter.LeadershipChanged(true)", "counter.Ensure", "counter.LeadershipChanged(false)"}
+	if got := calls.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+	clock.Advance(interval)
+	assertNotEnsured(t, ensured, "after losing leadership")
+}
+
+func TestBackendBeforeStartUp(t *testing.T) {
+	s := newTestState(t)
+	ctx := context.Background()
+	noop := func(context.Context, *sqlx.Tx) error { return nil }
+
+	// run runs a transaction through each of the ways of running one.
+	run := func() []error {
+		return []error{
+			s.Backend().Run(noop),
+			s.Backend().RunContext(ctx, noop),
+			s.Backend().RunReadOnly(ctx, noop),
+			s.View(ctx, noop),
+		}
+	}
+
+	if s.Ready() {
+		t.Fatalf("expected the state not to be ready before StartUp")
+	}
+	for i, err := range run() {
+		if !errors.IsNotProvisioned(err) {
+			t.Errorf("transaction %d: got error %v before StartUp, want not provisioned", i, err)
+		}
+	}
+
+	if err := s.StartUp(ctx); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if !s.Ready() {
+		t.Fatalf("expected the state to be ready after StartUp")
+	}
+	for i, err := range run() {
+		if err != nil {
+			t.Errorf("transaction %d: got error %v after StartUp", i, err)
+		}
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	s := newTestState(t)
+	s.SetStopTimeout(time.Second)
+
+	calls := new(callLog)
+	ensured := make(chan struct{}, 10)
+	ensure := func(context.Context) error {
+		ensured <- struct{}{}
+		return nil
+	}
+	if err := s.RegisterManager("a", &stubManager{name: "a", calls: calls, ensure: ensure}, DependsOn("actions")); err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if err := s.RegisterManager("b", &stubManager{name: "b", calls: calls, ensure: ensure}, DependsOn("a")); err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if err := s.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("running: %v", err)
+	}
+	waitEnsured(t, ensured, "the first pass of a")
+	waitEnsured(t, ensured, "the first pass of b")
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	// The ensure loop has stopped before the managers are stopped, and the
+	// managers are stopped before the managers they depend on.
+	want := []string{"a.StartUp", "b.StartUp", "a.Ensure", "b.Ensure", "b.Stop", "a.Stop"}
+	if got := calls.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestStopTwiceReturnsFirstError(t *testing.T) {
+	s := newTestState(t)
+	s.SetStopTimeout(50 * time.Millisecond)
+
+	calls := new(callLog)
+	block, _, release := wedged()
+	defer release()
+	if err := s.RegisterManager("wedged", &stubManager{name: "wedged", calls: calls, stop: block}); err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	if err := s.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("running: %v", err)
+	}
+
+	first := s.Stop()
+	if first == nil {
+		t.Fatalf("expected stopping the wedged manager to fail")
+	}
+	var second error
+	within(t, "the second Stop", func() {
+		second = s.Stop()
+	})
+	if second != first {
+		t.Fatalf("got error %v stopping again, want the first error %v", second, first)
+	}
+	if got := calls.count("wedged.Stop"); got != 1 {
+		t.Fatalf("got %d calls to stop the manager, want 1", got)
+	}
+}
+
+func TestViewDiscardsWrites(t *testing.T) {
+	s := newTestState(t)
+	ctx := context.Background()
+	if err := s.StartUp(ctx); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	var before int
+	err := s.View(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &before, "SELECT COUNT(*) FROM operations"); err != nil {
+			return err
+		}
+		// Whether the write fails or not, it's never committed.
+		_, _ = tx.ExecContext(ctx, "INSERT INTO operations (summary, enqueued, status) VALUES ('viewed', DateTime('now'), 'pending')")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("viewing: %v", err)
+	}
+
+	var after int
+	err = s.View(ctx, func(ctx context.Context, tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, &after, "SELECT COUNT(*) FROM operations")
+	})
+	if err != nil {
+		t.Fatalf("viewing: %v", err)
+	}
+	if after != before {
+		t.Fatalf("got %d operations after the view, want %d", after, before)
+	}
+}
@@ -2,16 +2,45 @@ package state
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/juju/clock"
 	"github.com/juju/errors"
 )
 
+const (
+	// minEnsureBackoff is the time a manager is skipped for after its first
+	// failed Ensure. The backoff doubles with every consecutive failure.
+	minEnsureBackoff = time.Second
+
+	// maxEnsureBackoff is the longest time a failing manager is skipped for.
+	maxEnsureBackoff = 5 * time.Minute
+)
+
+// Logger is the logging interface used by the state and its managers.
+type Logger interface {
+	Debugf(string, ...interface{})
+	Infof(string, ...interface{})
+	Warningf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
 type Backend interface {
 	// Run is a convince function for running one shot transactions, which
 	// correctly handles the rollback semantics and retries where available.
 	Run(func(context.Context, *sqlx.Tx) error) error
+
+	// RunContext is like Run, but the transaction is bound to the given
+	// context.
+	RunContext(context.Context, func(context.Context, *sqlx.Tx) error) error
+
+	// RunReadOnly runs the function within a transaction that is only used
+	// for reading, in which writes fail. It is always rolled back.
+	RunReadOnly(context.Context, func(context.Context, *sqlx.Tx) error) error
 }
 
 // StateManager is implemented by types responsible for observing
@@ -21,8 +50,30 @@ type StateManager interface {
 	StartUp(context.Context) error
 	// Stop asks the manager to terminate all activities running
 	// concurrently.  It must not return before these activities
-	// are finished.
-	Stop()
+	// are finished, or the context is done.
+	Stop(context.Context)
+}
+
+// LeadershipWatcher reports changes of leadership of the local node.
+type LeadershipWatcher interface {
+	// Changes returns a channel that receives true when the local node gains
+	// leadership and false when it loses leadership.
+	Changes() <-chan bool
+}
+
+// LeadershipAware is implemented by managers that only run some activities
+// whilst the local node holds leadership.
+type LeadershipAware interface {
+	// LeadershipChanged is called whenever the local node gains or loses
+	// leadership.
+	LeadershipChanged(ctx context.Context, leader bool)
+}
+
+// Ensurer is implemented by managers that periodically reconcile the state.
+type Ensurer interface {
+	// Ensure asks the manager to reconcile the state. It's called
+	// periodically by the ensure loop, after StartUp.
+	Ensure(context.Context) error
 }
 
 // StateEngine controls the dispatching of state changes to state managers.
@@ -33,58 +84,454 @@ type StateManager interface {
 // solely via the state.
 type StateEngine struct {
 	backend Backend
-	started bool
-	stopped bool
+	clock   clock.Clock
+	logger  Logger
 	// managers in use
 	mutex    sync.Mutex
-	managers []StateManager
+	starting bool
+	started  bool
+	stopped  bool
+	managers []managerEntry
+	// order is the order the managers were started in.
+	order []managerEntry
+	// backoff holds the managers that are backing off after failing to
+	// Ensure.
+	backoff map[string]ensureBackoff
+	// report holds the results of the last StartUp.
+	report []ManagerStartup
+}
+
+// ManagerStartup records the result of starting a manager.
+type ManagerStartup struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// ensureBackoff records the consecutive Ensure failures of a manager.
+type ensureBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// managerEntry holds a registered manager along with its name and the names
+// of the managers it depends on.
+type managerEntry struct {
+	name      string
+	manager   StateManager
+	dependsOn []string
+}
+
+// ManagerOption configures how a manager is registered with the StateEngine.
+type ManagerOption func(*managerEntry)
+
+// DependsOn declares that the manager must be started after the named
+// managers, and stopped before them.
+func DependsOn(names ...string) ManagerOption {
+	return func(e *managerEntry) {
+		e.dependsOn = append(e.dependsOn, names...)
+	}
 }
 
 // NewStateEngine returns a new state engine.
-func NewStateEngine(backend Backend) *StateEngine {
+func NewStateEngine(backend Backend, clock clock.Clock) *StateEngine {
 	return &StateEngine{
 		backend: backend,
+		clock:   clock,
+		logger:  noopLogger{},
+		backoff: make(map[string]ensureBackoff),
 	}
 }
 
-// AddManager adds the provided manager to take part in state operations.
-func (se *StateEngine) AddManager(m StateManager) {
+// SetLogger sets the logger used to report the progress of the managers.
+func (se *StateEngine) SetLogger(logger Logger) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	se.logger = logger
+}
+
+// StartupReport returns the result of starting each manager during the last
+// StartUp, in the order they were started.
+func (se *StateEngine) StartupReport() []ManagerStartup {
 	se.mutex.Lock()
 	defer se.mutex.Unlock()
 
-	se.managers = append(se.managers, m)
+	report := make([]ManagerStartup, len(se.report))
+	copy(report, se.report)
+	return report
+}
+
+// AddManager adds the provided manager to take part in state operations,
+// under the given name. Managers are started after the managers they depend
+// on, otherwise in the order they were added.
+func (se *StateEngine) AddManager(name string, m StateManager, opts ...ManagerOption) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	se.addManager(name, m, opts)
+}
+
+// addManager adds the manager. The caller must hold the mutex.
+func (se *StateEngine) addManager(name string, m StateManager, opts []ManagerOption) {
+	entry := managerEntry{
+		name:    name,
+		manager: m,
+	}
+	for _, opt := range opts {
+		opt(&entry)
+	}
+	se.managers = append(se.managers, entry)
+}
+
+// RegisterManager adds the provided manager to take part in state operations,
+// like AddManager, but fails if a manager is already registered under the
+// name, or if the engine has already been started.
+func (se *StateEngine) RegisterManager(name string, m StateManager, opts ...ManagerOption) error {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	if se.started || se.starting {
+		return errors.Errorf("registering manager %q after StartUp", name)
+	}
+	for _, entry := range se.managers {
+		if entry.name == name {
+			return errors.AlreadyExistsf("manager %q", name)
+		}
+	}
+	se.addManager(name, m, opts)
+	return nil
+}
+
+// Manager returns the manager registered under the given name.
+func (se *StateEngine) Manager(name string) (StateManager, error) {
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	for _, entry := range se.managers {
+		if entry.name == name {
+			return entry.manager, nil
+		}
+	}
+	return nil, errors.NotFoundf("manager %q", name)
 }
 
 // StartUp asks all managers to perform any expensive initialization.
-// It is a noop after the first invocation.
+// It is a noop after the first successful invocation. If a manager fails to
+// start, the managers that have already been started are stopped, so that
+// StartUp can be retried.
+//
+// The managers are called without holding the lock of the engine, so that a
+// slow manager doesn't block Stop.
 func (se *StateEngine) StartUp(ctx context.Context) error {
 	se.mutex.Lock()
-	defer se.mutex.Unlock()
 	if se.started {
+		se.mutex.Unlock()
 		return nil
 	}
+	if se.starting {
+		se.mutex.Unlock()
+		return errors.Errorf("state engine already starting")
+	}
+	if se.stopped {
+		se.mutex.Unlock()
+		return errors.Errorf("state engine stopped")
+	}
+	order, err := sortManagers(se.managers)
+	if err != nil {
+		se.mutex.Unlock()
+		return errors.Trace(err)
+	}
+	se.starting = true
+	logger := se.logger
+	se.mutex.Unlock()
 
+	report, err := se.startManagers(ctx, order, logger)
+
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+	se.starting = false
+	se.report = report
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The engine was stopped whilst the managers were starting, so nothing
+	// has stopped the managers that were started.
+	if se.stopped {
+		stopInReverse(order)
+		return errors.Errorf("state engine stopped during StartUp")
+	}
 	se.started = true
-	for _, m := range se.managers {
-		if err := m.StartUp(ctx); err != nil {
-			return errors.Trace(err)
+	se.order = order
+	return nil
+}
+
+// startManagers starts the managers in order, stopping the managers that have
+// already been started if one fails.
+func (se *StateEngine) startManagers(ctx context.Context, order []managerEntry, logger Logger) ([]ManagerStartup, error) {
+	var report []ManagerStartup
+	for i, entry := range order {
+		start := se.clock.Now()
+		err := entry.manager.StartUp(ctx)
+		duration := se.clock.Now().Sub(start)
+		report = append(report, ManagerStartup{
+			Name:     entry.name,
+			Duration: duration,
+			Err:      err,
+		})
+
+		if err != nil {
+			logger.Errorf("manager %q failed to start after %v: %v", entry.name, duration, err)
+			stopInReverse(order[:i])
+			return report, errors.Annotatef(err, "starting manager %q", entry.name)
 		}
+		logger.Infof("manager %q started in %v", entry.name, duration)
 	}
-	return nil
+	return report, nil
 }
 
-// Stop asks all managers to terminate activities running concurrently.
-func (se *StateEngine) Stop() {
+// stopInReverse stops the managers in the reverse of their order.
+func stopInReverse(order []managerEntry) {
+	for i := len(order) - 1; i >= 0; i-- {
+		order[i].manager.Stop(context.Background())
+	}
+}
+
+// running returns the started managers, in the order they were started, if
+// the engine hasn't been stopped.
+func (se *StateEngine) running() []managerEntry {
 	se.mutex.Lock()
 	defer se.mutex.Unlock()
 
-	if se.stopped {
-		return
+	if !se.started || se.stopped {
+		return nil
+	}
+	return se.order
+}
+
+// Ensure asks every started manager that implements Ensurer to reconcile the
+// state. A manager that fails is skipped by subsequent calls until its
+// backoff has expired; the backoff doubles with every consecutive failure.
+func (se *StateEngine) Ensure(ctx context.Context) error {
+	order := se.running()
+
+	now := se.clock.Now()
+	var failed []string
+	for _, entry := range order {
+		ensurer, ok := entry.manager.(Ensurer)
+		if !ok {
+			continue
+		}
+		se.mutex.Lock()
+		backoff, ok := se.backoff[entry.name]
+		se.mutex.Unlock()
+		if ok && now.Before(backoff.next) {
+			continue
+		}
+
+		if err := ensurer.Ensure(ctx); err != nil {
+			backoff.failures++
+			delay := minEnsureBackoff
+			for i := 1; i < backoff.failures && delay < maxEnsureBackoff; i++ {
+				delay *= 2
+			}
+			if delay > maxEnsureBackoff {
+				delay = maxEnsureBackoff
+			}
+			backoff.next = now.Add(delay)
+			se.mutex.Lock()
+			se.backoff[entry.name] = backoff
+			se.mutex.Unlock()
+
+			failed = append(failed, fmt.Sprintf("%s: %v", entry.name, err))
+			continue
+		}
+		se.mutex.Lock()
+		delete(se.backoff, entry.name)
+		se.mutex.Unlock()
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("ensure failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// LeadershipChanged notifies every started manager that implements
+// LeadershipAware of the change of leadership.
+func (se *StateEngine) LeadershipChanged(ctx context.Context, leader bool) {
+	for _, entry := range se.running() {
+		if aware, ok := entry.manager.(LeadershipAware); ok {
+			aware.LeadershipChanged(ctx, leader)
+		}
 	}
-	for _, m := range se.managers {
-		m.Stop()
+}
+
+// Stop asks all the started managers to terminate activities running
+// concurrently. The managers are stopped concurrently, although a manager is
+// only stopped once the managers that depend on it have stopped. Stop waits
+// until all the managers have stopped or the context is done, in which case
+// the managers that failed to stop in time are reported, separately from the
+// managers that were never asked to stop because a manager depending on them
+// hadn't stopped.
+//
+// Managers that were never started aren't stopped. Stop doesn't wait for
+// calls to the managers that are in progress, such as Ensure, other than
+// through stopping the managers.
+func (se *StateEngine) Stop(ctx context.Context) error {
+	se.mutex.Lock()
+	if se.stopped {
+		se.mutex.Unlock()
+		return nil
 	}
 	se.stopped = true
+	order := se.order
+	se.mutex.Unlock()
+
+	done := make(map[string]chan struct{}, len(order))
+	dependents := make(map[string][]string, len(order))
+	for _, entry := range order {
+		done[entry.name] = make(chan struct{})
+		for _, dep := range entry.dependsOn {
+			dependents[dep] = append(dependents[dep], entry.name)
+		}
+	}
+
+	// stopMutex guards stopping, the managers that have been asked to stop,
+	// and gaveUp, which is set once the context is done so that no more
+	// managers are asked to stop.
+	var (
+		stopMutex sync.Mutex
+		stopping  = make(map[string]bool, len(order))
+		gaveUp    bool
+	)
+	for _, entry := range order {
+		go func(entry managerEntry) {
+			for _, name := range dependents[entry.name] {
+				select {
+				case <-done[name]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			stopMutex.Lock()
+			if gaveUp {
+				stopMutex.Unlock()
+				return
+			}
+			stopping[entry.name] = true
+			stopMutex.Unlock()
+
+			entry.manager.Stop(ctx)
+			close(done[entry.name])
+		}(entry)
+	}
+
+	var timedOut, neverStopped []string
+	for _, entry := range order {
+		// A manager that has already stopped is never reported, even if
+		// the context is done too.
+		select {
+		case <-done[entry.name]:
+			continue
+		default:
+		}
+		select {
+		case <-done[entry.name]:
+			continue
+		case <-ctx.Done():
+		}
+
+		stopMutex.Lock()
+		gaveUp = true
+		asked := stopping[entry.name]
+		stopMutex.Unlock()
+		select {
+		case <-done[entry.name]:
+		default:
+			if asked {
+				timedOut = append(timedOut, entry.name)
+			} else {
+				neverStopped = append(neverStopped, entry.name)
+			}
+		}
+	}
+
+	var failed []string
+	if len(timedOut) > 0 {
+		failed = append(failed, "managers failed to stop in time: "+strings.Join(timedOut, ", "))
+	}
+	if len(neverStopped) > 0 {
+		failed = append(failed, "managers never stopped: "+strings.Join(neverStopped, ", "))
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// noopLogger discards all log messages.
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...interface{})   {}
+func (noopLogger) Infof(string, ...interface{})    {}
+func (noopLogger) Warningf(string, ...interface{}) {}
+func (noopLogger) Errorf(string, ...interface{})   {}
+
+// sortManagers orders the managers so that every manager comes after the
+// managers it depends on. Managers without any ordering constraints between
+// them keep the order they were added in.
+func sortManagers(managers []managerEntry) ([]managerEntry, error) {
+	index := make(map[string]int, len(managers))
+	for i, entry := range managers {
+		if _, ok := index[entry.name]; ok {
+			return nil, errors.AlreadyExistsf("manager %q", entry.name)
+		}
+		index[entry.name] = i
+	}
+	for _, entry := range managers {
+		for _, dep := range entry.dependsOn {
+			if _, ok := index[dep]; !ok {
+				return nil, errors.NotFoundf("manager %q dependency %q", entry.name, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	var (
+		sorted = make([]managerEntry, 0, len(managers))
+		states = make([]int, len(managers))
+		visit  func(int, []string) error
+	)
+	visit = func(i int, path []string) error {
+		entry := managers[i]
+		path = append(path, entry.name)
+		switch states[i] {
+		case visited:
+			return nil
+		case visiting:
+			return errors.Errorf("manager dependency cycle: %s", strings.Join(path, " -> "))
+		}
+
+		states[i] = visiting
+		for _, dep := range entry.dependsOn {
+			if err := visit(index[dep], path); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		states[i] = visited
+		sorted = append(sorted, entry)
+		return nil
+	}
+	for i := range managers {
+		if err := visit(i, nil); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return sorted, nil
 }
 
 // Backend returns the current system backend state.
@@ -0,0 +1,442 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/clock"
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+)
+
+// stubManager is a StateManager that records the calls made to it.
+type stubManager struct {
+	name  string
+	calls *callLog
+
+	// startErr is returned by StartUp.
+	startErr error
+	// ensure, if set, is called by Ensure.
+	ensure func(context.Context) error
+	// stop, if set, is called by Stop.
+	stop func(context.Context)
+}
+
+func (m *stubManager) StartUp(context.Context) error {
+	m.calls.add(m.name + ".StartUp")
+	return m.startErr
+}
+
+func (m *stubManager) Ensure(ctx context.Context) error {
+	m.calls.add(m.name + ".Ensure")
+	if m.ensure != nil {
+		return m.ensure(ctx)
+	}
+	return nil
+}
+
+func (m *stubManager) LeadershipChanged(_ context.Context, leader bool) {
+	m.calls.add(fmt.Sprintf("%s.LeadershipChanged(%v)", m.name, leader))
+}
+
+func (m *stubManager) Stop(ctx context.Context) {
+	m.calls.add(m.name + ".Stop")
+	if m.stop != nil {
+		m.stop(ctx)
+	}
+}
+
+// callLog records calls from many goroutines.
+type callLog struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(call string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (l *callLog) get() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.calls...)
+}
+
+// wedged returns a function that blocks until the returned release function
+// is called, closing entered once it has been called.
+func wedged() (block func(context.Context), entered <-chan struct{}, release func()) {
+	enteredCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	var once sync.Once
+	block = func(context.Context) {
+		once.Do(func() { close(enteredCh) })
+		<-releaseCh
+	}
+	return block, enteredCh, func() { close(releaseCh) }
+}
+
+// within fails the test if the function doesn't return in time.
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked", what)
+	}
+}
+
+func TestStopWhilstEnsureIsWedged(t *testing.T) {
+	calls := new(callLog)
+	block, entered, release := wedged()
+	defer release()
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("wedged", &stubManager{
+		name:  "wedged",
+		calls: calls,
+		ensure: func(ctx context.Context) error {
+			block(ctx)
+			return nil
+		},
+	})
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	go func() { _ = se.Ensure(context.Background()) }()
+	<-entered
+
+	within(t, "LeadershipChanged", func() {
+		se.LeadershipChanged(context.Background(), true)
+	})
+	within(t, "Stop", func() {
+		if err := se.Stop(context.Background()); err != nil {
+			t.Errorf("stopping: %v", err)
+		}
+	})
+}
+
+func TestStopIsBoundedByContext(t *testing.T) {
+	calls := new(callLog)
+	block, _, release := wedged()
+	defer release()
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("wedged", &stubManager{name: "wedged", calls: calls, stop: block})
+	se.AddManager("fine", &stubManager{name: "fine", calls: calls})
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	within(t, "Stop", func() {
+		if err := se.Stop(ctx); err == nil {
+			t.Errorf("stopping: expected an error for the wedged manager")
+		}
+	})
+}
+
+func TestStopReportsManagersNeverStopped(t *testing.T) {
+	calls := new(callLog)
+	block, _, release := wedged()
+	defer release()
+
+	// The schema manager is only stopped once the actions manager has, which
+	// never happens.
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("actions", &stubManager{name: "actions", calls: calls, stop: block}, DependsOn("schema"))
+	se.AddManager("schema", &stubManager{name: "schema", calls: calls})
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := se.Stop(ctx)
+	want := "managers failed to stop in time: actions; managers never stopped: schema"
+	if err == nil || err.Error() != want {
+		t.Fatalf("got error %v, want %q", err, want)
+	}
+	if n := calls.count("schema.Stop"); n != 0 {
+		t.Fatalf("got schema stopped %d times, want never", n)
+	}
+}
+
+func TestStopAtDeadlineOnlyReportsManagersStillStopping(t *testing.T) {
+	// The quick manager has stopped by the time the deadline expires, so
+	// both its stop and the deadline are ready once it's checked. It must
+	// never be reported, however the check is scheduled.
+	for i := 0; i < 20; i++ {
+		calls := new(callLog)
+		se := NewStateEngine(nil, clock.WallClock)
+		se.AddManager("slow", &stubManager{name: "slow", calls: calls, stop: func(ctx context.Context) {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+		}})
+		se.AddManager("quick", &stubManager{name: "quick", calls: calls})
+		if err := se.StartUp(context.Background()); err != nil {
+			t.Fatalf("starting: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := se.Stop(ctx)
+		cancel()
+		want := "managers failed to stop in time: slow"
+		if err == nil || err.Error() != want {
+			t.Fatalf("attempt %d: got error %v, want %q", i, err, want)
+		}
+	}
+}
+
+func TestStopBeforeStartUp(t *testing.T) {
+	calls := new(callLog)
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("a", &stubManager{name: "a", calls: calls})
+	if err := se.Stop(context.Background()); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	if got := calls.get(); len(got) != 0 {
+		t.Fatalf("got calls %v, want none for managers that never started", got)
+	}
+	if err := se.StartUp(context.Background()); err == nil {
+		t.Fatalf("expected StartUp after Stop to fail")
+	}
+}
+
+func TestRegisterManager(t *testing.T) {
+	calls := new(callLog)
+
+	se := NewStateEngine(nil, clock.WallClock)
+	if err := se.RegisterManager("a", &stubManager{name: "a", calls: calls}); err != nil {
+		t.Fatalf("registering: %v", err)
+	}
+	err := se.RegisterManager("a", &stubManager{name: "a", calls: calls})
+	if !errors.IsAlreadyExists(err) {
+		t.Fatalf("got error %v registering a duplicate, want already exists", err)
+	}
+
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := se.RegisterManager("b", &stubManager{name: "b", calls: calls}); err == nil {
+		t.Fatalf("expected registering after StartUp to fail")
+	}
+	if _, err := se.Manager("b"); !errors.IsNotFound(err) {
+		t.Fatalf("got error %v, want the late manager not to be registered", err)
+	}
+}
+
+func TestRegisterManagerConcurrently(t *testing.T) {
+	calls := new(callLog)
+	se := NewStateEngine(nil, clock.WallClock)
+
+	const attempts = 10
+	errs := make(chan error, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- se.RegisterManager("a", &stubManager{name: "a", calls: calls})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var registered int
+	for err := range errs {
+		if err == nil {
+			registered++
+		} else if !errors.IsAlreadyExists(err) {
+			t.Errorf("got error %v, want already exists", err)
+		}
+	}
+	if registered != 1 {
+		t.Fatalf("registered %d managers under the same name, want 1", registered)
+	}
+}
+
+func TestStartUpFailureStopsStartedManagers(t *testing.T) {
+	calls := new(callLog)
+	failing := &stubManager{name: "c", calls: calls, startErr: errors.New("boom")}
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("a", &stubManager{name: "a", calls: calls})
+	se.AddManager("b", &stubManager{name: "b", calls: calls})
+	se.AddManager("c", failing)
+	se.AddManager("d", &stubManager{name: "d", calls: calls})
+
+	if err := se.StartUp(context.Background()); err == nil {
+		t.Fatalf("expected StartUp to fail")
+	}
+	want := []string{"a.StartUp", "b.StartUp", "c.StartUp", "b.Stop", "a.Stop"}
+	if got := calls.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+	report := se.StartupReport()
+	if len(report) != 3 || report[2].Name != "c" || report[2].Err == nil {
+		t.Fatalf("got report %+v, want the failure of c last", report)
+	}
+
+	// StartUp can be retried once the failure is resolved.
+	failing.startErr = nil
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("retrying StartUp: %v", err)
+	}
+	if err := se.Stop(context.Background()); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+}
+
+func TestStartUpOrdersByDependencies(t *testing.T) {
+	calls := new(callLog)
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("actions", &stubManager{name: "actions", calls: calls}, DependsOn("schema", "operations"))
+	se.AddManager("operations", &stubManager{name: "operations", calls: calls}, DependsOn("schema"))
+	se.AddManager("other", &stubManager{name: "other", calls: calls})
+	se.AddManager("schema", &stubManager{name: "schema", calls: calls})
+
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	want := []string{"schema.StartUp", "operations.StartUp", "actions.StartUp", "other.StartUp"}
+	if got := calls.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
+
+func TestStartUpDependencyCycle(t *testing.T) {
+	calls := new(callLog)
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("a", &stubManager{name: "a", calls: calls}, DependsOn("c"))
+	se.AddManager("b", &stubManager{name: "b", calls: calls}, DependsOn("a"))
+	se.AddManager("c", &stubManager{name: "c", calls: calls}, DependsOn("b"))
+
+	err := se.StartUp(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "cycle: a -> c -> b -> a") {
+		t.Fatalf("got error %v, want the dependency cycle", err)
+	}
+	if got := calls.get(); len(got) != 0 {
+		t.Fatalf("got calls %v, want no manager started", got)
+	}
+}
+
+func TestStartUpUnregisteredDependency(t *testing.T) {
+	calls := new(callLog)
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("a", &stubManager{name: "a", calls: calls})
+	se.AddManager("b", &stubManager{name: "b", calls: calls}, DependsOn("a", "missing"))
+
+	if err := se.StartUp(context.Background()); !errors.IsNotFound(err) {
+		t.Fatalf("got error %v, want the missing dependency not found", err)
+	}
+	if got := calls.get(); len(got) != 0 {
+		t.Fatalf("got calls %v, want no manager started", got)
+	}
+}
+
+func TestStopInReverseDependencyOrder(t *testing.T) {
+	calls := new(callLog)
+
+	se := NewStateEngine(nil, clock.WallClock)
+	se.AddManager("actions", &stubManager{name: "actions", calls: calls}, DependsOn("operations"))
+	se.AddManager("operations", &stubManager{name: "operations", calls: calls}, DependsOn("schema"))
+	se.AddManager("schema", &stubManager{name: "schema", calls: calls})
+
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+	if err := se.Stop(context.Background()); err != nil {
+		t.Fatalf("stopping: %v", err)
+	}
+	want := []string{
+		"schema.StartUp", "operations.StartUp", "actions.StartUp",
+		"actions.Stop", "operations.Stop", "schema.Stop",
+	}
+	if got := calls.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got calls %v, want %v", got, want)
+	}
+}
+
+// count returns the number of calls made.
+func (l *callLog) count(call string) int {
+	var n int
+	for _, got := range l.get() {
+		if got == call {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEnsureBackoffDoubles(t *testing.T) {
+	calls := new(callLog)
+	clock := testclock.NewClock(time.Now())
+	failure := errors.New("boom")
+
+	se := NewStateEngine(nil, clock)
+	se.AddManager("failing", &stubManager{
+		name:  "failing",
+		calls: calls,
+		ensure: func(context.Context) error {
+			return failure
+		},
+	})
+	se.AddManager("healthy", &stubManager{name: "healthy", calls: calls})
+	if err := se.StartUp(context.Background()); err != nil {
+		t.Fatalf("starting: %v", err)
+	}
+
+	// ensure advances the clock and runs a pass, checking the number of
+	// times the failing manager has been called.
+	ensure := func(advance time.Duration, want int) error {
+		t.Helper()
+		clock.Advance(advance)
+		err := se.Ensure(context.Background())
+		if got := calls.count("failing.Ensure"); got != want {
+			t.Fatalf("got %d calls of the failing manager, want %d", got, want)
+		}
+		return err
+	}
+
+	if err := ensure(0, 1); err == nil || !strings.Contains(err.Error(), "failing: boom") {
+		t.Fatalf("got error %v, want the failure reported", err)
+	}
+	// The manager is skipped for a second, then two seconds, then four.
+	ensure(time.Second-time.Millisecond, 1)
+	ensure(time.Millisecond, 2)
+	ensure(2*time.Second-time.Millisecond, 2)
+	ensure(time.Millisecond, 3)
+	ensure(4*time.Second-time.Millisecond, 3)
+	ensure(time.Millisecond, 4)
+
+	// The healthy manager is called on every pass.
+	if got := calls.count("healthy.Ensure"); got != 7 {
+		t.Fatalf("got %d calls of the healthy manager, want 7", got)
+	}
+
+	// Once the manager recovers, the backoff is reset.
+	failure = nil
+	if err := ensure(8*time.Second, 5); err != nil {
+		t.Fatalf("got error %v once recovered", err)
+	}
+	ensure(0, 6)
+}